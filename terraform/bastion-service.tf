@@ -142,6 +142,8 @@ resource "oci_bastion_bastion" "bastion_service" {
   name                         = format("oke-bastion-service-%s", local.state_id)
   client_cidr_block_allow_list = var.bastion_service_allowed_cidrs
   max_session_ttl_in_seconds   = var.bastion_service_max_session_ttl
+  freeform_tags                = var.freeform_tags
+  defined_tags                 = var.defined_tags
 
   lifecycle {
     ignore_changes = [defined_tags]
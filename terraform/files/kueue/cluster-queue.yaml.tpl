@@ -14,6 +14,6 @@ spec:
       - name: memory
         nominalQuota: "102400Gi"
       - name: "${gpu_resource}"
-        nominalQuota: "10000"
+        nominalQuota: "${gpu_quota}"
       - name: ephemeral-storage
         nominalQuota: "12800Gi"
@@ -41,6 +41,12 @@ resource "oci_file_storage_file_system" "fss" {
   availability_domain = local.fss_ad
   compartment_id      = var.compartment_ocid
   display_name        = "${local.cluster_name}-fss"
+  freeform_tags       = var.freeform_tags
+  defined_tags        = var.defined_tags
+
+  lifecycle {
+    ignore_changes = [defined_tags]
+  }
 }
 
 resource "oci_file_storage_mount_target" "fss_mt" {
@@ -50,6 +56,12 @@ resource "oci_file_storage_mount_target" "fss_mt" {
   subnet_id           = module.oke.fss_subnet_id
   display_name        = "${local.cluster_name}-mt"
   nsg_ids             = [module.oke.fss_nsg_id]
+  freeform_tags       = var.freeform_tags
+  defined_tags        = var.defined_tags
+
+  lifecycle {
+    ignore_changes = [defined_tags]
+  }
 }
 
 resource "oci_file_storage_export" "FSSExport" {
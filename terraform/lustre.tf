@@ -90,6 +90,8 @@ resource "oci_lustre_file_storage_lustre_file_system" "lustre" {
   cluster_placement_group_id = var.lustre_cluster_placement_group_id
   display_name               = format("lustre-fs-%s", local.state_id)
   nsg_ids                    = compact([lookup(module.oke.custom_nsg_ids, "lustre", null)])
+  freeform_tags              = var.freeform_tags
+  defined_tags               = var.defined_tags
 
   depends_on = [time_sleep.wait_for_lustre_prerequisites]
 
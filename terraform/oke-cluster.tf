@@ -37,6 +37,11 @@ locals {
 
   vcn_name = format("%v-%v", var.vcn_name, local.state_id)
 
+  # The OKE module takes tags per resource category.
+  oke_tag_categories = ["bastion", "cluster", "iam", "network", "operator", "persistent_volume", "service_lb", "workers"]
+  oke_freeform_tags  = { for category in local.oke_tag_categories : category => var.freeform_tags }
+  oke_defined_tags   = { for category in local.oke_tag_categories : category => var.defined_tags }
+
   cluster_endpoints        = module.oke.cluster_endpoints
   cluster_public_endpoint  = try(format("https://%s", lookup(local.cluster_endpoints, "public_endpoint", "not-defined")), "not-defined")
   cluster_private_endpoint = try(format("https://%s", lookup(local.cluster_endpoints, "private_endpoint", "not-defined")), "not-defined")
@@ -328,6 +333,8 @@ module "oke" {
   ssh_public_key                    = trimspace(local.ssh_public_key)
   ssh_private_key                   = local.any_deployments_via_operator ? tls_private_key.stack_key.private_key_openssh : null
   use_defined_tags                  = false
+  freeform_tags                     = local.oke_freeform_tags
+  defined_tags                      = local.oke_defined_tags
   vcn_cidrs                         = split(",", var.vcn_cidrs)
   vcn_create_internet_gateway       = var.create_public_subnets ? "auto" : "never"
   vcn_create_nat_gateway            = "auto"
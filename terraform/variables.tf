@@ -434,6 +434,16 @@ variable "monitoring_advanced_options" {
 
 # OKE Cluster Setup
 variable "cluster_name" { default = "oke-gpu-quickstart" }
+variable "freeform_tags" {
+  default     = {}
+  type        = map(string)
+  description = "Freeform tags applied to the cluster, network, instances, bastion service and storage created by the stack."
+}
+variable "defined_tags" {
+  default     = {}
+  type        = map(string)
+  description = "Defined tags (\"Namespace.key\" = \"value\") applied alongside freeform_tags. The tag namespaces must already exist."
+}
 variable "kubernetes_version" { default = "v1.36.1" }
 variable "control_plane_allowed_cidrs" { default = ["0.0.0.0/0"] }
 variable "cni_type" {
@@ -65,6 +65,7 @@ module "kueue" {
       split("\n", templatefile("${path.module}/files/kueue/cluster-queue.yaml.tpl", {
         flavor_name  = local.kueue_flavor_name
         gpu_resource = local.kueue_gpu_resource
+        gpu_quota    = local.kueue_gpu_quota
       })),
       "EOF",
       # Deploy LocalQueue
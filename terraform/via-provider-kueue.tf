@@ -7,6 +7,28 @@ locals {
   kueue_is_amd       = contains(local.kueue_amd_shapes, local.kueue_shape)
   kueue_gpu_resource = local.kueue_is_amd ? "amd.com/gpu" : "nvidia.com/gpu"
   kueue_flavor_name  = "${lower(replace(local.kueue_shape, ".", "-"))}-rdma-topology-aware"
+  # GPUs per node of each shape the RDMA and GMC pools support.
+  kueue_shape_gpu_count = {
+    "BM.GPU4.8"          = 8
+    "BM.GPU.A100-v2.8"   = 8
+    "BM.GPU.B4.8"        = 8
+    "BM.GPU.B200.8"      = 8
+    "BM.GPU.B300.8"      = 8
+    "BM.GPU.GB200.4"     = 4
+    "BM.GPU.GB200-v2.4"  = 4
+    "BM.GPU.GB200-v3.4"  = 4
+    "BM.GPU.GB300.4"     = 4
+    "BM.GPU.H100.8"      = 8
+    "BM.GPU.H200.8"      = 8
+    "BM.GPU.MI300X.8"    = 8
+    "BM.GPU.MI355X.8"    = 8
+    "BM.GPU.MI355X-v1.8" = 8
+    "BM.GPU.RTXPRO.8"    = 8
+  }
+  # The ClusterQueue admits as many GPUs as the Kueue pool has. GMC pools
+  # scale per GPU memory fabric; the RDMA pool only counts when it is enabled.
+  kueue_pool_size = var.worker_gmc_enabled ? length(local.worker_gmc_gpu_memory_fabric_ids) * var.worker_gmc_scale_target_size : (var.worker_rdma_enabled ? var.worker_rdma_pool_size : 0)
+  kueue_gpu_quota = local.kueue_pool_size * lookup(local.kueue_shape_gpu_count, local.kueue_shape, 0)
 }
 
 resource "helm_release" "kueue" {
@@ -77,6 +99,7 @@ resource "kubectl_manifest" "kueue_cluster_queue" {
   yaml_body = templatefile("${path.module}/files/kueue/cluster-queue.yaml.tpl", {
     flavor_name  = local.kueue_flavor_name
     gpu_resource = local.kueue_gpu_resource
+    gpu_quota    = local.kueue_gpu_quota
   })
 
   depends_on = [helm_release.kueue, kubectl_manifest.kueue_resource_flavor]
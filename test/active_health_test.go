@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/activehealth"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+)
+
+// TestActiveHealthChecks runs the active health checks on the GPU nodes and
+// fails on any node that fails one. ACTIVE_HEALTH_CHECKS picks the checks and
+// ACTIVE_HEALTH_NODES the nodes; ACTIVE_HEALTH_LABEL_NODES=1 labels and
+// annotates the nodes like the CronJob appliers.
+func TestActiveHealthChecks(t *testing.T) {
+	skipUnlessEnv(t, "RUN_ACTIVE_HEALTH_CHECKS")
+
+	cluster := suiteCluster(t, nil)
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping active health checks: API requests are not recorded in cassettes")
+	}
+	if cluster.options == nil {
+		t.Skip("Skipping active health checks: existing cluster has no terraform variables")
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	pools, err := gpuPoolShapes(vars)
+	require.NoError(t, err, "failed to resolve GPU pools")
+	if len(pools) == 0 {
+		t.Skip("Skipping active health checks: no GPU pools in this topology")
+	}
+	cfg, err := activeHealthConfig(vars)
+	require.NoError(t, err)
+	if len(cfg.Checks) == 0 {
+		t.Skip("Skipping active health checks: the selected checks need install_mpi_operator")
+	}
+	cfg.Namespace = "active-health-" + currentRunID()
+	cfg.Root = filepath.Dir(terraformDir())
+	cfg.Logf = func(format string, args ...any) { t.Logf("active health: "+format, args...) }
+
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+	config, err := clientcmd.BuildConfigFromFlags("", cluster.kubeconfigPath)
+	require.NoError(t, err)
+	dyn, err := dynamic.NewForConfig(config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Hour)
+	defer cancel()
+	report, err := activehealth.Run(ctx, client, dyn, cfg)
+	require.NoError(t, err, "active health checks could not run")
+	t.Logf("active health: results\n%s", report)
+	require.Empty(t, report.Failures(), "active health checks failed")
+}
+
+// activeHealthConfig reads ACTIVE_HEALTH_CHECKS (default all),
+// ACTIVE_HEALTH_NODES and ACTIVE_HEALTH_LABEL_NODES. The multi-node checks
+// are dropped when the MPI Operator is not installed, and go through Kueue
+// like TestCollectives (see collectivesUseKueue).
+func activeHealthConfig(vars map[string]interface{}) (activehealth.Config, error) {
+	list := os.Getenv("ACTIVE_HEALTH_CHECKS")
+	if list == "" {
+		list = "all"
+	}
+	checks, err := activehealth.ParseChecks(list)
+	if err != nil {
+		return activehealth.Config{}, err
+	}
+	mpiOperator, err := varBool(vars, "install_mpi_operator")
+	if err != nil {
+		return activehealth.Config{}, err
+	}
+	if !mpiOperator {
+		checks = slices.DeleteFunc(slices.Clone(checks), func(check activehealth.Check) bool {
+			return check == activehealth.NCCLTests || check == activehealth.RCCLTests
+		})
+	}
+	kueue, err := collectivesUseKueue(vars)
+	if err != nil {
+		return activehealth.Config{}, err
+	}
+	networkOperator, err := varBool(vars, "deploy_nvidia_network_operator")
+	if err != nil {
+		return activehealth.Config{}, err
+	}
+	cfg := activehealth.Config{
+		Checks:           checks,
+		Kueue:            kueue,
+		VirtualFunctions: networkOperator,
+		Label:            envFlagEnabled("ACTIVE_HEALTH_LABEL_NODES"),
+		Annotate:         envFlagEnabled("ACTIVE_HEALTH_LABEL_NODES"),
+	}
+	if nodes := os.Getenv("ACTIVE_HEALTH_NODES"); nodes != "" {
+		cfg.Nodes = strings.Split(nodes, ",")
+	}
+	return cfg, nil
+}
+
+func TestActiveHealthConfig(t *testing.T) {
+	t.Setenv("ACTIVE_HEALTH_CHECKS", "")
+	t.Setenv("ACTIVE_HEALTH_NODES", "")
+	t.Setenv("ACTIVE_HEALTH_LABEL_NODES", "")
+	t.Setenv("NCCL_SUBMIT", "")
+	vars := map[string]interface{}{"install_mpi_operator": false, "install_kueue": true, "deploy_nvidia_network_operator": false}
+	cfg, err := activeHealthConfig(vars)
+	require.NoError(t, err)
+	require.Equal(t, []activehealth.Check{activehealth.DCGMDiag, activehealth.GPUFryer, activehealth.RVS}, cfg.Checks)
+	require.True(t, cfg.Kueue)
+	require.False(t, cfg.Label)
+	require.Nil(t, cfg.Nodes)
+	require.Len(t, activehealth.AllChecks, 5, "the multi-node checks are dropped from a copy")
+
+	t.Setenv("ACTIVE_HEALTH_CHECKS", "nccl-tests,dcgm-diag")
+	t.Setenv("ACTIVE_HEALTH_NODES", "10.0.3.2,10.0.3.3")
+	t.Setenv("ACTIVE_HEALTH_LABEL_NODES", "1")
+	vars["install_mpi_operator"] = true
+	cfg, err = activeHealthConfig(vars)
+	require.NoError(t, err)
+	require.Equal(t, []activehealth.Check{activehealth.NCCLTests, activehealth.DCGMDiag}, cfg.Checks)
+	require.Equal(t, []string{"10.0.3.2", "10.0.3.3"}, cfg.Nodes)
+	require.True(t, cfg.Label)
+	require.True(t, cfg.Annotate)
+
+	t.Setenv("ACTIVE_HEALTH_CHECKS", "burn")
+	_, err = activeHealthConfig(vars)
+	require.Error(t, err)
+}
@@ -0,0 +1,720 @@
+// Package activehealth runs the active health checks of
+// manifests/active-health-checks on demand: DCGM diagnostics, gpu-fryer and
+// the ROCm Validation Suite on single nodes, and nccl-tests or rccl-tests
+// across nodes of the same shape. Each tool's output is parsed into a
+// per-node pass/fail record with metrics, and the nodes can be labeled the
+// way the CronJob appliers label them.
+package activehealth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// Check is an active health check, named like its manifest and node labels.
+type Check string
+
+const (
+	DCGMDiag  Check = "dcgm-diag"
+	GPUFryer  Check = "gpu-fryer"
+	NCCLTests Check = "nccl-tests"
+	RCCLTests Check = "rccl-tests"
+	RVS       Check = "rvs"
+)
+
+// AllChecks lists every check in the order Run runs them: the single-node
+// checks first, so a node that fails them is known before the multi-node ones.
+var AllChecks = []Check{DCGMDiag, GPUFryer, RVS, NCCLTests, RCCLTests}
+
+// Vendor is the GPU vendor whose nodes the check runs on.
+func (c Check) Vendor() shapes.Vendor {
+	if c == RVS || c == RCCLTests {
+		return shapes.AMD
+	}
+	return shapes.NVIDIA
+}
+
+func (c Check) multiNode() bool { return c == NCCLTests || c == RCCLTests }
+
+// ParseChecks reads a comma-separated list of check names; "all" selects
+// AllChecks.
+func ParseChecks(list string) ([]Check, error) {
+	if strings.TrimSpace(list) == "all" {
+		return AllChecks, nil
+	}
+	var checks []Check
+	for _, name := range strings.Split(list, ",") {
+		check := Check(strings.TrimSpace(name))
+		if !slices.Contains(AllChecks, check) {
+			return nil, fmt.Errorf("unknown active health check %q, want all or some of %v", name, AllChecks)
+		}
+		if !slices.Contains(checks, check) {
+			checks = append(checks, check)
+		}
+	}
+	return checks, nil
+}
+
+// LabelPrefix is the prefix of the labels the CronJob appliers set.
+const LabelPrefix = "oke.oraclecloud.com"
+
+// ResultLabel is the label holding the last result of check, pass or fail.
+func ResultLabel(check Check) string { return LabelPrefix + "/active-health-checks-" + string(check) }
+
+// LastRunLabel is the label holding when check last ran, in the appliers'
+// 2006-01-02T15-04-05Z format.
+func LastRunLabel(check Check) string { return ResultLabel(check) + "-last-run" }
+
+// DetailsAnnotation is the annotation explaining why check failed on a node.
+func DetailsAnnotation(check Check) string { return ResultLabel(check) + "-details" }
+
+const lastRunFormat = "2006-01-02T15-04-05Z"
+
+// Status is the outcome of a check on a node.
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	// Skip means the check could not run on the node, such as a multi-node
+	// check on the only node of its shape. Skipped nodes are not labeled.
+	Skip Status = "skip"
+)
+
+// Images and defaults of the manifests' jobs.
+const (
+	DefaultHostImage  = "alpine:latest"
+	DefaultFryerImage = "ghcr.io/huggingface/gpu-fryer:1.1.0"
+	DefaultRVSImage   = "docker.io/rocm/test-runner:v1.4.0"
+	DefaultRVSRecipe  = "gst_single"
+)
+
+// Config describes an active health check run.
+type Config struct {
+	// Namespace is created for the check pods and deleted afterwards. The
+	// multi-node checks get their own namespaces, prefixed with it. Defaults
+	// to active-health-checks.
+	Namespace string
+	// Checks run in order. Defaults to AllChecks.
+	Checks []Check
+	// Nodes are the nodes to check, each with the checks of its GPU vendor.
+	// Defaults to every node labeled nvidia.com/gpu=true or amd.com/gpu=true
+	// that no pod requests GPUs on, as the appliers select them.
+	Nodes []string
+	// Root is the repository checkout holding the nccl-tests and rccl-tests
+	// manifests (see nccl.ManifestPath). Required for the multi-node checks.
+	Root string
+	// VirtualFunctions picks the virtual-functions manifests for shapes that
+	// have them.
+	VirtualFunctions bool
+	// Kueue submits the multi-node checks through Kueue (see nccl.Options).
+	Kueue bool
+	// Label sets the result and last-run labels on every node that passed or
+	// failed a check.
+	Label bool
+	// Annotate sets DetailsAnnotation on nodes that failed a check and removes
+	// it from nodes that passed.
+	Annotate bool
+	// DCGMLevel is the dcgmi diag run level. Defaults to 3.
+	DCGMLevel int
+	// FryerDuration is how long gpu-fryer stresses the GPUs. Defaults to 5
+	// minutes.
+	FryerDuration time.Duration
+	// RVSRecipe is the test runner recipe. Defaults to DefaultRVSRecipe.
+	RVSRecipe  string
+	HostImage  string
+	FryerImage string
+	RVSImage   string
+	// Timeout bounds each check, including image pulls. Defaults to an hour.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = "active-health-checks"
+	}
+	if c.Checks == nil {
+		c.Checks = AllChecks
+	}
+	if c.DCGMLevel == 0 {
+		c.DCGMLevel = 3
+	}
+	if c.FryerDuration == 0 {
+		c.FryerDuration = 5 * time.Minute
+	}
+	if c.RVSRecipe == "" {
+		c.RVSRecipe = DefaultRVSRecipe
+	}
+	if c.HostImage == "" {
+		c.HostImage = DefaultHostImage
+	}
+	if c.FryerImage == "" {
+		c.FryerImage = DefaultFryerImage
+	}
+	if c.RVSImage == "" {
+		c.RVSImage = DefaultRVSImage
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Hour
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 10 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// Result is one check on one node.
+type Result struct {
+	Node  string `json:"node"`
+	Shape string `json:"shape"`
+	Check Check  `json:"check"`
+	Outcome
+}
+
+// Report lists the results of every check, in check and node order.
+type Report struct {
+	Results []Result
+}
+
+// Failures lists every failure as "node: check: detail".
+func (r Report) Failures() []string {
+	var failures []string
+	for _, result := range r.Results {
+		if result.Status != Fail {
+			continue
+		}
+		if len(result.Details) == 0 {
+			failures = append(failures, fmt.Sprintf("%s: %s: failed", result.Node, result.Check))
+		}
+		for _, detail := range result.Details {
+			failures = append(failures, fmt.Sprintf("%s: %s: %s", result.Node, result.Check, detail))
+		}
+	}
+	return failures
+}
+
+// String renders one row per result with its metrics and first detail.
+func (r Report) String() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "node\tshape\tcheck\tresult\tmetrics\tdetail")
+	for _, result := range r.Results {
+		detail := "-"
+		if len(result.Details) > 0 {
+			detail = result.Details[0]
+			if len(result.Details) > 1 {
+				detail += fmt.Sprintf(" (+%d more)", len(result.Details)-1)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", result.Node, result.Shape, result.Check, result.Status, formatMetrics(result.Metrics), detail)
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+func formatMetrics(metrics map[string]float64) string {
+	if len(metrics) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%g", name, metrics[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// target is a node a check runs on.
+type target struct {
+	Node  string
+	Shape shapes.Shape
+	GPUs  int64
+}
+
+// Run runs the configured checks and deletes what it created. An error means
+// the checks could not run; unhealthy nodes are failures in the report. A
+// multi-node check fails every node of the run, since the output cannot tell
+// which node was at fault.
+func Run(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config) (Report, error) {
+	cfg.setDefaults()
+
+	for _, check := range cfg.Checks {
+		if !slices.Contains(AllChecks, check) {
+			return Report{}, fmt.Errorf("unknown active health check %q", check)
+		}
+		if check.multiNode() && (dyn == nil || cfg.Root == "") {
+			return Report{}, fmt.Errorf("%s needs a dynamic client and the repository root", check)
+		}
+	}
+	targets, err := selectTargets(ctx, client, cfg)
+	if err != nil {
+		return Report{}, err
+	}
+
+	namespaces := client.CoreV1().Namespaces()
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.Namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return Report{}, fmt.Errorf("failed to create namespace %s: %w", cfg.Namespace, err)
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := namespaces.Delete(cleanup, cfg.Namespace, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			cfg.Logf("failed to delete namespace %s: %v", cfg.Namespace, err)
+		}
+	}()
+
+	var report Report
+	for _, check := range cfg.Checks {
+		var nodes []target
+		for _, t := range targets {
+			if t.Shape.Vendor == check.Vendor() {
+				nodes = append(nodes, t)
+			}
+		}
+		if len(nodes) == 0 {
+			cfg.Logf("%s: no %s nodes to check", check, check.Vendor())
+			continue
+		}
+		var results []Result
+		if check.multiNode() {
+			results = runAllReduce(ctx, client, dyn, cfg, check, nodes)
+		} else {
+			results, err = runPods(ctx, client, cfg, check, nodes)
+			if err != nil {
+				return report, err
+			}
+		}
+		for _, result := range results {
+			cfg.Logf("%s on %s: %s", check, result.Node, result.Status)
+		}
+		report.Results = append(report.Results, results...)
+	}
+
+	if cfg.Label || cfg.Annotate {
+		if err := markNodes(ctx, client, cfg, report, time.Now()); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// selectTargets returns the configured nodes, or the idle GPU nodes, with
+// their shapes and GPU counts.
+func selectTargets(ctx context.Context, client kubernetes.Interface, cfg Config) ([]target, error) {
+	var nodes []corev1.Node
+	if len(cfg.Nodes) > 0 {
+		for _, name := range cfg.Nodes {
+			node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get node %s: %w", name, err)
+			}
+			nodes = append(nodes, *node)
+		}
+	} else {
+		for _, selector := range []string{"nvidia.com/gpu=true", "amd.com/gpu=true"} {
+			list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list GPU nodes: %w", err)
+			}
+			nodes = append(nodes, list.Items...)
+		}
+		busy, err := gpuRequests(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		nodes = slices.DeleteFunc(nodes, func(node corev1.Node) bool {
+			if busy[node.Name] > 0 {
+				cfg.Logf("skipping %s: pods request %d GPU(s)", node.Name, busy[node.Name])
+				return true
+			}
+			return false
+		})
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	}
+
+	var targets []target
+	for _, node := range nodes {
+		name := node.Labels[corev1.LabelInstanceTypeStable]
+		shape, ok := shapes.Lookup(name)
+		if !ok || shape.GPUs == 0 {
+			if len(cfg.Nodes) > 0 {
+				return nil, fmt.Errorf("node %s: %q is not a GPU shape in the shapes catalog", node.Name, name)
+			}
+			cfg.Logf("skipping %s: %q is not a GPU shape in the shapes catalog", node.Name, name)
+			continue
+		}
+		gpus := int64(shape.GPUs)
+		if capacity, ok := node.Status.Capacity[corev1.ResourceName(shape.GPUResource())]; ok && capacity.Value() > 0 {
+			gpus = capacity.Value()
+		}
+		targets = append(targets, target{Node: node.Name, Shape: shape, GPUs: gpus})
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no GPU nodes to check")
+	}
+	return targets, nil
+}
+
+// gpuRequests sums the GPUs that running and pending pods request per node.
+func gpuRequests(ctx context.Context, client kubernetes.Interface) (map[string]int64, error) {
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	requests := map[string]int64{}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, name := range []corev1.ResourceName{"nvidia.com/gpu", "amd.com/gpu"} {
+				if quantity, ok := container.Resources.Requests[name]; ok {
+					requests[pod.Spec.NodeName] += quantity.Value()
+				}
+			}
+		}
+	}
+	return requests, nil
+}
+
+func podName(check Check, i int) string { return fmt.Sprintf("%s-%d", check, i) }
+
+// runPods runs a single-node check on every node at once and parses each
+// pod's log, in node order, once all of them finished.
+func runPods(ctx context.Context, client kubernetes.Interface, cfg Config, check Check, nodes []target) ([]Result, error) {
+	pods := client.CoreV1().Pods(cfg.Namespace)
+	if check == RVS {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: rvsConfigMap, Namespace: cfg.Namespace},
+			Data:       map[string]string{"config.json": rvsConfig(cfg.RVSRecipe)},
+		}
+		_, err := client.CoreV1().ConfigMaps(cfg.Namespace).Create(ctx, configMap, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("failed to create ConfigMap %s: %w", rvsConfigMap, err)
+		}
+	}
+	for i, node := range nodes {
+		if _, err := pods.Create(ctx, checkPod(cfg, check, i, node), metav1.CreateOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create %s pod on %s: %w", check, node.Node, err)
+		}
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		for i := range nodes {
+			if err := pods.Delete(cleanup, podName(check, i), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				cfg.Logf("failed to delete pod %s: %v", podName(check, i), err)
+			}
+		}
+	}()
+
+	cfg.Logf("%s: waiting for %d pod(s)", check, len(nodes))
+	finished, err := waitForPods(ctx, client, cfg, check, len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(nodes))
+	for i, node := range nodes {
+		results[i] = Result{Node: node.Node, Shape: node.Shape.Name, Check: check}
+		pod, ok := finished[i]
+		if !ok {
+			results[i].Outcome = Outcome{Status: Fail, Details: []string{fmt.Sprintf("pod did not finish in %s", cfg.Timeout)}}
+			continue
+		}
+		raw, err := pods.GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get logs of pod %s: %w", pod.Name, err)
+		}
+		results[i].Outcome = podOutcome(cfg, check, pod, string(raw))
+	}
+	return results, nil
+}
+
+// waitForPods polls the pods of check until every one succeeded or failed,
+// or the timeout. It returns the finished pods by node index.
+func waitForPods(ctx context.Context, client kubernetes.Interface, cfg Config, check Check, n int) (map[int]*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	finished := map[int]*corev1.Pod{}
+	for {
+		for i := 0; i < n; i++ {
+			if finished[i] != nil {
+				continue
+			}
+			pod, err := client.CoreV1().Pods(cfg.Namespace).Get(ctx, podName(check, i), metav1.GetOptions{})
+			if err != nil && ctx.Err() == nil {
+				return nil, fmt.Errorf("failed to get pod %s: %w", podName(check, i), err)
+			}
+			if err == nil && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+				finished[i] = pod
+			}
+		}
+		if len(finished) == n {
+			return finished, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err := context.Cause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				return nil, err
+			}
+			return finished, nil
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+// podOutcome parses a finished pod's log. A pod that failed without output
+// the parser understands, or whose output passed, fails with its exit code.
+func podOutcome(cfg Config, check Check, pod *corev1.Pod, log string) Outcome {
+	var outcome Outcome
+	var err error
+	switch check {
+	case DCGMDiag:
+		outcome, err = ParseDCGMDiag(log)
+	case GPUFryer:
+		outcome, err = ParseGPUFryer(log)
+	case RVS:
+		outcome, err = ParseRVS(log, cfg.RVSRecipe)
+	}
+	if err != nil {
+		outcome = Outcome{Status: Fail, Details: []string{err.Error()}}
+	}
+	if pod.Status.Phase == corev1.PodFailed && (err != nil || outcome.Status == Pass) {
+		outcome.fail("%s", describeExit(pod))
+	}
+	return outcome
+}
+
+func describeExit(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if terminated := status.State.Terminated; terminated != nil {
+			return strings.TrimSpace(fmt.Sprintf("container exited with code %d %s", terminated.ExitCode, terminated.Reason))
+		}
+	}
+	return strings.TrimSpace("pod failed " + pod.Status.Reason)
+}
+
+const rvsConfigMap = "rvs-config"
+
+// rvsConfig is the test runner configuration of the rvs manifest.
+func rvsConfig(recipe string) string {
+	config := map[string]any{"TestConfig": map[string]any{"GPU_HEALTH_CHECK": map[string]any{"TestLocationTrigger": map[string]any{"global": map[string]any{
+		"TestParameters": map[string]any{"MANUAL": map[string]any{"TestCases": []any{map[string]any{
+			"Recipe": recipe, "Iterations": 1, "StopOnFailure": true, "TimeoutSeconds": 600, "Arguments": "--parallel",
+		}}}},
+	}}}}}
+	data, _ := json.MarshalIndent(config, "", "  ")
+	return string(data)
+}
+
+// checkPod builds the pod a single-node check runs in, following the job the
+// check's CronJob applier creates.
+func checkPod(cfg Config, check Check, i int, node target) *corev1.Pod {
+	privileged := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podName(check, i),
+			Namespace: cfg.Namespace,
+			Labels:    map[string]string{"app": "active-health-checks", "active-health-check": string(check)},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      node.Node,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Tolerations: []corev1.Toleration{
+				{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists},
+				{Key: "amd.com/gpu", Operator: corev1.TolerationOpExists},
+			},
+		},
+	}
+	gpus := corev1.ResourceList{corev1.ResourceName(node.Shape.GPUResource()): *resource.NewQuantity(node.GPUs, resource.DecimalSI)}
+	hostPathDirectory := corev1.HostPathDirectory
+	hostPathDirectoryOrCreate := corev1.HostPathDirectoryOrCreate
+	switch check {
+	case DCGMDiag:
+		// dcgmi talks to the host's nv-hostengine, so it runs through chroot
+		// and requests no GPUs.
+		pod.Spec.HostNetwork, pod.Spec.HostPID, pod.Spec.HostIPC = true, true, true
+		pod.Spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+		pod.Spec.Containers = []corev1.Container{{
+			Name:            "dcgm-diag",
+			Image:           cfg.HostImage,
+			Command:         []string{"/bin/sh", "-c", fmt.Sprintf("chroot /host /usr/bin/dcgmi diag -r %d --statsonfail --json", cfg.DCGMLevel)},
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "host-root", MountPath: "/host", ReadOnly: true},
+				{Name: "devinf", MountPath: "/dev/infiniband"},
+			},
+		}}
+		pod.Spec.Volumes = []corev1.Volume{
+			{Name: "host-root", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/", Type: &hostPathDirectory}}},
+			{Name: "devinf", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/dev/infiniband"}}},
+		}
+	case GPUFryer:
+		pod.Spec.Containers = []corev1.Container{{
+			Name:      "gpu-fryer",
+			Image:     cfg.FryerImage,
+			Command:   []string{"gpu-fryer", fmt.Sprint(int(cfg.FryerDuration.Seconds()))},
+			Resources: corev1.ResourceRequirements{Requests: gpus, Limits: gpus},
+			SecurityContext: &corev1.SecurityContext{
+				Privileged:   &privileged,
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"IPC_LOCK"}},
+			},
+		}}
+	case RVS:
+		pod.Spec.Containers = []corev1.Container{{
+			Name:            "amd-test-runner",
+			Image:           cfg.RVSImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Resources:       corev1.ResourceRequirements{Requests: gpus, Limits: gpus},
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+			Env: []corev1.EnvVar{
+				{Name: "TEST_TRIGGER", Value: "MANUAL"},
+				{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+				{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+				{Name: "NODE_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "test-runner-volume", MountPath: "/var/log/amd-test-runner"},
+				{Name: "config-volume", MountPath: "/etc/test-runner/"},
+			},
+		}}
+		pod.Spec.Volumes = []corev1.Volume{
+			{Name: "config-volume", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: rvsConfigMap}}}},
+			{Name: "test-runner-volume", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/log/amd-test-runner", Type: &hostPathDirectoryOrCreate}}},
+		}
+	}
+	return pod
+}
+
+// runAllReduce runs one all_reduce MPIJob per shape across all of its nodes.
+// A shape with a single node cannot run it and is skipped.
+func runAllReduce(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config, check Check, nodes []target) []Result {
+	var order []string
+	groups := map[string][]target{}
+	for _, node := range nodes {
+		if _, ok := groups[node.Shape.Name]; !ok {
+			order = append(order, node.Shape.Name)
+		}
+		groups[node.Shape.Name] = append(groups[node.Shape.Name], node)
+	}
+
+	var results []Result
+	for _, shape := range order {
+		group := groups[shape]
+		outcome := allReduceOutcome(ctx, client, dyn, cfg, check, group)
+		for _, node := range group {
+			results = append(results, Result{Node: node.Node, Shape: shape, Check: check, Outcome: outcome})
+		}
+	}
+	return results
+}
+
+func allReduceOutcome(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config, check Check, group []target) Outcome {
+	shape := group[0].Shape
+	if len(group) < 2 {
+		return Outcome{Status: Skip, Details: []string{fmt.Sprintf("needs at least 2 %s nodes", shape.Name)}}
+	}
+	path, err := nccl.ManifestPath(cfg.Root, shape.Name, cfg.VirtualFunctions && shape.VFs > 0)
+	if err != nil {
+		return Outcome{Status: Skip, Details: []string{err.Error()}}
+	}
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		return Outcome{Status: Skip, Details: []string{err.Error()}}
+	}
+	names := make([]string, len(group))
+	for i, node := range group {
+		names[i] = node.Node
+	}
+	name := string(check) + "-" + strings.NewReplacer(".", "-", "_", "-").Replace(strings.ToLower(shape.Name))
+	cfg.Logf("%s: running %s on %d %s nodes", check, name, len(group), shape.Name)
+	result, err := nccl.Run(ctx, client, dyn, nccl.Config{
+		Namespace:    cfg.Namespace + "-" + name,
+		Manifest:     manifest,
+		Options:      nccl.Options{Name: name, Workers: len(group), Kueue: cfg.Kueue, Nodes: names},
+		Timeout:      cfg.Timeout,
+		PollInterval: cfg.PollInterval,
+		Logf:         cfg.Logf,
+	})
+	if err != nil {
+		return Outcome{Status: Fail, Details: strings.Split(err.Error(), "\n")}
+	}
+	return AllReduceOutcome(result, shape.Name)
+}
+
+// maxDetails bounds DetailsAnnotation.
+const maxDetails = 4096
+
+// markNodes labels and annotates the nodes with their results. A node failing
+// several checks gets the labels and annotation of each.
+func markNodes(ctx context.Context, client kubernetes.Interface, cfg Config, report Report, now time.Time) error {
+	patches := map[string]map[string]map[string]any{}
+	var order []string
+	for _, result := range report.Results {
+		if result.Status == Skip {
+			continue
+		}
+		patch, ok := patches[result.Node]
+		if !ok {
+			patch = map[string]map[string]any{"labels": {}, "annotations": {}}
+			patches[result.Node] = patch
+			order = append(order, result.Node)
+		}
+		if cfg.Label {
+			patch["labels"][ResultLabel(result.Check)] = string(result.Status)
+			patch["labels"][LastRunLabel(result.Check)] = now.UTC().Format(lastRunFormat)
+		}
+		if cfg.Annotate {
+			var details any // null removes the annotation
+			if result.Status == Fail {
+				text := strings.Join(result.Details, "\n")
+				if len(text) > maxDetails {
+					text = text[:maxDetails]
+				}
+				details = text
+			}
+			patch["annotations"][DetailsAnnotation(result.Check)] = details
+		}
+	}
+	for _, node := range order {
+		data, err := json.Marshal(map[string]any{"metadata": patches[node]})
+		if err != nil {
+			return err
+		}
+		if _, err := client.CoreV1().Nodes().Patch(ctx, node, types.MergePatchType, data, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to mark node %s: %w", node, err)
+		}
+		cfg.Logf("marked node %s", node)
+	}
+	return nil
+}
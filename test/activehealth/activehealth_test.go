@@ -0,0 +1,363 @@
+package activehealth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// repoRoot is the repository checkout holding manifests/.
+const repoRoot = "../.."
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestParseDCGMDiag(t *testing.T) {
+	outcome, err := ParseDCGMDiag(readTestdata(t, "dcgm-diag.log"))
+	require.NoError(t, err)
+	require.Equal(t, Pass, outcome.Status)
+	require.Equal(t, map[string]float64{"tests_passed": 49, "tests_failed": 0, "tests_skipped": 8}, outcome.Metrics)
+	require.Empty(t, outcome.Details)
+
+	outcome, err = ParseDCGMDiag(readTestdata(t, "dcgm-diag-fail.log"))
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.Equal(t, map[string]float64{"tests_passed": 47, "tests_failed": 2, "tests_skipped": 8}, outcome.Metrics)
+	require.Equal(t, []string{
+		"Hardware/GPU Memory: GPU 5: Pending page retirements together with a DBE were detected on GPU 5. Drain the GPU and reset it or reboot the node.",
+		"Stress/Targeted Power: GPU 5: Detected 11 double bit ECC error(s) in GPU 5.",
+	}, outcome.Details)
+}
+
+func TestParseDCGMDiagOlderFormats(t *testing.T) {
+	outcome, err := ParseDCGMDiag(`{"DCGM GPU Diagnostic": {"test_categories": [{"category": "Hardware", "tests": [
+		{"name": "GPU Memory", "results": [{"gpu_ids": 0, "status": "FAIL", "warnings": ["Error using CUDA API cudaMalloc", "Retired pages"]}]}]}]}}`)
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.Equal(t, []string{"Hardware/GPU Memory: GPU 0: Error using CUDA API cudaMalloc; Retired pages"}, outcome.Details)
+}
+
+func TestParseDCGMDiagRejectsOtherOutput(t *testing.T) {
+	_, err := ParseDCGMDiag("chroot: can't execute '/usr/bin/dcgmi': No such file or directory\n")
+	require.EqualError(t, err, "no JSON document in dcgmi diag output")
+
+	_, err = ParseDCGMDiag(`{"error": "Unable to connect to host engine"}`)
+	require.EqualError(t, err, "dcgmi diag output has no test_categories")
+}
+
+func TestParseGPUFryer(t *testing.T) {
+	outcome, err := ParseGPUFryer(readTestdata(t, "gpu-fryer.log"))
+	require.NoError(t, err)
+	require.Equal(t, Pass, outcome.Status)
+	require.Equal(t, map[string]float64{"gpus": 8, "min_tflops": 707.4}, outcome.Metrics)
+
+	outcome, err = ParseGPUFryer(readTestdata(t, "gpu-fryer-fail.log"))
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.Equal(t, map[string]float64{"gpus": 8, "min_tflops": 397.7}, outcome.Metrics)
+	require.Equal(t, []string{
+		`"All GPUs seem healthy" not found in gpu-fryer output`,
+		"GPU #3 is unhealthy: 397.7 TFLOPS is 44% below the average of the other GPUs",
+		"GPU #3 throttled: HW slowdown",
+		"Some GPUs seem unhealthy",
+	}, outcome.Details)
+
+	_, err = ParseGPUFryer("exec /usr/local/bin/gpu-fryer: exec format error\n")
+	require.NoError(t, err, "an exec error is a problem line")
+	_, err = ParseGPUFryer("")
+	require.EqualError(t, err, "no gpu-fryer results in output")
+}
+
+func TestParseRVS(t *testing.T) {
+	outcome, err := ParseRVS(readTestdata(t, "rvs.log"), DefaultRVSRecipe)
+	require.NoError(t, err)
+	require.Equal(t, Pass, outcome.Status)
+	require.Equal(t, map[string]float64{"iterations_passed": 1}, outcome.Metrics)
+
+	outcome, err = ParseRVS(readTestdata(t, "rvs-fail.log"), DefaultRVSRecipe)
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.Equal(t, []string{
+		"gst_single did not complete successfully",
+		"[2025-10-01 15:36:13] ERROR cmd gst_single [iteration=1, pid=3981] failed with exit code 1",
+	}, outcome.Details)
+
+	_, err = ParseRVS(readTestdata(t, "rvs.log"), "mem_single")
+	require.EqualError(t, err, "no mem_single results in test runner output")
+}
+
+func TestParseAllReduce(t *testing.T) {
+	output, err := os.ReadFile("../nccl/testdata/BM.GPU.B4.8.log")
+	require.NoError(t, err)
+	outcome, err := ParseAllReduce(string(output), "BM.GPU.B4.8")
+	require.NoError(t, err)
+	require.Equal(t, Pass, outcome.Status)
+	require.Contains(t, outcome.Metrics, "peak_busbw_gbps")
+
+	regressed, err := os.ReadFile("../nccl/testdata/BM.GPU.B4.8-regressed.log")
+	require.NoError(t, err)
+	outcome, err = ParseAllReduce(string(regressed), "BM.GPU.B4.8")
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.NotEmpty(t, outcome.Details)
+
+	outcome, err = ParseAllReduce(string(regressed), "BM.GPU.H100.8")
+	require.NoError(t, err)
+	require.Equal(t, Fail, outcome.Status)
+	require.Equal(t, []string{"2G: 2 wrong values"}, outcome.Details, "shapes without a baseline only fail on wrong values")
+
+	_, err = ParseAllReduce("All workers are ready!\n", "BM.GPU.B4.8")
+	require.Error(t, err)
+}
+
+func TestParseChecks(t *testing.T) {
+	checks, err := ParseChecks("all")
+	require.NoError(t, err)
+	require.Equal(t, AllChecks, checks)
+
+	checks, err = ParseChecks("gpu-fryer, dcgm-diag,gpu-fryer")
+	require.NoError(t, err)
+	require.Equal(t, []Check{GPUFryer, DCGMDiag}, checks)
+
+	_, err = ParseChecks("dcgm")
+	require.EqualError(t, err, `unknown active health check "dcgm", want all or some of [dcgm-diag gpu-fryer rvs nccl-tests rccl-tests]`)
+}
+
+func gpuNode(name, shape string, gpus int64) *corev1.Node {
+	resourceName, vendorLabel := corev1.ResourceName("nvidia.com/gpu"), "nvidia.com/gpu"
+	if shape == "BM.GPU.MI300X.8" {
+		resourceName, vendorLabel = "amd.com/gpu", "amd.com/gpu"
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{
+			corev1.LabelInstanceTypeStable: shape,
+			vendorLabel:                    "true",
+		}},
+		Status: corev1.NodeStatus{Capacity: corev1.ResourceList{resourceName: *resource.NewQuantity(gpus, resource.DecimalSI)}},
+	}
+}
+
+// fakeCluster finishes every check pod with the phase phases returns for it
+// and serves logs, in order, as the pod logs.
+func fakeCluster(t *testing.T, phases func(pod *corev1.Pod) corev1.PodPhase, logs []string, objects ...runtime.Object) *fake.Clientset {
+	t.Helper()
+	client := fake.NewClientset(objects...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Status.Phase = phases(pod)
+		if pod.Status.Phase == corev1.PodFailed {
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}}}}
+		}
+		return false, nil, nil
+	})
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "log" {
+			return false, nil, nil
+		}
+		require.NotEmpty(t, logs, "unexpected pod log request")
+		log := logs[0]
+		logs = logs[1:]
+		return true, &runtime.Unknown{Raw: []byte(log)}, nil
+	})
+	return client
+}
+
+func TestRunSingleNodeChecksAndMarkNodes(t *testing.T) {
+	busy := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "training"},
+		Spec: corev1.PodSpec{NodeName: "10.0.3.4", Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{"nvidia.com/gpu": *resource.NewQuantity(8, resource.DecimalSI)},
+		}}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	stale := gpuNode("10.0.4.17", "BM.GPU.MI300X.8", 8)
+	stale.Annotations = map[string]string{DetailsAnnotation(RVS): "gst_single did not complete successfully"}
+	client := fakeCluster(t,
+		func(pod *corev1.Pod) corev1.PodPhase {
+			if pod.Name == "gpu-fryer-1" {
+				return corev1.PodFailed
+			}
+			return corev1.PodSucceeded
+		},
+		[]string{
+			readTestdata(t, "dcgm-diag.log"), readTestdata(t, "dcgm-diag-fail.log"),
+			readTestdata(t, "gpu-fryer.log"), readTestdata(t, "gpu-fryer-fail.log"),
+			readTestdata(t, "rvs.log"),
+		},
+		gpuNode("10.0.3.2", "BM.GPU.H100.8", 8), gpuNode("10.0.3.3", "BM.GPU.H100.8", 8), gpuNode("10.0.3.4", "BM.GPU.H100.8", 8),
+		stale, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.5"}}, busy)
+
+	var created []*corev1.Pod
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		created = append(created, action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).DeepCopy())
+		return false, nil, nil
+	})
+
+	report, err := Run(context.Background(), client, nil, Config{
+		Checks:       []Check{DCGMDiag, GPUFryer, RVS},
+		Label:        true,
+		Annotate:     true,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Results, 5)
+	require.Equal(t, []string{
+		"10.0.3.3: dcgm-diag: Hardware/GPU Memory: GPU 5: Pending page retirements together with a DBE were detected on GPU 5. Drain the GPU and reset it or reboot the node.",
+		"10.0.3.3: dcgm-diag: Stress/Targeted Power: GPU 5: Detected 11 double bit ECC error(s) in GPU 5.",
+		`10.0.3.3: gpu-fryer: "All GPUs seem healthy" not found in gpu-fryer output`,
+		"10.0.3.3: gpu-fryer: GPU #3 is unhealthy: 397.7 TFLOPS is 44% below the average of the other GPUs",
+		"10.0.3.3: gpu-fryer: GPU #3 throttled: HW slowdown",
+		"10.0.3.3: gpu-fryer: Some GPUs seem unhealthy",
+	}, report.Failures())
+	require.Equal(t, Result{Node: "10.0.4.17", Shape: "BM.GPU.MI300X.8", Check: RVS, Outcome: Outcome{Status: Pass, Metrics: map[string]float64{"iterations_passed": 1}}}, report.Results[4])
+	require.Contains(t, report.String(), "10.0.3.3   BM.GPU.H100.8    gpu-fryer  fail    gpus=8 min_tflops=397.7")
+
+	require.Len(t, created, 5, "the busy node and the CPU node are not checked")
+	require.Equal(t, "10.0.3.2", created[0].Spec.NodeName)
+	require.Equal(t, []string{"/bin/sh", "-c", "chroot /host /usr/bin/dcgmi diag -r 3 --statsonfail --json"}, created[0].Spec.Containers[0].Command)
+	require.True(t, created[0].Spec.HostPID)
+	require.Empty(t, created[0].Spec.Containers[0].Resources.Requests, "dcgm-diag runs on the host engine")
+	require.Equal(t, []string{"gpu-fryer", "300"}, created[2].Spec.Containers[0].Command)
+	require.Equal(t, "8", created[2].Spec.Containers[0].Resources.Limits.Name("nvidia.com/gpu", resource.DecimalSI).String())
+	require.Equal(t, "10.0.4.17", created[4].Spec.NodeName)
+	require.Equal(t, "8", created[4].Spec.Containers[0].Resources.Limits.Name("amd.com/gpu", resource.DecimalSI).String())
+
+	ctx := context.Background()
+	configMap, err := client.CoreV1().ConfigMaps("active-health-checks").Get(ctx, rvsConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, configMap.Data["config.json"], `"Recipe": "gst_single"`)
+	_, err = client.CoreV1().Namespaces().Get(ctx, "active-health-checks", metav1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err), "the namespace is deleted")
+
+	lastRun := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z$`)
+	node, err := client.CoreV1().Nodes().Get(ctx, "10.0.3.3", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "fail", node.Labels[ResultLabel(DCGMDiag)])
+	require.Equal(t, "fail", node.Labels[ResultLabel(GPUFryer)])
+	require.Regexp(t, lastRun, node.Labels[LastRunLabel(GPUFryer)])
+	require.Equal(t, "Hardware/GPU Memory: GPU 5: Pending page retirements together with a DBE were detected on GPU 5. Drain the GPU and reset it or reboot the node.\n"+
+		"Stress/Targeted Power: GPU 5: Detected 11 double bit ECC error(s) in GPU 5.", node.Annotations[DetailsAnnotation(DCGMDiag)])
+
+	node, err = client.CoreV1().Nodes().Get(ctx, "10.0.4.17", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "pass", node.Labels[ResultLabel(RVS)])
+	require.NotContains(t, node.Annotations, DetailsAnnotation(RVS), "a passing check removes the stale details")
+	require.NotContains(t, node.Labels, ResultLabel(DCGMDiag))
+
+	node, err = client.CoreV1().Nodes().Get(ctx, "10.0.3.4", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Empty(t, node.Labels[ResultLabel(DCGMDiag)], "skipped nodes are not labeled")
+}
+
+func TestRunFailsPodsThatDoNotFinish(t *testing.T) {
+	client := fakeCluster(t, func(*corev1.Pod) corev1.PodPhase { return corev1.PodPending }, nil, gpuNode("10.0.3.2", "BM.GPU.H100.8", 8))
+
+	report, err := Run(context.Background(), client, nil, Config{
+		Checks:       []Check{GPUFryer},
+		Nodes:        []string{"10.0.3.2"},
+		Timeout:      20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.3.2: gpu-fryer: pod did not finish in 20ms"}, report.Failures())
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "10.0.3.2", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, node.Labels, ResultLabel(GPUFryer), "nodes are only labeled when asked to")
+}
+
+func TestRunRejectsUnusableConfigs(t *testing.T) {
+	client := fake.NewClientset(gpuNode("10.0.3.2", "BM.GPU.H100.8", 8), &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "10.0.0.5"}})
+
+	_, err := Run(context.Background(), client, nil, Config{Checks: []Check{NCCLTests}})
+	require.EqualError(t, err, "nccl-tests needs a dynamic client and the repository root")
+
+	_, err = Run(context.Background(), client, nil, Config{Checks: []Check{GPUFryer}, Nodes: []string{"10.0.0.5"}})
+	require.EqualError(t, err, `node 10.0.0.5: "" is not a GPU shape in the shapes catalog`)
+
+	_, err = Run(context.Background(), client, nil, Config{Checks: []Check{GPUFryer}, Nodes: []string{"10.0.9.9"}})
+	require.ErrorContains(t, err, "failed to get node 10.0.9.9")
+
+	_, err = Run(context.Background(), fake.NewClientset(), nil, Config{Checks: []Check{DCGMDiag}})
+	require.EqualError(t, err, "no GPU nodes to check")
+}
+
+var mpiJobs = schema.GroupVersionResource{Group: "kubeflow.org", Version: "v2beta1", Resource: "mpijobs"}
+
+func TestRunAllReducePerShape(t *testing.T) {
+	output, err := os.ReadFile("../nccl/testdata/BM.GPU.B4.8-regressed.log")
+	require.NoError(t, err)
+	client := fake.NewClientset(
+		gpuNode("10.0.3.2", "BM.GPU.B4.8", 8), gpuNode("10.0.3.3", "BM.GPU.B4.8", 8), gpuNode("10.0.5.2", "BM.GPU.H100.8", 8))
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "log" {
+			return false, nil, nil
+		}
+		return true, &runtime.Unknown{Raw: output}, nil
+	})
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{mpiJobs: "MPIJobList"})
+	var jobs []*unstructured.Unstructured
+	dyn.PrependReactor("create", "mpijobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		conditions := []interface{}{map[string]interface{}{"type": "Succeeded", "status": "True"}}
+		require.NoError(t, unstructured.SetNestedSlice(job.Object, conditions, "status", "conditions"))
+		jobs = append(jobs, job.DeepCopy())
+		_, err := client.CoreV1().Pods(job.GetNamespace()).Create(context.Background(), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      job.GetName() + "-launcher-x7k2p",
+			Namespace: job.GetNamespace(),
+			Labels:    map[string]string{"training.kubeflow.org/job-name": job.GetName(), "training.kubeflow.org/job-role": "launcher"},
+		}}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		return false, nil, nil
+	})
+
+	report, err := Run(context.Background(), client, dyn, Config{
+		Checks:       []Check{NCCLTests, RCCLTests},
+		Root:         repoRoot,
+		Label:        true,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Results, 3)
+	for _, result := range report.Results[:2] {
+		require.Equal(t, "BM.GPU.B4.8", result.Shape)
+		require.Equal(t, Fail, result.Status, "the regressed run fails both nodes")
+	}
+	require.Equal(t, Result{Node: "10.0.5.2", Shape: "BM.GPU.H100.8", Check: NCCLTests, Outcome: Outcome{Status: Skip, Details: []string{"needs at least 2 BM.GPU.H100.8 nodes"}}}, report.Results[2])
+
+	require.Len(t, jobs, 1)
+	require.Equal(t, "nccl-tests-bm-gpu-b4-8", jobs[0].GetName())
+	require.Equal(t, "active-health-checks-nccl-tests-bm-gpu-b4-8", jobs[0].GetNamespace())
+	replicas, _, err := unstructured.NestedInt64(jobs[0].Object, "spec", "mpiReplicaSpecs", "Worker", "replicas")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, replicas)
+	terms, _, err := unstructured.NestedSlice(jobs[0].Object, "spec", "mpiReplicaSpecs", "Worker", "template", "spec",
+		"affinity", "nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms")
+	require.NoError(t, err)
+	require.Len(t, terms, 1, "the workers are pinned to the B4.8 nodes")
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "10.0.5.2", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, node.Labels, ResultLabel(NCCLTests))
+	node, err = client.CoreV1().Nodes().Get(context.Background(), "10.0.3.2", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "fail", node.Labels[ResultLabel(NCCLTests)])
+}
@@ -0,0 +1,239 @@
+package activehealth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+)
+
+// Outcome is what a parser made of one check's output on one node. Metrics
+// are numbers worth tracking across runs; Details explain a failure, one
+// problem per entry.
+type Outcome struct {
+	Status  Status             `json:"status"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	Details []string           `json:"details,omitempty"`
+}
+
+func (o *Outcome) fail(format string, args ...any) {
+	o.Status = Fail
+	o.Details = append(o.Details, fmt.Sprintf(format, args...))
+}
+
+// dcgmReport is the part of dcgmi diag --json output the parser reads. DCGM
+// 3.x reports gpu_ids as a string and warnings as objects; older releases
+// use plain strings, so both are kept raw.
+type dcgmReport struct {
+	TestCategories []struct {
+		Category string `json:"category"`
+		Tests    []struct {
+			Name    string `json:"name"`
+			Results []struct {
+				GPUIDs   json.RawMessage `json:"gpu_ids"`
+				Status   string          `json:"status"`
+				Warnings json.RawMessage `json:"warnings"`
+			} `json:"results"`
+		} `json:"tests"`
+	} `json:"test_categories"`
+}
+
+// ParseDCGMDiag reads the output of dcgmi diag --json, skipping anything
+// printed before the JSON document. The node fails when any test result has
+// status Fail, like the dcgm-diag CronJob applier decides.
+func ParseDCGMDiag(output string) (Outcome, error) {
+	start, end := strings.Index(output, "{"), strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return Outcome{}, errors.New("no JSON document in dcgmi diag output")
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(output[start:end+1]), &top); err != nil {
+		return Outcome{}, fmt.Errorf("dcgmi diag output: %w", err)
+	}
+	keys := make([]string, 0, len(top))
+	for key := range top {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var report dcgmReport
+	for _, key := range keys {
+		if err := json.Unmarshal(top[key], &report); err == nil && len(report.TestCategories) > 0 {
+			break
+		}
+	}
+	if len(report.TestCategories) == 0 {
+		return Outcome{}, errors.New("dcgmi diag output has no test_categories")
+	}
+
+	outcome := Outcome{Status: Pass, Metrics: map[string]float64{"tests_passed": 0, "tests_failed": 0, "tests_skipped": 0}}
+	for _, category := range report.TestCategories {
+		for _, test := range category.Tests {
+			for _, result := range test.Results {
+				switch {
+				case strings.EqualFold(result.Status, "pass"):
+					outcome.Metrics["tests_passed"]++
+				case strings.EqualFold(result.Status, "skip"):
+					outcome.Metrics["tests_skipped"]++
+				case strings.EqualFold(result.Status, "fail"):
+					outcome.Metrics["tests_failed"]++
+					detail := category.Category + "/" + test.Name
+					if gpus := strings.Trim(string(result.GPUIDs), `"`); gpus != "" && gpus != "null" {
+						detail += ": GPU " + gpus
+					}
+					if warnings := dcgmWarnings(result.Warnings); warnings != "" {
+						detail += ": " + warnings
+					}
+					outcome.fail("%s", detail)
+				}
+			}
+		}
+	}
+	return outcome, nil
+}
+
+// dcgmWarnings joins the warnings of a test result, given as strings or as
+// {"warning": ...} objects.
+func dcgmWarnings(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var texts []string
+	if err := json.Unmarshal(raw, &texts); err == nil {
+		return oneLine(strings.Join(texts, "; "))
+	}
+	var objects []struct {
+		Warning string `json:"warning"`
+	}
+	if err := json.Unmarshal(raw, &objects); err == nil {
+		texts = nil
+		for _, object := range objects {
+			texts = append(texts, object.Warning)
+		}
+		return oneLine(strings.Join(texts, "; "))
+	}
+	return oneLine(string(raw))
+}
+
+var (
+	fryerTFLOPS  = regexp.MustCompile(`(?i)GPU\s*#?(\d+)\D[^\n]*?(\d+(?:\.\d+)?)\s*TFLOPS`)
+	fryerProblem = regexp.MustCompile(`(?i)unhealthy|throttl|error`)
+)
+
+// fryerHealthy is the line gpu-fryer prints when every GPU passed.
+const fryerHealthy = "All GPUs seem healthy"
+
+// ParseGPUFryer reads gpu-fryer output. The node passes when gpu-fryer says
+// all GPUs seem healthy, like the gpu-fryer CronJob applier decides. The last
+// TFLOPS figure of each GPU gives the gpus and min_tflops metrics.
+func ParseGPUFryer(output string) (Outcome, error) {
+	tflops := map[string]float64{}
+	var problems []string
+	for _, line := range strings.Split(output, "\n") {
+		if fryerProblem.MatchString(line) {
+			problems = append(problems, strings.TrimSpace(line))
+			continue
+		}
+		if m := fryerTFLOPS.FindStringSubmatch(line); m != nil {
+			tflops[m[1]], _ = strconv.ParseFloat(m[2], 64)
+		}
+	}
+	healthy := strings.Contains(output, fryerHealthy)
+	if !healthy && len(tflops) == 0 && len(problems) == 0 {
+		return Outcome{}, errors.New("no gpu-fryer results in output")
+	}
+
+	outcome := Outcome{Status: Pass, Metrics: map[string]float64{"gpus": float64(len(tflops))}}
+	if len(tflops) > 0 {
+		lowest := -1.0
+		for _, value := range tflops {
+			if lowest < 0 || value < lowest {
+				lowest = value
+			}
+		}
+		outcome.Metrics["min_tflops"] = lowest
+	}
+	if !healthy {
+		outcome.fail("%q not found in gpu-fryer output", fryerHealthy)
+		outcome.Details = append(outcome.Details, problems...)
+	}
+	return outcome, nil
+}
+
+// ParseRVS reads the log of the ROCm test runner for recipe. The node passes
+// when an iteration of the recipe completed successfully, like the rvs
+// CronJob applier decides; lines reporting failures explain a failed run.
+func ParseRVS(output, recipe string) (Outcome, error) {
+	completed := regexp.MustCompile(`cmd ` + regexp.QuoteMeta(recipe) + ` \[iteration=\d+, pid=\d+\] completed successfully`)
+	mentioned := regexp.MustCompile(`\b` + regexp.QuoteMeta(recipe) + `\b`)
+	failed := regexp.MustCompile(`(?i)\bfail(ed|ure)?\b`)
+
+	outcome := Outcome{Status: Pass, Metrics: map[string]float64{"iterations_passed": 0}}
+	seen := false
+	var problems []string
+	for _, line := range strings.Split(output, "\n") {
+		if mentioned.MatchString(line) {
+			seen = true
+		}
+		switch {
+		case completed.MatchString(line):
+			outcome.Metrics["iterations_passed"]++
+		case failed.MatchString(line):
+			problems = append(problems, strings.TrimSpace(line))
+		}
+	}
+	if !seen {
+		return Outcome{}, fmt.Errorf("no %s results in test runner output", recipe)
+	}
+	if outcome.Metrics["iterations_passed"] == 0 {
+		outcome.fail("%s did not complete successfully", recipe)
+		outcome.Details = append(outcome.Details, problems...)
+	}
+	return outcome, nil
+}
+
+// ParseAllReduce reads nccl-tests or rccl-tests all_reduce_perf output and
+// judges it with AllReduceOutcome.
+func ParseAllReduce(output, shape string) (Outcome, error) {
+	result, err := nccl.Parse(output)
+	if err != nil {
+		return Outcome{}, err
+	}
+	return AllReduceOutcome(result, shape), nil
+}
+
+// AllReduceOutcome fails a run that reported wrong values or, for shapes with
+// a baseline in nccl.Baselines, whose peak bus bandwidth regressed beyond
+// nccl.DefaultTolerance.
+func AllReduceOutcome(result nccl.Result, shape string) Outcome {
+	outcome := Outcome{Status: Pass, Metrics: map[string]float64{}}
+	if peak, ok := result.Peak(); ok {
+		outcome.Metrics["peak_busbw_gbps"] = peak.BusBW()
+		outcome.Metrics["peak_size_bytes"] = float64(peak.Size)
+	}
+	if result.AvgBusBW > 0 {
+		outcome.Metrics["avg_busbw_gbps"] = result.AvgBusBW
+	}
+	if baseline, ok := nccl.Baselines[shape]; ok {
+		if err := nccl.Compare(result, baseline, nccl.DefaultTolerance); err != nil {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				outcome.fail("%s", line)
+			}
+		}
+		return outcome
+	}
+	for _, row := range result.Rows {
+		if n := row.Wrong(); n > 0 {
+			outcome.fail("%s: %d wrong values", nccl.FormatSize(row.Size), n)
+		}
+	}
+	return outcome
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
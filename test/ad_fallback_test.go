@@ -0,0 +1,189 @@
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+	"github.com/stretchr/testify/require"
+)
+
+// workerPoolADs maps each worker pool key in oke-workers.tf to the variable
+// holding its AD and the env vars that list candidate ADs, comma-separated in
+// order of preference (for example WORKER_GPU_AD="AD-1,AD-2,AD-3").
+var workerPoolADs = []struct {
+	pool     string
+	variable string
+	envKeys  []string
+}{
+	{"oke-system", "worker_ops_ad", []string{"WORKER_OPS_AD", "OCI_WORKER_OPS_AD"}},
+	{"oke-cpu", "worker_cpu_ad", []string{"WORKER_CPU_AD"}},
+	{"oke-gpu", "worker_gpu_ad", []string{"WORKER_GPU_AD"}},
+	{"oke-rdma", "worker_rdma_ad", []string{"WORKER_RDMA_AD"}},
+	{"oke-gmc", "worker_gmc_ad", []string{"WORKER_GMC_AD"}},
+}
+
+// workerPoolAddress finds the pool key in resource addresses such as
+// module.oke.module.workers[0].oci_core_cluster_network.workers["oke-rdma"].
+var workerPoolAddress = regexp.MustCompile(`\["(oke-[\w-]+)"\]`)
+
+// capacityFailedPools returns the worker pools named in the capacity errors of
+// a terraform output.
+func capacityFailedPools(output string) []string {
+	seen := map[string]bool{}
+	var pools []string
+	for _, block := range strings.Split(output, "Error: ") {
+		if classifyFailure(block).Category != failureCapacity {
+			continue
+		}
+		for _, match := range workerPoolAddress.FindAllStringSubmatch(block, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				pools = append(pools, match[1])
+			}
+		}
+	}
+	return pools
+}
+
+// adFallback moves worker pools that ran out of capacity to the next AD in
+// their candidate list, never retrying an AD that already failed.
+type adFallback struct {
+	tried map[string]map[string]bool
+}
+
+func newADFallback() *adFallback {
+	return &adFallback{tried: map[string]map[string]bool{}}
+}
+
+// advance updates options for the next apply after a capacity failure in
+// output. It returns the variables it changed, or an error if the failure is
+// not a pool capacity error or a failed pool has no untried AD left.
+func (f *adFallback) advance(options *terraform.Options, output string) (map[string]string, error) {
+	pools := capacityFailedPools(output)
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("not a worker pool capacity failure")
+	}
+
+	changed := map[string]string{}
+	for _, pool := range pools {
+		for _, entry := range workerPoolADs {
+			if entry.pool != pool {
+				continue
+			}
+			current, _ := options.Vars[entry.variable].(string)
+			if f.tried[entry.variable] == nil {
+				f.tried[entry.variable] = map[string]bool{}
+			}
+			f.tried[entry.variable][current] = true
+
+			next := ""
+			for _, ad := range splitADs(envOrDefault(entry.envKeys, "")) {
+				if !f.tried[entry.variable][ad] {
+					next = ad
+					break
+				}
+			}
+			if next == "" {
+				return nil, fmt.Errorf("pool %s is out of capacity in every candidate AD (%s)", pool, strings.Join(sortedKeys(f.tried[entry.variable]), ", "))
+			}
+			options.Vars[entry.variable] = next
+			changed[entry.variable] = next
+		}
+	}
+	if len(changed) == 0 {
+		return nil, fmt.Errorf("no AD candidates configured for pools %s", strings.Join(pools, ", "))
+	}
+	return changed, nil
+}
+
+// poolADs returns the AD of every worker pool that has one set in options.
+func poolADs(options *terraform.Options) map[string]string {
+	ads := map[string]string{}
+	for _, entry := range workerPoolADs {
+		if ad, _ := options.Vars[entry.variable].(string); ad != "" {
+			ads[entry.variable] = ad
+		}
+	}
+	return ads
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func capacityError(pool string) string {
+	return fmt.Sprintf(`Error: 500-InternalError, Out of host capacity.
+Suggestion: The service for this resource encountered an error. Please contact support for help with service: Core Instance Pool
+
+  with module.oke.module.workers[0].oci_core_instance_pool.workers["%s"],
+  on .terraform/modules/oke/modules/workers/instancepools.tf line 5, in resource "oci_core_instance_pool" "workers":`, pool)
+}
+
+func TestCapacityFailedPoolsIgnoresOtherErrors(t *testing.T) {
+	output := capacityError("oke-rdma") + "\n\nError: 400-InvalidParameter, bad shape\n  with oci_core_instance_pool.workers[\"oke-cpu\"],"
+	require.Equal(t, []string{"oke-rdma"}, capacityFailedPools(output))
+	require.Empty(t, capacityFailedPools("Error: 429-TooManyRequests\n  with oci_core_instance_pool.workers[\"oke-gpu\"],"))
+}
+
+func TestApplyFallsBackToNextADOnCapacityError(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	t.Setenv("WORKER_GPU_AD", "AD-1, AD-2,AD-3")
+
+	stages := newClusterStages("TestADFallback")
+	stages.setup(t, nil)
+	fake := &fakeTerraform{
+		applyOutputs: []string{capacityError("oke-gpu"), capacityError("oke-gpu")},
+		outputs:      map[string]interface{}{"cluster_id": "ocid1.cluster.oc1.iad.aaaa"},
+	}
+	stages.exec.terraform = fake
+	stages.apply(t)
+
+	require.Equal(t, []string{"AD-1", "AD-2", "AD-3"}, fake.appliedADs)
+	require.Equal(t, "AD-3", test_structure.LoadTerraformOptions(t, stages.workDir).Vars["worker_gpu_ad"])
+	audit, err := readRunAudit(runAuditPath(currentRunID(), t.Name()))
+	require.NoError(t, err)
+	require.Equal(t, "AD-3", audit.AvailabilityDomains["worker_gpu_ad"])
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", audit.ClusterID)
+}
+
+func TestApplyFailsWhenEveryADIsOutOfCapacity(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	t.Setenv("WORKER_GPU_AD", "AD-1,AD-2")
+
+	stages := newClusterStages("TestADExhausted")
+	stages.setup(t, nil)
+	stages.exec.terraform = &fakeTerraform{applyOutputs: []string{capacityError("oke-gpu"), capacityError("oke-gpu"), capacityError("oke-gpu")}}
+
+	err := runFixtureStage("apply", func(ft *fixtureT) { stages.apply(ft) })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "terraform apply failed [capacity:")
+}
+
+func TestADFallbackAdvancesGMCPool(t *testing.T) {
+	t.Setenv("WORKER_GMC_AD", "AD-2,AD-3")
+	options := &terraform.Options{Vars: map[string]interface{}{"worker_gmc_ad": "AD-2", "worker_rdma_ad": "AD-1"}}
+	output := `Error: 500-InternalError, Out of host capacity.
+
+  with module.oke.module.workers[0].oci_core_compute_gpu_memory_cluster.workers["oke-gmc"],`
+
+	fallback := newADFallback()
+	changed, err := fallback.advance(options, output)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"worker_gmc_ad": "AD-3"}, changed)
+	require.Equal(t, map[string]string{"worker_gmc_ad": "AD-3", "worker_rdma_ad": "AD-1"}, poolADs(options))
+
+	_, err = fallback.advance(options, output)
+	require.ErrorContains(t, err, "pool oke-gmc is out of capacity in every candidate AD (AD-2, AD-3)")
+}
@@ -0,0 +1,442 @@
+// Package bastion forwards a local port to a private IP through an OCI Bastion
+// Service port-forwarding session, like files/oke-bastion-service-session.sh
+// but without the oci CLI or an ssh binary.
+package bastion
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/bastion"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes the session to open.
+type Config struct {
+	BastionID  string
+	TargetIP   string
+	TargetPort int
+	// TTL is the session lifetime; OCI closes the session after it.
+	TTL time.Duration
+	// RenewBefore is how long before the TTL ends the tunnel replaces the
+	// session with a new one. It defaults to 10 minutes, or half the TTL if
+	// that is shorter.
+	RenewBefore time.Duration
+	DisplayName string
+	// SessionTimeout bounds the wait for the session to become ACTIVE and
+	// accept the SSH connection.
+	SessionTimeout time.Duration
+	// PollInterval is the first wait between session polls; it doubles up to
+	// 15s.
+	PollInterval time.Duration
+	Log          io.Writer
+}
+
+// Tunnel is an open session plus the local listener forwarding through it.
+// Sessions cannot be extended, so the tunnel opens a new one before the TTL
+// ends, or as soon as a forward finds the session gone, and keeps listening on
+// the same address.
+type Tunnel struct {
+	cfg      Config
+	client   bastion.BastionClient
+	listener net.Listener
+	target   string
+	log      io.Writer
+	// ctx is cancelled by Close, stopping renewals.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// renewing serializes session replacements.
+	renewing sync.Mutex
+	mu       sync.Mutex
+	current  *session
+	// retiring are replaced sessions that still carry forwards opened before
+	// the replacement; each is closed when it expires.
+	retiring []*session
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// session is a port-forwarding session and the SSH connection to it.
+type session struct {
+	id      string
+	ssh     *ssh.Client
+	expires time.Time
+}
+
+const maxPollInterval = 15 * time.Second
+
+// Open creates a port-forwarding session to cfg.TargetIP with an ephemeral
+// key, waits for it to become ACTIVE, connects to it over SSH and listens on
+// a random loopback port. Close the tunnel to delete the session.
+func Open(ctx context.Context, client bastion.BastionClient, cfg Config) (*Tunnel, error) {
+	if cfg.TargetPort == 0 {
+		cfg.TargetPort = 6443
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 3 * time.Hour
+	}
+	if cfg.RenewBefore == 0 {
+		cfg.RenewBefore = min(10*time.Minute, cfg.TTL/2)
+	}
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = "oke-test-tunnel"
+	}
+	if cfg.SessionTimeout == 0 {
+		cfg.SessionTimeout = 5 * time.Minute
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	if cfg.Log == nil {
+		cfg.Log = io.Discard
+	}
+
+	t := &Tunnel{
+		cfg:    cfg,
+		client: client,
+		target: net.JoinHostPort(cfg.TargetIP, strconv.Itoa(cfg.TargetPort)),
+		log:    cfg.Log,
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	s, err := t.openSession(ctx)
+	if err != nil {
+		t.cancel()
+		return nil, err
+	}
+	t.current = s
+	if t.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.cancel()
+		return nil, errors.Join(err, t.closeSession(s))
+	}
+	t.wg.Add(2)
+	go t.serve()
+	go t.renew()
+	fmt.Fprintf(cfg.Log, "forwarding %s to %s\n", t.Addr(), t.target)
+	return t, nil
+}
+
+// openSession creates a session with a new ephemeral key and connects to it.
+func (t *Tunnel) openSession(ctx context.Context) (*session, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(t.cfg.TTL)
+	created, err := t.client.CreateSession(ctx, bastion.CreateSessionRequest{
+		CreateSessionDetails: bastion.CreateSessionDetails{
+			BastionId:   common.String(t.cfg.BastionID),
+			DisplayName: common.String(t.cfg.DisplayName),
+			KeyType:     bastion.CreateSessionDetailsKeyTypePub,
+			KeyDetails: &bastion.PublicKeyDetails{
+				PublicKeyContent: common.String(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))),
+			},
+			TargetResourceDetails: bastion.CreatePortForwardingSessionTargetResourceDetails{
+				TargetResourcePrivateIpAddress: common.String(t.cfg.TargetIP),
+				TargetResourcePort:             common.Int(t.cfg.TargetPort),
+			},
+			SessionTtlInSeconds: common.Int(int(t.cfg.TTL.Seconds())),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bastion session: %w", err)
+	}
+	s := &session{id: *created.Id, expires: expires}
+	fmt.Fprintf(t.log, "bastion session %s created for %s\n", s.id, t.target)
+
+	if s.ssh, err = t.connect(ctx, s.id, signer); err != nil {
+		return nil, errors.Join(err, t.deleteSession(s.id))
+	}
+	return s, nil
+}
+
+// connect waits for the session to become ACTIVE and dials it. The first SSH
+// attempts can be refused while the session propagates, so dialing is retried
+// until the session timeout.
+func (t *Tunnel) connect(ctx context.Context, id string, signer ssh.Signer) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.SessionTimeout)
+	defer cancel()
+
+	interval := t.cfg.PollInterval
+	wait := func() error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, maxPollInterval)
+		return nil
+	}
+
+	var session bastion.Session
+	for {
+		resp, err := t.client.GetSession(ctx, bastion.GetSessionRequest{SessionId: common.String(id)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bastion session %s: %w", id, err)
+		}
+		session = resp.Session
+		fmt.Fprintf(t.log, "bastion session %s is %s\n", id, session.LifecycleState)
+		if session.LifecycleState == bastion.SessionLifecycleStateActive {
+			break
+		}
+		if session.LifecycleState != bastion.SessionLifecycleStateCreating {
+			details := ""
+			if session.LifecycleDetails != nil {
+				details = ": " + *session.LifecycleDetails
+			}
+			return nil, fmt.Errorf("bastion session %s is %s%s", id, session.LifecycleState, details)
+		}
+		if err := wait(); err != nil {
+			return nil, fmt.Errorf("bastion session %s did not become ACTIVE: %w", id, err)
+		}
+	}
+
+	user, addr, err := sshTarget(session.SshMetadata["command"])
+	if err != nil {
+		return nil, fmt.Errorf("bastion session %s: %w", id, err)
+	}
+	hostKey, err := hostKeyCallback(session.BastionPublicHostKeyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("bastion session %s: %w", id, err)
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}
+	for {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err == nil {
+			return client, nil
+		}
+		if strings.Contains(err.Error(), "host key mismatch") {
+			return nil, fmt.Errorf("bastion %s presented an unexpected host key: %w", addr, err)
+		}
+		fmt.Fprintf(t.log, "ssh to %s not ready: %v\n", addr, err)
+		if waitErr := wait(); waitErr != nil {
+			return nil, fmt.Errorf("failed to connect to bastion %s: %w", addr, err)
+		}
+	}
+}
+
+// sshTarget extracts user@host and -p from the session's ssh command, such as
+// "ssh -i <privateKey> -N -L <localPort>:10.0.0.5:6443 -p 22 ocid1.bastionsession...@host.bastion.us-ashburn-1.oci.oraclecloud.com".
+func sshTarget(command string) (user, addr string, err error) {
+	port := "22"
+	fields := strings.Fields(command)
+	for i, field := range fields {
+		switch {
+		case field == "-p" && i+1 < len(fields):
+			port = fields[i+1]
+		case strings.Contains(field, "@") && !strings.HasPrefix(field, "-"):
+			user, addr, _ = strings.Cut(field, "@")
+		}
+	}
+	if user == "" || addr == "" {
+		return "", "", fmt.Errorf("no user@host in ssh command %q", command)
+	}
+	return user, net.JoinHostPort(addr, port), nil
+}
+
+// hostKeyCallback pins the bastion host key the session reports. Sessions
+// that report none are accepted as-is, like StrictHostKeyChecking=accept-new
+// in the shell script.
+func hostKeyCallback(info *string) (ssh.HostKeyCallback, error) {
+	if info == nil || strings.TrimSpace(*info) == "" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(*info))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bastion host key: %w", err)
+	}
+	return ssh.FixedHostKey(key), nil
+}
+
+// Addr is the local host:port that forwards to the target. It stays the same
+// when the session is renewed.
+func (t *Tunnel) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// SessionID is the OCID of the session new forwards go through.
+func (t *Tunnel) SessionID() string {
+	return t.session().id
+}
+
+func (t *Tunnel) session() *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+func (t *Tunnel) serve() {
+	defer t.wg.Done()
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer local.Close()
+			remote, err := t.dial()
+			if err != nil {
+				fmt.Fprintf(t.log, "failed to forward to %s: %v\n", t.target, err)
+				return
+			}
+			defer remote.Close()
+			done := make(chan struct{}, 2)
+			go func() { _, _ = io.Copy(remote, local); done <- struct{}{} }()
+			go func() { _, _ = io.Copy(local, remote); done <- struct{}{} }()
+			<-done
+		}()
+	}
+}
+
+// dial opens a channel to the target through the current session. If the SSH
+// connection is gone, for example because the session expired, it replaces the
+// session and tries once more. A channel the bastion rejects is not retried.
+func (t *Tunnel) dial() (net.Conn, error) {
+	s := t.session()
+	conn, err := s.ssh.Dial("tcp", t.target)
+	var rejected *ssh.OpenChannelError
+	if err == nil || errors.As(err, &rejected) {
+		return conn, err
+	}
+	fmt.Fprintf(t.log, "bastion session %s is gone: %v\n", s.id, err)
+	if err := t.replace(s, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.session().ssh.Dial("tcp", t.target)
+}
+
+// renew replaces the session RenewBefore ahead of its TTL. Failed renewals
+// are retried with backoff until the tunnel is closed.
+func (t *Tunnel) renew() {
+	defer t.wg.Done()
+	interval := t.cfg.PollInterval
+	for {
+		s := t.session()
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(time.Until(s.expires.Add(-t.cfg.RenewBefore))):
+		}
+		if err := t.replace(s, s.expires); err != nil {
+			if t.ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(t.log, "failed to renew bastion session %s, retrying in %s: %v\n", s.id, interval, err)
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			interval = min(2*interval, maxPollInterval)
+			continue
+		}
+		interval = t.cfg.PollInterval
+	}
+}
+
+// replace opens a new session for new forwards if old is still the current
+// one, and closes old at retireAt. Forwards already running through old keep
+// going until then.
+func (t *Tunnel) replace(old *session, retireAt time.Time) error {
+	t.renewing.Lock()
+	defer t.renewing.Unlock()
+	if t.session() != old {
+		return nil
+	}
+	next, err := t.openSession(t.ctx)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.current = next
+	t.retiring = append(t.retiring, old)
+	t.mu.Unlock()
+	fmt.Fprintf(t.log, "bastion session %s replaced %s\n", next.id, old.id)
+	time.AfterFunc(time.Until(retireAt), func() { t.retire(old) })
+	return nil
+}
+
+// retire closes a replaced session unless Close already did.
+func (t *Tunnel) retire(s *session) {
+	t.mu.Lock()
+	i := slices.Index(t.retiring, s)
+	if i >= 0 {
+		t.retiring = slices.Delete(t.retiring, i, i+1)
+	}
+	t.mu.Unlock()
+	if i < 0 {
+		return
+	}
+	if err := t.closeSession(s); err != nil {
+		fmt.Fprintf(t.log, "%v\n", err)
+	}
+}
+
+// Close stops forwarding and renewals, disconnects and deletes the sessions.
+func (t *Tunnel) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		errs := []error{ignoreClosed(t.listener.Close())}
+		t.renewing.Lock()
+		t.mu.Lock()
+		sessions := append(t.retiring, t.current)
+		t.retiring = nil
+		t.mu.Unlock()
+		t.renewing.Unlock()
+		for _, s := range sessions {
+			errs = append(errs, t.closeSession(s))
+		}
+		t.wg.Wait()
+		t.closeErr = errors.Join(errs...)
+	})
+	return t.closeErr
+}
+
+func (t *Tunnel) closeSession(s *session) error {
+	return errors.Join(ignoreClosed(s.ssh.Close()), t.deleteSession(s.id))
+}
+
+func (t *Tunnel) deleteSession(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := t.client.DeleteSession(ctx, bastion.DeleteSessionRequest{SessionId: common.String(id)})
+	if serviceErr, ok := common.IsServiceError(err); ok && serviceErr.GetHTTPStatusCode() == 404 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete bastion session %s: %w", id, err)
+	}
+	return nil
+}
+
+func ignoreClosed(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,397 @@
+package bastion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/bastion"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+const sessionID = "ocid1.bastionsession.oc1.iad.test"
+
+// fakeBastion serves the Bastion Service session API and an SSH server that
+// stands in for host.bastion.<region>.oci.oraclecloud.com. It only accepts
+// the key registered with a live session and only forwards to the session
+// target.
+type fakeBastion struct {
+	t        *testing.T
+	hostKey  ssh.Signer
+	sshAddr  string
+	backends map[string]string
+
+	mu sync.Mutex
+	// finalState is the state the session reaches after one CREATING poll.
+	finalState  string
+	reportedKey string
+	// ttl, if set, expires sessions that long after they are created: their
+	// SSH connections are closed and their key is refused.
+	ttl       time.Duration
+	sessions  []string
+	keys      map[string]string
+	expired   map[string]bool
+	conns     map[string][]ssh.Conn
+	target    string
+	polls     int
+	deleted   bool
+	deletedID []string
+	forwarded []string
+}
+
+func newFakeBastion(t *testing.T, backends map[string]string) *fakeBastion {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	f := &fakeBastion{
+		t: t, hostKey: hostKey, backends: backends, finalState: "ACTIVE",
+		keys: map[string]string{}, expired: map[string]bool{}, conns: map[string][]ssh.Conn{},
+	}
+	f.reportedKey = string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	f.sshAddr = listener.Addr().String()
+	go f.serveSSH(listener)
+	return f
+}
+
+func (f *fakeBastion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Drop the API version segment, e.g. /20210331/sessions/<id>.
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[1:]
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 1:
+		var body struct {
+			KeyDetails struct {
+				PublicKeyContent string `json:"publicKeyContent"`
+			} `json:"keyDetails"`
+			TargetResourceDetails struct {
+				IP   string `json:"targetResourcePrivateIpAddress"`
+				Port int    `json:"targetResourcePort"`
+			} `json:"targetResourceDetails"`
+		}
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&body))
+		id := sessionID
+		if len(f.sessions) > 0 {
+			id = fmt.Sprintf("%s-%d", sessionID, len(f.sessions)+1)
+		}
+		f.sessions = append(f.sessions, id)
+		f.keys[id] = body.KeyDetails.PublicKeyContent
+		f.target = fmt.Sprintf("%s:%d", body.TargetResourceDetails.IP, body.TargetResourceDetails.Port)
+		if f.ttl > 0 {
+			time.AfterFunc(f.ttl, func() { f.expire(id) })
+		}
+		writeJSON(w, f.session(id, "CREATING"))
+	case r.Method == http.MethodGet && len(parts) == 2:
+		f.polls++
+		state := "CREATING"
+		if f.polls > 1 {
+			state = f.finalState
+		}
+		writeJSON(w, f.session(parts[1], state))
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		f.deleted = true
+		f.deletedID = append(f.deletedID, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"code":"NotFound","message":"not found"}`, http.StatusNotFound)
+	}
+}
+
+// expire ends session id the way OCI does when its TTL runs out.
+func (f *fakeBastion) expire(id string) {
+	f.mu.Lock()
+	f.expired[id] = true
+	conns := f.conns[id]
+	f.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeBastion) wasDeleted(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Contains(f.deletedID, id)
+}
+
+func (f *fakeBastion) session(id, state string) map[string]interface{} {
+	host, port, _ := net.SplitHostPort(f.sshAddr)
+	return map[string]interface{}{
+		"id":                    id,
+		"bastionId":             "ocid1.bastion.oc1.iad.test",
+		"bastionName":           "oke-bastion",
+		"lifecycleState":        state,
+		"sessionTtlInSeconds":   10800,
+		"timeCreated":           "2026-10-19T12:00:00.000Z",
+		"keyDetails":            map[string]string{"publicKeyContent": f.keys[id]},
+		"targetResourceDetails": map[string]interface{}{"sessionType": "PORT_FORWARDING"},
+		"sshMetadata": map[string]string{
+			"command": fmt.Sprintf("ssh -i <privateKey> -N -L <localPort>:%s -p %s %s@%s", f.target, port, id, host),
+		},
+		"bastionPublicHostKeyInfo": f.reportedKey,
+	}
+}
+
+func (f *fakeBastion) serveSSH(listener net.Listener) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.expired[conn.User()] || strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) != f.keys[conn.User()] {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(f.hostKey)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			f.mu.Lock()
+			f.conns[serverConn.User()] = append(f.conns[serverConn.User()], serverConn)
+			f.mu.Unlock()
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				go f.forward(newChannel)
+			}
+		}()
+	}
+}
+
+// forward handles a direct-tcpip channel the way the bastion does: only to the
+// session target, here mapped to a local backend.
+func (f *fakeBastion) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &payload) != nil {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+		return
+	}
+	target := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+	f.mu.Lock()
+	f.forwarded = append(f.forwarded, target)
+	allowed := target == f.target
+	f.mu.Unlock()
+	backend, ok := f.backends[target]
+	if !allowed || !ok {
+		_ = newChannel.Reject(ssh.Prohibited, "target not allowed by session")
+		return
+	}
+
+	upstream, err := net.Dial("tcp", backend)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(upstream, channel)
+		upstream.Close()
+	}()
+	_, _ = io.Copy(channel, upstream)
+	channel.Close()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newTestClient(t *testing.T, fake *fakeBastion) bastion.BastionClient {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	provider := common.NewRawConfigurationProvider("ocid1.tenancy.oc1..test", "ocid1.user.oc1..test", "us-ashburn-1", "aa:bb", string(keyPEM), nil)
+
+	client, err := bastion.NewBastionClientWithConfigurationProvider(provider)
+	require.NoError(t, err)
+	client.Host = server.URL
+	return client
+}
+
+func testConfig() Config {
+	return Config{
+		BastionID:      "ocid1.bastion.oc1.iad.test",
+		TargetIP:       "10.0.0.5",
+		SessionTimeout: 10 * time.Second,
+		PollInterval:   10 * time.Millisecond,
+	}
+}
+
+func TestOpenForwardsToPrivateEndpoint(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok from private endpoint")
+	}))
+	t.Cleanup(api.Close)
+	fake := newFakeBastion(t, map[string]string{"10.0.0.5:6443": api.Listener.Addr().String()})
+
+	tunnel, err := Open(context.Background(), newTestClient(t, fake), testConfig())
+	require.NoError(t, err)
+	require.Equal(t, sessionID, tunnel.SessionID())
+
+	// Two connections, each forwarded over its own channel.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for range 2 {
+		resp, err := client.Get("http://" + tunnel.Addr())
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, "ok from private endpoint", string(body))
+	}
+
+	require.NoError(t, tunnel.Close())
+	require.NoError(t, tunnel.Close(), "Close is idempotent")
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Equal(t, "10.0.0.5:6443", fake.target)
+	require.Equal(t, []string{"10.0.0.5:6443", "10.0.0.5:6443"}, fake.forwarded)
+	require.True(t, fake.deleted, "closing the tunnel deletes the session")
+	_, err = net.Dial("tcp", tunnel.Addr())
+	require.Error(t, err, "the local listener is closed")
+}
+
+// privateEndpoint starts the stand-in for the API server behind 10.0.0.5:6443.
+func privateEndpoint(t *testing.T) map[string]string {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok from private endpoint")
+	}))
+	t.Cleanup(api.Close)
+	return map[string]string{"10.0.0.5:6443": api.Listener.Addr().String()}
+}
+
+// requireForwards checks that a new connection to the tunnel reaches the
+// private endpoint.
+func requireForwards(t *testing.T, tunnel *Tunnel) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + tunnel.Addr())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok from private endpoint", string(body))
+}
+
+func TestTunnelRenewsSessionBeforeTTL(t *testing.T) {
+	fake := newFakeBastion(t, privateEndpoint(t))
+	fake.ttl = 600 * time.Millisecond
+	cfg := testConfig()
+	cfg.TTL = fake.ttl
+	cfg.RenewBefore = 300 * time.Millisecond
+
+	tunnel, err := Open(context.Background(), newTestClient(t, fake), cfg)
+	require.NoError(t, err)
+	addr := tunnel.Addr()
+	requireForwards(t, tunnel)
+
+	// Past the TTL of the first session.
+	time.Sleep(3 * fake.ttl / 2)
+	requireForwards(t, tunnel)
+	require.Equal(t, addr, tunnel.Addr(), "the local address survives renewals")
+	require.NotEqual(t, sessionID, tunnel.SessionID())
+	require.Eventually(t, func() bool { return fake.wasDeleted(sessionID) }, 5*time.Second, 10*time.Millisecond,
+		"the replaced session is deleted once it expires")
+
+	current := tunnel.SessionID()
+	require.NoError(t, tunnel.Close())
+	require.True(t, fake.wasDeleted(current), "closing the tunnel deletes the current session")
+}
+
+func TestTunnelReopensExpiredSession(t *testing.T) {
+	fake := newFakeBastion(t, privateEndpoint(t))
+	fake.ttl = 200 * time.Millisecond
+
+	// The tunnel believes the session lives for an hour, so only the failed
+	// forward notices it expired.
+	tunnel, err := Open(context.Background(), newTestClient(t, fake), testConfig())
+	require.NoError(t, err)
+	defer tunnel.Close()
+	requireForwards(t, tunnel)
+
+	time.Sleep(2 * fake.ttl)
+	requireForwards(t, tunnel)
+	require.NotEqual(t, sessionID, tunnel.SessionID())
+	require.Eventually(t, func() bool { return fake.wasDeleted(sessionID) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOpenFailsWhenSessionFails(t *testing.T) {
+	fake := newFakeBastion(t, nil)
+	fake.finalState = "FAILED"
+
+	_, err := Open(context.Background(), newTestClient(t, fake), testConfig())
+	require.ErrorContains(t, err, "is FAILED")
+	require.True(t, fake.deleted, "a failed session is cleaned up")
+}
+
+func TestOpenRejectsUnexpectedHostKey(t *testing.T) {
+	fake := newFakeBastion(t, nil)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherSigner, err := ssh.NewSignerFromKey(other)
+	require.NoError(t, err)
+	fake.reportedKey = string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))
+
+	_, err = Open(context.Background(), newTestClient(t, fake), testConfig())
+	require.ErrorContains(t, err, "unexpected host key")
+	require.True(t, fake.deleted)
+}
+
+func TestSSHTarget(t *testing.T) {
+	user, addr, err := sshTarget("ssh -i <privateKey> -N -L <localPort>:10.0.0.5:6443 -p 22 ocid1.bastionsession.oc1.iad.abc@host.bastion.us-ashburn-1.oci.oraclecloud.com")
+	require.NoError(t, err)
+	require.Equal(t, "ocid1.bastionsession.oc1.iad.abc", user)
+	require.Equal(t, "host.bastion.us-ashburn-1.oci.oraclecloud.com:22", addr)
+
+	_, _, err = sshTarget("")
+	require.ErrorContains(t, err, "no user@host")
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	ocibastion "github.com/oracle/oci-go-sdk/v65/bastion"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/bastion"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/ociauth"
+)
+
+// connect writes the fixture's kubeconfig into kubeconfigDir. When no endpoint
+// is selected and the cluster is private, it tunnels to oke_private_endpoint_ip
+// through the cluster's Bastion Service instead; fixture.close ends the
+// session. Replayed runs skip the tunnel because kubectl never runs.
+func (c *clusterFixture) connect(t terratesting.TestingT, kubeconfigDir string) {
+	t.Helper()
+
+	settings := kubeconfigSettingsFromEnv()
+	c.kubeconfigPath = writeKubeconfig(t, kubeconfigDir, c.outputs, settings)
+	if c.kubeconfigPath != "" || settings.Endpoint != "" || c.outputs.BastionServiceID == "" || c.outputs.OKEPrivateEndpointIP == "" {
+		return
+	}
+
+	addr := c.outputs.OKEPrivateEndpointIP + ":6443"
+	if cassetteMode() != cassetteReplay {
+		tunnel, err := openBastionTunnel(t, c.outputs)
+		if err != nil {
+			t.Fatalf("failed to tunnel to the private endpoint of cluster %s: %v", c.outputs.ClusterID, err)
+		}
+		c.closers = append(c.closers, tunnel.Close)
+		addr = tunnel.Addr()
+	}
+	settings.TLSServerName = c.outputs.OKEPrivateEndpointIP
+	c.kubeconfigPath = saveKubeconfig(t, kubeconfigDir, c.outputs, settings, "https://"+addr)
+}
+
+// openBastionTunnel opens a port-forwarding session to the cluster's private
+// endpoint with the same OCI credentials as the tests.
+func openBastionTunnel(t terratesting.TestingT, outputs clusterOutputs) (*bastion.Tunnel, error) {
+	provider, err := ociauth.Provider(
+		strings.ToLower(envOrDefault([]string{"OCI_AUTH", "TF_VAR_oci_auth"}, "")),
+		"",
+		envOrDefault([]string{"OCI_CONFIG_FILE_PROFILE", "OCI_CLI_PROFILE", "TF_VAR_oci_profile"}, ""),
+	)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ocibastion.NewBastionClientWithConfigurationProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	if region := envOrDefault([]string{"OCI_REGION", "TF_VAR_region"}, ""); region != "" {
+		client.SetRegion(region)
+	}
+	return bastion.Open(context.Background(), client, bastion.Config{
+		BastionID:   outputs.BastionServiceID,
+		TargetIP:    outputs.OKEPrivateEndpointIP,
+		DisplayName: fmt.Sprintf("%s-%s", outputs.ClusterName, currentRunID()),
+		Log:         logWriter{t},
+	})
+}
+
+// logWriter sends bastion progress lines to the terratest logger.
+type logWriter struct {
+	t terratesting.TestingT
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	logger.Default.Logf(w.t, "%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,296 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// redactedOutput matches terraform outputs whose values must not be written to
+// a cassette.
+var redactedOutput = regexp.MustCompile(`(?i)password|secret|token|private_key`)
+
+// interaction is one recorded command. Args identify it on replay; Input holds
+// the manifest for kubectl apply.
+type interaction struct {
+	Tool   string   `json:"tool"`
+	Args   []string `json:"args"`
+	Input  string   `json:"input,omitempty"`
+	Output string   `json:"output"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// cassette is an ordered transcript of interactions. Replay is strict: each
+// command must match the next recorded interaction exactly.
+type cassette struct {
+	path string
+	mode string
+
+	mu           sync.Mutex
+	interactions []interaction
+	next         int
+}
+
+// cassettePath is where the cassette for name lives. Override the directory
+// with TEST_CASSETTE_DIR.
+func cassettePath(name string) string {
+	dir := resolveVarFilePath(envOrDefault([]string{cassetteDirEnv}, "testdata/cassettes"))
+	return filepath.Join(dir, strings.ReplaceAll(name, "/", "_")+".json")
+}
+
+// openCassette returns the cassette for name in the current mode, or nil when
+// cassettes are disabled. Replaying a cassette that was never recorded fails.
+func openCassette(name string) (*cassette, error) {
+	c := &cassette{path: cassettePath(name), mode: cassetteMode()}
+	switch c.mode {
+	case cassetteRecord:
+		return c, nil
+	case cassetteReplay:
+		content, err := os.ReadFile(c.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cassette for %s: %w", name, err)
+		}
+		if err := json.Unmarshal(content, &c.interactions); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: %w", c.path, err)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// executors wraps the real executors so every command goes through c.
+func (c *cassette) executors() executors {
+	if c == nil {
+		return executors{}.withDefaults()
+	}
+	base := executors{}.withDefaults()
+	return executors{
+		terraform: cassetteTerraform{c, base.terraform},
+		kubectl:   cassetteKubectl{c, base.kubectl},
+	}
+}
+
+// save writes a recorded cassette. It is a no-op when replaying.
+func (c *cassette) save() error {
+	if c == nil || c.mode != cassetteRecord {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	content, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, content, 0644)
+}
+
+// play records the result of run, or returns the next recorded interaction
+// after checking it matches tool, args and input.
+func (c *cassette) play(t terratesting.TestingT, tool string, args []string, input string, run func() (string, error)) (string, error) {
+	t.Helper()
+
+	if c.mode == cassetteReplay {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.next >= len(c.interactions) {
+			t.Fatalf("cassette %s: unexpected %s %v after the last recorded interaction", c.path, tool, args)
+		}
+		recorded := c.interactions[c.next]
+		if recorded.Tool != tool || !reflect.DeepEqual(recorded.Args, args) || recorded.Input != input {
+			t.Fatalf("cassette %s: interaction %d is %s %v, got %s %v", c.path, c.next, recorded.Tool, recorded.Args, tool, args)
+		}
+		c.next++
+		if recorded.Error != "" {
+			return recorded.Output, errors.New(recorded.Error)
+		}
+		return recorded.Output, nil
+	}
+
+	output, err := run()
+	recorded := interaction{Tool: tool, Args: args, Input: input, Output: output}
+	if err != nil {
+		recorded.Error = err.Error()
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, recorded)
+	c.mu.Unlock()
+	return output, err
+}
+
+// cassetteExecutors returns the executors for a suite named name, saving the
+// cassette when the test and its cleanups finish. Register it before the
+// teardown cleanup so destroy is recorded too.
+func cassetteExecutors(t *testing.T, name string) executors {
+	t.Helper()
+
+	c, err := openCassette(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := c.save(); err != nil {
+			t.Errorf("failed to save cassette %s: %v", c.path, err)
+		}
+	})
+	return c.executors()
+}
+
+type cassetteTerraform struct {
+	c    *cassette
+	real terraformExecutor
+}
+
+func (e cassetteTerraform) InitAndApply(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error) {
+	return e.c.play(t, "terraform", []string{"apply"}, "", func() (string, error) {
+		return e.real.InitAndApply(t, ctx, options)
+	})
+}
+
+func (e cassetteTerraform) Destroy(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error) {
+	return e.c.play(t, "terraform", []string{"destroy"}, "", func() (string, error) {
+		return e.real.Destroy(t, ctx, options)
+	})
+}
+
+func (e cassetteTerraform) StateList(t terratesting.TestingT, options *terraform.Options) (string, error) {
+	return e.c.play(t, "terraform", []string{"state", "list"}, "", func() (string, error) {
+		return e.real.StateList(t, options)
+	})
+}
+
+// OutputAll records the outputs as JSON, with secrets redacted.
+func (e cassetteTerraform) OutputAll(t terratesting.TestingT, options *terraform.Options) (map[string]interface{}, error) {
+	var live map[string]interface{}
+	out, err := e.c.play(t, "terraform", []string{"output", "-json"}, "", func() (string, error) {
+		all, err := e.real.OutputAll(t, options)
+		if err != nil {
+			return "", err
+		}
+		live = all
+		redacted := map[string]interface{}{}
+		for key, value := range all {
+			if redactedOutput.MatchString(key) {
+				value = "REDACTED"
+			}
+			redacted[key] = value
+		}
+		content, err := json.Marshal(redacted)
+		return string(content), err
+	})
+	if err != nil || live != nil {
+		return live, err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &all); err != nil {
+		return nil, fmt.Errorf("failed to parse recorded terraform outputs: %w", err)
+	}
+	return all, nil
+}
+
+type cassetteKubectl struct {
+	c    *cassette
+	real kubectlExecutor
+}
+
+// Run records kubectl args with the namespace but not the kubeconfig path,
+// which differs between runs.
+func (e cassetteKubectl) Run(t terratesting.TestingT, options *k8s.KubectlOptions, args ...string) (string, error) {
+	return e.c.play(t, "kubectl", append([]string{"--namespace", options.Namespace}, args...), "", func() (string, error) {
+		return e.real.Run(t, options, args...)
+	})
+}
+
+func (e cassetteKubectl) Apply(t terratesting.TestingT, options *k8s.KubectlOptions, manifest string) error {
+	_, err := e.c.play(t, "kubectl", []string{"--namespace", options.Namespace, "apply", "-f", "-"}, manifest, func() (string, error) {
+		return "", e.real.Apply(t, options, manifest)
+	})
+	return err
+}
+
+// scriptedKubectl stands in for a cluster running the FSS suite's pods.
+type scriptedKubectl struct{}
+
+func (scriptedKubectl) Run(_ terratesting.TestingT, _ *k8s.KubectlOptions, args ...string) (string, error) {
+	switch {
+	case args[0] == "logs":
+		return "fss-test-content\n", nil
+	case args[len(args)-1] == "jsonpath={.spec.nodeName}":
+		return "10.0.64.12", nil
+	}
+	return "", nil
+}
+
+func (scriptedKubectl) Apply(terratesting.TestingT, *k8s.KubectlOptions, string) error {
+	return nil
+}
+
+func TestCassetteReplaysFSSKubernetesFlow(t *testing.T) {
+	t.Setenv(cassetteDirEnv, t.TempDir())
+	options := k8s.NewKubectlOptions("", "", "default")
+
+	t.Setenv(cassetteModeEnv, cassetteRecord)
+	recorder, err := openCassette("TestStorageFSS")
+	require.NoError(t, err)
+	testFSSKubernetes(t, kubectlClient{exec: cassetteKubectl{recorder, scriptedKubectl{}}, options: options}, "/mnt/oci-fss")
+	require.NoError(t, recorder.save())
+
+	t.Setenv(cassetteModeEnv, cassetteReplay)
+	player, err := openCassette("TestStorageFSS")
+	require.NoError(t, err)
+	require.NotEmpty(t, player.interactions)
+	testFSSKubernetes(t, kubectlClient{exec: player.executors().kubectl, options: options}, "/mnt/oci-fss")
+	require.Equal(t, len(player.interactions), player.next, "every recorded interaction should be replayed")
+
+	player, err = openCassette("TestStorageFSS")
+	require.NoError(t, err)
+	err = runFixtureStage("replay", func(ft *fixtureT) {
+		kubectlClient{exec: player.executors().kubectl, options: options}.run(ft, "get", "nodes")
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "interaction 0 is kubectl")
+}
+
+func TestCassetteRedactsSecretOutputs(t *testing.T) {
+	t.Setenv(cassetteDirEnv, t.TempDir())
+	t.Setenv(cassetteModeEnv, cassetteRecord)
+
+	recorder, err := openCassette("TestMonitoring")
+	require.NoError(t, err)
+	fake := &fakeTerraform{outputs: map[string]interface{}{
+		"cluster_id":             "ocid1.cluster.oc1.iad.aaaa",
+		"grafana_admin_password": "hunter2",
+	}}
+	all, err := cassetteTerraform{recorder, fake}.OutputAll(t, &terraform.Options{})
+	require.NoError(t, err)
+	require.Equal(t, "hunter2", all["grafana_admin_password"], "the live run still sees the real value")
+	require.NoError(t, recorder.save())
+
+	content, err := os.ReadFile(cassettePath("TestMonitoring"))
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "hunter2")
+
+	t.Setenv(cassetteModeEnv, cassetteReplay)
+	player, err := openCassette("TestMonitoring")
+	require.NoError(t, err)
+	all, err = player.executors().terraform.OutputAll(t, &terraform.Options{})
+	require.NoError(t, err)
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", all["cluster_id"])
+	require.Equal(t, "REDACTED", all["grafana_admin_password"])
+}
@@ -0,0 +1,36 @@
+package test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCleanupOrphans destroys clusters whose teardown failed or was interrupted.
+// It walks the orphans directory under TEST_WORK_DIR, or only ORPHAN_DIR when set.
+func TestCleanupOrphans(t *testing.T) {
+	skipUnlessEnv(t, "RUN_CLEANUP")
+
+	dirs := []string{}
+	if dir := envOrDefault([]string{"ORPHAN_DIR"}, ""); dir != "" {
+		dirs = append(dirs, resolveVarFilePath(dir))
+	} else {
+		found, err := findOrphanDirs(orphanRoot())
+		require.NoError(t, err)
+		dirs = found
+	}
+	if len(dirs) == 0 {
+		t.Logf("No orphaned work directories under %s", orphanRoot())
+		return
+	}
+
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			stages := &clusterStages{workDir: dir}
+			require.True(t, stages.optionsPresent(t), "%s has no saved terraform options", dir)
+			stages.teardown(t)
+		})
+	}
+}
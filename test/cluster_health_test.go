@@ -1,60 +1,89 @@
 package test
 
 import (
-	"os/exec"
+	"context"
 	"path/filepath"
-	"strings"
 	"testing"
+	"time"
 
-	"github.com/gruntwork-io/terratest/modules/k8s"
 	"github.com/stretchr/testify/require"
-)
+	"k8s.io/client-go/kubernetes"
 
-// generateKubeconfig creates a kubeconfig for the given OKE cluster using OCI CLI.
-func generateKubeconfig(t *testing.T, clusterID, region string) string {
-	t.Helper()
-	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig")
-	cmd := exec.Command("oci", "ce", "cluster", "create-kubeconfig",
-		"--cluster-id", clusterID,
-		"--file", kubeconfigPath,
-		"--region", region,
-		"--token-version", "2.0.0",
-		"--kube-endpoint", "PUBLIC_ENDPOINT",
-	)
-	output, err := cmd.CombinedOutput()
-	require.NoError(t, err, "Failed to generate kubeconfig: %s", string(output))
-	return kubeconfigPath
-}
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/images"
+)
 
 // runClusterHealthChecks performs Tier 1 K8s health checks against a running cluster.
-func runClusterHealthChecks(t *testing.T, kubeconfigPath string) {
+func runClusterHealthChecks(t *testing.T, cluster *clusterFixture) {
 	t.Helper()
 
-	opts := k8s.NewKubectlOptions("", kubeconfigPath, "default")
-	sysOpts := k8s.NewKubectlOptions("", kubeconfigPath, "kube-system")
-
 	// API server reachable
 	t.Log("Health check: API server connectivity")
-	k8s.RunKubectl(t, opts, "cluster-info")
-
-	// All nodes ready (wait up to 5 min)
-	t.Log("Health check: waiting for nodes to be Ready")
-	k8s.RunKubectl(t, opts, "wait", "--for=condition=Ready", "nodes", "--all", "--timeout=300s")
+	cluster.kubectl("default").run(t, "cluster-info")
 
-	// Verify at least 1 node exists
-	output, err := k8s.RunKubectlAndGetOutputE(t, opts, "get", "nodes", "--no-headers")
+	if cassetteMode() == cassetteReplay {
+		t.Log("Health check: skipping client-go checks, API requests are not recorded in cassettes")
+		return
+	}
+	client, err := health.NewClient(cluster.kubeconfigPath)
 	require.NoError(t, err)
-	nodeLines := strings.Split(strings.TrimSpace(output), "\n")
-	require.True(t, len(nodeLines) >= 1 && nodeLines[0] != "", "cluster should have at least one node")
-	t.Logf("Health check: %d node(s) ready", len(nodeLines))
 
-	// CoreDNS pods ready
-	t.Log("Health check: CoreDNS pods")
-	k8s.RunKubectl(t, sysOpts, "wait", "--for=condition=Ready", "pods", "-l", "k8s-app=kube-dns", "--timeout=120s")
+	// Every pool at the size its variables ask for (wait up to 30 min)
+	if expected := expectedNodePools(t, cluster); expected != nil {
+		t.Logf("Health check: waiting for node pools %v", expected)
+		waitForHealth(t, client, 30*time.Minute, 30*time.Second, health.PoolNodesReady(poolNameLabel, expected))
+	}
 
-	// kube-proxy pods running
-	t.Log("Health check: kube-proxy pods")
-	k8s.RunKubectl(t, sysOpts, "wait", "--for=condition=Ready", "pods", "-l", "k8s-app=kube-proxy", "--timeout=120s")
+	// Nodes Ready, kube-system pods and DaemonSets healthy (wait up to 5 min)
+	t.Log("Health check: waiting for nodes and kube-system workloads")
+	waitForHealth(t, client, 5*time.Minute, 15*time.Second, health.DefaultChecks()...)
+
+	// GPU nodes run the images docs/worker-node-images.json recommends
+	catalog, err := images.Load(filepath.Join("..", "docs", "worker-node-images.json"))
+	require.NoError(t, err)
+	if envFlagEnabled("REQUIRE_RECOMMENDED_IMAGES") {
+		t.Log("Health check: requiring recommended worker images")
+		waitForHealth(t, client, time.Minute, 15*time.Second, images.ComplianceCheck(catalog))
+	} else {
+		engine := health.Engine{Client: client, Checks: []health.Check{images.ComplianceCheck(catalog)}}
+		for _, result := range engine.Run(context.Background()) {
+			t.Logf("Health check (not enforced, set REQUIRE_RECOMMENDED_IMAGES=1): %s", result)
+		}
+	}
 
 	t.Log("Health check: all cluster health checks passed")
 }
+
+// expectedNodePools returns the expected node count per pool, or nil for
+// existing clusters described only by their outputs.
+func expectedNodePools(t *testing.T, cluster *clusterFixture) map[string]int {
+	t.Helper()
+	if cluster.options == nil {
+		t.Log("Health check: skipping node pool sizes, existing cluster has no terraform variables")
+		return nil
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	expected, err := expectedPoolSizes(vars)
+	require.NoError(t, err, "failed to compute node pool sizes")
+	return expected
+}
+
+// waitForHealth polls checks until they pass or timeout, logging what is still
+// failing each round, and fails the test with the final results.
+func waitForHealth(t *testing.T, client kubernetes.Interface, timeout, interval time.Duration, checks ...health.Check) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	engine := health.Engine{Client: client, Checks: checks}
+	results := engine.Wait(ctx, interval, func(results []health.Result) {
+		for _, result := range health.Failed(results) {
+			t.Logf("Health check: waiting: %s", result)
+		}
+	})
+	for _, result := range results {
+		t.Logf("Health check: %s", result)
+	}
+	require.Empty(t, health.Failed(results), "cluster health checks failed")
+}
@@ -0,0 +1,109 @@
+// Command activehealth runs the active health checks of
+// manifests/active-health-checks on demand and prints one result per node and
+// check. It exits with status 1 when any node failed a check.
+//
+//	go run ./cmd/activehealth -checks dcgm-diag,gpu-fryer
+//	go run ./cmd/activehealth -checks nccl-tests -nodes 10.0.3.2,10.0.3.3 -label -annotate
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/activehealth"
+)
+
+func main() {
+	var (
+		kubeconfig       = flag.String("kubeconfig", defaultKubeconfig(), "kubeconfig of the cluster (KUBECONFIG)")
+		checkList        = flag.String("checks", "all", "comma-separated checks: dcgm-diag, gpu-fryer, rvs, nccl-tests, rccl-tests, or all")
+		nodeList         = flag.String("nodes", "", "comma-separated nodes to check (default every idle GPU node)")
+		repo             = flag.String("repo", "..", "repository checkout with the nccl-tests and rccl-tests manifests")
+		namespace        = flag.String("namespace", "active-health-checks", "namespace created for the checks")
+		kueue            = flag.Bool("kueue", false, "submit nccl-tests and rccl-tests through Kueue")
+		virtualFunctions = flag.Bool("virtual-functions", false, "use the virtual-functions nccl-tests and rccl-tests manifests")
+		label            = flag.Bool("label", false, "label checked nodes with the results, like the CronJob appliers")
+		annotate         = flag.Bool("annotate", false, "annotate failing nodes with the failure details")
+		timeout          = flag.Duration("timeout", time.Hour, "how long each check may take")
+		asJSON           = flag.Bool("json", false, "print the results as JSON")
+	)
+	flag.Parse()
+
+	checks, err := activehealth.ParseChecks(*checkList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "activehealth: %v\n", err)
+		os.Exit(2)
+	}
+	var nodes []string
+	if *nodeList != "" {
+		nodes = strings.Split(*nodeList, ",")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "activehealth: %v\n", err)
+		os.Exit(2)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "activehealth: %v\n", err)
+		os.Exit(1)
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "activehealth: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := activehealth.Run(ctx, client, dyn, activehealth.Config{
+		Namespace:        *namespace,
+		Checks:           checks,
+		Nodes:            nodes,
+		Root:             *repo,
+		VirtualFunctions: *virtualFunctions,
+		Kueue:            *kueue,
+		Label:            *label,
+		Annotate:         *annotate,
+		Timeout:          *timeout,
+		Logf:             func(format string, args ...any) { fmt.Fprintf(os.Stderr, format+"\n", args...) },
+	})
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report.Results)
+	} else if len(report.Results) > 0 {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "activehealth: %v\n", err)
+		os.Exit(1)
+	}
+	if len(report.Failures()) > 0 {
+		os.Exit(1)
+	}
+}
+
+func defaultKubeconfig() string {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
@@ -0,0 +1,190 @@
+// Command hostorder writes a hostfile, and optionally an Open MPI rankfile,
+// with hosts ordered by RDMA topology: hosts in the same local block and rack
+// get consecutive ranks. Topology comes from the labeler's node labels, or
+// from scontrol show topology output with -slurm-topology.
+//
+//	go run ./cmd/hostorder -selector nvidia.com/gpu=true -format slots
+//	go run ./cmd/hostorder -namespace default -pods training.kubeflow.org/job-name=nccl-tests -rankfile rankfile
+//	scontrol show topology > topo.txt && go run ./cmd/hostorder -slurm-topology topo.txt -hosts hosts.txt -shape BM.GPU.H100.8 -format srun
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/topology"
+)
+
+func main() {
+	var (
+		kubeconfig    = flag.String("kubeconfig", defaultKubeconfig(), "kubeconfig of the cluster (KUBECONFIG)")
+		selector      = flag.String("selector", "", "label selector of the nodes to order (default every node)")
+		podSelector   = flag.String("pods", "", "order the pods matching this label selector instead of nodes, named like the MPI Operator hostfile")
+		namespace     = flag.String("namespace", "default", "namespace of -pods")
+		levels        = flag.String("levels", strings.Join(topology.DefaultLevels, ","), "comma-separated node labels to group by, widest first; a|b uses b when a is unset")
+		slurmTopology = flag.String("slurm-topology", "", "file with scontrol show topology output to order by instead of node labels")
+		hostList      = flag.String("hosts", "", "file with one host per line to order (default every node, or every node in -slurm-topology)")
+		shape         = flag.String("shape", "", "shape of the hosts of -slurm-topology, for their slot count")
+		slots         = flag.Int("slots", 0, "slots per host, overriding the per-shape GPU count")
+		format        = flag.String("format", topology.Plain, "hostfile format: plain, slots or srun")
+		hostfile      = flag.String("hostfile", "-", "where to write the hostfile")
+		rankfile      = flag.String("rankfile", "", "where to write an Open MPI rankfile")
+	)
+	flag.Parse()
+
+	var names []string
+	if *hostList != "" {
+		var err error
+		if names, err = readHosts(*hostList); err != nil {
+			fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var hosts []topology.Host
+	if *slurmTopology != "" {
+		perHost := *slots
+		if perHost == 0 && *shape != "" {
+			s, ok := shapes.Lookup(*shape)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "hostorder: unknown shape %q\n", *shape)
+				os.Exit(2)
+			}
+			perHost = s.GPUs
+		}
+		if perHost == 0 {
+			fmt.Fprintln(os.Stderr, "hostorder: -slurm-topology needs -shape or -slots")
+			os.Exit(2)
+		}
+		data, err := os.ReadFile(*slurmTopology)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+			os.Exit(2)
+		}
+		paths, err := topology.ParseSlurmTopology(string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+			os.Exit(1)
+		}
+		if names == nil {
+			for name := range paths {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+		}
+		hosts = topology.FromNames(names, paths, perHost)
+	} else {
+		var err error
+		if hosts, err = clusterHosts(*kubeconfig, *selector, *namespace, *podSelector, strings.Split(*levels, ",")); err != nil {
+			fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+			os.Exit(1)
+		}
+		if names != nil {
+			hosts = slices.DeleteFunc(hosts, func(host topology.Host) bool { return !slices.Contains(names, host.Name) })
+		}
+		if *slots > 0 {
+			for i := range hosts {
+				hosts[i].Slots = *slots
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		fmt.Fprintln(os.Stderr, "hostorder: no hosts to order")
+		os.Exit(1)
+	}
+
+	hosts = topology.Order(hosts)
+	if depth := len(hosts[0].Path); depth > 0 {
+		for i, group := range topology.Groups(hosts, depth-1) {
+			fmt.Fprintf(os.Stderr, "# group %d: %d hosts\n", i+1, len(group))
+		}
+	}
+	if err := writeFile(*hostfile, func(w io.Writer) error { return topology.WriteHostfile(w, hosts, *format) }); err != nil {
+		fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+		os.Exit(1)
+	}
+	if *rankfile != "" {
+		if err := writeFile(*rankfile, func(w io.Writer) error { return topology.WriteRankfile(w, hosts) }); err != nil {
+			fmt.Fprintf(os.Stderr, "hostorder: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func clusterHosts(kubeconfig, selector, namespace, podSelector string, levels []string) ([]topology.Host, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+	if podSelector == "" {
+		return topology.FromNodes(nodes.Items, levels), nil
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: podSelector})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+	return topology.FromPods(pods.Items, nodes.Items, levels), nil
+}
+
+func readHosts(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func defaultKubeconfig() string {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
@@ -0,0 +1,87 @@
+// Command janitor deletes resources left in a compartment by test harness
+// runs older than a TTL. It only reports what it would delete unless -delete
+// is passed.
+//
+//	go run ./cmd/janitor -compartment ocid1.compartment.oc1..xxx -ttl 6h
+//	go run ./cmd/janitor -compartment ocid1.compartment.oc1..xxx -ttl 6h -delete
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/janitor"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/ociauth"
+)
+
+func main() {
+	var (
+		compartment = flag.String("compartment", envOr("OCI_COMPARTMENT_OCID", "TF_VAR_compartment_ocid"), "compartment to clean up (OCI_COMPARTMENT_OCID)")
+		region      = flag.String("region", envOr("OCI_REGION", "TF_VAR_region"), "OCI region (OCI_REGION)")
+		authType    = flag.String("auth", strings.ToLower(envOr("OCI_AUTH", "TF_VAR_oci_auth")), "api_key, security_token or instance_principal (OCI_AUTH)")
+		configFile  = flag.String("config-file", "", "OCI config file (default ~/.oci/config)")
+		profile     = flag.String("profile", envOr("OCI_CONFIG_FILE_PROFILE", "OCI_CLI_PROFILE", "TF_VAR_oci_profile"), "OCI config profile (OCI_CONFIG_FILE_PROFILE)")
+		ttl         = flag.Duration("ttl", 6*time.Hour, "delete runs whose oldest resource is at least this old")
+		runID       = flag.String("run-id", "", "only clean up this run ID")
+		doDelete    = flag.Bool("delete", false, "delete the selected resources (default is a dry run)")
+		waitTimeout = flag.Duration("wait-timeout", time.Hour, "how long to wait for each kind of resource to be deleted")
+	)
+	flag.Parse()
+
+	if *compartment == "" {
+		fmt.Fprintln(os.Stderr, "janitor: -compartment or OCI_COMPARTMENT_OCID is required")
+		os.Exit(2)
+	}
+	provider, err := ociauth.Provider(*authType, *configFile, *profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "janitor: %v\n", err)
+		os.Exit(2)
+	}
+	clients, err := janitor.NewClients(provider, *region, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "janitor: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := janitor.New(clients, janitor.Config{
+		CompartmentID: *compartment,
+		TTL:           *ttl,
+		RunID:         *runID,
+		Delete:        *doDelete,
+		WaitTimeout:   *waitTimeout,
+		Log:           os.Stderr,
+	}).Run(ctx)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tKIND\tNAME\tAGE\tID")
+	for _, r := range report.Selected {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.RunID, r.Kind, r.Name, time.Since(r.Created).Round(time.Minute), r.ID)
+	}
+	w.Flush()
+	if !*doDelete && len(report.Selected) > 0 {
+		fmt.Fprintln(os.Stderr, "dry run: pass -delete to delete these resources")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "janitor: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
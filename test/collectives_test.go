@@ -0,0 +1,173 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// collectiveWorkers is the node count of the documented baselines.
+const collectiveWorkers = 2
+
+// TestCollectives runs the nccl-tests or rccl-tests all_reduce MPIJob from
+// manifests/ on two nodes of the RDMA pool (or the GMC pool) and compares its
+// peak bus bandwidth with the shape's baseline. The job goes through Kueue when
+// it is installed, unless NCCL_SUBMIT=mpi-operator.
+func TestCollectives(t *testing.T) {
+	skipUnlessEnv(t, "RUN_NCCL_TESTS")
+
+	cluster := suiteCluster(t, ncclSuiteVars())
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping collectives: API requests are not recorded in cassettes")
+	}
+	if cluster.options == nil {
+		t.Skip("Skipping collectives: existing cluster has no terraform variables")
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	pool, shape, err := collectivesPool(vars)
+	require.NoError(t, err)
+	if pool == "" {
+		t.Skipf("Skipping collectives: no RDMA or GMC GPU pool with %d nodes", collectiveWorkers)
+	}
+	mpiOperator, err := varBool(vars, "install_mpi_operator")
+	require.NoError(t, err)
+	if !mpiOperator {
+		t.Skip("Skipping collectives: install_mpi_operator is false")
+	}
+	kueue, err := collectivesUseKueue(vars)
+	require.NoError(t, err)
+	networkOperator, err := varBool(vars, "deploy_nvidia_network_operator")
+	require.NoError(t, err)
+	s, _ := shapes.Lookup(shape)
+
+	path, err := nccl.ManifestPath(filepath.Dir(terraformDir()), shape, networkOperator && s.VFs > 0)
+	require.NoError(t, err)
+	manifest, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+	config, err := clientcmd.BuildConfigFromFlags("", cluster.kubeconfigPath)
+	require.NoError(t, err)
+	dyn, err := dynamic.NewForConfig(config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Minute)
+	defer cancel()
+	t.Logf("Running %s on %d %s nodes of %s (kueue: %t)", filepath.Base(path), collectiveWorkers, shape, pool, kueue)
+	result, err := nccl.Run(ctx, client, dyn, nccl.Config{
+		Namespace: "nccl-" + currentRunID(),
+		Manifest:  manifest,
+		Options:   nccl.Options{Workers: collectiveWorkers, Kueue: kueue},
+		Logf:      func(format string, args ...any) { t.Logf("collectives: "+format, args...) },
+	})
+	require.NoError(t, err, "all_reduce job did not produce results")
+	t.Logf("collectives: all_reduce on %s\n%s", shape, result)
+
+	baseline, ok := nccl.Baselines[shape]
+	if !ok {
+		peak, _ := result.Peak()
+		t.Skipf("Skipping baseline comparison: no baseline for %s (peak busbw %.2f GB/s at %s)", shape, peak.BusBW(), nccl.FormatSize(peak.Size))
+	}
+	require.NoError(t, nccl.Compare(result, baseline, nccl.DefaultTolerance), "all_reduce bus bandwidth regressed")
+}
+
+// ncclSuiteVars returns the topology overrides TestCollectives needs.
+func ncclSuiteVars() map[string]interface{} {
+	return map[string]interface{}{
+		"install_mpi_operator": true,
+	}
+}
+
+// collectivesPool returns the pool and shape the all_reduce job runs on:
+// oke-rdma, or oke-gmc without it, when it is a GPU pool with at least
+// collectiveWorkers nodes. The pool is empty when there is none.
+func collectivesPool(vars map[string]interface{}) (string, string, error) {
+	pools, err := gpuPoolShapes(vars)
+	if err != nil {
+		return "", "", err
+	}
+	sizes, err := expectedPoolSizes(vars)
+	if err != nil {
+		return "", "", err
+	}
+	for _, pool := range []string{"oke-rdma", "oke-gmc"} {
+		if shape, ok := pools[pool]; ok && sizes[pool] >= collectiveWorkers {
+			return pool, shape, nil
+		}
+	}
+	return "", "", nil
+}
+
+// collectivesUseKueue submits through Kueue when install_kueue is set. The
+// NCCL_SUBMIT environment variable picks "kueue" or "mpi-operator" explicitly.
+func collectivesUseKueue(vars map[string]interface{}) (bool, error) {
+	switch submit := os.Getenv("NCCL_SUBMIT"); submit {
+	case "":
+		return varBool(vars, "install_kueue")
+	case "kueue":
+		return true, nil
+	case "mpi-operator":
+		return false, nil
+	default:
+		return false, fmt.Errorf("NCCL_SUBMIT=%q: want kueue or mpi-operator", submit)
+	}
+}
+
+func TestCollectivesPool(t *testing.T) {
+	defaults, err := terraformVariableDefaults(terraformDir())
+	require.NoError(t, err)
+	pool, _, err := collectivesPool(defaults)
+	require.NoError(t, err)
+	require.Empty(t, pool)
+
+	pool, shape, err := collectivesPool(mergeVars(defaults, map[string]interface{}{
+		"worker_rdma_enabled":              true,
+		"worker_gmc_enabled":               true,
+		"worker_gmc_scale_target_size":     2,
+		"worker_gmc_gpu_memory_fabric_ids": "ocid1.computegpumemoryfabric.oc1..a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "oke-rdma", pool)
+	require.Equal(t, "BM.GPU.H100.8", shape)
+
+	pool, shape, err = collectivesPool(mergeVars(defaults, map[string]interface{}{
+		"worker_rdma_enabled":              true,
+		"worker_rdma_pool_size":            1,
+		"worker_gmc_enabled":               true,
+		"worker_gmc_scale_target_size":     2,
+		"worker_gmc_gpu_memory_fabric_ids": "ocid1.computegpumemoryfabric.oc1..a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "oke-gmc", pool, "a single RDMA node cannot run the two-node job")
+	require.Equal(t, "BM.GPU.GB200-v3.4", shape)
+}
+
+func TestCollectivesUseKueue(t *testing.T) {
+	t.Setenv("NCCL_SUBMIT", "")
+	kueue, err := collectivesUseKueue(map[string]interface{}{"install_kueue": true})
+	require.NoError(t, err)
+	require.True(t, kueue)
+
+	t.Setenv("NCCL_SUBMIT", "mpi-operator")
+	kueue, err = collectivesUseKueue(map[string]interface{}{"install_kueue": true})
+	require.NoError(t, err)
+	require.False(t, kueue)
+
+	t.Setenv("NCCL_SUBMIT", "slurm")
+	_, err = collectivesUseKueue(nil)
+	require.EqualError(t, err, `NCCL_SUBMIT="slurm": want kueue or mpi-operator`)
+}
@@ -1,7 +1,7 @@
 package test
 
 import (
-	"os"
+	"context"
 	"strings"
 	"testing"
 
@@ -17,94 +17,100 @@ func TestPlanSmoke(t *testing.T) {
 }
 
 func TestCoreProvisioning(t *testing.T) {
-	options := newTerraformOptions(t, nil)
-
-	defer terraform.Destroy(t, options)
-	terraform.InitAndApply(t, options)
-
-	// Validate state_id is present
-	require.NotEmpty(t, terraform.Output(t, options, "state_id"))
-
-	// Validate OCIDs have correct format
-	clusterID := terraform.Output(t, options, "cluster_id")
-	require.True(t, isValidOCID(clusterID), "cluster_id should be a valid OCID: %s", clusterID)
-
-	vcnID := terraform.Output(t, options, "vcn_id")
-	require.True(t, isValidOCID(vcnID), "vcn_id should be a valid OCID: %s", vcnID)
-
-	controlPlaneSubnetID := terraform.Output(t, options, "control_plane_subnet_id")
-	require.True(t, isValidOCID(controlPlaneSubnetID), "control_plane_subnet_id should be a valid OCID: %s", controlPlaneSubnetID)
-
-	controlPlaneNsgID := terraform.Output(t, options, "control_plane_nsg_id")
-	require.True(t, isValidOCID(controlPlaneNsgID), "control_plane_nsg_id should be a valid OCID: %s", controlPlaneNsgID)
-
-	// Pod subnet/NSG — npn (default) and "VCN-Native Pod Networking" both create pod subnets
-	cniType := terraform.Output(t, options, "cni_type")
-	if cniType == "npn" || cniType == "VCN-Native Pod Networking" {
-		podSubnetID := terraform.Output(t, options, "pod_subnet_id")
-		require.True(t, isValidOCID(podSubnetID), "pod_subnet_id should be a valid OCID: %s", podSubnetID)
-
-		podNsgID := terraform.Output(t, options, "pod_nsg_id")
-		require.True(t, isValidOCID(podNsgID), "pod_nsg_id should be a valid OCID: %s", podNsgID)
-	}
-
-	workerSubnetID := terraform.Output(t, options, "worker_subnet_id")
-	require.True(t, isValidOCID(workerSubnetID), "worker_subnet_id should be a valid OCID: %s", workerSubnetID)
-
-	workerNsgID := terraform.Output(t, options, "worker_nsg_id")
-	require.True(t, isValidOCID(workerNsgID), "worker_nsg_id should be a valid OCID: %s", workerNsgID)
-
-	// Ops worker pool is always created
-	workerOpsPoolID := terraform.Output(t, options, "worker_ops_pool_id")
-	require.True(t, isValidOCID(workerOpsPoolID), "worker_ops_pool_id should be a valid OCID: %s", workerOpsPoolID)
-
-	// Internal LB subnet/NSG are always created
-	intLbSubnetID := terraform.Output(t, options, "int_lb_subnet_id")
-	require.True(t, isValidOCID(intLbSubnetID), "int_lb_subnet_id should be a valid OCID: %s", intLbSubnetID)
-
-	intLbNsgID := terraform.Output(t, options, "int_lb_nsg_id")
-	require.True(t, isValidOCID(intLbNsgID), "int_lb_nsg_id should be a valid OCID: %s", intLbNsgID)
-
-	// Cluster private endpoint is always present and must be HTTPS
-	clusterPrivateEndpoint := terraform.Output(t, options, "cluster_private_endpoint")
-	require.NotEmpty(t, clusterPrivateEndpoint)
-	require.True(t, strings.HasPrefix(clusterPrivateEndpoint, "https://"), "cluster_private_endpoint should start with https://: %s", clusterPrivateEndpoint)
-
-	// Public endpoint only present when control plane is public
-	clusterPublicEndpoint := optionalOutput(t, options, "cluster_public_endpoint")
-	if clusterPublicEndpoint != "" {
-		require.True(t, strings.HasPrefix(clusterPublicEndpoint, "https://"), "cluster_public_endpoint should start with https://: %s", clusterPublicEndpoint)
-	}
-
-	// Public LB subnet/NSG only present when public subnets are enabled
-	pubLbSubnetID := optionalOutput(t, options, "pub_lb_subnet_id")
-	if pubLbSubnetID != "" {
-		require.True(t, isValidOCID(pubLbSubnetID), "pub_lb_subnet_id should be a valid OCID: %s", pubLbSubnetID)
-
-		pubLbNsgID := optionalOutput(t, options, "pub_lb_nsg_id")
-		require.True(t, isValidOCID(pubLbNsgID), "pub_lb_nsg_id should be a valid OCID: %s", pubLbNsgID)
-	}
-
-	// Bastion only present when create_bastion = true
-	bastionID := optionalOutput(t, options, "bastion_id")
-	if bastionID != "" {
-		require.True(t, isValidOCID(bastionID), "bastion_id should be a valid OCID: %s", bastionID)
-		bastionIP := optionalOutput(t, options, "bastion_public_ip")
-		require.NotEmpty(t, bastionIP, "bastion_public_ip should not be empty when bastion is created")
-	}
-
-	// Operator only present when create_operator = true
-	operatorID := optionalOutput(t, options, "operator_id")
-	if operatorID != "" {
-		require.True(t, isValidOCID(operatorID), "operator_id should be a valid OCID: %s", operatorID)
-	}
-
-	// Tier 1 cluster health checks (only for public clusters reachable from CI)
-	if strings.HasPrefix(clusterPublicEndpoint, "https://") {
-		region := os.Getenv("OCI_REGION")
-		kubeconfigPath := generateKubeconfig(t, clusterID, region)
-		runClusterHealthChecks(t, kubeconfigPath)
-	} else {
-		t.Log("Skipping cluster health checks: no public endpoint")
-	}
+	cluster := suiteCluster(t, nil)
+	outputs := cluster.outputs
+
+	t.Run("Outputs", func(t *testing.T) {
+		// Validate state_id is present
+		require.NotEmpty(t, outputs.StateID)
+
+		// Validate OCIDs have correct format
+		require.True(t, isValidOCID(outputs.ClusterID), "cluster_id should be a valid OCID: %s", outputs.ClusterID)
+		require.True(t, isValidOCID(outputs.VCNID), "vcn_id should be a valid OCID: %s", outputs.VCNID)
+		require.True(t, isValidOCID(outputs.ControlPlaneSubnetID), "control_plane_subnet_id should be a valid OCID: %s", outputs.ControlPlaneSubnetID)
+		require.True(t, isValidOCID(outputs.ControlPlaneNSGID), "control_plane_nsg_id should be a valid OCID: %s", outputs.ControlPlaneNSGID)
+
+		// Pod subnet/NSG — npn (default) and "VCN-Native Pod Networking" both create pod subnets
+		if outputs.CNIType == "npn" || outputs.CNIType == "VCN-Native Pod Networking" {
+			require.True(t, isValidOCID(outputs.PodSubnetID), "pod_subnet_id should be a valid OCID: %s", outputs.PodSubnetID)
+			require.True(t, isValidOCID(outputs.PodNSGID), "pod_nsg_id should be a valid OCID: %s", outputs.PodNSGID)
+		}
+
+		require.True(t, isValidOCID(outputs.WorkerSubnetID), "worker_subnet_id should be a valid OCID: %s", outputs.WorkerSubnetID)
+		require.True(t, isValidOCID(outputs.WorkerNSGID), "worker_nsg_id should be a valid OCID: %s", outputs.WorkerNSGID)
+
+		// Ops worker pool is always created
+		require.True(t, isValidOCID(outputs.WorkerOpsPoolID), "worker_ops_pool_id should be a valid OCID: %s", outputs.WorkerOpsPoolID)
+
+		// Internal LB subnet/NSG are always created
+		require.True(t, isValidOCID(outputs.IntLBSubnetID), "int_lb_subnet_id should be a valid OCID: %s", outputs.IntLBSubnetID)
+		require.True(t, isValidOCID(outputs.IntLBNSGID), "int_lb_nsg_id should be a valid OCID: %s", outputs.IntLBNSGID)
+
+		// Cluster private endpoint is always present and must be HTTPS
+		require.NotEmpty(t, outputs.ClusterPrivateEndpoint)
+		require.True(t, strings.HasPrefix(outputs.ClusterPrivateEndpoint, "https://"), "cluster_private_endpoint should start with https://: %s", outputs.ClusterPrivateEndpoint)
+
+		// Public endpoint only present when control plane is public
+		if outputs.ClusterPublicEndpoint != "" {
+			require.True(t, strings.HasPrefix(outputs.ClusterPublicEndpoint, "https://"), "cluster_public_endpoint should start with https://: %s", outputs.ClusterPublicEndpoint)
+		}
+
+		// Public LB subnet/NSG only present when public subnets are enabled
+		if outputs.PubLBSubnetID != "" {
+			require.True(t, isValidOCID(outputs.PubLBSubnetID), "pub_lb_subnet_id should be a valid OCID: %s", outputs.PubLBSubnetID)
+			require.True(t, isValidOCID(outputs.PubLBNSGID), "pub_lb_nsg_id should be a valid OCID: %s", outputs.PubLBNSGID)
+		}
+
+		// Bastion only present when create_bastion = true
+		if outputs.BastionID != "" {
+			require.True(t, isValidOCID(outputs.BastionID), "bastion_id should be a valid OCID: %s", outputs.BastionID)
+			require.NotEmpty(t, outputs.BastionPublicIP, "bastion_public_ip should not be empty when bastion is created")
+		}
+
+		// Operator only present when create_operator = true
+		if outputs.OperatorID != "" {
+			require.True(t, isValidOCID(outputs.OperatorID), "operator_id should be a valid OCID: %s", outputs.OperatorID)
+		}
+	})
+
+	// Tier 1 cluster health checks (public clusters, or private ones through a Bastion Service tunnel)
+	t.Run("ClusterHealth", func(t *testing.T) {
+		if cluster.kubeconfigPath == "" {
+			t.Skip("Skipping cluster health checks: no public endpoint or Bastion Service")
+		}
+		runClusterHealthChecks(t, cluster)
+	})
+
+	// Data plane: pod-to-pod across nodes of every pool, service DNS and routing
+	t.Run("Network", func(t *testing.T) {
+		if cluster.kubeconfigPath == "" {
+			t.Skip("Skipping network checks: no public endpoint or Bastion Service")
+		}
+		runNetworkChecks(t, cluster)
+	})
+
+	// GPU pools: advertised GPUs, device plugin and DCGM pods, driver versions
+	t.Run("GPU", func(t *testing.T) {
+		if cluster.kubeconfigPath == "" {
+			t.Skip("Skipping GPU checks: no public endpoint or Bastion Service")
+		}
+		runGPUChecks(t, cluster)
+	})
+
+	// Operator path: the operator host can drive the cluster, and the API is
+	// reachable from CI through it.
+	t.Run("Operator", func(t *testing.T) {
+		host := cluster.operator(t)
+		ctx := context.Background()
+
+		nodes, err := host.Kubectl(ctx, "get", "nodes", "--no-headers")
+		require.NoError(t, err, "kubectl on the operator host")
+		require.NotEmpty(t, strings.TrimSpace(nodes), "operator kubectl should list nodes")
+
+		releases, err := host.Helm(ctx, "list", "--all-namespaces", "--short")
+		require.NoError(t, err, "helm on the operator host")
+		t.Logf("Helm releases on the operator host:\n%s", releases)
+
+		cluster.operatorKubectl(t, "default").run(t, "cluster-info")
+	})
 }
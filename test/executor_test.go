@@ -0,0 +1,186 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+)
+
+// terraformExecutor runs the terraform commands behind the cluster stages.
+// Unit tests swap in a fake to replay apply failures without a cloud.
+type terraformExecutor interface {
+	InitAndApply(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error)
+	Destroy(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error)
+	OutputAll(t terratesting.TestingT, options *terraform.Options) (map[string]interface{}, error)
+	StateList(t terratesting.TestingT, options *terraform.Options) (string, error)
+}
+
+// kubectlExecutor runs kubectl against the cluster in options.
+type kubectlExecutor interface {
+	Run(t terratesting.TestingT, options *k8s.KubectlOptions, args ...string) (string, error)
+	Apply(t terratesting.TestingT, options *k8s.KubectlOptions, manifest string) error
+}
+
+// executors bundles the command runners a cluster fixture uses. Zero fields
+// fall back to the real implementations.
+type executors struct {
+	terraform terraformExecutor
+	kubectl   kubectlExecutor
+}
+
+func (e executors) withDefaults() executors {
+	if e.terraform == nil {
+		e.terraform = terratestExecutor{}
+	}
+	if e.kubectl == nil {
+		e.kubectl = terratestKubectl{}
+	}
+	return e
+}
+
+// terratestExecutor runs terraform through terratest.
+type terratestExecutor struct{}
+
+func (terratestExecutor) InitAndApply(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error) {
+	if _, err := terraform.InitContextE(t, ctx, options); err != nil {
+		return "", err
+	}
+	return applyGracefully(t, ctx, options)
+}
+
+// applyGracefully runs terraform apply like terraform.ApplyContextE, except
+// that cancelling ctx sends terraform SIGINT rather than SIGKILL. Terraform
+// then finishes the resource operations in flight and writes them to state,
+// so the destroy that follows can see them.
+func applyGracefully(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error) {
+	options, args := terraform.GetCommonOptions(options, terraform.FormatArgs(options,
+		append([]string{"apply", "-input=false", "-auto-approve"}, options.ExtraArgs.Apply...)...)...)
+	log := options.Logger
+	if log == nil {
+		log = logger.Default
+	}
+	description := fmt.Sprintf("%s %v", options.TerraformBinary, args)
+	return retry.DoWithRetryableErrorsContextE(t, ctx, description, options.RetryableTerraformErrors, options.MaxRetries, options.TimeBetweenRetries, func() (string, error) {
+		log.Logf(t, "Running command %s with args %s", options.TerraformBinary, args)
+		cmd := exec.CommandContext(ctx, options.TerraformBinary, args...)
+		cmd.Dir = options.TerraformDir
+		cmd.Env = os.Environ()
+		for name, value := range options.EnvVars {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+
+		reader, writer := io.Pipe()
+		cmd.Stdout, cmd.Stderr = writer, writer
+		var output strings.Builder
+		logged := make(chan struct{})
+		go func() {
+			defer close(logged)
+			scanner := bufio.NewScanner(reader)
+			scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+			for scanner.Scan() {
+				log.Logf(t, "%s", scanner.Text())
+				output.WriteString(scanner.Text() + "\n")
+			}
+			io.Copy(io.Discard, reader)
+		}()
+		err := cmd.Run()
+		writer.Close()
+		<-logged
+		if err != nil {
+			return output.String(), fmt.Errorf("%s: %w", description, err)
+		}
+		return output.String(), nil
+	})
+}
+
+func (terratestExecutor) Destroy(t terratesting.TestingT, ctx context.Context, options *terraform.Options) (string, error) {
+	return terraform.DestroyContextE(t, ctx, options)
+}
+
+func (terratestExecutor) OutputAll(t terratesting.TestingT, options *terraform.Options) (map[string]interface{}, error) {
+	return terraform.OutputAllE(t, options)
+}
+
+func (terratestExecutor) StateList(t terratesting.TestingT, options *terraform.Options) (string, error) {
+	return terraform.RunTerraformCommandAndGetStdoutE(t, options, "state", "list")
+}
+
+// terratestKubectl runs kubectl through terratest's k8s module.
+type terratestKubectl struct{}
+
+func (terratestKubectl) Run(t terratesting.TestingT, options *k8s.KubectlOptions, args ...string) (string, error) {
+	return k8s.RunKubectlAndGetOutputE(t, options, args...)
+}
+
+func (terratestKubectl) Apply(t terratesting.TestingT, options *k8s.KubectlOptions, manifest string) error {
+	return k8s.KubectlApplyFromStringE(t, options, manifest)
+}
+
+// kubectlClient runs kubectl in one namespace of a fixture's cluster.
+type kubectlClient struct {
+	exec    kubectlExecutor
+	options *k8s.KubectlOptions
+}
+
+// run runs kubectl and fails the test on error.
+func (k kubectlClient) run(t terratesting.TestingT, args ...string) {
+	t.Helper()
+	if _, err := k.exec.Run(t, k.options, args...); err != nil {
+		t.Fatalf("kubectl %v failed: %v", args, err)
+	}
+}
+
+// output runs kubectl and returns its output.
+func (k kubectlClient) output(t terratesting.TestingT, args ...string) (string, error) {
+	t.Helper()
+	return k.exec.Run(t, k.options, args...)
+}
+
+// apply applies manifest and fails the test on error.
+func (k kubectlClient) apply(t terratesting.TestingT, manifest string) {
+	t.Helper()
+	if err := k.exec.Apply(t, k.options, manifest); err != nil {
+		t.Fatalf("kubectl apply failed: %v", err)
+	}
+}
+
+// fakeTerraform replays scripted apply failures instead of running terraform.
+type fakeTerraform struct {
+	applyOutputs []string
+	appliedADs   []string
+	outputs      map[string]interface{}
+}
+
+func (f *fakeTerraform) InitAndApply(_ terratesting.TestingT, _ context.Context, options *terraform.Options) (string, error) {
+	f.appliedADs = append(f.appliedADs, options.Vars["worker_gpu_ad"].(string))
+	if len(f.applyOutputs) == 0 {
+		return "Apply complete!", nil
+	}
+	out := f.applyOutputs[0]
+	f.applyOutputs = f.applyOutputs[1:]
+	return out, errors.New("exit status 1")
+}
+
+func (f *fakeTerraform) Destroy(terratesting.TestingT, context.Context, *terraform.Options) (string, error) {
+	return "Destroy complete!", nil
+}
+
+func (f *fakeTerraform) StateList(terratesting.TestingT, *terraform.Options) (string, error) {
+	return "", nil
+}
+
+func (f *fakeTerraform) OutputAll(terratesting.TestingT, *terraform.Options) (map[string]interface{}, error) {
+	return f.outputs, nil
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// Env vars that point the Kubernetes-level suites at a cluster deployed outside
+// the harness (ORM, a customer stack, a previous run). Setting any of them skips
+// terraform apply/destroy entirely.
+const (
+	existingKubeconfigEnv = "EXISTING_KUBECONFIG"
+	existingOutputsEnv    = "EXISTING_OUTPUTS_JSON"
+	existingStateDirEnv   = "EXISTING_STATE_DIR"
+)
+
+func existingClusterConfigured() bool {
+	return envOrDefault([]string{existingKubeconfigEnv, existingOutputsEnv, existingStateDirEnv}, "") != ""
+}
+
+// loadExistingClusterFixture describes an already-deployed cluster. Outputs come
+// from EXISTING_OUTPUTS_JSON or, failing that, from `terraform output` in
+// EXISTING_STATE_DIR (which also enables state assertions). The kubeconfig comes
+// from EXISTING_KUBECONFIG or is generated from the outputs.
+func loadExistingClusterFixture(t terratesting.TestingT, kubeconfigDir string) *clusterFixture {
+	t.Helper()
+
+	fixture := &clusterFixture{exec: executors{}.withDefaults()}
+
+	if stateDir := envOrDefault([]string{existingStateDirEnv}, ""); stateDir != "" {
+		fixture.options = &terraform.Options{
+			TerraformDir: resolveVarFilePath(stateDir),
+			NoColor:      true,
+		}
+	}
+
+	switch {
+	case envOrDefault([]string{existingOutputsEnv}, "") != "":
+		path := envOrDefault([]string{existingOutputsEnv}, "")
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", existingOutputsEnv, err)
+		}
+		all, err := parseOutputsJSON(content)
+		if err != nil {
+			t.Fatalf("failed to parse %s (%s): %v", existingOutputsEnv, path, err)
+		}
+		outputs, err := decodeClusterOutputs(all)
+		if err != nil {
+			t.Fatalf("failed to decode %s (%s): %v", existingOutputsEnv, path, err)
+		}
+		fixture.outputs = outputs
+	case fixture.options != nil:
+		fixture.outputs = readClusterOutputs(t, fixture.exec.terraform, fixture.options)
+	}
+
+	if kubeconfig := envOrDefault([]string{existingKubeconfigEnv}, ""); kubeconfig != "" {
+		if _, err := os.Stat(kubeconfig); err != nil {
+			t.Fatalf("%s is not readable: %v", existingKubeconfigEnv, err)
+		}
+		fixture.kubeconfigPath = resolveVarFilePath(kubeconfig)
+	} else {
+		fixture.connect(t, kubeconfigDir)
+	}
+
+	return fixture
+}
+
+// parseOutputsJSON accepts either the `terraform output -json` format, where each
+// output is wrapped in {"value": ..., "type": ..., "sensitive": ...}, or a flat
+// map of output names to values.
+func parseOutputsJSON(content []byte) (map[string]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	all := make(map[string]interface{}, len(raw))
+	for key, message := range raw {
+		var wrapped map[string]json.RawMessage
+		if err := json.Unmarshal(message, &wrapped); err == nil && isTerraformOutputWrapper(wrapped) {
+			message = wrapped["value"]
+			if message == nil {
+				message = json.RawMessage("null")
+			}
+		}
+		var value interface{}
+		if err := json.Unmarshal(message, &value); err != nil {
+			return nil, fmt.Errorf("output %q: %w", key, err)
+		}
+		all[key] = value
+	}
+	return all, nil
+}
+
+func isTerraformOutputWrapper(fields map[string]json.RawMessage) bool {
+	_, hasSensitive := fields["sensitive"]
+	_, hasType := fields["type"]
+	return hasSensitive && hasType
+}
+
+func TestParseOutputsJSONAcceptsTerraformAndFlatFormats(t *testing.T) {
+	terraformFormat := []byte(`{
+  "cluster_id": {"sensitive": false, "type": "string", "value": "ocid1.cluster.oc1.iad.aaaa"},
+  "cluster_public_endpoint": {"sensitive": false, "type": "string", "value": null},
+  "grafana_admin_password": {"sensitive": true, "type": "string", "value": "secret"}
+}`)
+	all, err := parseOutputsJSON(terraformFormat)
+	require.NoError(t, err)
+	outputs, err := decodeClusterOutputs(all)
+	require.NoError(t, err)
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", outputs.ClusterID)
+	require.Empty(t, outputs.ClusterPublicEndpoint)
+	require.Equal(t, "secret", outputs.GrafanaAdminPassword)
+
+	flatFormat := []byte(`{"cluster_id": "ocid1.cluster.oc1.iad.bbbb", "fss_mount_path": "/mnt/oci-fss"}`)
+	all, err = parseOutputsJSON(flatFormat)
+	require.NoError(t, err)
+	outputs, err = decodeClusterOutputs(all)
+	require.NoError(t, err)
+	require.Equal(t, "ocid1.cluster.oc1.iad.bbbb", outputs.ClusterID)
+	require.Equal(t, "/mnt/oci-fss", outputs.FSSMountPath)
+}
+
+func TestLoadExistingClusterFixtureSkipsTerraform(t *testing.T) {
+	dir := t.TempDir()
+	outputsPath := filepath.Join(dir, "outputs.json")
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	require.NoError(t, os.WriteFile(outputsPath, []byte(`{
+  "cluster_id": {"sensitive": false, "type": "string", "value": "ocid1.cluster.oc1.iad.aaaa"},
+  "cluster_public_endpoint": {"sensitive": false, "type": "string", "value": "https://203.0.113.10:6443"}
+}`), 0600))
+	require.NoError(t, os.WriteFile(kubeconfigPath, []byte("apiVersion: v1\nkind: Config\n"), 0600))
+
+	t.Setenv(existingOutputsEnv, outputsPath)
+	t.Setenv(existingKubeconfigEnv, kubeconfigPath)
+	t.Setenv(existingStateDirEnv, "")
+	require.True(t, existingClusterConfigured())
+
+	fixture := loadExistingClusterFixture(t, dir)
+	require.Nil(t, fixture.options, "outputs-only fixtures have no terraform options")
+	require.Equal(t, kubeconfigPath, fixture.kubeconfigPath)
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", fixture.outputs.ClusterID)
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// failureCategory says who has to act on a failure: quota and capacity need
+// another region, AD or limit increase, auth needs credentials, timeout may
+// pass on rerun, validation means bad inputs, and bug is everything else.
+type failureCategory string
+
+const (
+	failureQuota      failureCategory = "quota"
+	failureCapacity   failureCategory = "capacity"
+	failureAuth       failureCategory = "auth"
+	failureTimeout    failureCategory = "timeout"
+	failureValidation failureCategory = "validation"
+	failureBug        failureCategory = "bug"
+)
+
+// failureRules are checked in order; the first match decides the category.
+var failureRules = []struct {
+	category failureCategory
+	pattern  *regexp.Regexp
+	reason   string
+}{
+	{failureCapacity, regexp.MustCompile(`(?i)out of (host )?capacity|InsufficientCapacity`), "no capacity for the requested shape"},
+	{failureQuota, regexp.MustCompile(`LimitExceeded|QuotaExceeded|(?i)service limit`), "service limit or compartment quota reached"},
+	{failureAuth, regexp.MustCompile(`NotAuthenticated|NotAuthorizedOrNotFound|403-Forbidden`), "credentials rejected or missing IAM policy"},
+	{failureAuth, regexp.MustCompile(`(?i)(security|session) token.*expired|can not create client, bad configuration`), "OCI credentials are invalid or expired"},
+	{failureTimeout, regexp.MustCompile(`context deadline exceeded|context canceled|(?i)timeout while waiting for state|timed out`), "operation timed out"},
+	// Only diagnostics about the inputs: "Invalid reference", "Unsupported
+	// argument" and the like are bugs in the stack's own configuration.
+	{failureValidation, regexp.MustCompile(`Invalid value for (input )?variable|No value for required variable|Value for undeclared variable|Resource precondition failed|400-InvalidParameter`), "rejected inputs"},
+}
+
+type failureClassification struct {
+	Category failureCategory `json:"category"`
+	Reason   string          `json:"reason"`
+}
+
+// classifyFailure categorises a terraform or helm failure from its output.
+func classifyFailure(output string) failureClassification {
+	for _, rule := range failureRules {
+		if rule.pattern.MatchString(output) {
+			return failureClassification{Category: rule.category, Reason: rule.reason}
+		}
+	}
+	return failureClassification{Category: failureBug, Reason: "unrecognised failure"}
+}
+
+// failureRecord is one entry in the failure report.
+type failureRecord struct {
+	Test     string          `json:"test"`
+	Stage    string          `json:"stage"`
+	Category failureCategory `json:"category"`
+	Reason   string          `json:"reason"`
+	Error    string          `json:"error"`
+	Time     time.Time       `json:"time"`
+}
+
+const maxFailureExcerpt = 4000
+
+// failureReportPath is where classified failures are collected as a JSON
+// array. Override with TEST_FAILURE_REPORT.
+func failureReportPath() string {
+	if path := os.Getenv("TEST_FAILURE_REPORT"); path != "" {
+		return resolveVarFilePath(path)
+	}
+	return filepath.Join(stageWorkRoot(), "failures.json")
+}
+
+var failureReportMu sync.Mutex
+
+func recordFailure(record failureRecord) error {
+	failureReportMu.Lock()
+	defer failureReportMu.Unlock()
+
+	path := failureReportPath()
+	var records []failureRecord
+	if content, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(content, &records); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	records = append(records, record)
+
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// failureExcerpt keeps the output from the first terraform "Error:" on, capped
+// at maxFailureExcerpt, so the report stays readable.
+func failureExcerpt(output string) string {
+	if i := strings.Index(output, "Error: "); i >= 0 {
+		output = output[i:]
+	}
+	if len(output) > maxFailureExcerpt {
+		output = output[:maxFailureExcerpt] + "..."
+	}
+	return strings.TrimSpace(output)
+}
+
+// fatalClassified fails the test with the failure category in the message and
+// records it in the failure report.
+func fatalClassified(t terratesting.TestingT, stage, output string, err error) {
+	t.Helper()
+
+	combined := output + "\n" + err.Error()
+	classification := classifyFailure(combined)
+	if recordErr := recordFailure(failureRecord{
+		Test:     t.Name(),
+		Stage:    stage,
+		Category: classification.Category,
+		Reason:   classification.Reason,
+		Error:    failureExcerpt(combined),
+		Time:     time.Now().UTC(),
+	}); recordErr != nil {
+		t.Errorf("failed to record failure in %s: %v", failureReportPath(), recordErr)
+	}
+	t.Fatalf("%s failed [%s: %s]: %v", stage, classification.Category, classification.Reason, err)
+}
+
+func TestClassifyFailureCategories(t *testing.T) {
+	cases := map[string]failureCategory{
+		"Error: 500-InternalError, Out of host capacity.":                                                     failureCapacity,
+		"Error: 400-LimitExceeded, The following service limits were exceeded: vcn-count":                     failureQuota,
+		"Error: 400-QuotaExceeded, Compartment quota exceeded":                                                failureQuota,
+		"Error: 401-NotAuthenticated, The required information to complete authentication was not provided":   failureAuth,
+		"Error: 404-NotAuthorizedOrNotFound, Authorization failed or requested resource not found":            failureAuth,
+		"Error: can not create client, bad configuration: did not find a proper configuration for key id":     failureAuth,
+		"Error: timeout while waiting for state to become 'ACTIVE' (last state: 'CREATING', timeout: 1h0m0s)": failureTimeout,
+		"context deadline exceeded":                                                          failureTimeout,
+		"Error: Invalid value for variable\n  on variables.tf line 12":                       failureValidation,
+		"Error: Invalid value for input variable\n  on variables.tf line 30":                 failureValidation,
+		"Error: No value for required variable\n  on variables.tf line 3":                    failureValidation,
+		"Error: Resource precondition failed\n  worker_rdma_shape must be a BM shape":        failureValidation,
+		"Error: Invalid reference\n  on oke-cluster.tf line 40":                              failureBug,
+		"Error: Invalid function argument\n  on oke-workers.tf line 12":                      failureBug,
+		"Error: Unsupported argument\n  on oke-cluster.tf line 18":                           failureBug,
+		"Error: Missing required argument\n  on fss.tf line 7":                               failureBug,
+		"Error: Unsupported attribute; This object does not have an attribute named \"id\".": failureBug,
+		"panic: runtime error: invalid memory address or nil pointer dereference":            failureBug,
+	}
+	for output, want := range cases {
+		require.Equal(t, want, classifyFailure(output).Category, output)
+	}
+}
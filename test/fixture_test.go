@@ -0,0 +1,447 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/operator"
+)
+
+// sharedFixtureFlag enables the TestMain-managed cluster fixture. When set, one
+// union topology is applied before any test runs and destroyed after all of them.
+const sharedFixtureFlag = "SHARED_FIXTURE"
+
+// sharedFixture is populated by TestMain when SHARED_FIXTURE=1. Suites pick it up
+// through suiteCluster instead of applying their own topology.
+var sharedFixture *clusterFixture
+
+// clusterOutputs mirrors the terraform outputs the suites assert on.
+// Null outputs decode to the zero value, matching optionalOutput.
+type clusterOutputs struct {
+	StateID                        string `json:"state_id"`
+	CNIType                        string `json:"cni_type"`
+	ClusterID                      string `json:"cluster_id"`
+	ClusterName                    string `json:"cluster_name"`
+	ClusterPublicEndpoint          string `json:"cluster_public_endpoint"`
+	ClusterPrivateEndpoint         string `json:"cluster_private_endpoint"`
+	ClusterCACert                  string `json:"cluster_ca_cert"`
+	VCNID                          string `json:"vcn_id"`
+	VCNName                        string `json:"vcn_name"`
+	ControlPlaneSubnetID           string `json:"control_plane_subnet_id"`
+	ControlPlaneNSGID              string `json:"control_plane_nsg_id"`
+	PodSubnetID                    string `json:"pod_subnet_id"`
+	PodNSGID                       string `json:"pod_nsg_id"`
+	WorkerSubnetID                 string `json:"worker_subnet_id"`
+	WorkerNSGID                    string `json:"worker_nsg_id"`
+	WorkerOpsPoolID                string `json:"worker_ops_pool_id"`
+	WorkerCPUPoolID                string `json:"worker_cpu_pool_id"`
+	WorkerGPUPoolID                string `json:"worker_gpu_pool_id"`
+	WorkerRDMAPoolID               string `json:"worker_rdma_pool_id"`
+	IntLBSubnetID                  string `json:"int_lb_subnet_id"`
+	IntLBNSGID                     string `json:"int_lb_nsg_id"`
+	PubLBSubnetID                  string `json:"pub_lb_subnet_id"`
+	PubLBNSGID                     string `json:"pub_lb_nsg_id"`
+	BastionID                      string `json:"bastion_id"`
+	BastionPublicIP                string `json:"bastion_public_ip"`
+	BastionSSHUser                 string `json:"bastion_ssh_user"`
+	BastionServiceID               string `json:"bastion_service_id"`
+	OKEPrivateEndpointIP           string `json:"oke_private_endpoint_ip"`
+	OperatorID                     string `json:"operator_id"`
+	OperatorPrivateIP              string `json:"operator_private_ip"`
+	OperatorSSHUser                string `json:"operator_ssh_user"`
+	FSSFileSystemID                string `json:"fss_file_system_id"`
+	FSSMountTargetIP               string `json:"fss_mount_target_ip"`
+	FSSExportPath                  string `json:"fss_export_path"`
+	FSSNSGID                       string `json:"fss_nsg_id"`
+	FSSSubnetID                    string `json:"fss_subnet_id"`
+	FSSMountPath                   string `json:"fss_mount_path"`
+	LustreFileSystemID             string `json:"lustre_file_system_id"`
+	LustreManagementServiceAddress string `json:"lustre_management_service_address"`
+	LustreNSGID                    string `json:"lustre_nsg_id"`
+	LustreSubnetID                 string `json:"lustre_subnet_id"`
+	LustreMountPath                string `json:"lustre_mount_path"`
+	GrafanaURL                     string `json:"grafana_url"`
+	GrafanaAdminPassword           string `json:"grafana_admin_password"`
+}
+
+// clusterFixture is an applied cluster plus everything a suite needs to inspect it.
+// options is nil for existing clusters described only by an outputs file.
+type clusterFixture struct {
+	exec           executors
+	options        *terraform.Options
+	outputs        clusterOutputs
+	kubeconfigPath string
+	// operatorHost is the SSH connection opened by operator, if any.
+	operatorHost *operator.Host
+	// closers release what the fixture holds open, such as Bastion tunnels.
+	closers []func() error
+}
+
+// close runs the fixture's closers in reverse order.
+func (c *clusterFixture) close() error {
+	var errs []error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		errs = append(errs, c.closers[i]())
+	}
+	c.closers = nil
+	return errors.Join(errs...)
+}
+
+// stateList returns the resources in the fixture's terraform state, skipping the
+// test when the cluster was provided without one.
+func (c *clusterFixture) stateList(t *testing.T) []string {
+	t.Helper()
+	if c.options == nil {
+		t.Skip("Skipping state assertions: existing cluster has no terraform state")
+	}
+	out, err := c.exec.terraform.StateList(t, c.options)
+	if err != nil {
+		t.Fatalf("failed to list terraform state: %v", err)
+	}
+	return parseStateList(out)
+}
+
+// kubectl returns a client for namespace in the fixture's cluster.
+func (c *clusterFixture) kubectl(namespace string) kubectlClient {
+	return kubectlClient{
+		exec:    c.exec.kubectl,
+		options: k8s.NewKubectlOptions("", c.kubeconfigPath, namespace),
+	}
+}
+
+// suiteCluster returns the cluster a suite should run against. With a shared or
+// existing fixture it is returned as-is; otherwise the suite's own topology goes
+// through the setup/apply stages and is torn down when the test finishes. The
+// test is skipped when SKIP_validate is set.
+func suiteCluster(t *testing.T, overrides map[string]interface{}) *clusterFixture {
+	t.Helper()
+
+	if sharedFixture != nil {
+		t.Log("Using shared cluster fixture")
+		return sharedFixture
+	}
+
+	return provisionCluster(t, cassetteExecutors(t, t.Name()), overrides)
+}
+
+// provisionCluster runs the setup and apply stages for the test's own cluster
+// with exec and tears it down when the test finishes.
+func provisionCluster(t *testing.T, exec executors, overrides map[string]interface{}) *clusterFixture {
+	t.Helper()
+
+	stages := newClusterStages(t.Name())
+	stages.exec = exec
+	t.Cleanup(func() { stages.runTeardown(t) })
+	stages.runSetupAndApply(t, overrides)
+
+	if stageSkipped(stageValidate) {
+		t.Skipf("Skipping validation: SKIP_%s is set (work dir: %s)", stageValidate, stages.workDir)
+	}
+	fixture := stages.load(t, t.TempDir())
+	t.Cleanup(func() {
+		if err := fixture.close(); err != nil {
+			t.Errorf("failed to close cluster fixture: %v", err)
+		}
+	})
+	return fixture
+}
+
+// newClusterFixture writes a kubeconfig into kubeconfigDir (see connect).
+func newClusterFixture(t terratesting.TestingT, exec executors, options *terraform.Options, outputs clusterOutputs, kubeconfigDir string) *clusterFixture {
+	t.Helper()
+
+	fixture := &clusterFixture{
+		exec:    exec,
+		options: options,
+		outputs: outputs,
+	}
+	fixture.connect(t, kubeconfigDir)
+	return fixture
+}
+
+func readClusterOutputs(t terratesting.TestingT, exec terraformExecutor, options *terraform.Options) clusterOutputs {
+	t.Helper()
+
+	all, err := exec.OutputAll(t, options)
+	if err != nil {
+		t.Fatalf("failed to read terraform outputs: %v", err)
+	}
+	outputs, err := decodeClusterOutputs(all)
+	if err != nil {
+		t.Fatalf("failed to decode terraform outputs: %v", err)
+	}
+	return outputs
+}
+
+// decodeClusterOutputs maps `terraform output -json` values onto clusterOutputs.
+// Outputs that are not strings (or that the harness does not know) are ignored.
+func decodeClusterOutputs(all map[string]interface{}) (clusterOutputs, error) {
+	strs := map[string]string{}
+	for key, value := range all {
+		if s, ok := value.(string); ok {
+			strs[key] = s
+		}
+	}
+	raw, err := json.Marshal(strs)
+	if err != nil {
+		return clusterOutputs{}, err
+	}
+	var outputs clusterOutputs
+	if err := json.Unmarshal(raw, &outputs); err != nil {
+		return clusterOutputs{}, err
+	}
+	return outputs, nil
+}
+
+// sharedFixtureVars is the union of the topology overrides of every suite whose
+// RUN_* flag is enabled, so a single apply can serve all of them.
+func sharedFixtureVars() map[string]interface{} {
+	vars := map[string]interface{}{}
+	if envFlagEnabled("RUN_FSS_TESTS") {
+		vars = mergeVars(vars, fssSuiteVars())
+	}
+	if envFlagEnabled("RUN_LUSTRE_TESTS") {
+		vars = mergeVars(vars, lustreSuiteVars())
+	}
+	if envFlagEnabled("RUN_MONITORING_TESTS") {
+		vars = mergeVars(vars, monitoringSuiteVars())
+	}
+	if envFlagEnabled("RUN_NCCL_TESTS") {
+		vars = mergeVars(vars, ncclSuiteVars())
+	}
+	if envFlagEnabled("RUN_KUEUE_TESTS") {
+		vars = mergeVars(vars, kueueSuiteVars())
+	}
+	return vars
+}
+
+// runWithSharedFixture wraps m.Run with the shared fixture lifecycle, using the
+// same skippable stages as per-suite clusters. Teardown runs once setup has
+// saved options, even if apply or the tests fail. An
+// existing cluster (see existingClusterConfigured) is used as-is and never
+// applied or destroyed.
+func runWithSharedFixture(m *testing.M) int {
+	existing := existingClusterConfigured()
+	if !existing && !envFlagEnabled(sharedFixtureFlag) {
+		return m.Run()
+	}
+
+	kubeconfigDir, err := os.MkdirTemp("", "oke-fixture-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create fixture temp dir: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(kubeconfigDir)
+
+	if existing {
+		if err := runFixtureStage("setup", func(t *fixtureT) {
+			sharedFixture = loadExistingClusterFixture(t, kubeconfigDir)
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "existing cluster fixture setup failed: %v\n", err)
+			return 1
+		}
+		code := m.Run()
+		if err := sharedFixture.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close existing cluster fixture: %v\n", err)
+			code = 1
+		}
+		return code
+	}
+
+	stages := newClusterStages("SharedFixture")
+	fixtureCassette, err := openCassette("SharedFixture")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	stages.exec = fixtureCassette.executors()
+	setupErr := runFixtureStage("setup", func(t *fixtureT) {
+		stages.runSetupAndApply(t, sharedFixtureVars())
+		if !stageSkipped(stageValidate) {
+			sharedFixture = stages.load(t, kubeconfigDir)
+		}
+	})
+
+	code := 1
+	switch {
+	case setupErr != nil:
+		fmt.Fprintf(os.Stderr, "shared fixture setup failed: %v\n", setupErr)
+	case stageSkipped(stageValidate):
+		fmt.Fprintf(os.Stderr, "SKIP_%s is set; not running tests against the shared fixture (work dir: %s)\n", stageValidate, stages.workDir)
+		code = 0
+	default:
+		code = m.Run()
+		if err := sharedFixture.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close shared fixture: %v\n", err)
+			code = 1
+		}
+	}
+
+	if err := runFixtureStage("teardown", func(t *fixtureT) {
+		stages.runTeardown(t)
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "shared fixture teardown failed: %v\n", err)
+		code = 1
+	}
+	if err := fixtureCassette.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save shared fixture cassette: %v\n", err)
+		code = 1
+	}
+	return code
+}
+
+// fixtureT adapts terratest's TestingT for code that runs outside a *testing.T,
+// such as TestMain. FailNow exits the stage goroutine like testing.T does.
+type fixtureT struct {
+	name   string
+	mu     sync.Mutex
+	failed bool
+	errors []string
+}
+
+var _ terratesting.TestingT = (*fixtureT)(nil)
+
+func (f *fixtureT) Fail() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = true
+}
+
+func (f *fixtureT) FailNow() {
+	f.Fail()
+	runtime.Goexit()
+}
+
+func (f *fixtureT) Fatal(args ...any) {
+	f.log(fmt.Sprint(args...))
+	f.FailNow()
+}
+
+func (f *fixtureT) Fatalf(format string, args ...any) {
+	f.log(fmt.Sprintf(format, args...))
+	f.FailNow()
+}
+
+func (f *fixtureT) Error(args ...any) {
+	f.log(fmt.Sprint(args...))
+	f.Fail()
+}
+
+func (f *fixtureT) Errorf(format string, args ...any) {
+	f.log(fmt.Sprintf(format, args...))
+	f.Fail()
+}
+
+func (f *fixtureT) Name() string { return f.name }
+
+func (f *fixtureT) Helper() {}
+
+func (f *fixtureT) log(msg string) {
+	f.mu.Lock()
+	f.errors = append(f.errors, msg)
+	f.mu.Unlock()
+	logger.Default.Logf(f, "%s", msg)
+}
+
+// runFixtureStage runs stage in its own goroutine so FailNow can unwind it, and
+// returns an error describing the failure, if any.
+func runFixtureStage(name string, stage func(t *fixtureT)) error {
+	t := &fixtureT{name: "TestMain/" + name}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stage(t)
+	}()
+	<-done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.failed {
+		return nil
+	}
+	if len(t.errors) == 0 {
+		return fmt.Errorf("stage %s failed", name)
+	}
+	return fmt.Errorf("stage %s failed: %s", name, strings.Join(t.errors, "; "))
+}
+
+func TestDecodeClusterOutputsTreatsNullAsEmpty(t *testing.T) {
+	outputs, err := decodeClusterOutputs(map[string]interface{}{
+		"cluster_id":              "ocid1.cluster.oc1.iad.aaaa",
+		"cluster_public_endpoint": nil,
+		"fss_mount_path":          "/mnt/oci-fss",
+		"stack_version":           "v26.7.0",
+		"worker_pool_sizes":       map[string]interface{}{"oke-system": 1},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", outputs.ClusterID)
+	require.Empty(t, outputs.ClusterPublicEndpoint)
+	require.Equal(t, "/mnt/oci-fss", outputs.FSSMountPath)
+}
+
+func TestSharedFixtureVarsUnionsEnabledSuites(t *testing.T) {
+	t.Setenv("RUN_FSS_TESTS", "1")
+	t.Setenv("RUN_LUSTRE_TESTS", "")
+	t.Setenv("RUN_MONITORING_TESTS", "true")
+	t.Setenv("RUN_NCCL_TESTS", "")
+	t.Setenv("RUN_KUEUE_TESTS", "")
+	t.Setenv("FSS_AD", "")
+	t.Setenv("OCI_FSS_AD", "")
+	t.Setenv("TF_VAR_fss_ad", "")
+
+	vars := sharedFixtureVars()
+	require.Equal(t, true, vars["create_fss"])
+	require.Equal(t, true, vars["install_monitoring"])
+	require.Equal(t, "internal", vars["preferred_kubernetes_services"])
+	require.NotContains(t, vars, "create_lustre")
+	require.NotContains(t, vars, "install_mpi_operator")
+	require.NotContains(t, vars, "fss_ad")
+}
+
+func TestRunFixtureStageReportsFailNow(t *testing.T) {
+	reachedEnd := false
+	err := runFixtureStage("setup", func(ft *fixtureT) {
+		ft.Fatalf("apply failed: %s", "Out of host capacity")
+		reachedEnd = true
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Out of host capacity")
+	require.False(t, reachedEnd, "FailNow should stop the stage")
+
+	require.NoError(t, runFixtureStage("teardown", func(ft *fixtureT) {}))
+}
+
+func TestConnectTunnelsPrivateClustersThroughBastionService(t *testing.T) {
+	t.Setenv(cassetteModeEnv, cassetteReplay)
+	dir := t.TempDir()
+	fixture := &clusterFixture{outputs: clusterOutputs{
+		ClusterID:              "ocid1.cluster.oc1.iad.aaaa",
+		ClusterPrivateEndpoint: "https://10.0.0.5:6443",
+		ClusterCACert:          testCACert,
+		BastionServiceID:       "ocid1.bastion.oc1.iad.aaaa",
+		OKEPrivateEndpointIP:   "10.0.0.5",
+	}}
+
+	fixture.connect(t, dir)
+	require.Equal(t, filepath.Join(dir, "kubeconfig"), fixture.kubeconfigPath)
+	content, err := os.ReadFile(fixture.kubeconfigPath)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "tls-server-name: 10.0.0.5")
+
+	fixture.outputs.BastionServiceID = ""
+	fixture.connect(t, dir)
+	require.Empty(t, fixture.kubeconfigPath, "private clusters without a Bastion Service stay unreachable")
+}
@@ -0,0 +1,428 @@
+// Package gpu verifies GPU worker nodes: the GPU resource each node
+// advertises, the per-node device plugin and DCGM exporter pods, and the
+// driver seen from a pod through nvidia-smi or amd-smi.
+package gpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// Default images for the driver pods. The NVIDIA container toolkit mounts
+// nvidia-smi from the host; the ROCm image ships amd-smi.
+const (
+	DefaultNVIDIAImage = "nvcr.io/nvidia/cuda:13.0.0-base-ubuntu24.04"
+	DefaultAMDImage    = "iad.ocir.io/idxzjcdglx2s/rccl-tests:rocm-7.2.0-ubuntu22.04-rccl-2.27.7-anp-1.4.0-022526.2"
+)
+
+// Component is a per-node pod that must be Ready on every GPU node of Vendor,
+// found by pod name prefix in any namespace.
+type Component struct {
+	Name        string
+	Vendor      shapes.Vendor
+	PodPrefixes []string
+}
+
+// DefaultComponents are the device plugins of the GPU Operator, the OKE
+// NvidiaGpuPlugin and AmdGpuPlugin add-ons, and the GPU Operator's DCGM
+// exporter.
+var DefaultComponents = []Component{
+	{Name: "device-plugin", Vendor: shapes.NVIDIA, PodPrefixes: []string{"nvidia-device-plugin-daemonset-", "nvidia-gpu-device-plugin-"}},
+	{Name: "dcgm-exporter", Vendor: shapes.NVIDIA, PodPrefixes: []string{"nvidia-dcgm-exporter-"}},
+	{Name: "device-plugin", Vendor: shapes.AMD, PodPrefixes: []string{"amd-gpu-device-plugin-", "amdgpu-device-plugin-", "amdgpu-dp-ds-"}},
+}
+
+// Config describes a GPU check run.
+type Config struct {
+	// Namespace is created for the driver pods and deleted afterwards.
+	Namespace string
+	// PoolLabel groups nodes into pools. Defaults to oke.oraclecloud.com/pool.name.
+	PoolLabel string
+	// Pools maps each GPU pool to its shape, which decides the vendor and the
+	// GPU count every node must advertise.
+	Pools map[string]string
+	// Components are the pods checked on every node. Defaults to
+	// DefaultComponents.
+	Components  []Component
+	NVIDIAImage string
+	AMDImage    string
+	// Timeout bounds the driver pods. Defaults to 10 minutes, enough to pull
+	// the images.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = "gpu-check"
+	}
+	if c.PoolLabel == "" {
+		c.PoolLabel = "oke.oraclecloud.com/pool.name"
+	}
+	if c.Components == nil {
+		c.Components = DefaultComponents
+	}
+	if c.NVIDIAImage == "" {
+		c.NVIDIAImage = DefaultNVIDIAImage
+	}
+	if c.AMDImage == "" {
+		c.AMDImage = DefaultAMDImage
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 5 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// NodeResult is what Run found on one node. Advertised is the node's
+// allocatable GPU resource; GPUs and Driver are what the driver pod saw.
+type NodeResult struct {
+	Pool       string
+	Node       string
+	Shape      shapes.Shape
+	Advertised int64
+	GPUs       int
+	Driver     string
+	Problems   []string
+}
+
+// Report lists the nodes of every configured pool, ordered by pool and node.
+type Report struct {
+	Nodes []NodeResult
+}
+
+// Failures lists every problem as "pool/node: problem".
+func (r Report) Failures() []string {
+	var failures []string
+	for _, node := range r.Nodes {
+		for _, problem := range node.Problems {
+			failures = append(failures, fmt.Sprintf("%s/%s: %s", node.Pool, node.Node, problem))
+		}
+	}
+	return failures
+}
+
+// String renders one row per node.
+func (r Report) String() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "pool\tnode\tshape\tresource\tadvertised\tseen\tdriver\tresult")
+	for _, node := range r.Nodes {
+		result := "ok"
+		if len(node.Problems) > 0 {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%d\t%s\t%s\n",
+			node.Pool, node.Node, node.Shape.Name, node.Shape.GPUResource(), node.Advertised, node.Shape.GPUs, node.GPUs, orDash(node.Driver), result)
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Run checks every node of the configured pools and deletes the namespace it
+// created. An error means the check could not run; node problems are in the
+// report. Pools whose shape is not a GPU shape in the shapes catalog are an
+// error, so a misconfigured caller does not pass silently.
+func Run(ctx context.Context, client kubernetes.Interface, cfg Config) (Report, error) {
+	cfg.setDefaults()
+
+	poolShapes := map[string]shapes.Shape{}
+	for pool, name := range cfg.Pools {
+		shape, ok := shapes.Lookup(name)
+		if !ok || shape.GPUs == 0 {
+			return Report{}, fmt.Errorf("pool %s: %s is not a GPU shape in the shapes catalog", pool, name)
+		}
+		poolShapes[pool] = shape
+	}
+	if len(poolShapes) == 0 {
+		return Report{}, errors.New("no GPU pools to check")
+	}
+
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var report Report
+	for _, node := range nodes.Items {
+		shape, ok := poolShapes[node.Labels[cfg.PoolLabel]]
+		if !ok {
+			continue
+		}
+		result := NodeResult{Pool: node.Labels[cfg.PoolLabel], Node: node.Name, Shape: shape}
+		quantity := node.Status.Allocatable[corev1.ResourceName(shape.GPUResource())]
+		result.Advertised = quantity.Value()
+		if result.Advertised != int64(shape.GPUs) {
+			result.Problems = append(result.Problems, fmt.Sprintf("advertises %d %s, want %d", result.Advertised, shape.GPUResource(), shape.GPUs))
+		}
+		for _, component := range cfg.Components {
+			if component.Vendor == shape.Vendor {
+				if problem := componentProblem(pods.Items, node.Name, component); problem != "" {
+					result.Problems = append(result.Problems, problem)
+				}
+			}
+		}
+		report.Nodes = append(report.Nodes, result)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		a, b := report.Nodes[i], report.Nodes[j]
+		return a.Pool < b.Pool || a.Pool == b.Pool && a.Node < b.Node
+	})
+	for pool := range poolShapes {
+		if !slices.ContainsFunc(report.Nodes, func(n NodeResult) bool { return n.Pool == pool }) {
+			return Report{}, fmt.Errorf("pool %s has no nodes", pool)
+		}
+	}
+
+	// Only nodes that advertise their GPUs can schedule a pod requesting them.
+	var ready []int
+	for i, node := range report.Nodes {
+		if node.Advertised == int64(node.Shape.GPUs) {
+			ready = append(ready, i)
+		}
+	}
+	if len(ready) == 0 {
+		return report, nil
+	}
+
+	namespaces := client.CoreV1().Namespaces()
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.Namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return Report{}, fmt.Errorf("failed to create namespace %s: %w", cfg.Namespace, err)
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := namespaces.Delete(cleanup, cfg.Namespace, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			cfg.Logf("failed to delete namespace %s: %v", cfg.Namespace, err)
+		}
+	}()
+
+	for _, i := range ready {
+		if _, err := client.CoreV1().Pods(cfg.Namespace).Create(ctx, driverPod(cfg, i, report.Nodes[i]), metav1.CreateOptions{}); err != nil {
+			return Report{}, fmt.Errorf("failed to create driver pod on %s: %w", report.Nodes[i].Node, err)
+		}
+	}
+	cfg.Logf("waiting for %d driver pod(s)", len(ready))
+	if err := waitForDriverPods(ctx, client, cfg, &report, ready); err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// componentProblem reports a component pod on node that is missing or not Ready.
+func componentProblem(pods []corev1.Pod, node string, component Component) string {
+	for _, pod := range pods {
+		if pod.Spec.NodeName != node || !slices.ContainsFunc(component.PodPrefixes, func(prefix string) bool { return strings.HasPrefix(pod.Name, prefix) }) {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodRunning && podReady(pod) {
+			return ""
+		}
+		return fmt.Sprintf("%s pod %s/%s is not Ready (%s)", component.Name, pod.Namespace, pod.Name, pod.Status.Phase)
+	}
+	return fmt.Sprintf("no %s pod", component.Name)
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func driverPodName(i int) string { return fmt.Sprintf("gpu-driver-%d", i) }
+
+// driverScript runs the vendor's SMI tool and writes its output to stdout and
+// the termination message.
+func driverScript(vendor shapes.Vendor) string {
+	command := "nvidia-smi --query-gpu=index,name,driver_version --format=csv,noheader"
+	if vendor == shapes.AMD {
+		command = "amd-smi version && amd-smi list"
+	}
+	return fmt.Sprintf("{ %s; } > /dev/termination-log 2>&1\nstatus=$?\ncat /dev/termination-log\nexit $status\n", command)
+}
+
+// driverPod requests every GPU of the node, so the SMI tool sees all of them.
+func driverPod(cfg Config, i int, node NodeResult) *corev1.Pod {
+	image := cfg.NVIDIAImage
+	if node.Shape.Vendor == shapes.AMD {
+		image = cfg.AMDImage
+	}
+	gpus := corev1.ResourceList{corev1.ResourceName(node.Shape.GPUResource()): *resource.NewQuantity(int64(node.Shape.GPUs), resource.DecimalSI)}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      driverPodName(i),
+			Namespace: cfg.Namespace,
+			Labels:    map[string]string{"app": "gpu-check"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      node.Node,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Tolerations: []corev1.Toleration{
+				{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists},
+				{Key: "amd.com/gpu", Operator: corev1.TolerationOpExists},
+			},
+			Containers: []corev1.Container{{
+				Name:      "smi",
+				Image:     image,
+				Command:   []string{"sh", "-c", driverScript(node.Shape.Vendor)},
+				Resources: corev1.ResourceRequirements{Requests: gpus, Limits: gpus},
+			}},
+		},
+	}
+}
+
+// waitForDriverPods waits for the driver pods on the nodes at indexes and
+// records what they saw. A pod still running at the timeout is a node problem.
+func waitForDriverPods(ctx context.Context, client kubernetes.Interface, cfg Config, report *Report, indexes []int) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	pods := client.CoreV1().Pods(cfg.Namespace)
+	pending := slices.Clone(indexes)
+	for {
+		var still []int
+		for _, i := range pending {
+			pod, err := pods.Get(ctx, driverPodName(i), metav1.GetOptions{})
+			if err != nil && ctx.Err() == nil {
+				return fmt.Errorf("failed to get driver pod on %s: %w", report.Nodes[i].Node, err)
+			}
+			if err != nil || pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+				still = append(still, i)
+				continue
+			}
+			recordDriver(&report.Nodes[i], pod)
+		}
+		pending = still
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, i := range pending {
+				report.Nodes[i].Problems = append(report.Nodes[i].Problems, "driver pod did not finish in "+cfg.Timeout.String())
+			}
+			return nil
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+func recordDriver(node *NodeResult, pod *corev1.Pod) {
+	var message string
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil {
+			message = status.State.Terminated.Message
+		}
+	}
+	tool := "nvidia-smi"
+	parse := ParseNvidiaSMI
+	if node.Shape.Vendor == shapes.AMD {
+		tool, parse = "amd-smi", ParseAMDSMI
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		node.Problems = append(node.Problems, fmt.Sprintf("%s failed: %s", tool, oneLine(message)))
+		return
+	}
+	gpus, driver, err := parse(message)
+	if err != nil {
+		node.Problems = append(node.Problems, fmt.Sprintf("%s: %v", tool, err))
+		return
+	}
+	node.GPUs, node.Driver = gpus, driver
+	if gpus != node.Shape.GPUs {
+		node.Problems = append(node.Problems, fmt.Sprintf("%s sees %d GPU(s), want %d", tool, gpus, node.Shape.GPUs))
+	}
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ParseNvidiaSMI reads "index, name, driver_version" CSV lines and returns the
+// GPU count and the driver version, which must be the same on every GPU.
+func ParseNvidiaSMI(output string) (int, string, error) {
+	var drivers []string
+	gpus := 0
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return 0, "", fmt.Errorf("unexpected output %q", oneLine(output))
+		}
+		gpus++
+		if driver := strings.TrimSpace(fields[2]); !slices.Contains(drivers, driver) {
+			drivers = append(drivers, driver)
+		}
+	}
+	switch {
+	case gpus == 0:
+		return 0, "", errors.New("no GPUs listed")
+	case len(drivers) > 1:
+		return gpus, "", fmt.Errorf("GPUs report different drivers: %s", strings.Join(drivers, ", "))
+	}
+	return gpus, drivers[0], nil
+}
+
+var (
+	rocmVersion   = regexp.MustCompile(`ROCm version: ([^\s|]+)`)
+	amdgpuVersion = regexp.MustCompile(`amdgpu version: ([^\s|]+)`)
+	amdGPUEntry   = regexp.MustCompile(`(?m)^GPU: \d+`)
+)
+
+// ParseAMDSMI reads "amd-smi version" followed by "amd-smi list" and returns
+// the GPU count and "ROCm <version>", with the amdgpu kernel driver version
+// when amd-smi reports it.
+func ParseAMDSMI(output string) (int, string, error) {
+	m := rocmVersion.FindStringSubmatch(output)
+	if m == nil {
+		return 0, "", fmt.Errorf("no ROCm version in %q", oneLine(output))
+	}
+	driver := "ROCm " + m[1]
+	if m := amdgpuVersion.FindStringSubmatch(output); m != nil {
+		driver += ", amdgpu " + m[1]
+	}
+	gpus := len(amdGPUEntry.FindAllString(output, -1))
+	if gpus == 0 {
+		return 0, "", errors.New("no GPUs listed")
+	}
+	return gpus, driver, nil
+}
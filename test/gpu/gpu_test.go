@@ -0,0 +1,245 @@
+package gpu
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+const poolLabel = "oke.oraclecloud.com/pool.name"
+
+func gpuNode(name, pool, resourceName string, gpus int64) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{poolLabel: pool}},
+		Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{
+			corev1.ResourceName(resourceName): *resource.NewQuantity(gpus, resource.DecimalSI),
+		}},
+	}
+}
+
+func componentPod(namespace, name, node string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func nvidiaSMI(gpus int, driver string) string {
+	var out string
+	for i := range gpus {
+		out += fmt.Sprintf("%d, NVIDIA H100 80GB HBM3, %s\n", i, driver)
+	}
+	return out
+}
+
+const amdSMI = `AMDSMI Tool: 26.2.1+fc0010cf6a | AMDSMI Library version: 26.2.1 | ROCm version: 7.2.4 | amdgpu version: 6.16.6 | amd_hsmp version: N/A
+GPU: 0
+    BDF: 0000:11:00.0
+    UUID: 1fff74a1-0000-1000-80ff-f5e6c3b5a8f4
+GPU: 1
+    BDF: 0000:2f:00.0
+    UUID: 5cff74a1-0000-1000-80c1-4e1cb7f8bd7d
+`
+
+// fakeCluster finishes driver pods with the SMI output output returns for
+// their node, failing them when it returns an error.
+func fakeCluster(output func(node string) (string, error), objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewClientset(objects...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		if pod.Labels["app"] != "gpu-check" {
+			return false, nil, nil
+		}
+		message, err := output(pod.Spec.NodeName)
+		if message == "" && err == nil {
+			return false, nil, nil
+		}
+		pod.Status.Phase = corev1.PodSucceeded
+		if err != nil {
+			pod.Status.Phase = corev1.PodFailed
+			message = err.Error()
+		}
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "smi",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+		}}
+		return false, nil, nil
+	})
+	return client
+}
+
+func TestRunReportsEveryNodeOfEachPool(t *testing.T) {
+	output := func(node string) (string, error) {
+		switch node {
+		case "10.0.3.2":
+			return nvidiaSMI(8, "595.45.04"), nil
+		case "10.0.3.3":
+			return nvidiaSMI(7, "595.45.04"), nil
+		case "10.0.4.2":
+			return "", fmt.Errorf("NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver.\n")
+		}
+		return "", nil
+	}
+	client := fakeCluster(output,
+		gpuNode("10.0.3.2", "oke-rdma", "nvidia.com/gpu", 8),
+		gpuNode("10.0.3.3", "oke-rdma", "nvidia.com/gpu", 8),
+		gpuNode("10.0.3.4", "oke-rdma", "nvidia.com/gpu", 0),
+		gpuNode("10.0.4.2", "oke-gpu", "nvidia.com/gpu", 1),
+		gpuNode("10.0.1.2", "oke-system", "nvidia.com/gpu", 0),
+		componentPod("gpu-operator", "nvidia-device-plugin-daemonset-a", "10.0.3.2", true),
+		componentPod("gpu-operator", "nvidia-dcgm-exporter-a", "10.0.3.2", true),
+		componentPod("gpu-operator", "nvidia-device-plugin-daemonset-b", "10.0.3.3", true),
+		componentPod("gpu-operator", "nvidia-dcgm-exporter-b", "10.0.3.3", false),
+		componentPod("gpu-operator", "nvidia-dcgm-exporter-c", "10.0.3.4", true),
+		componentPod("kube-system", "nvidia-gpu-device-plugin-d", "10.0.4.2", true),
+		componentPod("gpu-operator", "nvidia-dcgm-exporter-d", "10.0.4.2", true),
+	)
+
+	var logs []string
+	report, err := Run(context.Background(), client, Config{
+		Namespace:    "gpu-check-run-1",
+		Pools:        map[string]string{"oke-rdma": "BM.GPU.H100.8", "oke-gpu": "VM.GPU.A10.1"},
+		PollInterval: time.Millisecond,
+		Logf:         func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) },
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"oke-gpu/10.0.4.2: nvidia-smi failed: NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver.",
+		"oke-rdma/10.0.3.3: dcgm-exporter pod gpu-operator/nvidia-dcgm-exporter-b is not Ready (Running)",
+		"oke-rdma/10.0.3.3: nvidia-smi sees 7 GPU(s), want 8",
+		"oke-rdma/10.0.3.4: advertises 0 nvidia.com/gpu, want 8",
+		"oke-rdma/10.0.3.4: no device-plugin pod",
+	}, report.Failures())
+	require.Equal(t, "pool      node      shape          resource        advertised  seen  driver     result\n"+
+		"oke-gpu   10.0.4.2  VM.GPU.A10.1   nvidia.com/gpu  1/1         0     -          FAIL\n"+
+		"oke-rdma  10.0.3.2  BM.GPU.H100.8  nvidia.com/gpu  8/8         8     595.45.04  ok\n"+
+		"oke-rdma  10.0.3.3  BM.GPU.H100.8  nvidia.com/gpu  8/8         7     595.45.04  FAIL\n"+
+		"oke-rdma  10.0.3.4  BM.GPU.H100.8  nvidia.com/gpu  0/8         0     -          FAIL\n",
+		report.String())
+	require.Equal(t, []string{"waiting for 3 driver pod(s)"}, logs)
+
+	var created []*corev1.Pod
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok {
+			if pod, ok := create.GetObject().(*corev1.Pod); ok {
+				created = append(created, pod)
+			}
+		}
+	}
+	require.Len(t, created, 3, "no driver pod where the GPUs are not allocatable")
+	container := created[1].Spec.Containers[0]
+	require.Equal(t, "10.0.3.2", created[1].Spec.NodeName)
+	require.Equal(t, DefaultNVIDIAImage, container.Image)
+	gpus := container.Resources.Limits[corev1.ResourceName("nvidia.com/gpu")]
+	require.Equal(t, int64(8), gpus.Value(), "the driver pod takes every GPU of the node")
+
+	_, err = client.CoreV1().Namespaces().Get(context.Background(), "gpu-check-run-1", metav1.GetOptions{})
+	require.Error(t, err, "the namespace is deleted after the run")
+}
+
+func TestRunUsesAMDResourceAndTools(t *testing.T) {
+	client := fakeCluster(func(string) (string, error) { return amdSMI, nil },
+		gpuNode("10.0.3.2", "oke-rdma", "amd.com/gpu", 8),
+		componentPod("kube-system", "amd-gpu-device-plugin-a", "10.0.3.2", true),
+	)
+
+	report, err := Run(context.Background(), client, Config{
+		Pools:        map[string]string{"oke-rdma": "BM.GPU.MI300X.8"},
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"oke-rdma/10.0.3.2: amd-smi sees 2 GPU(s), want 8"}, report.Failures())
+	require.Equal(t, "ROCm 7.2.4, amdgpu 6.16.6", report.Nodes[0].Driver)
+
+	pod, err := client.CoreV1().Pods("gpu-check").Get(context.Background(), "gpu-driver-0", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, DefaultAMDImage, pod.Spec.Containers[0].Image)
+	gpus := pod.Spec.Containers[0].Resources.Requests[corev1.ResourceName("amd.com/gpu")]
+	require.Equal(t, int64(8), gpus.Value())
+}
+
+func TestRunTimesOutOnPendingDriverPods(t *testing.T) {
+	client := fakeCluster(func(string) (string, error) { return "", nil },
+		gpuNode("10.0.3.2", "oke-rdma", "nvidia.com/gpu", 8),
+		componentPod("gpu-operator", "nvidia-device-plugin-daemonset-a", "10.0.3.2", true),
+		componentPod("gpu-operator", "nvidia-dcgm-exporter-a", "10.0.3.2", true),
+	)
+
+	report, err := Run(context.Background(), client, Config{
+		Pools:        map[string]string{"oke-rdma": "BM.GPU.H100.8"},
+		Timeout:      10 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"oke-rdma/10.0.3.2: driver pod did not finish in 10ms"}, report.Failures())
+}
+
+func TestRunRejectsUnusablePools(t *testing.T) {
+	client := fake.NewClientset(gpuNode("10.0.3.2", "oke-rdma", "nvidia.com/gpu", 8))
+
+	_, err := Run(context.Background(), client, Config{Pools: map[string]string{"oke-cpu": "VM.Standard.E5.Flex"}})
+	require.EqualError(t, err, "pool oke-cpu: VM.Standard.E5.Flex is not a GPU shape in the shapes catalog")
+
+	_, err = Run(context.Background(), client, Config{Pools: map[string]string{"oke-gpu": "VM.GPU.A10.1"}})
+	require.EqualError(t, err, "pool oke-gpu has no nodes")
+
+	_, err = Run(context.Background(), client, Config{})
+	require.EqualError(t, err, "no GPU pools to check")
+}
+
+func TestParseNvidiaSMI(t *testing.T) {
+	gpus, driver, err := ParseNvidiaSMI(nvidiaSMI(8, "595.45.04"))
+	require.NoError(t, err)
+	require.Equal(t, 8, gpus)
+	require.Equal(t, "595.45.04", driver)
+
+	_, _, err = ParseNvidiaSMI("0, NVIDIA H100, 595.45.04\n1, NVIDIA H100, 580.95.05\n")
+	require.EqualError(t, err, "GPUs report different drivers: 595.45.04, 580.95.05")
+	_, _, err = ParseNvidiaSMI("No devices were found\n")
+	require.EqualError(t, err, `unexpected output "No devices were found"`)
+	_, _, err = ParseNvidiaSMI("")
+	require.EqualError(t, err, "no GPUs listed")
+}
+
+func TestParseAMDSMI(t *testing.T) {
+	gpus, driver, err := ParseAMDSMI(amdSMI)
+	require.NoError(t, err)
+	require.Equal(t, 2, gpus)
+	require.Equal(t, "ROCm 7.2.4, amdgpu 6.16.6", driver)
+
+	gpus, driver, err = ParseAMDSMI("AMDSMI Tool: 24.6.2+2b02a07 | AMDSMI Library version: 24.6.2.0 | ROCm version: 6.2.0\nGPU: 0\n")
+	require.NoError(t, err)
+	require.Equal(t, 1, gpus)
+	require.Equal(t, "ROCm 6.2.0", driver)
+
+	_, _, err = ParseAMDSMI("sh: 1: amd-smi: not found\n")
+	require.EqualError(t, err, `no ROCm version in "sh: 1: amd-smi: not found"`)
+}
+
+func TestDriverScriptIsValidShell(t *testing.T) {
+	for _, vendor := range []shapes.Vendor{shapes.NVIDIA, shapes.AMD} {
+		out, err := exec.Command("sh", "-n", "-c", driverScript(vendor)).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/gpu"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+)
+
+// runGPUChecks verifies every node of the GPU pools in the effective
+// variables: the advertised GPU resource, the device plugin and DCGM exporter
+// pods, and the driver seen by nvidia-smi or amd-smi.
+func runGPUChecks(t *testing.T, cluster *clusterFixture) {
+	t.Helper()
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping GPU checks: API requests are not recorded in cassettes")
+	}
+	if cluster.options == nil {
+		t.Skip("Skipping GPU checks: existing cluster has no terraform variables")
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	pools, err := gpuPoolShapes(vars)
+	require.NoError(t, err, "failed to resolve GPU pools")
+	if len(pools) == 0 {
+		t.Skip("Skipping GPU checks: no GPU pools in this topology")
+	}
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	defer cancel()
+	report, err := gpu.Run(ctx, client, gpu.Config{
+		Namespace:  "gpu-check-" + currentRunID(),
+		PoolLabel:  poolNameLabel,
+		Pools:      pools,
+		Components: gpuComponents(vars),
+		Logf:       func(format string, args ...any) { t.Logf("GPU check: "+format, args...) },
+	})
+	require.NoError(t, err, "GPU checks could not run")
+	t.Logf("GPU check: nodes\n%s", report)
+	require.Empty(t, report.Failures(), "GPU checks failed")
+}
+
+// gpuComponents drops the DCGM exporter when the GPU Operator or its exporter
+// is not deployed.
+func gpuComponents(vars map[string]interface{}) []gpu.Component {
+	operator, err := varBool(vars, "deploy_nvidia_gpu_operator")
+	dcgm := err == nil && operator
+	if config, ok := vars["nvidia_gpu_operator_configuration"].(map[string]interface{}); ok && config["dcgmExporter.enabled"] == "false" {
+		dcgm = false
+	}
+	var components []gpu.Component
+	for _, component := range gpu.DefaultComponents {
+		if component.Name != "dcgm-exporter" || dcgm {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+func TestGPUComponents(t *testing.T) {
+	names := func(components []gpu.Component) []string {
+		var names []string
+		for _, component := range components {
+			names = append(names, string(component.Vendor)+"/"+component.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"nvidia/device-plugin", "nvidia/dcgm-exporter", "amd/device-plugin"},
+		names(gpuComponents(map[string]interface{}{"deploy_nvidia_gpu_operator": true})))
+	require.Equal(t, []string{"nvidia/device-plugin", "amd/device-plugin"},
+		names(gpuComponents(map[string]interface{}{"deploy_nvidia_gpu_operator": "false"})))
+	require.Equal(t, []string{"nvidia/device-plugin", "amd/device-plugin"},
+		names(gpuComponents(map[string]interface{}{
+			"deploy_nvidia_gpu_operator":        true,
+			"nvidia_gpu_operator_configuration": map[string]interface{}{"dcgmExporter.enabled": "false"},
+		})))
+}
@@ -0,0 +1,366 @@
+// Package health runs Kubernetes health checks against a cluster through
+// client-go and reports structured results instead of parsed kubectl output.
+package health
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+)
+
+// Result is what one check found. Details list the offending objects, one per
+// line, such as "kube-system/coredns-abc: Pending: FailedScheduling: ...".
+type Result struct {
+	Check   string   `json:"check"`
+	Status  Status   `json:"status"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf("%s [%s]: %s", r.Check, r.Status, r.Message)
+	for _, detail := range r.Details {
+		s += "\n  " + detail
+	}
+	return s
+}
+
+// Check inspects the cluster. Run returns an error only when the cluster
+// could not be queried; unhealthy objects are reported in the Result.
+type Check interface {
+	Name() string
+	Run(ctx context.Context, client kubernetes.Interface) (Result, error)
+}
+
+// CheckFunc adapts a function to Check.
+type CheckFunc struct {
+	CheckName string
+	Fn        func(ctx context.Context, client kubernetes.Interface) (Result, error)
+}
+
+func (c CheckFunc) Name() string { return c.CheckName }
+
+func (c CheckFunc) Run(ctx context.Context, client kubernetes.Interface) (Result, error) {
+	result, err := c.Fn(ctx, client)
+	result.Check = c.CheckName
+	return result, err
+}
+
+// Engine runs a set of checks against one cluster.
+type Engine struct {
+	Client kubernetes.Interface
+	Checks []Check
+}
+
+// DefaultChecks are the checks every topology should pass.
+func DefaultChecks() []Check {
+	return []Check{
+		NodesReady(),
+		PodsHealthy(metav1.NamespaceSystem),
+		DaemonSetsRolledOut(metav1.NamespaceSystem),
+		PendingPodsExplained(metav1.NamespaceSystem),
+	}
+}
+
+// NewClient builds a clientset from a kubeconfig file.
+func NewClient(kubeconfigPath string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Run runs every check once. A check that cannot query the cluster fails with
+// the error as its message.
+func (e *Engine) Run(ctx context.Context) []Result {
+	results := make([]Result, 0, len(e.Checks))
+	for _, check := range e.Checks {
+		result, err := check.Run(ctx, e.Client)
+		if err != nil {
+			result = Result{Check: check.Name(), Status: Fail, Message: err.Error()}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Wait reruns the checks every interval until they all pass or ctx is done,
+// and returns the last results. progress, if set, gets each round's results.
+func (e *Engine) Wait(ctx context.Context, interval time.Duration, progress func([]Result)) []Result {
+	for {
+		results := e.Run(ctx)
+		if progress != nil {
+			progress(results)
+		}
+		if len(Failed(results)) == 0 {
+			return results
+		}
+		select {
+		case <-ctx.Done():
+			return results
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Failed returns the results that did not pass.
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, result := range results {
+		if result.Status != Pass {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// NodesReady passes when the cluster has nodes and all of them are Ready.
+func NodesReady() Check {
+	return CheckFunc{CheckName: "nodes-ready", Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list nodes: %w", err)
+		}
+		if len(nodes.Items) == 0 {
+			return Result{Status: Fail, Message: "cluster has no nodes"}, nil
+		}
+		var details []string
+		for _, node := range nodes.Items {
+			if ready := nodeCondition(node, corev1.NodeReady); ready == nil || ready.Status != corev1.ConditionTrue {
+				details = append(details, fmt.Sprintf("%s: %s", node.Name, describeCondition(ready)))
+			}
+		}
+		return summarize(details, fmt.Sprintf("%d node(s) Ready", len(nodes.Items)), fmt.Sprintf("%d of %d node(s) not Ready", len(details), len(nodes.Items))), nil
+	}}
+}
+
+func nodeCondition(node corev1.Node, conditionType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func describeCondition(condition *corev1.NodeCondition) string {
+	if condition == nil {
+		return "no Ready condition"
+	}
+	s := "Ready=" + string(condition.Status)
+	if condition.Reason != "" {
+		s += " (" + condition.Reason + ")"
+	}
+	if condition.Message != "" {
+		s += ": " + condition.Message
+	}
+	return s
+}
+
+// PoolNodesReady passes when each pool in expected has exactly that many
+// Ready nodes, where a node's pool is the value of its label. Nodes in pools
+// missing from expected count against an expected size of 0; nodes without the
+// label are ignored. On failure the details report every pool.
+func PoolNodesReady(label string, expected map[string]int) Check {
+	return CheckFunc{CheckName: "pool-nodes-ready", Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list nodes: %w", err)
+		}
+		ready, total := map[string]int{}, map[string]int{}
+		for _, node := range nodes.Items {
+			pool, ok := node.Labels[label]
+			if !ok {
+				continue
+			}
+			total[pool]++
+			if condition := nodeCondition(node, corev1.NodeReady); condition != nil && condition.Status == corev1.ConditionTrue {
+				ready[pool]++
+			}
+		}
+
+		pools := make([]string, 0, len(expected))
+		for pool := range expected {
+			pools = append(pools, pool)
+		}
+		for pool := range total {
+			if _, ok := expected[pool]; !ok {
+				pools = append(pools, pool)
+			}
+		}
+		sort.Strings(pools)
+
+		var details []string
+		mismatched, want := 0, 0
+		for _, pool := range pools {
+			want += expected[pool]
+			details = append(details, fmt.Sprintf("%s: %d of %d node(s) Ready, %d registered", pool, ready[pool], expected[pool], total[pool]))
+			if ready[pool] != expected[pool] || total[pool] != expected[pool] {
+				mismatched++
+			}
+		}
+		if mismatched == 0 {
+			return Result{Status: Pass, Message: fmt.Sprintf("%d node(s) Ready across %d pool(s)", want, len(pools))}, nil
+		}
+		return Result{Status: Fail, Message: fmt.Sprintf("%d of %d pool(s) not at their expected size", mismatched, len(pools)), Details: details}, nil
+	}}
+}
+
+// PodsHealthy passes when every pod in namespace has Completed, or is Running
+// with all containers ready.
+func PodsHealthy(namespace string) Check {
+	return CheckFunc{CheckName: "pods-healthy/" + namespaceLabel(namespace), Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list pods in %s: %w", namespaceLabel(namespace), err)
+		}
+		var details []string
+		for _, pod := range pods.Items {
+			if problem := podProblem(pod); problem != "" {
+				details = append(details, fmt.Sprintf("%s/%s: %s", pod.Namespace, pod.Name, problem))
+			}
+		}
+		return summarize(details, fmt.Sprintf("%d pod(s) Running or Completed", len(pods.Items)), fmt.Sprintf("%d of %d pod(s) unhealthy", len(details), len(pods.Items))), nil
+	}}
+}
+
+// podProblem describes why pod is unhealthy, or returns "".
+func podProblem(pod corev1.Pod) string {
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		return ""
+	case corev1.PodRunning:
+		var notReady []string
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Ready {
+				continue
+			}
+			reason := "not ready"
+			if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+				reason = status.State.Waiting.Reason
+			}
+			notReady = append(notReady, fmt.Sprintf("%s %s (%d restarts)", status.Name, reason, status.RestartCount))
+		}
+		if len(notReady) == 0 {
+			return ""
+		}
+		return "Running but " + strings.Join(notReady, ", ")
+	}
+	problem := string(pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		problem += " (" + pod.Status.Reason + ")"
+	}
+	return problem
+}
+
+// DaemonSetsRolledOut passes when every DaemonSet in namespace has its
+// desired pods scheduled, updated and available.
+func DaemonSetsRolledOut(namespace string) Check {
+	return CheckFunc{CheckName: "daemonsets-rolled-out/" + namespaceLabel(namespace), Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		daemonSets, err := client.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list daemonsets in %s: %w", namespaceLabel(namespace), err)
+		}
+		var details []string
+		for _, ds := range daemonSets.Items {
+			s := ds.Status
+			if s.ObservedGeneration < ds.Generation || s.UpdatedNumberScheduled < s.DesiredNumberScheduled ||
+				s.NumberAvailable < s.DesiredNumberScheduled || s.NumberUnavailable > 0 {
+				details = append(details, fmt.Sprintf("%s/%s: desired %d, updated %d, ready %d, available %d",
+					ds.Namespace, ds.Name, s.DesiredNumberScheduled, s.UpdatedNumberScheduled, s.NumberReady, s.NumberAvailable))
+			}
+		}
+		return summarize(details, fmt.Sprintf("%d daemonset(s) rolled out", len(daemonSets.Items)), fmt.Sprintf("%d of %d daemonset(s) not rolled out", len(details), len(daemonSets.Items))), nil
+	}}
+}
+
+// PendingPodsExplained fails when pods in namespace are Pending, and explains
+// each one with its most recent warning event, such as FailedScheduling.
+func PendingPodsExplained(namespace string) Check {
+	return CheckFunc{CheckName: "pending-pods/" + namespaceLabel(namespace), Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list pods in %s: %w", namespaceLabel(namespace), err)
+		}
+		var pending []corev1.Pod
+		for _, pod := range pods.Items {
+			if pod.Status.Phase == corev1.PodPending {
+				pending = append(pending, pod)
+			}
+		}
+		if len(pending) == 0 {
+			return Result{Status: Pass, Message: "no pending pods"}, nil
+		}
+
+		events, err := client.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to list events in %s: %w", namespaceLabel(namespace), err)
+		}
+		var details []string
+		for _, pod := range pending {
+			details = append(details, fmt.Sprintf("%s/%s: %s", pod.Namespace, pod.Name, explainPending(pod, events.Items)))
+		}
+		return Result{Status: Fail, Message: fmt.Sprintf("%d pod(s) Pending", len(pending)), Details: details}, nil
+	}}
+}
+
+// explainPending returns the latest event about pod, preferring warnings.
+func explainPending(pod corev1.Pod, events []corev1.Event) string {
+	var related []corev1.Event
+	for _, event := range events {
+		if event.InvolvedObject.Kind == "Pod" && event.InvolvedObject.Namespace == pod.Namespace &&
+			(event.InvolvedObject.UID == pod.UID || event.InvolvedObject.Name == pod.Name) {
+			related = append(related, event)
+		}
+	}
+	if len(related) == 0 {
+		return "no events"
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		if wi, wj := related[i].Type == corev1.EventTypeWarning, related[j].Type == corev1.EventTypeWarning; wi != wj {
+			return wi
+		}
+		return eventTime(related[i]).After(eventTime(related[j]))
+	})
+	return fmt.Sprintf("%s: %s", related[0].Reason, related[0].Message)
+}
+
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+func namespaceLabel(namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return "all-namespaces"
+	}
+	return namespace
+}
+
+func summarize(details []string, passMessage, failMessage string) Result {
+	if len(details) == 0 {
+		return Result{Status: Pass, Message: passMessage}
+	}
+	return Result{Status: Fail, Message: failMessage, Details: details}
+}
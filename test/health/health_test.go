@@ -0,0 +1,252 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func node(name string, ready corev1.ConditionStatus, reason string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeReady, Status: ready, Reason: reason},
+		}},
+	}
+}
+
+func pod(namespace, name string, phase corev1.PodPhase, containers ...corev1.ContainerStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name)},
+		Status:     corev1.PodStatus{Phase: phase, ContainerStatuses: containers},
+	}
+}
+
+func event(namespace, podName, eventType, reason, message string, at time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: namespace, Name: podName + "." + reason},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: namespace, Name: podName},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func daemonSet(name string, generation, observed int64, desired, updated, ready, available int32) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: name, Generation: generation},
+		Status: appsv1.DaemonSetStatus{
+			ObservedGeneration:     observed,
+			DesiredNumberScheduled: desired,
+			UpdatedNumberScheduled: updated,
+			NumberReady:            ready,
+			NumberAvailable:        available,
+			NumberUnavailable:      desired - available,
+		},
+	}
+}
+
+func run(t *testing.T, check Check, objects ...runtime.Object) Result {
+	t.Helper()
+	result, err := check.Run(context.Background(), fake.NewClientset(objects...))
+	require.NoError(t, err)
+	require.Equal(t, check.Name(), result.Check)
+	return result
+}
+
+func TestNodesReady(t *testing.T) {
+	result := run(t, NodesReady(), node("10.0.1.2", corev1.ConditionTrue, ""), node("10.0.1.3", corev1.ConditionTrue, ""))
+	require.Equal(t, Pass, result.Status)
+	require.Equal(t, "2 node(s) Ready", result.Message)
+
+	result = run(t, NodesReady(),
+		node("10.0.1.2", corev1.ConditionTrue, ""),
+		node("10.0.1.3", corev1.ConditionFalse, "KubeletNotReady"),
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "10.0.1.4"}},
+	)
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "2 of 3 node(s) not Ready", result.Message)
+	require.Equal(t, []string{"10.0.1.3: Ready=False (KubeletNotReady)", "10.0.1.4: no Ready condition"}, result.Details)
+
+	result = run(t, NodesReady())
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "cluster has no nodes", result.Message)
+}
+
+func inPool(n *corev1.Node, pool string) *corev1.Node {
+	n.Labels = map[string]string{"oke.oraclecloud.com/pool.name": pool}
+	return n
+}
+
+func TestPoolNodesReady(t *testing.T) {
+	const label = "oke.oraclecloud.com/pool.name"
+	expected := map[string]int{"oke-system": 2, "oke-gpu": 1, "oke-cpu": 0}
+
+	result := run(t, PoolNodesReady(label, expected),
+		inPool(node("10.0.1.2", corev1.ConditionTrue, ""), "oke-system"),
+		inPool(node("10.0.1.3", corev1.ConditionTrue, ""), "oke-system"),
+		inPool(node("10.0.2.2", corev1.ConditionTrue, ""), "oke-gpu"),
+		node("virtual-node", corev1.ConditionTrue, ""),
+	)
+	require.Equal(t, Pass, result.Status)
+	require.Equal(t, "3 node(s) Ready across 3 pool(s)", result.Message)
+
+	result = run(t, PoolNodesReady(label, expected),
+		inPool(node("10.0.1.2", corev1.ConditionTrue, ""), "oke-system"),
+		inPool(node("10.0.1.3", corev1.ConditionFalse, "KubeletNotReady"), "oke-system"),
+		inPool(node("10.0.2.2", corev1.ConditionTrue, ""), "oke-gpu"),
+		inPool(node("10.0.2.3", corev1.ConditionTrue, ""), "oke-gpu"),
+		inPool(node("10.0.3.2", corev1.ConditionTrue, ""), "oke-rdma"),
+	)
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "3 of 4 pool(s) not at their expected size", result.Message)
+	require.Equal(t, []string{
+		"oke-cpu: 0 of 0 node(s) Ready, 0 registered",
+		"oke-gpu: 2 of 1 node(s) Ready, 2 registered",
+		"oke-rdma: 1 of 0 node(s) Ready, 1 registered",
+		"oke-system: 1 of 2 node(s) Ready, 2 registered",
+	}, result.Details)
+}
+
+func TestPodsHealthy(t *testing.T) {
+	result := run(t, PodsHealthy("kube-system"),
+		pod("kube-system", "coredns-1", corev1.PodRunning, corev1.ContainerStatus{Name: "coredns", Ready: true}),
+		pod("kube-system", "csi-setup", corev1.PodSucceeded),
+		pod("default", "broken", corev1.PodFailed),
+	)
+	require.Equal(t, Pass, result.Status)
+	require.Equal(t, "pods-healthy/kube-system", result.Check)
+
+	result = run(t, PodsHealthy("kube-system"),
+		pod("kube-system", "coredns-1", corev1.PodRunning, corev1.ContainerStatus{Name: "coredns", Ready: true}),
+		pod("kube-system", "kube-proxy-x", corev1.PodRunning, corev1.ContainerStatus{
+			Name:         "kube-proxy",
+			RestartCount: 4,
+			State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		}),
+		pod("kube-system", "csi-node-y", corev1.PodPending),
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "evicted"},
+			Status:     corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted"},
+		},
+	)
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "3 of 4 pod(s) unhealthy", result.Message)
+	require.ElementsMatch(t, []string{
+		"kube-system/kube-proxy-x: Running but kube-proxy CrashLoopBackOff (4 restarts)",
+		"kube-system/csi-node-y: Pending",
+		"kube-system/evicted: Failed (Evicted)",
+	}, result.Details)
+}
+
+func TestDaemonSetsRolledOut(t *testing.T) {
+	result := run(t, DaemonSetsRolledOut("kube-system"), daemonSet("kube-proxy", 2, 2, 3, 3, 3, 3), daemonSet("idle", 1, 1, 0, 0, 0, 0))
+	require.Equal(t, Pass, result.Status)
+
+	result = run(t, DaemonSetsRolledOut("kube-system"),
+		daemonSet("kube-proxy", 2, 2, 3, 3, 3, 3),
+		daemonSet("nvidia-device-plugin", 1, 1, 4, 4, 2, 2),
+		daemonSet("csi-node", 3, 2, 3, 3, 3, 3),
+	)
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "2 of 3 daemonset(s) not rolled out", result.Message)
+	require.ElementsMatch(t, []string{
+		"kube-system/nvidia-device-plugin: desired 4, updated 4, ready 2, available 2",
+		"kube-system/csi-node: desired 3, updated 3, ready 3, available 3",
+	}, result.Details)
+}
+
+func TestPendingPodsExplained(t *testing.T) {
+	now := time.Now()
+	result := run(t, PendingPodsExplained(metav1.NamespaceAll), pod("default", "ok", corev1.PodRunning))
+	require.Equal(t, Pass, result.Status)
+
+	result = run(t, PendingPodsExplained(metav1.NamespaceAll),
+		pod("default", "ok", corev1.PodRunning),
+		pod("default", "gpu-job", corev1.PodPending),
+		pod("monitoring", "prometheus-0", corev1.PodPending),
+		pod("kube-system", "quiet", corev1.PodPending),
+		event("default", "gpu-job", corev1.EventTypeNormal, "Scheduled", "later normal event", now),
+		event("default", "gpu-job", corev1.EventTypeWarning, "FailedScheduling", "0/3 nodes are available: 3 Insufficient nvidia.com/gpu.", now.Add(-time.Minute)),
+		event("monitoring", "prometheus-0", corev1.EventTypeWarning, "FailedScheduling", "old", now.Add(-time.Hour)),
+		event("monitoring", "prometheus-0", corev1.EventTypeWarning, "FailedAttachVolume", "volume is not attached", now),
+		event("default", "quiet", corev1.EventTypeWarning, "FailedScheduling", "same name, other namespace", now),
+	)
+	require.Equal(t, Fail, result.Status)
+	require.Equal(t, "pending-pods/all-namespaces", result.Check)
+	require.Equal(t, "3 pod(s) Pending", result.Message)
+	require.ElementsMatch(t, []string{
+		"default/gpu-job: FailedScheduling: 0/3 nodes are available: 3 Insufficient nvidia.com/gpu.",
+		"monitoring/prometheus-0: FailedAttachVolume: volume is not attached",
+		"kube-system/quiet: no events",
+	}, result.Details)
+}
+
+func TestEngineReportsQueryErrorsAsFailures(t *testing.T) {
+	client := fake.NewClientset(node("10.0.1.2", corev1.ConditionTrue, ""))
+	client.PrependReactor("list", "daemonsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	engine := Engine{Client: client, Checks: []Check{NodesReady(), DaemonSetsRolledOut("kube-system")}}
+
+	results := engine.Run(context.Background())
+	require.Len(t, results, 2)
+	require.Equal(t, Pass, results[0].Status)
+	require.Equal(t, Result{
+		Check:   "daemonsets-rolled-out/kube-system",
+		Status:  Fail,
+		Message: "failed to list daemonsets in kube-system: forbidden",
+	}, results[1])
+	require.Equal(t, []Result{results[1]}, Failed(results))
+}
+
+func TestEngineWaitsUntilChecksPass(t *testing.T) {
+	client := fake.NewClientset(node("10.0.1.2", corev1.ConditionFalse, "KubeletNotReady"))
+	rounds := 0
+	custom := CheckFunc{CheckName: "flip-ready", Fn: func(ctx context.Context, client kubernetes.Interface) (Result, error) {
+		rounds++
+		if rounds == 2 {
+			_, err := client.CoreV1().Nodes().Update(ctx, node("10.0.1.2", corev1.ConditionTrue, ""), metav1.UpdateOptions{})
+			require.NoError(t, err)
+		}
+		return Result{Status: Pass}, nil
+	}}
+	engine := Engine{Client: client, Checks: []Check{custom, NodesReady()}}
+
+	var progress [][]Result
+	results := engine.Wait(context.Background(), time.Millisecond, func(results []Result) {
+		progress = append(progress, results)
+	})
+	require.Empty(t, Failed(results))
+	require.Len(t, progress, 2)
+	require.Equal(t, Fail, progress[0][1].Status)
+	require.Equal(t, "flip-ready", progress[0][0].Check)
+}
+
+func TestEngineWaitStopsAtDeadline(t *testing.T) {
+	engine := Engine{Client: fake.NewClientset(), Checks: []Check{NodesReady()}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	results := engine.Wait(ctx, time.Millisecond, nil)
+	require.Len(t, Failed(results), 1)
+	require.Equal(t, "cluster has no nodes", results[0].Message)
+}
+
+func TestResultString(t *testing.T) {
+	result := Result{Check: "nodes-ready", Status: Fail, Message: "1 of 2 node(s) not Ready", Details: []string{"10.0.1.3: Ready=Unknown"}}
+	require.Equal(t, "nodes-ready [fail]: 1 of 2 node(s) not Ready\n  10.0.1.3: Ready=Unknown", result.String())
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/gruntwork-io/terratest/modules/random"
 	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
 )
 
 const (
@@ -20,6 +21,17 @@ const (
 	defaultTimeBetweenRetries = 15 * time.Second
 )
 
+// Cassettes record every terraform and kubectl command a suite runs so
+// the suite can be replayed later without a cloud. TEST_CASSETTE_MODE selects
+// "record" or "replay"; anything else runs the real commands unrecorded.
+const (
+	cassetteModeEnv = "TEST_CASSETTE_MODE"
+	cassetteDirEnv  = "TEST_CASSETTE_DIR"
+
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+)
+
 type baseVarsOptions struct {
 	includeDefaults      bool
 	allowMissingRequired bool
@@ -29,7 +41,7 @@ func terraformDir() string {
 	return filepath.Join("..", "terraform")
 }
 
-func baseVars(t *testing.T, opts baseVarsOptions) map[string]interface{} {
+func baseVars(t terratesting.TestingT, opts baseVarsOptions) map[string]interface{} {
 	t.Helper()
 
 	auth := strings.ToLower(envOrDefault([]string{"OCI_AUTH", "TF_VAR_oci_auth"}, "api_key"))
@@ -44,7 +56,7 @@ func baseVars(t *testing.T, opts baseVarsOptions) map[string]interface{} {
 	tenancyOCID := required("OCI_TENANCY_OCID", "TF_VAR_tenancy_ocid")
 	region := required("OCI_REGION", "TF_VAR_region")
 	compartmentOCID := required("OCI_COMPARTMENT_OCID", "TF_VAR_compartment_ocid")
-	workerOpsAD := required("WORKER_OPS_AD", "OCI_WORKER_OPS_AD", "TF_VAR_worker_ops_ad")
+	workerOpsAD := firstAD(required("WORKER_OPS_AD", "OCI_WORKER_OPS_AD", "TF_VAR_worker_ops_ad"))
 	workerOpsImageID := required("WORKER_OPS_IMAGE_ID", "WORKER_OPS_IMAGE_CUSTOM_ID", "OCI_WORKER_OPS_IMAGE_ID", "TF_VAR_worker_ops_image_custom_id")
 	sshPublicKey := loadSSHPublicKey(t, !opts.allowMissingRequired)
 
@@ -67,10 +79,12 @@ func baseVars(t *testing.T, opts baseVarsOptions) map[string]interface{} {
 	setIfNotEmpty(vars, "ssh_public_key", sshPublicKey)
 	setIfNotEmpty(vars, "worker_ops_ad", workerOpsAD)
 	setIfNotEmpty(vars, "worker_ops_image_custom_id", workerOpsImageID)
-	setIfNotEmpty(vars, "worker_cpu_ad", envOrDefault([]string{"WORKER_CPU_AD", "TF_VAR_worker_cpu_ad"}, ""))
+	setIfNotEmpty(vars, "worker_cpu_ad", firstAD(envOrDefault([]string{"WORKER_CPU_AD", "TF_VAR_worker_cpu_ad"}, "")))
 	setIfNotEmpty(vars, "worker_cpu_image_custom_id", envOrDefault([]string{"WORKER_CPU_IMAGE_CUSTOM_ID", "TF_VAR_worker_cpu_image_custom_id"}, ""))
-	setIfNotEmpty(vars, "worker_gpu_ad", envOrDefault([]string{"WORKER_GPU_AD", "TF_VAR_worker_gpu_ad"}, ""))
+	setIfNotEmpty(vars, "worker_gpu_ad", firstAD(envOrDefault([]string{"WORKER_GPU_AD", "TF_VAR_worker_gpu_ad"}, "")))
 	setIfNotEmpty(vars, "worker_gpu_image_custom_id", envOrDefault([]string{"WORKER_GPU_IMAGE_CUSTOM_ID", "TF_VAR_worker_gpu_image_custom_id"}, ""))
+	setIfNotEmpty(vars, "worker_rdma_ad", firstAD(envOrDefault([]string{"WORKER_RDMA_AD", "TF_VAR_worker_rdma_ad"}, "")))
+	setIfNotEmpty(vars, "worker_gmc_ad", firstAD(envOrDefault([]string{"WORKER_GMC_AD", "TF_VAR_worker_gmc_ad"}, "")))
 	if opts.includeDefaults {
 		vars["create_bastion"] = false
 		vars["create_fss"] = false
@@ -93,21 +107,22 @@ func baseVars(t *testing.T, opts baseVarsOptions) map[string]interface{} {
 	return vars
 }
 
-func newTerraformOptions(t *testing.T, overrides map[string]interface{}) *terraform.Options {
+func newTerraformOptions(t terratesting.TestingT, overrides map[string]interface{}) *terraform.Options {
 	t.Helper()
 
 	varFiles := varFilesFromEnv()
+	// Replayed cassettes never reach OCI, so credentials are optional there.
 	baseOptions := baseVarsOptions{
 		includeDefaults:      len(varFiles) == 0,
-		allowMissingRequired: len(varFiles) > 0,
+		allowMissingRequired: len(varFiles) > 0 || cassetteMode() == cassetteReplay,
 	}
 	vars := mergeVars(baseVars(t, baseOptions), overrides)
 
-	options := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+	options := withOCIRetryableErrors(terraform.WithDefaultRetryableErrors(t, &terraform.Options{
 		TerraformDir: terraformDir(),
 		Vars:         vars,
 		NoColor:      true,
-	})
+	}))
 	options.MaxRetries = getMaxRetries()
 	options.TimeBetweenRetries = getTimeBetweenRetries()
 	if len(varFiles) > 0 {
@@ -150,6 +165,10 @@ func mergeVars(base map[string]interface{}, overrides map[string]interface{}) ma
 	return merged
 }
 
+func cassetteMode() string {
+	return os.Getenv(cassetteModeEnv)
+}
+
 func envOrDefault(keys []string, fallback string) string {
 	for _, key := range keys {
 		if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
@@ -159,7 +178,7 @@ func envOrDefault(keys []string, fallback string) string {
 	return fallback
 }
 
-func requireAnyEnv(t *testing.T, keys ...string) string {
+func requireAnyEnv(t terratesting.TestingT, keys ...string) string {
 	t.Helper()
 	for _, key := range keys {
 		if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
@@ -170,7 +189,7 @@ func requireAnyEnv(t *testing.T, keys ...string) string {
 	return ""
 }
 
-func loadSSHPublicKey(t *testing.T, required bool) string {
+func loadSSHPublicKey(t terratesting.TestingT, required bool) string {
 	t.Helper()
 
 	if key := envOrDefault([]string{"SSH_PUBLIC_KEY", "TF_VAR_ssh_public_key"}, ""); key != "" {
@@ -203,24 +222,43 @@ func requireStateHasPrefix(t *testing.T, resources []string, prefix string) {
 
 func skipUnlessEnv(t *testing.T, key string) {
 	t.Helper()
-	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
-	if value != "1" && value != "true" && value != "yes" {
+	if !envFlagEnabled(key) {
 		t.Skipf("missing required flag %s=1 to run this test", key)
 	}
 }
 
-func uniqueName(base string) string {
-	return fmt.Sprintf("%s-%s", base, strings.ToLower(random.UniqueId()))
+// envFlagEnabled reports whether a boolean-style flag env var (1/true/yes) is set.
+func envFlagEnabled(key string) bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	return value == "1" || value == "true" || value == "yes"
 }
 
-func terraformStateList(t *testing.T, options *terraform.Options) []string {
-	t.Helper()
+// splitADs parses a comma-separated AD list such as WORKER_GPU_AD="AD-1,AD-2".
+func splitADs(value string) []string {
+	var ads []string
+	for _, ad := range strings.Split(value, ",") {
+		if ad = strings.TrimSpace(ad); ad != "" {
+			ads = append(ads, ad)
+		}
+	}
+	return ads
+}
 
-	out, err := terraform.RunTerraformCommandAndGetStdoutE(t, options, "state", "list")
-	if err != nil {
-		t.Fatalf("failed to list terraform state: %v", err)
+// firstAD returns the first AD of a comma-separated list; the rest are
+// capacity fallbacks.
+func firstAD(value string) string {
+	if ads := splitADs(value); len(ads) > 0 {
+		return ads[0]
 	}
+	return ""
+}
+
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s-%s", base, strings.ToLower(random.UniqueId()))
+}
 
+// parseStateList splits `terraform state list` output into resource addresses.
+func parseStateList(out string) []string {
 	lines := strings.Split(strings.TrimSpace(out), "\n")
 	var resources []string
 	for _, line := range lines {
@@ -271,7 +309,7 @@ func setIfNotEmpty(vars map[string]interface{}, key, value string) {
 
 // optionalOutput reads a terraform output that may be null or missing.
 // Terratest's OutputE renders null JSON values as the literal string "<nil>".
-func optionalOutput(t *testing.T, options *terraform.Options, key string) string {
+func optionalOutput(t terratesting.TestingT, options *terraform.Options, key string) string {
 	t.Helper()
 	val, err := terraform.OutputE(t, options, key)
 	if err != nil || val == "<nil>" {
@@ -291,8 +329,15 @@ func isValidOCID(s string) bool {
 // working directory and don't race on terraform init lock files.
 func copyTerraformToTemp(t *testing.T) string {
 	t.Helper()
-	src := terraformDir()
 	dst := t.TempDir()
+	copyTerraformTo(t, dst)
+	return dst
+}
+
+// copyTerraformTo copies the terraform directory to dst, excluding .terraform/.
+func copyTerraformTo(t terratesting.TestingT, dst string) {
+	t.Helper()
+	src := terraformDir()
 	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -311,9 +356,8 @@ func copyTerraformToTemp(t *testing.T) string {
 		return copyFile(path, target)
 	})
 	if err != nil {
-		t.Fatalf("failed to copy terraform dir to temp: %v", err)
+		t.Fatalf("failed to copy terraform dir to %s: %v", dst, err)
 	}
-	return dst
 }
 
 func copyFile(src, dst string) error {
@@ -0,0 +1,373 @@
+// Package images loads docs/worker-node-images.json, the catalog of
+// recommended worker node images per shape, and checks live nodes against it.
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+)
+
+// SchemaVersion is the catalog schema this package understands.
+const SchemaVersion = 1
+
+// Node labels the compliance check reads. The NVIDIA GPU Operator's GPU
+// Feature Discovery sets the driver labels; older releases only set the
+// second one.
+const (
+	InstanceTypeLabel = "node.kubernetes.io/instance-type"
+	nvidiaDriverLabel = "nvidia.com/cuda.driver-version.major"
+	legacyDriverLabel = "nvidia.com/cuda.driver.major"
+)
+
+// Image is one published worker node image.
+type Image struct {
+	Shapes      []string `json:"shapes"`
+	OS          string   `json:"os"`
+	OSVersion   string   `json:"os_version"`
+	Kernel      string   `json:"kernel"`
+	Arch        string   `json:"arch"`
+	Vendor      string   `json:"vendor"`
+	GPUDriver   string   `json:"gpu_driver"`
+	CUDA        string   `json:"cuda"`
+	Name        string   `json:"name"`
+	ReleaseDate string   `json:"release_date"`
+	URL         string   `json:"url"`
+}
+
+// Catalog is the content of worker-node-images.json. Images are kept in file
+// order, which is the order worker-node-images.md lists them in.
+type Catalog struct {
+	SchemaVersion int     `json:"schema_version"`
+	Updated       string  `json:"updated"`
+	Images        []Image `json:"images"`
+}
+
+// Load reads and validates the catalog at path.
+func Load(path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return catalog, nil
+}
+
+// Parse decodes and validates a catalog. Unknown fields are rejected so a
+// schema change has to come with a SchemaVersion bump here.
+func Parse(data []byte) (*Catalog, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var catalog Catalog
+	if err := decoder.Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode image catalog: %w", err)
+	}
+	if err := catalog.Validate(); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// Validate reports every schema problem in the catalog. A shape may appear only
+// once per OS release, architecture and kernel, and every URL must be https.
+func (c *Catalog) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+
+	if c.SchemaVersion != SchemaVersion {
+		fail("schema_version %d is not supported, want %d", c.SchemaVersion, SchemaVersion)
+	}
+	if _, err := time.Parse(time.DateOnly, c.Updated); err != nil {
+		fail("updated %q is not a YYYY-MM-DD date", c.Updated)
+	}
+	if len(c.Images) == 0 {
+		fail("no images")
+	}
+
+	seenNames := map[string]bool{}
+	seenShapes := map[string]bool{}
+	for i, image := range c.Images {
+		where := fmt.Sprintf("images[%d]", i)
+		if image.Name != "" {
+			where += " (" + image.Name + ")"
+		}
+		for field, value := range map[string]string{
+			"os": image.OS, "os_version": image.OSVersion, "kernel": image.Kernel,
+			"gpu_driver": image.GPUDriver, "name": image.Name,
+		} {
+			if strings.TrimSpace(value) == "" {
+				fail("%s: %s is empty", where, field)
+			}
+		}
+		if image.Arch != "x86_64" && image.Arch != "aarch64" {
+			fail("%s: arch %q is not x86_64 or aarch64", where, image.Arch)
+		}
+		switch image.Vendor {
+		case "nvidia":
+			if image.CUDA == "" {
+				fail("%s: cuda is empty", where)
+			}
+		case "amd":
+		default:
+			fail("%s: vendor %q is not nvidia or amd", where, image.Vendor)
+		}
+		if _, err := time.Parse(time.DateOnly, image.ReleaseDate); err != nil {
+			fail("%s: release_date %q is not a YYYY-MM-DD date", where, image.ReleaseDate)
+		}
+		if u, err := url.Parse(image.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			fail("%s: url %q is not an https URL", where, image.URL)
+		}
+		if image.Name != "" && seenNames[image.Name] {
+			fail("%s: name is listed twice", where)
+		}
+		seenNames[image.Name] = true
+
+		if len(image.Shapes) == 0 {
+			fail("%s: shapes is empty", where)
+		}
+		for _, shape := range image.Shapes {
+			key := strings.Join([]string{shape, image.OS, image.OSVersion, image.Arch, image.Kernel}, "\x00")
+			if seenShapes[key] {
+				fail("%s: %s is listed twice for %s", where, shape, image.release())
+			}
+			seenShapes[key] = true
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (i Image) release() string {
+	return fmt.Sprintf("%s %s %s kernel %s", i.OS, i.OSVersion, i.Arch, i.Kernel)
+}
+
+// Supports reports whether the image is published for shape.
+func (i Image) Supports(shape string) bool {
+	return slices.Contains(i.Shapes, shape)
+}
+
+// ForShape returns the images published for shape, in catalog order.
+func (c *Catalog) ForShape(shape string) []Image {
+	var images []Image
+	for _, image := range c.Images {
+		if image.Supports(shape) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// Recommended returns the image for shape on osName osVersion, such as
+// "Ubuntu" "24.04". With an empty kernel it returns the first kernel listed,
+// the one worker-node-images.md puts first.
+func (c *Catalog) Recommended(shape, osName, osVersion, kernel string) (Image, bool) {
+	for _, image := range c.ForShape(shape) {
+		if image.OS == osName && image.OSVersion == osVersion && (kernel == "" || image.Kernel == kernel) {
+			return image, true
+		}
+	}
+	return Image{}, false
+}
+
+// NodeProblems compares a node's OS image, kernel and GPU driver with the
+// images published for its shape. ok is false when the node's shape has no
+// published image, such as CPU-only shapes, and the node was not checked. The
+// driver is only compared on NVIDIA nodes that carry the GPU Feature Discovery
+// labels; AMD nodes do not advertise their ROCm version.
+func (c *Catalog) NodeProblems(node corev1.Node) (problems []string, ok bool) {
+	shape := node.Labels[InstanceTypeLabel]
+	candidates := c.ForShape(shape)
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	info := node.Status.NodeInfo
+	arch := map[string]string{"amd64": "x86_64", "arm64": "aarch64"}[info.Architecture]
+	var releases []string
+	var sameOS []Image
+	for _, image := range candidates {
+		if release := image.OS + " " + image.OSVersion; !slices.Contains(releases, release) {
+			releases = append(releases, release)
+		}
+		if image.Arch == arch && osMatches(info.OSImage, image) {
+			sameOS = append(sameOS, image)
+		}
+	}
+	if len(sameOS) == 0 {
+		return []string{fmt.Sprintf("OS %q (%s) has no recommended image, want one of %s", info.OSImage, info.Architecture, strings.Join(releases, ", "))}, true
+	}
+
+	// Compare the driver with the image for the node's kernel, or with every
+	// image for its OS when the kernel is not recommended either.
+	var kernels []string
+	matched := sameOS
+	for _, image := range sameOS {
+		kernels = append(kernels, image.Kernel)
+		if kernelMatches(info.KernelVersion, image.Kernel) {
+			matched = []Image{image}
+		}
+	}
+	if !kernelMatches(info.KernelVersion, matched[0].Kernel) {
+		problems = append(problems, fmt.Sprintf("kernel %s is not a recommended kernel (%s)", info.KernelVersion, strings.Join(kernels, ", ")))
+	}
+
+	driver := node.Labels[nvidiaDriverLabel]
+	if driver == "" {
+		driver = node.Labels[legacyDriverLabel]
+	}
+	if driver != "" && matched[0].Vendor == "nvidia" {
+		var drivers []string
+		for _, image := range matched {
+			if !slices.Contains(drivers, image.GPUDriver) {
+				drivers = append(drivers, image.GPUDriver)
+			}
+		}
+		if !slices.Contains(drivers, driver) {
+			problems = append(problems, fmt.Sprintf("GPU driver %s is not the recommended %s", driver, strings.Join(drivers, ", ")))
+		}
+	}
+	return problems, true
+}
+
+// osMatches reports whether a node OS image such as "Ubuntu 24.04.2 LTS" is
+// the image's OS release.
+func osMatches(osImage string, image Image) bool {
+	rest, ok := strings.CutPrefix(osImage, image.OS+" "+image.OSVersion)
+	return ok && (rest == "" || rest[0] == '.' || rest[0] == ' ')
+}
+
+// kernelMatches reports whether a node kernel such as "6.8.0-1029-oracle" is
+// the image kernel series "6.8".
+func kernelMatches(nodeKernel, series string) bool {
+	rest, ok := strings.CutPrefix(nodeKernel, series)
+	return ok && (rest == "" || rest[0] == '.' || rest[0] == '-')
+}
+
+// ComplianceCheck fails when a node whose shape has published images is not
+// running one of them.
+func ComplianceCheck(c *Catalog) health.Check {
+	return health.CheckFunc{CheckName: "worker-images", Fn: func(ctx context.Context, client kubernetes.Interface) (health.Result, error) {
+		nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return health.Result{}, fmt.Errorf("failed to list nodes: %w", err)
+		}
+		var details []string
+		checked := 0
+		for _, node := range nodes.Items {
+			problems, ok := c.NodeProblems(node)
+			if !ok {
+				continue
+			}
+			checked++
+			if len(problems) > 0 {
+				details = append(details, fmt.Sprintf("%s (%s): %s", node.Name, node.Labels[InstanceTypeLabel], strings.Join(problems, "; ")))
+			}
+		}
+		if len(details) == 0 {
+			return health.Result{Status: health.Pass, Message: fmt.Sprintf("%d GPU node(s) run recommended images", checked)}, nil
+		}
+		return health.Result{
+			Status:  health.Fail,
+			Message: fmt.Sprintf("%d of %d GPU node(s) do not run a recommended image", len(details), checked),
+			Details: details,
+		}, nil
+	}}
+}
+
+var (
+	shapesHeading  = regexp.MustCompile(`^## (.+)$`)
+	osHeading      = regexp.MustCompile(`^### (\S+) (\S+)$`)
+	kernelHeading  = regexp.MustCompile(`^#### (\S+) Kernel$`)
+	imageLink      = regexp.MustCompile(`^- \[([^\]]+)\]\(([^)]+)\)$`)
+	headingOrImage = regexp.MustCompile(`^(#{2,4} |- \[)`)
+)
+
+// CheckMarkdown reports where worker-node-images.md, which lists the images as
+// "## <shapes>", "### <OS> <version>", "#### <kernel> Kernel" and one link per
+// image, disagrees with the catalog.
+func (c *Catalog) CheckMarkdown(data []byte) error {
+	var listed []Image
+	var errs []error
+	var shapes []string
+	var osName, osVersion, kernel string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case !headingOrImage.MatchString(text):
+		case kernelHeading.MatchString(text):
+			kernel = kernelHeading.FindStringSubmatch(text)[1]
+		case osHeading.MatchString(text):
+			m := osHeading.FindStringSubmatch(text)
+			osName, osVersion, kernel = m[1], m[2], ""
+		case shapesHeading.MatchString(text):
+			shapes = strings.Split(shapesHeading.FindStringSubmatch(text)[1], ", ")
+			osName, osVersion, kernel = "", "", ""
+		case imageLink.MatchString(text):
+			m := imageLink.FindStringSubmatch(text)
+			if shapes == nil || kernel == "" {
+				errs = append(errs, fmt.Errorf("line %d: image link outside a shape, OS and kernel section", line))
+				continue
+			}
+			listed = append(listed, Image{Shapes: shapes, OS: osName, OSVersion: osVersion, Kernel: kernel, URL: m[2], Name: m[1]})
+		default:
+			errs = append(errs, fmt.Errorf("line %d: unexpected %q", line, text))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i, image := range c.Images {
+		j := slices.IndexFunc(listed, func(l Image) bool { return l.URL == image.URL })
+		if j < 0 {
+			errs = append(errs, fmt.Errorf("%s is not linked in the markdown", image.Name))
+			continue
+		}
+		doc := listed[j]
+		if j != i {
+			errs = append(errs, fmt.Errorf("%s is image %d in the markdown, want %d", image.Name, j+1, i+1))
+		}
+		if !slices.Equal(doc.Shapes, image.Shapes) {
+			errs = append(errs, fmt.Errorf("%s is listed under %s, want %s", image.Name, strings.Join(doc.Shapes, ", "), strings.Join(image.Shapes, ", ")))
+		}
+		if doc.OS != image.OS || doc.OSVersion != image.OSVersion || doc.Kernel != image.Kernel {
+			errs = append(errs, fmt.Errorf("%s is listed under %s %s kernel %s, want %s %s kernel %s", image.Name, doc.OS, doc.OSVersion, doc.Kernel, image.OS, image.OSVersion, image.Kernel))
+		}
+		if label := image.linkLabel(); doc.Name != label {
+			errs = append(errs, fmt.Errorf("%s is labeled %q, want %q", image.Name, doc.Name, label))
+		}
+	}
+	for _, doc := range listed {
+		if !slices.ContainsFunc(c.Images, func(image Image) bool { return image.URL == doc.URL }) {
+			errs = append(errs, fmt.Errorf("markdown links %s, which is not in the catalog", doc.URL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// linkLabel is how worker-node-images.md names the image's driver stack.
+func (i Image) linkLabel() string {
+	if i.Vendor == "amd" {
+		return "ROCm " + i.GPUDriver
+	}
+	return fmt.Sprintf("GPU driver %s & CUDA %s", i.GPUDriver, i.CUDA)
+}
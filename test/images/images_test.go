@@ -0,0 +1,258 @@
+package images
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+)
+
+var (
+	catalogPath  = filepath.Join("..", "..", "docs", "worker-node-images.json")
+	markdownPath = filepath.Join("..", "..", "docs", "worker-node-images.md")
+)
+
+const validCatalog = `{
+  "schema_version": 1,
+  "updated": "2026-07-14",
+  "images": [
+    {"shapes": ["BM.GPU.H100.8", "BM.GPU.H200.8"], "os": "Ubuntu", "os_version": "24.04", "kernel": "6.8", "arch": "x86_64", "vendor": "nvidia", "gpu_driver": "595", "cuda": "13.2", "name": "ubuntu-24.04-6.8-gpu-595", "release_date": "2026-07-13", "url": "https://objectstorage.example.com/ubuntu-24.04-6.8-gpu-595.oci"},
+    {"shapes": ["BM.GPU.H100.8", "BM.GPU.H200.8"], "os": "Ubuntu", "os_version": "24.04", "kernel": "6.14", "arch": "x86_64", "vendor": "nvidia", "gpu_driver": "595", "cuda": "13.2", "name": "ubuntu-24.04-6.14-gpu-595", "release_date": "2026-07-13", "url": "https://objectstorage.example.com/ubuntu-24.04-6.14-gpu-595.oci"},
+    {"shapes": ["BM.GPU.H100.8"], "os": "Ubuntu", "os_version": "22.04", "kernel": "6.8", "arch": "x86_64", "vendor": "nvidia", "gpu_driver": "580", "cuda": "13.0", "name": "ubuntu-22.04-6.8-gpu-580", "release_date": "2026-07-13", "url": "https://objectstorage.example.com/ubuntu-22.04-6.8-gpu-580.oci"},
+    {"shapes": ["BM.GPU.MI300X.8"], "os": "Ubuntu", "os_version": "24.04", "kernel": "6.8", "arch": "x86_64", "vendor": "amd", "gpu_driver": "7.2.4", "cuda": null, "name": "ubuntu-24.04-6.8-rocm-724", "release_date": "2026-07-13", "url": "https://objectstorage.example.com/ubuntu-24.04-6.8-rocm-724.oci"}
+  ]
+}`
+
+func parseValid(t *testing.T) *Catalog {
+	t.Helper()
+	catalog, err := Parse([]byte(validCatalog))
+	require.NoError(t, err)
+	return catalog
+}
+
+func TestRepositoryCatalogIsValid(t *testing.T) {
+	catalog, err := Load(catalogPath)
+	require.NoError(t, err)
+	require.NotEmpty(t, catalog.ForShape("BM.GPU.H100.8"))
+}
+
+func TestRepositoryMarkdownMatchesCatalog(t *testing.T) {
+	catalog, err := Load(catalogPath)
+	require.NoError(t, err)
+	markdown, err := os.ReadFile(markdownPath)
+	require.NoError(t, err)
+	require.NoError(t, catalog.CheckMarkdown(markdown))
+}
+
+func TestParseRejectsInvalidCatalogs(t *testing.T) {
+	cases := map[string]struct {
+		edit func(string) string
+		want string
+	}{
+		"schema version": {
+			edit: func(s string) string { return strings.Replace(s, `"schema_version": 1`, `"schema_version": 2`, 1) },
+			want: "schema_version 2 is not supported, want 1",
+		},
+		"unknown field": {
+			edit: func(s string) string { return strings.Replace(s, `"updated"`, `"driver": "595", "updated"`, 1) },
+			want: `json: unknown field "driver"`,
+		},
+		"duplicate shape": {
+			edit: func(s string) string {
+				return strings.Replace(s, `"kernel": "6.14"`, `"kernel": "6.8"`, 1)
+			},
+			want: "images[1] (ubuntu-24.04-6.14-gpu-595): BM.GPU.H100.8 is listed twice for Ubuntu 24.04 x86_64 kernel 6.8",
+		},
+		"http url": {
+			edit: func(s string) string {
+				return strings.Replace(s, "https://objectstorage.example.com/ubuntu-22.04", "http://objectstorage.example.com/ubuntu-22.04", 1)
+			},
+			want: `images[2] (ubuntu-22.04-6.8-gpu-580): url "http://objectstorage.example.com/ubuntu-22.04-6.8-gpu-580.oci" is not an https URL`,
+		},
+		"nvidia without cuda": {
+			edit: func(s string) string { return strings.Replace(s, `"cuda": "13.0"`, `"cuda": null`, 1) },
+			want: "images[2] (ubuntu-22.04-6.8-gpu-580): cuda is empty",
+		},
+		"unknown arch": {
+			edit: func(s string) string {
+				return strings.Replace(s, `"arch": "x86_64", "vendor": "amd"`, `"arch": "amd64", "vendor": "amd"`, 1)
+			},
+			want: `images[3] (ubuntu-24.04-6.8-rocm-724): arch "amd64" is not x86_64 or aarch64`,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.edit(validCatalog)))
+			require.ErrorContains(t, err, tc.want)
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	catalog := parseValid(t)
+	catalog.Images[0].URL = "ftp://example.com/image.oci"
+	catalog.Images[1].Name = catalog.Images[0].Name
+	catalog.Images[3].Shapes = nil
+
+	err := catalog.Validate()
+	require.ErrorContains(t, err, "images[0] (ubuntu-24.04-6.8-gpu-595): url")
+	require.ErrorContains(t, err, "images[1] (ubuntu-24.04-6.8-gpu-595): name is listed twice")
+	require.ErrorContains(t, err, "images[3] (ubuntu-24.04-6.8-rocm-724): shapes is empty")
+}
+
+func TestRecommended(t *testing.T) {
+	catalog := parseValid(t)
+
+	image, ok := catalog.Recommended("BM.GPU.H200.8", "Ubuntu", "24.04", "")
+	require.True(t, ok)
+	require.Equal(t, "ubuntu-24.04-6.8-gpu-595", image.Name, "the first kernel listed is the default")
+
+	image, ok = catalog.Recommended("BM.GPU.H200.8", "Ubuntu", "24.04", "6.14")
+	require.True(t, ok)
+	require.Equal(t, "ubuntu-24.04-6.14-gpu-595", image.Name)
+
+	_, ok = catalog.Recommended("BM.GPU.H200.8", "Ubuntu", "22.04", "")
+	require.False(t, ok)
+	_, ok = catalog.Recommended("VM.Standard.E5.Flex", "Ubuntu", "24.04", "")
+	require.False(t, ok)
+}
+
+func gpuNode(name, shape, osImage, kernel, arch string, labels map[string]string) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{InstanceTypeLabel: shape}},
+		Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{
+			OSImage: osImage, KernelVersion: kernel, Architecture: arch,
+		}},
+	}
+	for key, value := range labels {
+		node.Labels[key] = value
+	}
+	return node
+}
+
+func TestNodeProblems(t *testing.T) {
+	catalog := parseValid(t)
+	driver := func(version string) map[string]string { return map[string]string{nvidiaDriverLabel: version} }
+
+	cases := map[string]struct {
+		node    *corev1.Node
+		want    []string
+		checked bool
+	}{
+		"recommended": {
+			node:    gpuNode("a", "BM.GPU.H100.8", "Ubuntu 24.04.2 LTS", "6.14.0-1011-oracle", "amd64", driver("595")),
+			checked: true,
+		},
+		"legacy driver label": {
+			node:    gpuNode("b", "BM.GPU.H100.8", "Ubuntu 22.04.5 LTS", "6.8.0-1029-oracle", "amd64", map[string]string{legacyDriverLabel: "580"}),
+			checked: true,
+		},
+		"unlisted shape": {
+			node: gpuNode("c", "VM.Standard.E5.Flex", "Oracle Linux Server 8.10", "5.15.0", "amd64", nil),
+		},
+		"unlisted os": {
+			node:    gpuNode("d", "BM.GPU.H200.8", "Ubuntu 22.04.5 LTS", "6.8.0-1029-oracle", "amd64", nil),
+			want:    []string{`OS "Ubuntu 22.04.5 LTS" (amd64) has no recommended image, want one of Ubuntu 24.04`},
+			checked: true,
+		},
+		"wrong arch": {
+			node:    gpuNode("e", "BM.GPU.H200.8", "Ubuntu 24.04.2 LTS", "6.8.0-1029-oracle", "arm64", nil),
+			want:    []string{`OS "Ubuntu 24.04.2 LTS" (arm64) has no recommended image, want one of Ubuntu 24.04`},
+			checked: true,
+		},
+		"kernel and driver": {
+			node: gpuNode("f", "BM.GPU.H100.8", "Ubuntu 24.04.2 LTS", "6.11.0-1001-oracle", "amd64", driver("580")),
+			want: []string{
+				"kernel 6.11.0-1001-oracle is not a recommended kernel (6.8, 6.14)",
+				"GPU driver 580 is not the recommended 595",
+			},
+			checked: true,
+		},
+		"similar kernel series": {
+			node:    gpuNode("g", "BM.GPU.H100.8", "Ubuntu 24.04.2 LTS", "6.80.0-1", "amd64", nil),
+			want:    []string{"kernel 6.80.0-1 is not a recommended kernel (6.8, 6.14)"},
+			checked: true,
+		},
+		"amd driver is not compared": {
+			node:    gpuNode("h", "BM.GPU.MI300X.8", "Ubuntu 24.04.2 LTS", "6.8.0-1029-oracle", "amd64", driver("595")),
+			checked: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			problems, checked := catalog.NodeProblems(*tc.node)
+			require.Equal(t, tc.checked, checked)
+			require.Equal(t, tc.want, problems)
+		})
+	}
+}
+
+func TestComplianceCheck(t *testing.T) {
+	catalog := parseValid(t)
+	client := fake.NewClientset(
+		gpuNode("10.0.1.2", "BM.GPU.H100.8", "Ubuntu 24.04.2 LTS", "6.8.0-1029-oracle", "amd64", nil),
+		gpuNode("10.0.1.3", "BM.GPU.H100.8", "Ubuntu 24.04.2 LTS", "6.8.0-1029-oracle", "amd64", map[string]string{nvidiaDriverLabel: "570"}),
+		gpuNode("10.0.1.4", "VM.Standard.E5.Flex", "Oracle Linux Server 8.10", "5.15.0", "amd64", nil),
+	)
+
+	result, err := ComplianceCheck(catalog).Run(context.Background(), client)
+	require.NoError(t, err)
+	require.Equal(t, health.Result{
+		Check:   "worker-images",
+		Status:  health.Fail,
+		Message: "1 of 2 GPU node(s) do not run a recommended image",
+		Details: []string{"10.0.1.3 (BM.GPU.H100.8): GPU driver 570 is not the recommended 595"},
+	}, result)
+
+	require.NoError(t, client.CoreV1().Nodes().Delete(context.Background(), "10.0.1.3", metav1.DeleteOptions{}))
+	result, err = ComplianceCheck(catalog).Run(context.Background(), client)
+	require.NoError(t, err)
+	require.Equal(t, health.Pass, result.Status)
+	require.Equal(t, "1 GPU node(s) run recommended images", result.Message)
+}
+
+func TestCheckMarkdownReportsDrift(t *testing.T) {
+	catalog := parseValid(t)
+	markdown := `# Images
+
+> [!TIP]
+> See [worker-node-images.json](./worker-node-images.json).
+
+## BM.GPU.H100.8, BM.GPU.H200.8
+
+### Ubuntu 24.04
+
+#### 6.8 Kernel
+
+- [GPU driver 595 & CUDA 13.2](https://objectstorage.example.com/ubuntu-24.04-6.8-gpu-595.oci)
+
+#### 6.14 Kernel
+
+- [GPU driver 580 & CUDA 13.2](https://objectstorage.example.com/ubuntu-24.04-6.14-gpu-595.oci)
+
+## BM.GPU.H100.8
+
+### Ubuntu 22.04
+
+#### 6.14 Kernel
+
+- [GPU driver 580 & CUDA 13.0](https://objectstorage.example.com/ubuntu-22.04-6.8-gpu-580.oci)
+- [GPU driver 570 & CUDA 12.8](https://objectstorage.example.com/ubuntu-22.04-6.8-gpu-570.oci)
+`
+	err := catalog.CheckMarkdown([]byte(markdown))
+	require.Error(t, err)
+	require.Equal(t, []string{
+		`ubuntu-24.04-6.14-gpu-595 is labeled "GPU driver 580 & CUDA 13.2", want "GPU driver 595 & CUDA 13.2"`,
+		"ubuntu-22.04-6.8-gpu-580 is listed under Ubuntu 22.04 kernel 6.14, want Ubuntu 22.04 kernel 6.8",
+		"ubuntu-24.04-6.8-rocm-724 is not linked in the markdown",
+		"markdown links https://objectstorage.example.com/ubuntu-22.04-6.8-gpu-570.oci, which is not in the catalog",
+	}, strings.Split(err.Error(), "\n"))
+}
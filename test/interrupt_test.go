@@ -0,0 +1,353 @@
+package test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+	"github.com/stretchr/testify/require"
+)
+
+const defaultDestroyBudget = 45 * time.Minute
+
+// harnessContext is cancelled when the run is interrupted or about to hit the
+// go test deadline. An in-flight terraform apply gets SIGINT (see
+// applyGracefully) and saves what it created to state before teardown starts.
+var harnessContext, cancelHarness = context.WithCancel(context.Background())
+
+// applyWait bounds how long teardown waits for an interrupted apply to save
+// its state.
+const applyWait = 20 * time.Minute
+
+// applies is read-locked while a terraform apply runs, so teardown can wait
+// for interrupted applies to return before it destroys.
+var applies sync.RWMutex
+
+// activeStages holds every cluster that has started setup and not finished
+// teardown; the interrupt watchdog tears these down. tracked is signalled
+// whenever a cluster is added.
+var activeStages = struct {
+	sync.Mutex
+	stages  map[*clusterStages]struct{}
+	tracked chan struct{}
+}{stages: map[*clusterStages]struct{}{}, tracked: make(chan struct{}, 1)}
+
+func trackStages(s *clusterStages) {
+	activeStages.Lock()
+	defer activeStages.Unlock()
+	activeStages.stages[s] = struct{}{}
+	select {
+	case activeStages.tracked <- struct{}{}:
+	default:
+	}
+}
+
+func hasActiveStages() bool {
+	activeStages.Lock()
+	defer activeStages.Unlock()
+	return len(activeStages.stages) > 0
+}
+
+func untrackStages(s *clusterStages) {
+	activeStages.Lock()
+	defer activeStages.Unlock()
+	delete(activeStages.stages, s)
+}
+
+// destroyBudget bounds each terraform destroy. Configurable via DESTROY_TIMEOUT
+// (a Go duration such as 45m).
+func destroyBudget() time.Duration {
+	if val := os.Getenv("DESTROY_TIMEOUT"); val != "" {
+		if budget, err := time.ParseDuration(val); err == nil && budget > 0 {
+			return budget
+		}
+	}
+	return defaultDestroyBudget
+}
+
+// testTimeout returns the -test.timeout value, or zero if there is none.
+func testTimeout() time.Duration {
+	f := flag.Lookup("test.timeout")
+	if f == nil {
+		return 0
+	}
+	if getter, ok := f.Value.(flag.Getter); ok {
+		if timeout, ok := getter.Get().(time.Duration); ok {
+			return timeout
+		}
+	}
+	return 0
+}
+
+// interruptDeadline is how long after start the watchdog begins teardown so
+// destroy can finish before go test panics. ok is false when the budget does
+// not fit in the timeout.
+func interruptDeadline(timeout, budget time.Duration) (deadline time.Duration, ok bool) {
+	if budget >= timeout {
+		return 0, false
+	}
+	return timeout - budget, true
+}
+
+// watchForInterrupts tears down active clusters and exits when the process
+// receives SIGINT/SIGTERM, or when the go test deadline is near and a cluster
+// is tracked. The deadline timer only runs while clusters are tracked; runs
+// without clusters end on their own. The returned func stops the watchdog.
+func watchForInterrupts(timeout time.Duration) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var deadlineAt time.Time
+	var noDeadline func()
+	if timeout > 0 {
+		if after, ok := interruptDeadline(timeout, destroyBudget()); ok {
+			deadlineAt = time.Now().Add(after)
+		} else {
+			// go test always passes -test.timeout, so warn only once a
+			// cluster is up and the missing deadline matters.
+			noDeadline = func() {
+				fmt.Fprintf(os.Stderr, "warning: destroy budget %s does not fit in go test -timeout %s; clusters are only torn down on SIGINT/SIGTERM\n",
+					destroyBudget(), timeout)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	go watchdog(signals, activeStages.tracked, deadlineAt, stop, noDeadline, func(reason string) {
+		os.Exit(teardownActiveStages(reason))
+	})
+
+	return func() {
+		signal.Stop(signals)
+		close(stop)
+	}
+}
+
+// watchdog calls interrupt on a signal, or at deadlineAt if a cluster is
+// tracked then. The deadline timer starts when tracked fires, and a deadline
+// that passes with nothing tracked waits for the next cluster. A zero
+// deadlineAt disables the deadline; noDeadline, if set, is then called the
+// first time a cluster is tracked.
+func watchdog(signals <-chan os.Signal, tracked <-chan struct{}, deadlineAt time.Time, stop <-chan struct{}, noDeadline func(), interrupt func(reason string)) {
+	var deadline <-chan time.Time
+	for {
+		select {
+		case sig := <-signals:
+			interrupt(fmt.Sprintf("received %s", sig))
+			return
+		case <-tracked:
+			if deadlineAt.IsZero() && noDeadline != nil {
+				noDeadline()
+				noDeadline = nil
+			}
+			if !deadlineAt.IsZero() && deadline == nil {
+				deadline = time.After(time.Until(deadlineAt))
+			}
+		case <-deadline:
+			deadline = nil
+			if hasActiveStages() {
+				interrupt(fmt.Sprintf("go test deadline is near (destroy budget %s)", destroyBudget()))
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// waitForApplies waits up to limit for every running terraform apply to
+// return, and reports whether they did.
+func waitForApplies(limit time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		applies.Lock()
+		defer applies.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(limit):
+		return false
+	}
+}
+
+// teardownActiveStages interrupts in-flight terraform applies, waits for them
+// to save state, and tears down every tracked cluster. It always returns a
+// failing exit code.
+func teardownActiveStages(reason string) int {
+	cancelHarness()
+	if !waitForApplies(applyWait) {
+		fmt.Fprintf(os.Stderr, "%s: terraform apply still running after %s; destroying what state has so far\n", reason, applyWait)
+	}
+
+	activeStages.Lock()
+	stages := make([]*clusterStages, 0, len(activeStages.stages))
+	for s := range activeStages.stages {
+		stages = append(stages, s)
+	}
+	activeStages.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s: tearing down %d active cluster(s)\n", reason, len(stages))
+	for _, s := range stages {
+		if err := runFixtureStage("interrupt-teardown", func(t *fixtureT) {
+			s.runTeardown(t)
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "teardown of %s failed: %v\n", s.workDir, err)
+		}
+	}
+	return 1
+}
+
+// orphanRoot holds work directories whose destroy failed or never ran.
+func orphanRoot() string {
+	return filepath.Join(stageWorkRoot(), "orphans")
+}
+
+// orphanDestroyCommand is the one-line command that destroys an orphaned work
+// directory through TestCleanupOrphans.
+func orphanDestroyCommand(dir string) string {
+	testDir, err := os.Getwd()
+	if err != nil {
+		testDir = "test"
+	}
+	return fmt.Sprintf("cd %s && RUN_CLEANUP=1 ORPHAN_DIR=%s go test -count=1 ./... -run '^TestCleanupOrphans$' -timeout 2h", testDir, dir)
+}
+
+// findOrphanDirs lists the work directories under root that still hold saved
+// terraform options.
+func findOrphanDirs(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if _, err := os.Stat(test_structure.FormatTestDataPath(dir, "TerraformOptions.json")); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func TestInterruptDeadlineLeavesDestroyBudget(t *testing.T) {
+	deadline, ok := interruptDeadline(3*time.Hour, 45*time.Minute)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Hour+15*time.Minute, deadline)
+	_, ok = interruptDeadline(10*time.Minute, 45*time.Minute)
+	require.False(t, ok, "a budget that does not fit disables the deadline instead of halving the timeout")
+}
+
+func TestWatchdogIgnoresTheDeadlineWithoutClusters(t *testing.T) {
+	tracked := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	interrupted := make(chan string, 1)
+	go watchdog(nil, tracked, time.Now().Add(10*time.Millisecond), stop, nil, func(reason string) { interrupted <- reason })
+	defer close(stop)
+
+	select {
+	case reason := <-interrupted:
+		t.Fatalf("watchdog fired without a tracked cluster: %s", reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s := &clusterStages{}
+	activeStages.Lock()
+	activeStages.stages[s] = struct{}{}
+	activeStages.Unlock()
+	defer untrackStages(s)
+	tracked <- struct{}{}
+	select {
+	case reason := <-interrupted:
+		require.Contains(t, reason, "deadline is near")
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not tear down the cluster tracked after the deadline")
+	}
+}
+
+func TestWatchdogWarnsAboutAMissingDeadlineOnceAClusterIsTracked(t *testing.T) {
+	tracked := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	warned := make(chan struct{}, 2)
+	go watchdog(nil, tracked, time.Time{}, stop, func() { warned <- struct{}{} }, func(string) {})
+	defer close(stop)
+
+	select {
+	case <-warned:
+		t.Fatal("watchdog warned without a tracked cluster")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tracked <- struct{}{}
+	tracked <- struct{}{}
+	require.Eventually(t, func() bool { return len(warned) > 0 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, warned, 1, "the warning is printed once")
+}
+
+func TestWaitForAppliesWaitsForRunningApply(t *testing.T) {
+	require.True(t, waitForApplies(time.Second))
+
+	applies.RLock()
+	require.False(t, waitForApplies(20*time.Millisecond))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		applies.RUnlock()
+	}()
+	require.True(t, waitForApplies(time.Second))
+}
+
+// interruptibleTerraform is a terraform binary that runs until interrupted and then,
+// like terraform, writes its state before exiting.
+const interruptibleTerraform = `#!/usr/bin/env bash
+trap 'echo "Interrupt received." ; echo saved > "$STATE_FILE"; exit 1' INT
+echo started > "$STARTED_FILE"
+while true; do sleep 0.05; done
+`
+
+func TestApplyGracefullyInterruptsTerraform(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "terraform")
+	require.NoError(t, os.WriteFile(binary, []byte(interruptibleTerraform), 0755))
+	started, state := filepath.Join(dir, "started"), filepath.Join(dir, "state")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(started); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	out, err := applyGracefully(t, ctx, &terraform.Options{
+		TerraformBinary: binary,
+		TerraformDir:    dir,
+		EnvVars:         map[string]string{"STARTED_FILE": started, "STATE_FILE": state},
+	})
+	require.Error(t, err)
+	require.Contains(t, out, "Interrupt received.")
+	saved, err := os.ReadFile(state)
+	require.NoError(t, err, "terraform was killed before it could save state")
+	require.Equal(t, "saved\n", string(saved))
+}
@@ -0,0 +1,270 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/janitor"
+)
+
+// Freeform tag keys stamped on every resource a run creates. The janitor
+// (cmd/janitor) matches on runIDTagKey.
+const (
+	runIDTagKey     = janitor.RunIDTagKey
+	runCommitTagKey = "test-commit"
+	runTestTagKey   = "test-name"
+
+	// OCI rejects tag values longer than 256 characters.
+	maxTagValueLength = 256
+)
+
+var (
+	runIDOnce sync.Once
+	runID     string
+
+	runCommitOnce sync.Once
+	runCommit     string
+)
+
+// currentRunID identifies everything this go test process creates. Override
+// with TEST_RUN_ID, for example to reuse a CI job ID.
+func currentRunID() string {
+	runIDOnce.Do(func() {
+		runID = envOrDefault([]string{"TEST_RUN_ID"}, uniqueName("run"))
+	})
+	return runID
+}
+
+// currentCommit is the commit under test: the CI-provided SHA if present,
+// otherwise git rev-parse HEAD, otherwise "unknown".
+func currentCommit() string {
+	runCommitOnce.Do(func() {
+		runCommit = envOrDefault([]string{"GITHUB_SHA", "CI_COMMIT_SHA", "GIT_COMMIT"}, "")
+		if runCommit != "" {
+			return
+		}
+		out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			runCommit = "unknown"
+			return
+		}
+		runCommit = strings.TrimSpace(string(out))
+	})
+	return runCommit
+}
+
+// runTags are the freeform tags applied to every resource of one test's cluster.
+func runTags(testName string) map[string]string {
+	return map[string]string{
+		runIDTagKey:     currentRunID(),
+		runCommitTagKey: truncateTagValue(currentCommit()),
+		runTestTagKey:   truncateTagValue(testName),
+	}
+}
+
+// runDefinedTags mirrors runTags under the TEST_DEFINED_TAG_NAMESPACE tag
+// namespace. The namespace and its keys must already exist in the tenancy.
+func runDefinedTags(testName string) map[string]string {
+	namespace := os.Getenv("TEST_DEFINED_TAG_NAMESPACE")
+	if namespace == "" {
+		return nil
+	}
+	defined := map[string]string{}
+	for key, value := range runTags(testName) {
+		defined[namespace+"."+key] = value
+	}
+	return defined
+}
+
+// runIsolationVars names the cluster and VCN after the run ID, with a unique
+// suffix per suite, and tags them so parallel runs and the suites of one run
+// never collide in a compartment and can be attributed.
+func runIsolationVars(testName string) map[string]interface{} {
+	name := uniqueName("oke-" + currentRunID())
+	vars := map[string]interface{}{
+		"cluster_name":  name,
+		"vcn_name":      name,
+		"freeform_tags": runTags(testName),
+	}
+	if defined := runDefinedTags(testName); len(defined) > 0 {
+		vars["defined_tags"] = defined
+	}
+	return vars
+}
+
+func truncateTagValue(value string) string {
+	if len(value) > maxTagValueLength {
+		return value[:maxTagValueLength]
+	}
+	return value
+}
+
+// runAudit records which resources a run owns. One file per cluster is written
+// under auditDir at setup and updated at apply and teardown; a record without
+// destroyed_at points at resources that may still exist.
+type runAudit struct {
+	RunID           string            `json:"run_id"`
+	Commit          string            `json:"commit"`
+	TestName        string            `json:"test_name"`
+	Region          string            `json:"region,omitempty"`
+	CompartmentOCID string            `json:"compartment_ocid,omitempty"`
+	ClusterName     string            `json:"cluster_name"`
+	VCNName         string            `json:"vcn_name"`
+	FreeformTags    map[string]string `json:"freeform_tags"`
+	DefinedTags     map[string]string `json:"defined_tags,omitempty"`
+	WorkDir         string            `json:"work_dir"`
+	StateID         string            `json:"state_id,omitempty"`
+	ClusterID       string            `json:"cluster_id,omitempty"`
+	VCNID           string            `json:"vcn_id,omitempty"`
+	// AvailabilityDomains holds the worker_*_ad values the apply succeeded
+	// with, after any capacity fallback.
+	AvailabilityDomains map[string]string `json:"availability_domains,omitempty"`
+	StartedAt           time.Time         `json:"started_at"`
+	AppliedAt           *time.Time        `json:"applied_at,omitempty"`
+	DestroyedAt         *time.Time        `json:"destroyed_at,omitempty"`
+}
+
+// auditDir holds the run audit records. Override with TEST_AUDIT_DIR.
+func auditDir() string {
+	if dir := os.Getenv("TEST_AUDIT_DIR"); dir != "" {
+		return resolveVarFilePath(dir)
+	}
+	return filepath.Join(stageWorkRoot(), "audit")
+}
+
+var auditFileUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func runAuditPath(runID, testName string) string {
+	return filepath.Join(auditDir(), runID+"-"+auditFileUnsafe.ReplaceAllString(testName, "_")+".json")
+}
+
+// newRunAudit builds the audit record from the run variables saved in options,
+// so later stages recover the same run ID even in a separate go test process.
+func newRunAudit(options *terraform.Options, workDir string) runAudit {
+	tags := stringMap(options.Vars["freeform_tags"])
+	return runAudit{
+		RunID:           tags[runIDTagKey],
+		Commit:          tags[runCommitTagKey],
+		TestName:        tags[runTestTagKey],
+		Region:          stringVar(options.Vars, "region"),
+		CompartmentOCID: stringVar(options.Vars, "compartment_ocid"),
+		ClusterName:     stringVar(options.Vars, "cluster_name"),
+		VCNName:         stringVar(options.Vars, "vcn_name"),
+		FreeformTags:    tags,
+		DefinedTags:     stringMap(options.Vars["defined_tags"]),
+		WorkDir:         workDir,
+		StartedAt:       time.Now().UTC(),
+	}
+}
+
+// updateRunAudit applies update to the audit record for options, creating the
+// record if it does not exist yet. Failures are reported but never stop the
+// stage, so a broken audit directory cannot block a destroy.
+func updateRunAudit(t terratesting.TestingT, options *terraform.Options, workDir string, update func(*runAudit)) {
+	t.Helper()
+
+	audit := newRunAudit(options, workDir)
+	if audit.RunID == "" {
+		return
+	}
+	path := runAuditPath(audit.RunID, audit.TestName)
+	if existing, err := readRunAudit(path); err == nil {
+		audit = existing
+	} else if !os.IsNotExist(err) {
+		t.Errorf("failed to read run audit %s: %v", path, err)
+		return
+	}
+	update(&audit)
+
+	content, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		t.Errorf("failed to encode run audit: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Errorf("failed to create audit dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Errorf("failed to write run audit %s: %v", path, err)
+	}
+}
+
+func readRunAudit(path string) (runAudit, error) {
+	var audit runAudit
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return audit, err
+	}
+	err = json.Unmarshal(content, &audit)
+	return audit, err
+}
+
+// stringMap accepts both the map[string]string the harness builds and the
+// map[string]interface{} that saved options decode to.
+func stringMap(value interface{}) map[string]string {
+	result := map[string]string{}
+	switch m := value.(type) {
+	case map[string]string:
+		for key, val := range m {
+			result[key] = val
+		}
+	case map[string]interface{}:
+		for key, val := range m {
+			if s, ok := val.(string); ok {
+				result[key] = s
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func stringVar(vars map[string]interface{}, key string) string {
+	s, _ := vars[key].(string)
+	return s
+}
+
+func TestClusterStagesTagClusterWithRunID(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	t.Setenv("TEST_DEFINED_TAG_NAMESPACE", "ci")
+
+	stages := newClusterStages("TestTagged")
+	stages.setup(t, nil)
+
+	options := test_structure.LoadTerraformOptions(t, stages.workDir)
+	runID := currentRunID()
+	name := stringVar(options.Vars, "cluster_name")
+	require.Regexp(t, "^"+regexp.QuoteMeta("oke-"+runID)+"-[a-z0-9]+$", name)
+	require.Equal(t, name, options.Vars["vcn_name"])
+	require.NotEqual(t, name, runIsolationVars("TestOther")["cluster_name"], "every suite gets its own cluster name")
+	tags := stringMap(options.Vars["freeform_tags"])
+	require.Equal(t, runID, tags[runIDTagKey])
+	require.Equal(t, t.Name(), tags[runTestTagKey])
+	require.NotEmpty(t, tags[runCommitTagKey])
+	require.Equal(t, runID, stringMap(options.Vars["defined_tags"])["ci."+runIDTagKey])
+
+	audit, err := readRunAudit(runAuditPath(runID, t.Name()))
+	require.NoError(t, err)
+	require.Equal(t, runID, audit.RunID)
+	require.Equal(t, stages.workDir, audit.WorkDir)
+	require.Equal(t, name, audit.ClusterName)
+	require.Equal(t, name, audit.VCNName)
+	require.Equal(t, tags, audit.FreeformTags)
+	require.Nil(t, audit.DestroyedAt)
+}
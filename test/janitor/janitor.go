@@ -0,0 +1,242 @@
+// Package janitor finds resources left behind by test harness runs in a
+// compartment and deletes them once their run is older than a TTL.
+//
+// Runs are identified by the RunIDTagKey freeform tag the harness stamps on
+// every resource it creates. A run expires as a whole: when its oldest
+// resource passes the TTL, everything carrying its run ID is deleted, in
+// dependency order, so a cluster network is gone before its VCN is touched.
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// RunIDTagKey is the freeform tag key the harness sets to its run ID.
+const RunIDTagKey = "test-run-id"
+
+const (
+	defaultWaitTimeout  = time.Hour
+	defaultPollInterval = 15 * time.Second
+)
+
+// Kind is a resource type the janitor can list and delete.
+type Kind string
+
+const (
+	KindCluster          Kind = "cluster"
+	KindClusterNetwork   Kind = "cluster_network"
+	KindInstancePool     Kind = "instance_pool"
+	KindInstance         Kind = "instance"
+	KindBastion          Kind = "bastion"
+	KindLustreFileSystem Kind = "lustre_file_system"
+	KindMountTarget      Kind = "mount_target"
+	KindFileSystem       Kind = "file_system"
+	KindVCN              Kind = "vcn"
+)
+
+// DeletionOrder lists kinds so that nothing is deleted before the resources
+// that depend on it. Instances come after pools so pool members are
+// terminated by their pool, and the VCN comes last because every other kind
+// holds VNICs in its subnets.
+var DeletionOrder = []Kind{
+	KindCluster,
+	KindClusterNetwork,
+	KindInstancePool,
+	KindInstance,
+	KindBastion,
+	KindLustreFileSystem,
+	KindMountTarget,
+	KindFileSystem,
+	KindVCN,
+}
+
+// Resource is one tagged resource found in the compartment.
+type Resource struct {
+	Kind    Kind
+	ID      string
+	Name    string
+	RunID   string
+	Created time.Time
+	// Deleting is set for resources already being deleted; they are waited
+	// on but not deleted again.
+	Deleting bool
+
+	exportSetID           string
+	defaultRouteTableID   string
+	defaultSecurityListID string
+}
+
+// Config controls which runs are cleaned up and how.
+type Config struct {
+	CompartmentID string
+	// TTL is how old a run's oldest resource must be before the run is
+	// cleaned up. Zero selects every run.
+	TTL time.Duration
+	// RunID limits cleanup to one run.
+	RunID string
+	// Delete performs the deletion. Without it the janitor only reports what
+	// it would delete.
+	Delete bool
+
+	WaitTimeout  time.Duration
+	PollInterval time.Duration
+	Now          func() time.Time
+	Log          io.Writer
+}
+
+// Report lists what the janitor selected and what it deleted.
+type Report struct {
+	Selected []Resource
+	Deleted  []Resource
+}
+
+// Janitor cleans up expired harness runs in one compartment.
+type Janitor struct {
+	cfg     Config
+	clients *Clients
+}
+
+// New returns a Janitor that uses clients for all OCI calls.
+func New(clients *Clients, cfg Config) *Janitor {
+	if cfg.WaitTimeout == 0 {
+		cfg.WaitTimeout = defaultWaitTimeout
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if cfg.Log == nil {
+		cfg.Log = io.Discard
+	}
+	return &Janitor{cfg: cfg, clients: clients}
+}
+
+// Run lists every kind, selects the resources of expired runs and, unless this
+// is a dry run, deletes them kind by kind in DeletionOrder. Each kind is
+// listed again right before deletion and waited on until it is gone, so
+// children removed along with a parent are not deleted twice. Deletion keeps
+// going past individual failures; they are returned together.
+func (j *Janitor) Run(ctx context.Context) (Report, error) {
+	var report Report
+
+	var inventory []Resource
+	for _, kind := range DeletionOrder {
+		resources, err := j.clients.list(ctx, kind, j.cfg.CompartmentID)
+		if err != nil {
+			return report, fmt.Errorf("list %s: %w", kind, err)
+		}
+		inventory = append(inventory, resources...)
+	}
+	report.Selected = Select(inventory, j.cfg.RunID, j.cfg.TTL, j.cfg.Now())
+	if !j.cfg.Delete {
+		for _, r := range report.Selected {
+			fmt.Fprintf(j.cfg.Log, "would delete %s %s (%s, run %s)\n", r.Kind, r.ID, r.Name, r.RunID)
+		}
+		return report, nil
+	}
+
+	expired := map[string]bool{}
+	for _, r := range report.Selected {
+		expired[r.RunID] = true
+	}
+
+	var errs []error
+	for _, kind := range DeletionOrder {
+		current, err := j.clients.list(ctx, kind, j.cfg.CompartmentID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("list %s: %w", kind, err))
+			continue
+		}
+		pending := map[string]bool{}
+		for _, r := range current {
+			if !expired[r.RunID] {
+				continue
+			}
+			if !r.Deleting {
+				fmt.Fprintf(j.cfg.Log, "deleting %s %s (%s, run %s)\n", r.Kind, r.ID, r.Name, r.RunID)
+				if err := j.clients.delete(ctx, j, r); err != nil {
+					errs = append(errs, fmt.Errorf("delete %s %s: %w", r.Kind, r.ID, err))
+					continue
+				}
+				report.Deleted = append(report.Deleted, r)
+			}
+			pending[r.ID] = true
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if err := j.waitGone(ctx, string(kind), pending, func(ctx context.Context) ([]Resource, error) {
+			return j.clients.list(ctx, kind, j.cfg.CompartmentID)
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// waitGone polls list until none of ids is returned any more.
+func (j *Janitor) waitGone(ctx context.Context, what string, ids map[string]bool, list func(context.Context) ([]Resource, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, j.cfg.WaitTimeout)
+	defer cancel()
+
+	for {
+		resources, err := list(ctx)
+		if err == nil {
+			remaining := 0
+			for _, r := range resources {
+				if ids[r.ID] {
+					remaining++
+				}
+			}
+			if remaining == 0 {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for %s deletion", j.cfg.WaitTimeout, what)
+		case <-time.After(j.cfg.PollInterval):
+		}
+	}
+}
+
+// Select returns the resources belonging to runs whose oldest resource is at
+// least ttl old at now, optionally limited to runID, sorted by DeletionOrder.
+func Select(resources []Resource, runID string, ttl time.Duration, now time.Time) []Resource {
+	oldest := map[string]time.Time{}
+	for _, r := range resources {
+		if r.RunID == "" || (runID != "" && r.RunID != runID) {
+			continue
+		}
+		if created, ok := oldest[r.RunID]; !ok || r.Created.Before(created) {
+			oldest[r.RunID] = r.Created
+		}
+	}
+
+	var selected []Resource
+	for _, r := range resources {
+		created, ok := oldest[r.RunID]
+		if ok && now.Sub(created) >= ttl {
+			selected = append(selected, r)
+		}
+	}
+
+	rank := map[Kind]int{}
+	for i, kind := range DeletionOrder {
+		rank[kind] = i
+	}
+	sort.SliceStable(selected, func(a, b int) bool {
+		if selected[a].RunID != selected[b].RunID {
+			return selected[a].RunID < selected[b].RunID
+		}
+		return rank[selected[a].Kind] < rank[selected[b].Kind]
+	})
+	return selected
+}
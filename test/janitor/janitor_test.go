@@ -0,0 +1,351 @@
+package janitor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/stretchr/testify/require"
+)
+
+const testCompartment = "ocid1.compartment.oc1..test"
+
+// fakeOCI is an in-memory stand-in for the OCI list and delete APIs the
+// janitor calls. Deleted resources report a *ING state on the next list and
+// are gone on the one after, so callers have to wait for them.
+type fakeOCI struct {
+	mu        sync.Mutex
+	resources map[string][]map[string]interface{}
+	calls     []string
+}
+
+var terminalState = map[string]string{
+	"clusters":              "DELETED",
+	"bastions":              "DELETED",
+	"lustreFileSystems":     "DELETED",
+	"fileSystems":           "DELETED",
+	"mountTargets":          "DELETED",
+	"exports":               "DELETED",
+	"instancePools":         "TERMINATED",
+	"clusterNetworks":       "TERMINATED",
+	"instances":             "TERMINATED",
+	"vcns":                  "TERMINATED",
+	"subnets":               "TERMINATED",
+	"networkSecurityGroups": "TERMINATED",
+	"routeTables":           "TERMINATED",
+	"securityLists":         "TERMINATED",
+	"internetGateways":      "TERMINATED",
+	"natGateways":           "TERMINATED",
+	"serviceGateways":       "TERMINATED",
+}
+
+func (f *fakeOCI) add(collection string, fields map[string]interface{}) {
+	if _, ok := fields["lifecycleState"]; !ok {
+		fields["lifecycleState"] = "ACTIVE"
+	}
+	if _, ok := fields["compartmentId"]; !ok {
+		fields["compartmentId"] = testCompartment
+	}
+	f.resources[collection] = append(f.resources[collection], fields)
+}
+
+func (f *fakeOCI) deleted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, call := range f.calls {
+		if !strings.HasPrefix(call, "GET ") {
+			out = append(out, call)
+		}
+	}
+	return out
+}
+
+func (f *fakeOCI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Drop the API version segment, e.g. /20180222/clusters/<id>.
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[1:]
+	collection := parts[0]
+	f.calls = append(f.calls, strings.Join(append([]string{r.Method}, parts...), " "))
+
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		if collection == "availabilityDomains" {
+			writeJSON(w, []map[string]string{{"name": "AD-1"}, {"name": "AD-2"}})
+			return
+		}
+		items := []map[string]interface{}{}
+		for _, res := range f.resources[collection] {
+			if !matchesQuery(res, r) {
+				continue
+			}
+			// Advance deletion: *ING on the list after delete, gone after that.
+			if state := res["lifecycleState"]; state == "DELETING" || state == "TERMINATING" {
+				if res["seen"] == true {
+					res["lifecycleState"] = terminalState[collection]
+				}
+				res["seen"] = true
+			}
+			items = append(items, res)
+		}
+		if collection == "lustreFileSystems" {
+			writeJSON(w, map[string]interface{}{"items": items})
+			return
+		}
+		writeJSON(w, items)
+		return
+	}
+
+	res := f.find(collection, parts[1])
+	if res == nil {
+		http.Error(w, `{"code":"NotFound","message":"not found"}`, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		if blocker := f.blocker(collection, res); blocker != "" {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"code": "Conflict", "message": "still has " + blocker})
+			return
+		}
+		if terminalState[collection] == "DELETED" {
+			res["lifecycleState"] = "DELETING"
+		} else {
+			res["lifecycleState"] = "TERMINATING"
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for key, value := range body {
+			res[key] = value
+		}
+		writeJSON(w, res)
+	}
+}
+
+// blocker mimics the OCI dependency checks the janitor's ordering avoids.
+func (f *fakeOCI) blocker(collection string, res map[string]interface{}) string {
+	live := func(children string, key string) bool {
+		for _, child := range f.resources[children] {
+			if child[key] == res["id"] && child["lifecycleState"] != terminalState[children] {
+				return true
+			}
+		}
+		return false
+	}
+	switch collection {
+	case "vcns":
+		for _, children := range []string{"subnets", "networkSecurityGroups", "internetGateways", "natGateways", "serviceGateways"} {
+			if live(children, "vcnId") {
+				return children
+			}
+		}
+		for _, rt := range f.resources["routeTables"] {
+			if rt["vcnId"] == res["id"] && rt["id"] != res["defaultRouteTableId"] && rt["lifecycleState"] != "TERMINATED" {
+				return "routeTables"
+			}
+		}
+	case "internetGateways":
+		for _, rt := range f.resources["routeTables"] {
+			if rules, _ := rt["routeRules"].([]interface{}); rt["vcnId"] == res["vcnId"] && len(rules) > 0 && rt["lifecycleState"] != "TERMINATED" {
+				return "route rules"
+			}
+		}
+	case "fileSystems":
+		if live("exports", "fileSystemId") {
+			return "exports"
+		}
+	case "mountTargets":
+		if live("exports", "exportSetId") {
+			return "exports"
+		}
+	}
+	return ""
+}
+
+func (f *fakeOCI) find(collection, id string) map[string]interface{} {
+	for _, res := range f.resources[collection] {
+		if res["id"] == id {
+			return res
+		}
+	}
+	return nil
+}
+
+func matchesQuery(res map[string]interface{}, r *http.Request) bool {
+	for _, key := range []string{"vcnId", "availabilityDomain", "exportSetId", "fileSystemId"} {
+		if want := r.URL.Query().Get(key); want != "" && res[key] != want {
+			return false
+		}
+	}
+	if want := r.URL.Query().Get("compartmentId"); want != "" && res["compartmentId"] != want {
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newTestClients(t *testing.T, fake *fakeOCI) *Clients {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	provider := common.NewRawConfigurationProvider("ocid1.tenancy.oc1..test", "ocid1.user.oc1..test", "us-ashburn-1", "aa:bb", string(keyPEM), nil)
+
+	clients, err := NewClients(provider, "us-ashburn-1", server.URL)
+	require.NoError(t, err)
+	return clients
+}
+
+// seedRun adds one of everything a harness run creates, tagged with runID.
+func seedRun(f *fakeOCI, runID string, created time.Time) {
+	tags := map[string]string{RunIDTagKey: runID}
+	ts := created.UTC().Format(time.RFC3339)
+	id := func(kind string) string { return fmt.Sprintf("ocid1.%s.%s", kind, runID) }
+
+	f.add("clusters", map[string]interface{}{"id": id("cluster"), "name": "oke-" + runID, "freeformTags": tags, "metadata": map[string]string{"timeCreated": ts}})
+	f.add("clusterNetworks", map[string]interface{}{"id": id("clusternetwork"), "displayName": "rdma", "freeformTags": tags, "timeCreated": ts, "lifecycleState": "RUNNING"})
+	f.add("instancePools", map[string]interface{}{"id": id("instancepool"), "displayName": "gpu", "freeformTags": tags, "timeCreated": ts, "lifecycleState": "RUNNING"})
+	f.add("instances", map[string]interface{}{"id": id("instance"), "displayName": "operator", "freeformTags": tags, "timeCreated": ts, "lifecycleState": "RUNNING"})
+	f.add("bastions", map[string]interface{}{"id": id("bastion"), "name": "bastion", "freeformTags": tags, "timeCreated": ts})
+	f.add("lustreFileSystems", map[string]interface{}{"id": id("lustre"), "displayName": "lustre", "freeformTags": tags, "timeCreated": ts})
+	f.add("mountTargets", map[string]interface{}{"id": id("mounttarget"), "displayName": "mt", "availabilityDomain": "AD-1", "exportSetId": id("exportset"), "freeformTags": tags, "timeCreated": ts})
+	f.add("fileSystems", map[string]interface{}{"id": id("filesystem"), "displayName": "fss", "availabilityDomain": "AD-1", "freeformTags": tags, "timeCreated": ts})
+	f.add("exports", map[string]interface{}{"id": id("export"), "fileSystemId": id("filesystem"), "exportSetId": id("exportset"), "path": "/fss"})
+	f.add("vcns", map[string]interface{}{
+		"id": id("vcn"), "displayName": "oke-" + runID, "freeformTags": tags, "timeCreated": ts, "lifecycleState": "AVAILABLE",
+		"defaultRouteTableId": id("defaultrt"), "defaultSecurityListId": id("defaultsl"),
+	})
+	f.add("subnets", map[string]interface{}{"id": id("subnet"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("networkSecurityGroups", map[string]interface{}{"id": id("nsg"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("routeTables", map[string]interface{}{"id": id("defaultrt"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE", "routeRules": []interface{}{map[string]string{"networkEntityId": id("igw")}}})
+	f.add("routeTables", map[string]interface{}{"id": id("privatert"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("securityLists", map[string]interface{}{"id": id("defaultsl"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("internetGateways", map[string]interface{}{"id": id("igw"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("natGateways", map[string]interface{}{"id": id("nat"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+	f.add("serviceGateways", map[string]interface{}{"id": id("sgw"), "vcnId": id("vcn"), "lifecycleState": "AVAILABLE"})
+}
+
+func newFake(now time.Time) *fakeOCI {
+	f := &fakeOCI{resources: map[string][]map[string]interface{}{}}
+	seedRun(f, "run-old", now.Add(-12*time.Hour))
+	seedRun(f, "run-new", now.Add(-time.Hour))
+	// Untagged resources are never touched, whatever their age.
+	f.add("vcns", map[string]interface{}{"id": "ocid1.vcn.shared", "displayName": "shared", "timeCreated": now.Add(-48 * time.Hour).Format(time.RFC3339), "lifecycleState": "AVAILABLE"})
+	return f
+}
+
+func TestRunDryRunDeletesNothing(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	fake := newFake(now)
+	var log strings.Builder
+
+	report, err := New(newTestClients(t, fake), Config{
+		CompartmentID: testCompartment,
+		TTL:           6 * time.Hour,
+		Now:           func() time.Time { return now },
+		Log:           &log,
+	}).Run(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, report.Selected, len(DeletionOrder))
+	for _, r := range report.Selected {
+		require.Equal(t, "run-old", r.RunID)
+	}
+	require.Equal(t, KindCluster, report.Selected[0].Kind)
+	require.Equal(t, KindVCN, report.Selected[len(report.Selected)-1].Kind)
+	require.Empty(t, report.Deleted)
+	require.Empty(t, fake.deleted())
+	require.Contains(t, log.String(), "would delete instance_pool ocid1.instancepool.run-old")
+}
+
+func TestRunDeletesExpiredRunInDependencyOrder(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	fake := newFake(now)
+
+	report, err := New(newTestClients(t, fake), Config{
+		CompartmentID: testCompartment,
+		TTL:           6 * time.Hour,
+		Delete:        true,
+		PollInterval:  time.Millisecond,
+		Now:           func() time.Time { return now },
+	}).Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Deleted, len(DeletionOrder))
+
+	require.Equal(t, []string{
+		"DELETE clusters ocid1.cluster.run-old",
+		"DELETE clusterNetworks ocid1.clusternetwork.run-old",
+		"DELETE instancePools ocid1.instancepool.run-old",
+		"DELETE instances ocid1.instance.run-old",
+		"DELETE bastions ocid1.bastion.run-old",
+		"DELETE lustreFileSystems ocid1.lustre.run-old",
+		"DELETE exports ocid1.export.run-old",
+		"DELETE mountTargets ocid1.mounttarget.run-old",
+		"DELETE fileSystems ocid1.filesystem.run-old",
+		"DELETE subnets ocid1.subnet.run-old",
+		"DELETE networkSecurityGroups ocid1.nsg.run-old",
+		"PUT routeTables ocid1.defaultrt.run-old",
+		"DELETE routeTables ocid1.privatert.run-old",
+		"DELETE internetGateways ocid1.igw.run-old",
+		"DELETE natGateways ocid1.nat.run-old",
+		"DELETE serviceGateways ocid1.sgw.run-old",
+		"DELETE vcns ocid1.vcn.run-old",
+	}, fake.deleted())
+
+	require.Equal(t, "ACTIVE", fake.find("clusters", "ocid1.cluster.run-new")["lifecycleState"])
+	require.Equal(t, "AVAILABLE", fake.find("vcns", "ocid1.vcn.shared")["lifecycleState"])
+}
+
+func TestRunLimitsCleanupToRunID(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	fake := newFake(now)
+
+	report, err := New(newTestClients(t, fake), Config{
+		CompartmentID: testCompartment,
+		RunID:         "run-new",
+		Now:           func() time.Time { return now },
+	}).Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Selected, len(DeletionOrder))
+	for _, r := range report.Selected {
+		require.Equal(t, "run-new", r.RunID)
+	}
+}
+
+func TestSelectExpiresRunsByOldestResource(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	resources := []Resource{
+		{Kind: KindVCN, ID: "vcn-a", RunID: "a", Created: now.Add(-7 * time.Hour)},
+		// Created late in run a, but still deleted with it.
+		{Kind: KindFileSystem, ID: "fs-a", RunID: "a", Created: now.Add(-time.Hour)},
+		{Kind: KindCluster, ID: "cluster-b", RunID: "b", Created: now.Add(-5 * time.Hour)},
+		{Kind: KindInstance, ID: "untagged", Created: now.Add(-100 * time.Hour)},
+	}
+
+	selected := Select(resources, "", 6*time.Hour, now)
+	require.Len(t, selected, 2)
+	require.Equal(t, "fs-a", selected[0].ID)
+	require.Equal(t, "vcn-a", selected[1].ID)
+}
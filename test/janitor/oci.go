@@ -0,0 +1,544 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oracle/oci-go-sdk/v65/bastion"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/containerengine"
+	"github.com/oracle/oci-go-sdk/v65/core"
+	"github.com/oracle/oci-go-sdk/v65/filestorage"
+	"github.com/oracle/oci-go-sdk/v65/identity"
+	"github.com/oracle/oci-go-sdk/v65/lustrefilestorage"
+)
+
+// Clients holds the OCI SDK clients the janitor uses.
+type Clients struct {
+	containerEngine   containerengine.ContainerEngineClient
+	compute           core.ComputeClient
+	computeManagement core.ComputeManagementClient
+	virtualNetwork    core.VirtualNetworkClient
+	bastion           bastion.BastionClient
+	lustre            lustrefilestorage.LustreFileStorageClient
+	fileStorage       filestorage.FileStorageClient
+	identity          identity.IdentityClient
+
+	availabilityDomains []string
+}
+
+// NewClients builds the SDK clients for region. If endpoint is set, every
+// client sends its requests there instead of the regional service endpoints.
+func NewClients(provider common.ConfigurationProvider, region, endpoint string) (*Clients, error) {
+	c := &Clients{}
+	var err error
+	if c.containerEngine, err = containerengine.NewContainerEngineClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.compute, err = core.NewComputeClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.computeManagement, err = core.NewComputeManagementClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.virtualNetwork, err = core.NewVirtualNetworkClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.bastion, err = bastion.NewBastionClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.lustre, err = lustrefilestorage.NewLustreFileStorageClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.fileStorage, err = filestorage.NewFileStorageClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+	if c.identity, err = identity.NewIdentityClientWithConfigurationProvider(provider); err != nil {
+		return nil, err
+	}
+
+	if endpoint != "" {
+		for _, base := range []*common.BaseClient{
+			&c.containerEngine.BaseClient,
+			&c.compute.BaseClient,
+			&c.computeManagement.BaseClient,
+			&c.virtualNetwork.BaseClient,
+			&c.bastion.BaseClient,
+			&c.lustre.BaseClient,
+			&c.fileStorage.BaseClient,
+			&c.identity.BaseClient,
+		} {
+			base.Host = endpoint
+		}
+	} else if region != "" {
+		c.containerEngine.SetRegion(region)
+		c.compute.SetRegion(region)
+		c.computeManagement.SetRegion(region)
+		c.virtualNetwork.SetRegion(region)
+		c.bastion.SetRegion(region)
+		c.lustre.SetRegion(region)
+		c.fileStorage.SetRegion(region)
+		c.identity.SetRegion(region)
+	}
+	return c, nil
+}
+
+// paginate collects every page of a list call.
+func paginate[T any](fetch func(page *string) ([]T, *string, error)) ([]T, error) {
+	var all []T
+	var page *string
+	for {
+		items, next, err := fetch(page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if next == nil || *next == "" {
+			return all, nil
+		}
+		page = next
+	}
+}
+
+// tagged converts a listed resource into a Resource. It returns false for
+// resources without a run ID and for resources that are already gone.
+func tagged(kind Kind, id, name *string, tags map[string]string, created *common.SDKTime, state string) (Resource, bool) {
+	runID := tags[RunIDTagKey]
+	if runID == "" || isGone(state) {
+		return Resource{}, false
+	}
+	r := Resource{
+		Kind:     kind,
+		ID:       deref(id),
+		Name:     deref(name),
+		RunID:    runID,
+		Deleting: state == "DELETING" || state == "TERMINATING",
+	}
+	if created != nil {
+		r.Created = created.Time
+	}
+	return r, true
+}
+
+func isGone(state string) bool {
+	return state == "DELETED" || state == "TERMINATED"
+}
+
+// list returns the tagged, not yet deleted resources of kind in compartmentID.
+func (c *Clients) list(ctx context.Context, kind Kind, compartmentID string) ([]Resource, error) {
+	var out []Resource
+	add := func(r Resource, ok bool) {
+		if ok {
+			out = append(out, r)
+		}
+	}
+
+	switch kind {
+	case KindCluster:
+		items, err := paginate(func(page *string) ([]containerengine.ClusterSummary, *string, error) {
+			resp, err := c.containerEngine.ListClusters(ctx, containerengine.ListClustersRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			var created *common.SDKTime
+			if item.Metadata != nil {
+				created = item.Metadata.TimeCreated
+			}
+			add(tagged(kind, item.Id, item.Name, item.FreeformTags, created, string(item.LifecycleState)))
+		}
+
+	case KindClusterNetwork:
+		items, err := paginate(func(page *string) ([]core.ClusterNetworkSummary, *string, error) {
+			resp, err := c.computeManagement.ListClusterNetworks(ctx, core.ListClusterNetworksRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+		}
+
+	case KindInstancePool:
+		items, err := paginate(func(page *string) ([]core.InstancePoolSummary, *string, error) {
+			resp, err := c.computeManagement.ListInstancePools(ctx, core.ListInstancePoolsRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+		}
+
+	case KindInstance:
+		items, err := paginate(func(page *string) ([]core.Instance, *string, error) {
+			resp, err := c.compute.ListInstances(ctx, core.ListInstancesRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+		}
+
+	case KindBastion:
+		items, err := paginate(func(page *string) ([]bastion.BastionSummary, *string, error) {
+			resp, err := c.bastion.ListBastions(ctx, bastion.ListBastionsRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(tagged(kind, item.Id, item.Name, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+		}
+
+	case KindLustreFileSystem:
+		items, err := paginate(func(page *string) ([]lustrefilestorage.LustreFileSystemSummary, *string, error) {
+			resp, err := c.lustre.ListLustreFileSystems(ctx, lustrefilestorage.ListLustreFileSystemsRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			add(tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+		}
+
+	case KindMountTarget, KindFileSystem:
+		// File storage is listed per availability domain.
+		ads, err := c.listAvailabilityDomains(ctx, compartmentID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ad := range ads {
+			if kind == KindMountTarget {
+				items, err := paginate(func(page *string) ([]filestorage.MountTargetSummary, *string, error) {
+					resp, err := c.fileStorage.ListMountTargets(ctx, filestorage.ListMountTargetsRequest{CompartmentId: &compartmentID, AvailabilityDomain: &ad, Page: page})
+					return resp.Items, resp.OpcNextPage, err
+				})
+				if err != nil {
+					return nil, err
+				}
+				for _, item := range items {
+					r, ok := tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState))
+					r.exportSetID = deref(item.ExportSetId)
+					add(r, ok)
+				}
+				continue
+			}
+			items, err := paginate(func(page *string) ([]filestorage.FileSystemSummary, *string, error) {
+				resp, err := c.fileStorage.ListFileSystems(ctx, filestorage.ListFileSystemsRequest{CompartmentId: &compartmentID, AvailabilityDomain: &ad, Page: page})
+				return resp.Items, resp.OpcNextPage, err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				add(tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState)))
+			}
+		}
+
+	case KindVCN:
+		items, err := paginate(func(page *string) ([]core.Vcn, *string, error) {
+			resp, err := c.virtualNetwork.ListVcns(ctx, core.ListVcnsRequest{CompartmentId: &compartmentID, Page: page})
+			return resp.Items, resp.OpcNextPage, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			r, ok := tagged(kind, item.Id, item.DisplayName, item.FreeformTags, item.TimeCreated, string(item.LifecycleState))
+			r.defaultRouteTableID = deref(item.DefaultRouteTableId)
+			r.defaultSecurityListID = deref(item.DefaultSecurityListId)
+			add(r, ok)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown resource kind %q", kind)
+	}
+	return out, nil
+}
+
+func (c *Clients) listAvailabilityDomains(ctx context.Context, compartmentID string) ([]string, error) {
+	if c.availabilityDomains != nil {
+		return c.availabilityDomains, nil
+	}
+	resp, err := c.identity.ListAvailabilityDomains(ctx, identity.ListAvailabilityDomainsRequest{CompartmentId: &compartmentID})
+	if err != nil {
+		return nil, err
+	}
+	ads := []string{}
+	for _, ad := range resp.Items {
+		ads = append(ads, deref(ad.Name))
+	}
+	c.availabilityDomains = ads
+	return ads, nil
+}
+
+// delete starts deleting r, first removing the children OCI refuses to delete
+// a resource with: exports for file systems and mount targets, and the
+// subnets, security rules and gateways of a VCN.
+func (c *Clients) delete(ctx context.Context, j *Janitor, r Resource) error {
+	id := r.ID
+	switch r.Kind {
+	case KindCluster:
+		_, err := c.containerEngine.DeleteCluster(ctx, containerengine.DeleteClusterRequest{ClusterId: &id})
+		return err
+	case KindClusterNetwork:
+		_, err := c.computeManagement.TerminateClusterNetwork(ctx, core.TerminateClusterNetworkRequest{ClusterNetworkId: &id})
+		return err
+	case KindInstancePool:
+		_, err := c.computeManagement.TerminateInstancePool(ctx, core.TerminateInstancePoolRequest{InstancePoolId: &id})
+		return err
+	case KindInstance:
+		preserveBootVolume := false
+		_, err := c.compute.TerminateInstance(ctx, core.TerminateInstanceRequest{InstanceId: &id, PreserveBootVolume: &preserveBootVolume})
+		return err
+	case KindBastion:
+		_, err := c.bastion.DeleteBastion(ctx, bastion.DeleteBastionRequest{BastionId: &id})
+		return err
+	case KindLustreFileSystem:
+		_, err := c.lustre.DeleteLustreFileSystem(ctx, lustrefilestorage.DeleteLustreFileSystemRequest{LustreFileSystemId: &id})
+		return err
+	case KindMountTarget:
+		if err := c.deleteExports(ctx, j, filestorage.ListExportsRequest{ExportSetId: &r.exportSetID}); err != nil {
+			return err
+		}
+		_, err := c.fileStorage.DeleteMountTarget(ctx, filestorage.DeleteMountTargetRequest{MountTargetId: &id})
+		return err
+	case KindFileSystem:
+		if err := c.deleteExports(ctx, j, filestorage.ListExportsRequest{FileSystemId: &id}); err != nil {
+			return err
+		}
+		_, err := c.fileStorage.DeleteFileSystem(ctx, filestorage.DeleteFileSystemRequest{FileSystemId: &id})
+		return err
+	case KindVCN:
+		return c.deleteVCN(ctx, j, r)
+	}
+	return fmt.Errorf("unknown resource kind %q", r.Kind)
+}
+
+func (c *Clients) deleteExports(ctx context.Context, j *Janitor, request filestorage.ListExportsRequest) error {
+	list := func(ctx context.Context) ([]Resource, error) {
+		items, err := paginate(func(page *string) ([]filestorage.ExportSummary, *string, error) {
+			request.Page = page
+			resp, err := c.fileStorage.ListExports(ctx, request)
+			return resp.Items, resp.OpcNextPage, err
+		})
+		var out []Resource
+		for _, item := range items {
+			if !isGone(string(item.LifecycleState)) {
+				out = append(out, Resource{ID: deref(item.Id), Deleting: item.LifecycleState == filestorage.ExportSummaryLifecycleStateDeleting})
+			}
+		}
+		return out, err
+	}
+	return c.deleteChildren(ctx, j, "export", list, func(ctx context.Context, id string) error {
+		_, err := c.fileStorage.DeleteExport(ctx, filestorage.DeleteExportRequest{ExportId: &id})
+		return err
+	})
+}
+
+// deleteChildren deletes everything list returns and waits until it is gone.
+func (c *Clients) deleteChildren(ctx context.Context, j *Janitor, what string, list func(context.Context) ([]Resource, error), del func(context.Context, string) error) error {
+	children, err := list(ctx)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", what, err)
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	ids := map[string]bool{}
+	for _, child := range children {
+		if !child.Deleting {
+			if err := del(ctx, child.ID); err != nil {
+				return fmt.Errorf("delete %s %s: %w", what, child.ID, err)
+			}
+		}
+		ids[child.ID] = true
+	}
+	return j.waitGone(ctx, what, ids, list)
+}
+
+// vcnChild lists one kind of VCN child as Resources.
+type vcnChild struct {
+	what string
+	list func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error)
+	del  func(ctx context.Context, id string) error
+}
+
+func vcnResource(id *string, state string) (Resource, bool) {
+	if isGone(state) {
+		return Resource{}, false
+	}
+	return Resource{ID: deref(id), Deleting: state == "TERMINATING"}, true
+}
+
+// deleteVCN removes a VCN's children in the order OCI allows, then the VCN.
+// The default route table and security list go with the VCN, but the default
+// route table's rules are cleared first because they reference the gateways.
+func (c *Clients) deleteVCN(ctx context.Context, j *Janitor, vcn Resource) error {
+	vn := c.virtualNetwork
+	children := []vcnChild{
+		{
+			what: "subnet",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListSubnets(ctx, core.ListSubnetsRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteSubnet(ctx, core.DeleteSubnetRequest{SubnetId: &id})
+				return err
+			},
+		},
+		{
+			what: "network security group",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListNetworkSecurityGroups(ctx, core.ListNetworkSecurityGroupsRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteNetworkSecurityGroup(ctx, core.DeleteNetworkSecurityGroupRequest{NetworkSecurityGroupId: &id})
+				return err
+			},
+		},
+		{
+			what: "route table",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListRouteTables(ctx, core.ListRouteTablesRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if deref(item.Id) == vcn.defaultRouteTableID {
+						continue
+					}
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteRouteTable(ctx, core.DeleteRouteTableRequest{RtId: &id})
+				return err
+			},
+		},
+		{
+			what: "security list",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListSecurityLists(ctx, core.ListSecurityListsRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if deref(item.Id) == vcn.defaultSecurityListID {
+						continue
+					}
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteSecurityList(ctx, core.DeleteSecurityListRequest{SecurityListId: &id})
+				return err
+			},
+		},
+		{
+			what: "internet gateway",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListInternetGateways(ctx, core.ListInternetGatewaysRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteInternetGateway(ctx, core.DeleteInternetGatewayRequest{IgId: &id})
+				return err
+			},
+		},
+		{
+			what: "NAT gateway",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListNatGateways(ctx, core.ListNatGatewaysRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteNatGateway(ctx, core.DeleteNatGatewayRequest{NatGatewayId: &id})
+				return err
+			},
+		},
+		{
+			what: "service gateway",
+			list: func(ctx context.Context, compartmentID, vcnID string, page *string) ([]Resource, *string, error) {
+				resp, err := vn.ListServiceGateways(ctx, core.ListServiceGatewaysRequest{CompartmentId: &compartmentID, VcnId: &vcnID, Page: page})
+				var out []Resource
+				for _, item := range resp.Items {
+					if r, ok := vcnResource(item.Id, string(item.LifecycleState)); ok {
+						out = append(out, r)
+					}
+				}
+				return out, resp.OpcNextPage, err
+			},
+			del: func(ctx context.Context, id string) error {
+				_, err := vn.DeleteServiceGateway(ctx, core.DeleteServiceGatewayRequest{ServiceGatewayId: &id})
+				return err
+			},
+		},
+	}
+
+	for _, child := range children {
+		if child.what == "route table" && vcn.defaultRouteTableID != "" {
+			if _, err := vn.UpdateRouteTable(ctx, core.UpdateRouteTableRequest{
+				RtId:                    &vcn.defaultRouteTableID,
+				UpdateRouteTableDetails: core.UpdateRouteTableDetails{RouteRules: []core.RouteRule{}},
+			}); err != nil {
+				return fmt.Errorf("clear default route table %s: %w", vcn.defaultRouteTableID, err)
+			}
+		}
+		list := func(ctx context.Context) ([]Resource, error) {
+			return paginate(func(page *string) ([]Resource, *string, error) {
+				return child.list(ctx, j.cfg.CompartmentID, vcn.ID, page)
+			})
+		}
+		if err := c.deleteChildren(ctx, j, child.what, list, child.del); err != nil {
+			return err
+		}
+	}
+
+	_, err := vn.DeleteVcn(ctx, core.DeleteVcnRequest{VcnId: &vcn.ID})
+	return err
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
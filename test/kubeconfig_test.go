@@ -0,0 +1,253 @@
+package test
+
+import (
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Kubernetes API endpoints a kubeconfig can point at.
+const (
+	kubeEndpointPublic  = "public"
+	kubeEndpointPrivate = "private"
+)
+
+// kubeconfigSettings choose the endpoint and credentials of a generated
+// kubeconfig. Without a token, kubectl gets credentials from the oci CLI exec
+// plugin, the same as `oci ce cluster create-kubeconfig`.
+type kubeconfigSettings struct {
+	// Endpoint is "public", "private", or empty for the public endpoint when
+	// the cluster has one and no kubeconfig otherwise.
+	Endpoint string
+	// TLSServerName verifies the API server certificate for that name when
+	// the server is reached through a tunnel.
+	TLSServerName string
+	Region        string
+	Profile       string
+	Auth          string
+	// Token is a bearer token, such as the one stored in the secret from
+	// manifests/service-account/oke-kubeconfig-sa-token.yaml.
+	Token string
+}
+
+func kubeconfigSettingsFromEnv() kubeconfigSettings {
+	return kubeconfigSettings{
+		Endpoint: strings.ToLower(envOrDefault([]string{"TEST_KUBE_ENDPOINT"}, "")),
+		Region:   envOrDefault([]string{"OCI_REGION", "TF_VAR_region"}, ""),
+		Profile:  envOrDefault([]string{"OCI_CONFIG_FILE_PROFILE", "OCI_CLI_PROFILE", "TF_VAR_oci_profile"}, ""),
+		Auth:     strings.ToLower(envOrDefault([]string{"OCI_AUTH", "TF_VAR_oci_auth"}, "")),
+		Token:    envOrDefault([]string{"TEST_KUBE_TOKEN"}, ""),
+	}
+}
+
+// clusterEndpoint picks the API server URL for endpoint. It returns "" when no
+// endpoint was requested and the cluster has no public one.
+func clusterEndpoint(outputs clusterOutputs, endpoint string) (string, error) {
+	public := endpointURL(outputs.ClusterPublicEndpoint)
+	private := endpointURL(outputs.ClusterPrivateEndpoint)
+	switch endpoint {
+	case "":
+		return public, nil
+	case kubeEndpointPublic:
+		if public == "" {
+			return "", fmt.Errorf("cluster %s has no public endpoint", outputs.ClusterID)
+		}
+		return public, nil
+	case kubeEndpointPrivate:
+		if private == "" {
+			return "", fmt.Errorf("cluster %s has no private endpoint", outputs.ClusterID)
+		}
+		return private, nil
+	}
+	return "", fmt.Errorf("unknown endpoint %q, want %q or %q", endpoint, kubeEndpointPublic, kubeEndpointPrivate)
+}
+
+// endpointURL returns value if it is a usable https endpoint output. The
+// terraform outputs use "https://not-defined" or "https://" when there is none.
+func endpointURL(value string) string {
+	host := strings.TrimPrefix(value, "https://")
+	if host == value || host == "" || host == "not-defined" {
+		return ""
+	}
+	return value
+}
+
+// renderKubeconfig builds a kubeconfig for the cluster in outputs that talks to
+// server.
+func renderKubeconfig(outputs clusterOutputs, settings kubeconfigSettings, server string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(outputs.ClusterCACert)); block == nil {
+		return nil, fmt.Errorf("cluster_ca_cert for cluster %s is not a PEM certificate", outputs.ClusterID)
+	}
+
+	name := outputs.ClusterName
+	if name == "" {
+		name = outputs.ClusterID
+	}
+	user := "user-" + name
+
+	authInfo := &clientcmdapi.AuthInfo{Token: settings.Token}
+	if settings.Token == "" {
+		args := []string{"ce", "cluster", "generate-token", "--cluster-id", outputs.ClusterID}
+		if settings.Region != "" {
+			args = append(args, "--region", settings.Region)
+		}
+		if settings.Profile != "" {
+			args = append(args, "--profile", settings.Profile)
+		}
+		if settings.Auth != "" && settings.Auth != "api_key" {
+			args = append(args, "--auth", settings.Auth)
+		}
+		authInfo.Exec = &clientcmdapi.ExecConfig{
+			APIVersion:      "client.authentication.k8s.io/v1beta1",
+			Command:         "oci",
+			Args:            args,
+			InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+		}
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   server,
+		TLSServerName:            settings.TLSServerName,
+		CertificateAuthorityData: []byte(outputs.ClusterCACert),
+	}
+	config.AuthInfos[user] = authInfo
+	config.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: user}
+	config.CurrentContext = name
+	return clientcmd.Write(*config)
+}
+
+// writeKubeconfig writes a kubeconfig for the cluster into dir and returns its
+// path, or "" when settings select no endpoint.
+func writeKubeconfig(t terratesting.TestingT, dir string, outputs clusterOutputs, settings kubeconfigSettings) string {
+	t.Helper()
+
+	server, err := clusterEndpoint(outputs, settings.Endpoint)
+	if err != nil {
+		t.Fatalf("failed to select the Kubernetes API endpoint: %v", err)
+	}
+	if server == "" {
+		return ""
+	}
+	return saveKubeconfig(t, dir, outputs, settings, server)
+}
+
+func saveKubeconfig(t terratesting.TestingT, dir string, outputs clusterOutputs, settings kubeconfigSettings, server string) string {
+	t.Helper()
+
+	content, err := renderKubeconfig(outputs, settings, server)
+	if err != nil {
+		t.Fatalf("failed to generate kubeconfig: %v", err)
+	}
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(kubeconfigPath, content, 0600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+	return kubeconfigPath
+}
+
+const testCACert = "-----BEGIN CERTIFICATE-----\nMIIBdGVzdA==\n-----END CERTIFICATE-----\n"
+
+func TestRenderKubeconfigUsesOCIExecPlugin(t *testing.T) {
+	outputs := clusterOutputs{ClusterID: "ocid1.cluster.oc1.iad.aaaa", ClusterName: "oke-run-1", ClusterCACert: testCACert}
+	settings := kubeconfigSettings{Region: "us-ashburn-1", Profile: "CI", Auth: "security_token"}
+
+	content, err := renderKubeconfig(outputs, settings, "https://10.0.0.5:6443")
+	require.NoError(t, err)
+	require.YAMLEq(t, `
+apiVersion: v1
+kind: Config
+clusters:
+- name: oke-run-1
+  cluster:
+    certificate-authority-data: LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUJkR1Z6ZEE9PQotLS0tLUVORCBDRVJUSUZJQ0FURS0tLS0tCg==
+    server: https://10.0.0.5:6443
+contexts:
+- name: oke-run-1
+  context:
+    cluster: oke-run-1
+    user: user-oke-run-1
+current-context: oke-run-1
+users:
+- name: user-oke-run-1
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: oci
+      args: [ce, cluster, generate-token, --cluster-id, ocid1.cluster.oc1.iad.aaaa, --region, us-ashburn-1, --profile, CI, --auth, security_token]
+      env: null
+      interactiveMode: Never
+      provideClusterInfo: false
+`, string(content))
+
+	content, err = renderKubeconfig(outputs, kubeconfigSettings{Region: "us-ashburn-1", Auth: "api_key"}, "https://10.0.0.5:6443")
+	require.NoError(t, err)
+	require.Contains(t, string(content), "- --region\n      - us-ashburn-1\n      command: oci")
+}
+
+func TestRenderKubeconfigUsesServiceAccountToken(t *testing.T) {
+	outputs := clusterOutputs{ClusterID: "ocid1.cluster.oc1.iad.aaaa", ClusterCACert: testCACert}
+
+	content, err := renderKubeconfig(outputs, kubeconfigSettings{Token: "sa-token"}, "https://129.80.1.2:6443")
+	require.NoError(t, err)
+	require.YAMLEq(t, `
+apiVersion: v1
+kind: Config
+clusters:
+- name: ocid1.cluster.oc1.iad.aaaa
+  cluster:
+    certificate-authority-data: LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUJkR1Z6ZEE9PQotLS0tLUVORCBDRVJUSUZJQ0FURS0tLS0tCg==
+    server: https://129.80.1.2:6443
+contexts:
+- name: ocid1.cluster.oc1.iad.aaaa
+  context:
+    cluster: ocid1.cluster.oc1.iad.aaaa
+    user: user-ocid1.cluster.oc1.iad.aaaa
+current-context: ocid1.cluster.oc1.iad.aaaa
+users:
+- name: user-ocid1.cluster.oc1.iad.aaaa
+  user:
+    token: sa-token
+`, string(content))
+
+	_, err = renderKubeconfig(clusterOutputs{ClusterID: "ocid1.cluster.oc1.iad.aaaa"}, kubeconfigSettings{}, "https://129.80.1.2:6443")
+	require.ErrorContains(t, err, "not a PEM certificate")
+}
+
+func TestClusterEndpointSelection(t *testing.T) {
+	both := clusterOutputs{ClusterPublicEndpoint: "https://129.80.1.2:6443", ClusterPrivateEndpoint: "https://10.0.0.5:6443"}
+	privateOnly := clusterOutputs{ClusterID: "ocid1.cluster.oc1.iad.aaaa", ClusterPrivateEndpoint: "https://10.0.0.5:6443"}
+	notDefined := clusterOutputs{ClusterPublicEndpoint: "https://not-defined", ClusterPrivateEndpoint: "https://"}
+
+	for _, tc := range []struct {
+		outputs  clusterOutputs
+		endpoint string
+		want     string
+		err      string
+	}{
+		{both, "", "https://129.80.1.2:6443", ""},
+		{both, kubeEndpointPrivate, "https://10.0.0.5:6443", ""},
+		{privateOnly, "", "", ""},
+		{privateOnly, kubeEndpointPrivate, "https://10.0.0.5:6443", ""},
+		{privateOnly, kubeEndpointPublic, "", "has no public endpoint"},
+		{notDefined, "", "", ""},
+		{notDefined, kubeEndpointPrivate, "", "has no private endpoint"},
+		{both, "bastion", "", "unknown endpoint"},
+	} {
+		got, err := clusterEndpoint(tc.outputs, tc.endpoint)
+		if tc.err != "" {
+			require.ErrorContains(t, err, tc.err, "endpoint %q", tc.endpoint)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got, "endpoint %q", tc.endpoint)
+	}
+}
@@ -0,0 +1,708 @@
+package kueue
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/topology"
+)
+
+// Resources the checks read and write.
+var (
+	ClusterQueues = schema.GroupVersionResource{Group: "kueue.x-k8s.io", Version: "v1beta2", Resource: "clusterqueues"}
+	Workloads     = schema.GroupVersionResource{Group: "kueue.x-k8s.io", Version: "v1beta2", Resource: "workloads"}
+)
+
+// namespacedResources are where the objects of a rendered manifest go.
+var namespacedResources = map[string]schema.GroupVersionResource{
+	"MPIJob":        {Group: "kubeflow.org", Version: "v2beta1", Resource: "mpijobs"},
+	"ComputeDomain": {Group: "resource.nvidia.com", Version: "v1beta1", Resource: "computedomains"},
+}
+
+const (
+	// jobUIDLabel is set by Kueue on the Workload of a job.
+	jobUIDLabel  = "kueue.x-k8s.io/job-uid"
+	jobNameLabel = "training.kubeflow.org/job-name"
+	jobRoleLabel = "training.kubeflow.org/job-role"
+	// workerPodSet is the Workload pod set of the MPIJob workers.
+	workerPodSet      = "worker"
+	hostnameLabel     = "kubernetes.io/hostname"
+	instanceTypeLabel = "node.kubernetes.io/instance-type"
+)
+
+// Config describes the Kueue checks. They submit the MPIJob of an nccl-tests
+// or rccl-tests manifest to the LocalQueue Terraform creates.
+type Config struct {
+	// Namespace holds the LocalQueue: kueue_local_queue_default_namespace.
+	// The checks create and delete their jobs there, but never the namespace.
+	Namespace string
+	// Shape is the shape of the Kueue pool. Queue and ClusterQueue default
+	// to FlavorName(Shape), like Terraform names them.
+	Shape        string
+	Queue        string
+	ClusterQueue string
+	// Manifest is the manifest of the shape (see nccl.ManifestPath). Its
+	// Kueue objects are dropped.
+	Manifest []byte
+	// Workers is the worker count of the job CheckAdmission places and of the
+	// job CheckPreemption queues behind a full ClusterQueue. Defaults to 2.
+	Workers int
+	// Levels are the levels of the Kueue Topology, widest first (see
+	// ParseTopology). CheckAdmission requires the workers in one domain of
+	// the narrowest level with a domain of Workers Ready nodes, and skips
+	// the placement check without one.
+	Levels []string
+	// Name prefixes the MPIJob names. Defaults to "kueue-e2e".
+	Name string
+	// Timeout bounds every wait for Kueue. Defaults to 15 minutes.
+	Timeout time.Duration
+	// Settle is how long a workload that must stay queued is watched.
+	// Defaults to 1 minute.
+	Settle       time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Queue == "" {
+		c.Queue = FlavorName(c.Shape)
+	}
+	if c.ClusterQueue == "" {
+		c.ClusterQueue = FlavorName(c.Shape)
+	}
+	if c.Workers == 0 {
+		c.Workers = 2
+	}
+	if c.Name == "" {
+		c.Name = "kueue-e2e"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 15 * time.Minute
+	}
+	if c.Settle == 0 {
+		c.Settle = time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 10 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// Workload is what the checks read from a Kueue Workload.
+type Workload struct {
+	Name   string
+	Active bool
+	// Conditions maps the type of every true condition to its message.
+	Conditions map[string]string
+	// Pending is the message of a false QuotaReserved condition: why the
+	// workload is still queued.
+	Pending      string
+	ClusterQueue string
+	// Flavors maps each pod set to the flavor of each of its resources.
+	Flavors map[string]map[string]string
+	// Topology holds the pod sets Kueue gave a topology assignment.
+	Topology map[string]bool
+}
+
+// Admitted reports whether the workload holds quota and may run.
+func (w Workload) Admitted() bool {
+	_, ok := w.Conditions["Admitted"]
+	return ok
+}
+
+func (w Workload) String() string {
+	var parts []string
+	for kind, message := range w.Conditions {
+		parts = append(parts, strings.TrimSpace(kind+" "+message))
+	}
+	sort.Strings(parts)
+	if w.Pending != "" {
+		parts = append(parts, "pending: "+w.Pending)
+	}
+	if len(parts) == 0 {
+		return "no conditions"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ParseWorkload reads a kueue.x-k8s.io Workload.
+func ParseWorkload(obj *unstructured.Unstructured) Workload {
+	w := Workload{
+		Name:       obj.GetName(),
+		Active:     true,
+		Conditions: map[string]string{},
+		Flavors:    map[string]map[string]string{},
+		Topology:   map[string]bool{},
+	}
+	if active, found, _ := unstructured.NestedBool(obj.Object, "spec", "active"); found {
+		w.Active = active
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kind, _ := condition["type"].(string)
+		message, _ := condition["message"].(string)
+		switch {
+		case condition["status"] == "True":
+			w.Conditions[kind] = message
+		case kind == "QuotaReserved":
+			w.Pending = message
+		}
+	}
+	w.ClusterQueue, _, _ = unstructured.NestedString(obj.Object, "status", "admission", "clusterQueue")
+	assignments, _, _ := unstructured.NestedSlice(obj.Object, "status", "admission", "podSetAssignments")
+	for _, item := range assignments {
+		assignment, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := assignment["name"].(string)
+		flavors, _, _ := unstructured.NestedStringMap(assignment, "flavors")
+		w.Flavors[name] = flavors
+		if topology, ok := assignment["topologyAssignment"]; ok && topology != nil {
+			w.Topology[name] = true
+		}
+	}
+	return w
+}
+
+// Quota reads the nominal quota of res in flavor from a ClusterQueue, and
+// how much of it admitted workloads use.
+func Quota(cq *unstructured.Unstructured, flavor string, res corev1.ResourceName) (nominal, used int64, err error) {
+	groups, _, _ := unstructured.NestedSlice(cq.Object, "spec", "resourceGroups")
+	found := false
+	for _, group := range groups {
+		flavors, _, _ := unstructured.NestedSlice(group.(map[string]interface{}), "flavors")
+		for _, item := range flavors {
+			if q, ok := flavorQuantity(item, flavor, res, "nominalQuota"); ok {
+				if nominal, err = quantity(q); err != nil {
+					return 0, 0, fmt.Errorf("ClusterQueue %s: %s nominalQuota: %w", cq.GetName(), res, err)
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("ClusterQueue %s has no %s quota in flavor %s", cq.GetName(), res, flavor)
+	}
+	usage, _, _ := unstructured.NestedSlice(cq.Object, "status", "flavorsUsage")
+	for _, item := range usage {
+		if q, ok := flavorQuantity(item, flavor, res, "total"); ok {
+			if used, err = quantity(q); err != nil {
+				return 0, 0, fmt.Errorf("ClusterQueue %s: %s usage: %w", cq.GetName(), res, err)
+			}
+		}
+	}
+	return nominal, used, nil
+}
+
+// flavorQuantity returns field of res in a ClusterQueue flavor entry, which
+// both spec.resourceGroups[].flavors and status.flavorsUsage list as
+// {name, resources: [{name, <field>}]}.
+func flavorQuantity(item interface{}, flavor string, res corev1.ResourceName, field string) (interface{}, bool) {
+	entry, ok := item.(map[string]interface{})
+	if !ok || entry["name"] != flavor {
+		return nil, false
+	}
+	resources, _, _ := unstructured.NestedSlice(entry, "resources")
+	for _, r := range resources {
+		if r, ok := r.(map[string]interface{}); ok && r["name"] == string(res) {
+			return r[field], true
+		}
+	}
+	return nil, false
+}
+
+func quantity(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case string:
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return 0, err
+		}
+		return q.Value(), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	case nil:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%v is not a quantity", v)
+	}
+}
+
+// PickLevel returns the narrowest of levels (widest first) with a domain of
+// at least workers nodes, and its largest such domain. The hostname level
+// and nodes the labeler found no RDMA data for are ignored. level is empty
+// when no domain is large enough.
+func PickLevel(nodes []corev1.Node, levels []string, workers int) (level, domain string) {
+	for i := len(levels) - 1; i >= 0; i-- {
+		if levels[i] == hostnameLabel {
+			continue
+		}
+		counts := map[string]int{}
+		for _, node := range nodes {
+			if value := node.Labels[levels[i]]; value != "" && value != topology.NoIMDS {
+				counts[value]++
+			}
+		}
+		best := ""
+		for value, n := range counts {
+			if n >= workers && (best == "" || n > counts[best] || n == counts[best] && value < best) {
+				best = value
+			}
+		}
+		if best != "" {
+			return levels[i], best
+		}
+	}
+	return "", ""
+}
+
+// Placement is where CheckAdmission's workers ran.
+type Placement struct {
+	// Level and Domain are the topology domain the workers were required
+	// in, empty when no domain had room for them.
+	Level  string
+	Domain string
+	Nodes  []string
+}
+
+// CheckAdmission submits a job with Workers workers to the LocalQueue and
+// checks that Kueue admits it through the ClusterQueue and the shape's
+// flavor, that the ClusterQueue counts its GPUs while it runs and releases
+// them after, and, with Levels, that its workers are placed in one topology
+// domain.
+func CheckAdmission(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config) (Placement, error) {
+	r, err := newRunner(client, dyn, cfg)
+	if err != nil {
+		return Placement{}, err
+	}
+	nodes, err := r.readyNodes(ctx)
+	if err != nil {
+		return Placement{}, err
+	}
+	var placement Placement
+	placement.Level, placement.Domain = PickLevel(nodes, r.cfg.Levels, r.cfg.Workers)
+	if placement.Level == "" {
+		r.cfg.Logf("no topology domain has %d Ready %s nodes; not checking placement", r.cfg.Workers, r.cfg.Shape)
+	}
+	_, baseline, err := r.quota(ctx)
+	if err != nil {
+		return Placement{}, err
+	}
+
+	name := r.cfg.Name + "-admission"
+	defer r.cleanup(ctx, name)
+	uid, err := r.submit(ctx, name, r.cfg.Workers, placement.Level)
+	if err != nil {
+		return Placement{}, err
+	}
+	w, err := r.waitWorkload(ctx, name, uid, "admitted", Workload.Admitted)
+	if err != nil {
+		return Placement{}, err
+	}
+	if w.ClusterQueue != r.cfg.ClusterQueue {
+		return Placement{}, fmt.Errorf("workload %s was admitted by ClusterQueue %q, want %q", w.Name, w.ClusterQueue, r.cfg.ClusterQueue)
+	}
+	if flavor := w.Flavors[workerPodSet][string(r.gpuResource)]; flavor != r.flavor {
+		return Placement{}, fmt.Errorf("workload %s got %s from flavor %q, want %q", w.Name, r.gpuResource, flavor, r.flavor)
+	}
+	if placement.Level != "" && !w.Topology[workerPodSet] {
+		return Placement{}, fmt.Errorf("workload %s has no topology assignment for its workers", w.Name)
+	}
+	want := baseline + int64(r.cfg.Workers*r.gpus)
+	if err := r.waitUsage(ctx, want); err != nil {
+		return Placement{}, err
+	}
+
+	if placement.Nodes, err = r.workerNodes(ctx, name, r.cfg.Workers); err != nil {
+		return Placement{}, err
+	}
+	if placement.Level != "" {
+		labels := map[string]map[string]string{}
+		for _, node := range nodes {
+			labels[node.Name] = node.Labels
+		}
+		for _, node := range placement.Nodes {
+			if got := labels[node][placement.Level]; got != labels[placement.Nodes[0]][placement.Level] {
+				return placement, fmt.Errorf("workers of %s span %s domains: %s is in %q, %s in %q", name, placement.Level,
+					placement.Nodes[0], labels[placement.Nodes[0]][placement.Level], node, got)
+			}
+		}
+	}
+
+	if err := r.deleteJob(ctx, name); err != nil {
+		return placement, err
+	}
+	return placement, r.waitUsage(ctx, baseline)
+}
+
+// CheckPreemption fills the idle ClusterQueue with a job on every Ready node
+// of the pool, or on as many as its GPU quota admits, and checks that a second
+// job of Workers workers stays queued without preempting it, since the
+// ClusterQueue Terraform creates does not preempt. It then evicts the first
+// job by deactivating its Workload, checks that the queued job is admitted in
+// its place, and that the evicted one is requeued and admitted again once the
+// pool is free.
+func CheckPreemption(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config) error {
+	r, err := newRunner(client, dyn, cfg)
+	if err != nil {
+		return err
+	}
+	quota, used, err := r.quota(ctx)
+	if err != nil {
+		return err
+	}
+	if used != 0 {
+		return fmt.Errorf("ClusterQueue %s already uses %d of %d %s; the preemption check needs it idle", r.cfg.ClusterQueue, used, quota, r.gpuResource)
+	}
+	nodes, err := r.readyNodes(ctx)
+	if err != nil {
+		return err
+	}
+	fill := min(len(nodes), int(quota)/r.gpus)
+	if r.cfg.Workers > fill {
+		return fmt.Errorf("%d workers do not fit in the %d Ready %s nodes that ClusterQueue %s can fill", r.cfg.Workers, fill, r.cfg.Shape, r.cfg.ClusterQueue)
+	}
+	full := int64(fill * r.gpus)
+
+	holder, waiter := r.cfg.Name+"-holder", r.cfg.Name+"-waiter"
+	defer r.cleanup(ctx, holder, waiter)
+	holderUID, err := r.submit(ctx, holder, fill, "")
+	if err != nil {
+		return err
+	}
+	if _, err := r.waitWorkload(ctx, holder, holderUID, "admitted", Workload.Admitted); err != nil {
+		return err
+	}
+	if err := r.waitUsage(ctx, full); err != nil {
+		return err
+	}
+
+	waiterUID, err := r.submit(ctx, waiter, r.cfg.Workers, "")
+	if err != nil {
+		return err
+	}
+	if err := r.settle(ctx, waiter, waiterUID, holder, holderUID); err != nil {
+		return err
+	}
+
+	r.cfg.Logf("deactivating the workload of %s", holder)
+	if err := r.setActive(ctx, holderUID, false); err != nil {
+		return err
+	}
+	if _, err := r.waitWorkload(ctx, holder, holderUID, "evicted", func(w Workload) bool { return !w.Admitted() }); err != nil {
+		return err
+	}
+	if _, err := r.waitWorkload(ctx, waiter, waiterUID, "admitted after the eviction", Workload.Admitted); err != nil {
+		return err
+	}
+	if err := r.waitUsage(ctx, int64(r.cfg.Workers*r.gpus)); err != nil {
+		return err
+	}
+
+	r.cfg.Logf("reactivating the workload of %s", holder)
+	if err := r.setActive(ctx, holderUID, true); err != nil {
+		return err
+	}
+	if _, err := r.waitWorkload(ctx, holder, holderUID, "requeued", func(w Workload) bool {
+		return w.Active && !w.Admitted() && w.Pending != ""
+	}); err != nil {
+		return err
+	}
+	if err := r.deleteJob(ctx, waiter); err != nil {
+		return err
+	}
+	if _, err := r.waitWorkload(ctx, holder, holderUID, "admitted after requeueing", Workload.Admitted); err != nil {
+		return err
+	}
+	if err := r.waitUsage(ctx, full); err != nil {
+		return err
+	}
+	if err := r.deleteJob(ctx, holder); err != nil {
+		return err
+	}
+	return r.waitUsage(ctx, 0)
+}
+
+type runner struct {
+	client      kubernetes.Interface
+	dyn         dynamic.Interface
+	cfg         Config
+	flavor      string
+	gpuResource corev1.ResourceName
+	gpus        int
+	// created are the objects of each submitted job, for cleanup.
+	created map[string][]*unstructured.Unstructured
+}
+
+func newRunner(client kubernetes.Interface, dyn dynamic.Interface, cfg Config) (*runner, error) {
+	cfg.setDefaults()
+	if cfg.Namespace == "" {
+		return nil, fmt.Errorf("no LocalQueue namespace")
+	}
+	shape, ok := shapes.Lookup(cfg.Shape)
+	if !ok || shape.GPUs == 0 {
+		return nil, fmt.Errorf("%q is not a GPU shape in the shapes catalog", cfg.Shape)
+	}
+	return &runner{
+		client:      client,
+		dyn:         dyn,
+		cfg:         cfg,
+		flavor:      FlavorName(cfg.Shape),
+		gpuResource: corev1.ResourceName(shape.GPUResource()),
+		gpus:        shape.GPUs,
+		created:     map[string][]*unstructured.Unstructured{},
+	}, nil
+}
+
+func (r *runner) readyNodes(ctx context.Context) ([]corev1.Node, error) {
+	list, err := r.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: instanceTypeLabel + "=" + r.cfg.Shape})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s nodes: %w", r.cfg.Shape, err)
+	}
+	var nodes []corev1.Node
+	for _, node := range list.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+func (r *runner) quota(ctx context.Context) (int64, int64, error) {
+	cq, err := r.dyn.Resource(ClusterQueues).Get(ctx, r.cfg.ClusterQueue, metav1.GetOptions{})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get ClusterQueue %s: %w", r.cfg.ClusterQueue, err)
+	}
+	return Quota(cq, r.flavor, r.gpuResource)
+}
+
+// submit creates the manifest's objects for a job called name and returns
+// the MPIJob's UID.
+func (r *runner) submit(ctx context.Context, name string, workers int, level string) (string, error) {
+	objects, err := nccl.Render(r.cfg.Manifest, nccl.Options{Name: name, Workers: workers, Queue: r.cfg.Queue, Topology: level})
+	if err != nil {
+		return "", err
+	}
+	var uid string
+	for _, obj := range objects {
+		res, ok := namespacedResources[obj.GetKind()]
+		if !ok {
+			return "", fmt.Errorf("%s %s: unsupported kind", obj.GetKind(), obj.GetName())
+		}
+		obj.SetNamespace(r.cfg.Namespace)
+		created, err := r.dyn.Resource(res).Namespace(r.cfg.Namespace).Create(ctx, obj, metav1.CreateOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to create %s %s/%s: %w", obj.GetKind(), r.cfg.Namespace, obj.GetName(), err)
+		}
+		r.created[name] = append(r.created[name], obj)
+		if obj.GetKind() == "MPIJob" {
+			uid = string(created.GetUID())
+		}
+	}
+	r.cfg.Logf("submitted MPIJob %s/%s with %d workers to LocalQueue %s", r.cfg.Namespace, name, workers, r.cfg.Queue)
+	return uid, nil
+}
+
+// deleteJob deletes the objects submit created for name, with their pods.
+func (r *runner) deleteJob(ctx context.Context, name string) error {
+	background := metav1.DeletePropagationBackground
+	objects := r.created[name]
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := objects[i]
+		err := r.dyn.Resource(namespacedResources[obj.GetKind()]).Namespace(r.cfg.Namespace).Delete(ctx, obj.GetName(), metav1.DeleteOptions{PropagationPolicy: &background})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s %s/%s: %w", obj.GetKind(), r.cfg.Namespace, obj.GetName(), err)
+		}
+	}
+	delete(r.created, name)
+	return nil
+}
+
+func (r *runner) cleanup(ctx context.Context, names ...string) {
+	cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	for _, name := range names {
+		if err := r.deleteJob(cleanup, name); err != nil {
+			r.cfg.Logf("%v", err)
+		}
+	}
+}
+
+func (r *runner) workload(ctx context.Context, uid string) (*unstructured.Unstructured, error) {
+	list, err := r.dyn.Resource(Workloads).Namespace(r.cfg.Namespace).List(ctx, metav1.ListOptions{LabelSelector: jobUIDLabel + "=" + uid})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workloads: %w", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, nil
+	}
+	return &list.Items[0], nil
+}
+
+// waitWorkload polls the Workload of the job called name until done accepts
+// it.
+func (r *runner) waitWorkload(ctx context.Context, name, uid, desc string, done func(Workload) bool) (Workload, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	state := "no workload"
+	for {
+		obj, err := r.workload(ctx, uid)
+		if err != nil && ctx.Err() == nil {
+			return Workload{}, err
+		}
+		if obj != nil {
+			w := ParseWorkload(obj)
+			if done(w) {
+				r.cfg.Logf("workload %s of %s is %s", w.Name, name, desc)
+				return w, nil
+			}
+			state = w.String()
+		}
+		select {
+		case <-ctx.Done():
+			return Workload{}, fmt.Errorf("the workload of MPIJob %s/%s was not %s in %s: %s", r.cfg.Namespace, name, desc, r.cfg.Timeout, state)
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// settle watches for Settle that the waiter stays queued and the holder
+// keeps its quota.
+func (r *runner) settle(ctx context.Context, waiter, waiterUID, holder, holderUID string) error {
+	deadline := time.Now().Add(r.cfg.Settle)
+	var pending string
+	for {
+		obj, err := r.workload(ctx, waiterUID)
+		if err != nil {
+			return err
+		}
+		if obj != nil {
+			w := ParseWorkload(obj)
+			if _, ok := w.Conditions["QuotaReserved"]; ok {
+				return fmt.Errorf("workload %s of %s got quota while ClusterQueue %s was full: %s", w.Name, waiter, r.cfg.ClusterQueue, w)
+			}
+			pending = w.Pending
+		}
+		if obj, err = r.workload(ctx, holderUID); err != nil {
+			return err
+		}
+		if obj == nil {
+			return fmt.Errorf("the workload of %s is gone", holder)
+		}
+		if w := ParseWorkload(obj); !w.Admitted() {
+			return fmt.Errorf("workload %s of %s lost its admission to a job without priority: %s", w.Name, holder, w)
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+	if pending == "" {
+		return fmt.Errorf("the workload of %s has no pending reason after %s", waiter, r.cfg.Settle)
+	}
+	r.cfg.Logf("%s stays queued: %s", waiter, pending)
+	return nil
+}
+
+func (r *runner) setActive(ctx context.Context, uid string, active bool) error {
+	obj, err := r.workload(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return fmt.Errorf("no workload for job %s", uid)
+	}
+	patch := fmt.Sprintf(`{"spec":{"active":%t}}`, active)
+	if _, err := r.dyn.Resource(Workloads).Namespace(r.cfg.Namespace).Patch(ctx, obj.GetName(), types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set workload %s active=%t: %w", obj.GetName(), active, err)
+	}
+	return nil
+}
+
+// waitUsage polls the ClusterQueue until its GPU usage is want.
+func (r *runner) waitUsage(ctx context.Context, want int64) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	var used int64
+	for {
+		var err error
+		if _, used, err = r.quota(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+		if used == want {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ClusterQueue %s uses %d %s, want %d", r.cfg.ClusterQueue, used, r.gpuResource, want)
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// workerNodes waits until the n workers of the job are bound to nodes and
+// returns the nodes.
+func (r *runner) workerNodes(ctx context.Context, job string, n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	selector := fmt.Sprintf("%s=%s,%s=worker", jobNameLabel, job, jobRoleLabel)
+	var nodes []string
+	for {
+		pods, err := r.client.CoreV1().Pods(r.cfg.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil && ctx.Err() == nil {
+			return nil, fmt.Errorf("failed to list worker pods: %w", err)
+		}
+		if err == nil {
+			nodes = nodes[:0]
+			for _, pod := range pods.Items {
+				if pod.Spec.NodeName != "" && pod.DeletionTimestamp == nil {
+					nodes = append(nodes, pod.Spec.NodeName)
+				}
+			}
+			if len(nodes) == n {
+				slices.Sort(nodes)
+				return nodes, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%d of %d workers of %s were scheduled in %s", len(nodes), n, job, r.cfg.Timeout)
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package kueue describes the Kueue objects the stack creates for topology
+// aware scheduling from terraform/files/kueue: the oci-rdma Topology, and a
+// ResourceFlavor, ClusterQueue and default LocalQueue for the shape of the
+// RDMA or GMC pool. CheckAdmission and CheckPreemption submit jobs to those
+// queues on a live cluster.
+package kueue
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"sigs.k8s.io/yaml"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// Topology is a kueue.x-k8s.io Topology.
+type Topology struct {
+	Name string
+	// Levels are the node labels of the topology, widest first.
+	Levels []string
+}
+
+// ParseTopology reads a Topology manifest such as
+// terraform/files/kueue/topology.yaml.
+func ParseTopology(data []byte) (Topology, error) {
+	var manifest struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			Levels []struct {
+				NodeLabel string `json:"nodeLabel"`
+			} `json:"levels"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return Topology{}, err
+	}
+	if manifest.Kind != "Topology" {
+		return Topology{}, fmt.Errorf("manifest is a %q, not a Topology", manifest.Kind)
+	}
+	topology := Topology{Name: manifest.Metadata.Name}
+	for _, level := range manifest.Spec.Levels {
+		if level.NodeLabel == "" {
+			return Topology{}, fmt.Errorf("topology %s has a level without nodeLabel", topology.Name)
+		}
+		topology.Levels = append(topology.Levels, level.NodeLabel)
+	}
+	if len(topology.Levels) == 0 {
+		return Topology{}, fmt.Errorf("topology %s has no levels", topology.Name)
+	}
+	return topology, nil
+}
+
+// FlavorName is the name of the ResourceFlavor, ClusterQueue and LocalQueue
+// for shape, like local.kueue_flavor_name.
+func FlavorName(shape string) string {
+	return strings.ToLower(strings.ReplaceAll(shape, ".", "-")) + "-rdma-topology-aware"
+}
+
+// GPUQuota is the GPU nominalQuota of the ClusterQueue for a pool of nodes
+// of shape: every GPU of the pool, like local.kueue_gpu_quota.
+func GPUQuota(shape string, nodes int) (int, error) {
+	s, ok := shapes.Lookup(shape)
+	if !ok {
+		return 0, fmt.Errorf("shape %s is not in the shapes catalog", shape)
+	}
+	return nodes * s.GPUs, nil
+}
+
+// RenderTemplate renders a Terraform template file the way templatefile
+// does, with vars as its variables.
+func RenderTemplate(data []byte, name string, vars map[string]cty.Value) (string, error) {
+	expr, diags := hclsyntax.ParseTemplate(data, name, hcl.InitialPos)
+	if diags.HasErrors() {
+		return "", diags
+	}
+	value, diags := expr.Value(&hcl.EvalContext{Variables: vars})
+	if diags.HasErrors() {
+		return "", diags
+	}
+	if value.IsNull() || !value.Type().Equals(cty.String) {
+		return "", fmt.Errorf("%s did not render to a string", name)
+	}
+	return value.AsString(), nil
+}
@@ -0,0 +1,733 @@
+package kueue
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/topology"
+)
+
+var terraformDir = filepath.Join("..", "..", "terraform")
+
+func readRepositoryFile(t *testing.T, path ...string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(append([]string{"..", ".."}, path...)...))
+	require.NoError(t, err)
+	return data
+}
+
+// wellKnownLabels are set on every node by the kubelet or the OCI cloud
+// controller manager, without the labeler.
+var wellKnownLabels = []string{
+	"kubernetes.io/hostname",
+	"kubernetes.io/arch",
+	"kubernetes.io/os",
+	"node.kubernetes.io/instance-type",
+	"topology.kubernetes.io/region",
+	"topology.kubernetes.io/zone",
+}
+
+// labelerLabels returns the node labels the oci-hpc-oke-utils labeler writes:
+// the ones its script sets from IMDS, and the target columns of the CSV files
+// the labeler-mapping ConfigMap renders from labeler.labelMappings.
+func labelerLabels(t *testing.T) []string {
+	t.Helper()
+	utils := []string{"terraform", "files", "oci-hpc-oke-utils"}
+	script := readRepositoryFile(t, append(utils, "templates", "labeler-configmap.yaml")...)
+	var labels []string
+	for _, m := range regexp.MustCompile(`"(oci\.oraclecloud\.com/[^"]+)"`).FindAllSubmatch(script, -1) {
+		labels = append(labels, string(m[1]))
+	}
+	require.NotEmpty(t, labels, "no labels found in the labeler script")
+
+	mapping := string(readRepositoryFile(t, append(utils, "templates", "labeler-mapping-configmap.yaml")...))
+	require.Contains(t, mapping, "range $filename, $content := .Values.labeler.labelMappings",
+		"the labeler-mapping ConfigMap no longer renders labeler.labelMappings; update labelerLabels")
+	var values struct {
+		Labeler struct {
+			LabelMappings map[string]string `json:"labelMappings"`
+		} `json:"labeler"`
+	}
+	require.NoError(t, yaml.Unmarshal(readRepositoryFile(t, append(utils, "values.yaml")...), &values))
+	for filename, content := range values.Labeler.LabelMappings {
+		if !strings.HasSuffix(filename, ".csv") {
+			continue
+		}
+		header, err := csv.NewReader(strings.NewReader(content)).Read()
+		require.NoError(t, err, filename)
+		for _, column := range header[1:] {
+			labels = append(labels, strings.TrimSpace(column))
+		}
+	}
+	slices.Sort(labels)
+	return slices.Compact(labels)
+}
+
+func TestTopologyLevelsAreWrittenByTheLabeler(t *testing.T) {
+	topology, err := ParseTopology(readRepositoryFile(t, "terraform", "files", "kueue", "topology.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "oci-rdma", topology.Name)
+
+	available := append(labelerLabels(t), wellKnownLabels...)
+	for _, level := range topology.Levels {
+		require.Contains(t, available, level, "Kueue topology level %s is a label neither the labeler nor the kubelet writes", level)
+	}
+	require.Len(t, slices.Compact(slices.Clone(topology.Levels)), len(topology.Levels), "levels are unique")
+	require.Equal(t, "kubernetes.io/hostname", topology.Levels[len(topology.Levels)-1], "the lowest level places pods on nodes")
+}
+
+func TestParseTopologyRejectsOtherManifests(t *testing.T) {
+	_, err := ParseTopology([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: x\n"))
+	require.Error(t, err)
+	_, err = ParseTopology([]byte("kind: Topology\nmetadata:\n  name: x\nspec:\n  levels: []\n"))
+	require.Error(t, err)
+	_, err = ParseTopology([]byte("kind: Topology\nmetadata:\n  name: x\nspec:\n  levels:\n  - {}\n"))
+	require.Error(t, err)
+}
+
+// terraformFunctions are the Terraform functions the Kueue locals call.
+var terraformFunctions = map[string]function.Function{
+	"compact":   stdlib.CompactFunc,
+	"contains":  stdlib.ContainsFunc,
+	"element":   stdlib.ElementFunc,
+	"length":    stdlib.LengthFunc,
+	"lookup":    stdlib.LookupFunc,
+	"lower":     stdlib.LowerFunc,
+	"replace":   stdlib.ReplaceFunc,
+	"split":     stdlib.SplitFunc,
+	"tonumber":  stdlib.MakeToFunc(cty.Number),
+	"trimspace": stdlib.TrimSpaceFunc,
+	"try":       tryfunc.TryFunc,
+}
+
+func parseTerraformFile(t *testing.T, file string) *hclsyntax.Body {
+	t.Helper()
+	parsed, diags := hclsyntax.ParseConfig(readRepositoryFile(t, "terraform", file), file, hcl.InitialPos)
+	require.False(t, diags.HasErrors(), diags.Error())
+	return parsed.Body.(*hclsyntax.Body)
+}
+
+// evalLocals evaluates the locals of file named in names, in declaration
+// order, adding each to ctx so later locals can use it.
+func evalLocals(t *testing.T, ctx *hcl.EvalContext, file string, names ...string) {
+	t.Helper()
+	locals := ctx.Variables["local"].AsValueMap()
+	if locals == nil {
+		locals = map[string]cty.Value{}
+	}
+	for _, block := range parseTerraformFile(t, file).Blocks {
+		if block.Type != "locals" {
+			continue
+		}
+		attrs := make([]*hclsyntax.Attribute, 0, len(block.Body.Attributes))
+		for _, attr := range block.Body.Attributes {
+			if slices.Contains(names, attr.Name) {
+				attrs = append(attrs, attr)
+			}
+		}
+		slices.SortFunc(attrs, func(a, b *hclsyntax.Attribute) int { return a.SrcRange.Start.Byte - b.SrcRange.Start.Byte })
+		for _, attr := range attrs {
+			value, diags := attr.Expr.Value(ctx)
+			require.False(t, diags.HasErrors(), "local.%s: %s", attr.Name, diags.Error())
+			locals[attr.Name] = value
+			ctx.Variables["local"] = cty.ObjectVal(locals)
+		}
+	}
+	for _, name := range names {
+		require.Contains(t, locals, name, "local.%s is not declared in terraform/%s", name, file)
+	}
+}
+
+// renderedTemplates renders every templatefile call in file with ctx, keyed
+// by template file name.
+func renderedTemplates(t *testing.T, ctx *hcl.EvalContext, file string) map[string]string {
+	t.Helper()
+	rendered := map[string]string{}
+	diags := hclsyntax.VisitAll(parseTerraformFile(t, file), func(node hclsyntax.Node) hcl.Diagnostics {
+		call, ok := node.(*hclsyntax.FunctionCallExpr)
+		if !ok || call.Name != "templatefile" {
+			return nil
+		}
+		require.Len(t, call.Args, 2)
+		path, diags := call.Args[0].Value(ctx)
+		require.False(t, diags.HasErrors(), diags.Error())
+		vars, diags := call.Args[1].Value(ctx)
+		require.False(t, diags.HasErrors(), diags.Error())
+		data, err := os.ReadFile(path.AsString())
+		require.NoError(t, err)
+		out, err := RenderTemplate(data, path.AsString(), vars.AsValueMap())
+		require.NoError(t, err, "%s: %s", file, path.AsString())
+		rendered[filepath.Base(path.AsString())] = out
+		return nil
+	})
+	require.False(t, diags.HasErrors(), diags.Error())
+	return rendered
+}
+
+// kueueContext evaluates the Kueue locals of the stack for a pool of shape
+// and returns the size of that pool. GMC shapes get two fabrics of three
+// nodes, other shapes an RDMA pool of four nodes, enabled if rdmaEnabled.
+func kueueContext(t *testing.T, shape shapes.Shape, rdmaEnabled bool) (*hcl.EvalContext, int) {
+	t.Helper()
+	vars := map[string]cty.Value{
+		"worker_gmc_enabled":                  cty.False,
+		"worker_gmc_shape":                    cty.StringVal("BM.GPU.GB200.4"),
+		"worker_gmc_gpu_memory_fabric_ids":    cty.StringVal(""),
+		"worker_gmc_scale_target_size":        cty.NumberIntVal(18),
+		"worker_rdma_enabled":                 cty.BoolVal(rdmaEnabled),
+		"worker_rdma_shape":                   cty.StringVal(shape.Name),
+		"worker_rdma_pool_size":               cty.NumberIntVal(4),
+		"kueue_local_queue_default_namespace": cty.StringVal("default"),
+	}
+	if shape.GMC {
+		vars["worker_gmc_enabled"] = cty.True
+		vars["worker_gmc_shape"] = cty.StringVal(shape.Name)
+		vars["worker_gmc_gpu_memory_fabric_ids"] = cty.StringVal("ocid1.computegpumemoryfabric.oc1..aaaa\n\nocid1.computegpumemoryfabric.oc1..bbbb\n")
+		vars["worker_gmc_scale_target_size"] = cty.NumberIntVal(3)
+		vars["worker_rdma_shape"] = cty.StringVal("BM.GPU.H100.8")
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var":   cty.ObjectVal(vars),
+			"local": cty.EmptyObjectVal,
+			"path":  cty.ObjectVal(map[string]cty.Value{"module": cty.StringVal(terraformDir)}),
+		},
+		Functions: terraformFunctions,
+	}
+	evalLocals(t, ctx, "oke-workers.tf", "worker_gmc_gpu_memory_fabric_ids")
+	evalLocals(t, ctx, "via-provider-kueue.tf",
+		"kueue_amd_shapes", "kueue_shape", "kueue_is_amd", "kueue_gpu_resource", "kueue_flavor_name",
+		"kueue_shape_gpu_count", "kueue_pool_size", "kueue_gpu_quota")
+	return ctx, kueuePoolSize(ctx)
+}
+
+// kueuePoolSize is the node count of the pool the Kueue queues are for: the
+// GMC pool's fabrics times worker_gmc_scale_target_size, or the RDMA pool
+// size when worker_rdma_enabled is set.
+func kueuePoolSize(ctx *hcl.EvalContext) int {
+	vars := ctx.Variables["var"]
+	if vars.GetAttr("worker_gmc_enabled").True() {
+		fabrics := ctx.Variables["local"].GetAttr("worker_gmc_gpu_memory_fabric_ids").LengthInt()
+		size, _ := vars.GetAttr("worker_gmc_scale_target_size").AsBigFloat().Int64()
+		return fabrics * int(size)
+	}
+	if !vars.GetAttr("worker_rdma_enabled").True() {
+		return 0
+	}
+	size, _ := vars.GetAttr("worker_rdma_pool_size").AsBigFloat().Int64()
+	return int(size)
+}
+
+func TestTemplatesRenderQuotasForEveryGPUShape(t *testing.T) {
+	topology, err := ParseTopology(readRepositoryFile(t, "terraform", "files", "kueue", "topology.yaml"))
+	require.NoError(t, err)
+
+	kueueShapes := shapes.Names(func(s shapes.Shape) bool { return s.RDMANICs > 0 })
+	require.NotEmpty(t, kueueShapes)
+	for _, name := range kueueShapes {
+		t.Run(name, func(t *testing.T) {
+			shape, _ := shapes.Lookup(name)
+			ctx, nodes := kueueContext(t, shape, true)
+			quota, err := GPUQuota(name, nodes)
+			require.NoError(t, err)
+			flavor := FlavorName(name)
+			require.Equal(t, flavor, ctx.Variables["local"].GetAttr("kueue_flavor_name").AsString())
+
+			provider := renderedTemplates(t, ctx, "via-provider-kueue.tf")
+			operator := renderedTemplates(t, ctx, "via-operator-kueue.tf")
+			require.Equal(t, provider, operator, "the operator and provider paths render the same Kueue objects")
+
+			var resourceFlavor struct {
+				Kind     string `json:"kind"`
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Spec struct {
+					NodeLabels   map[string]string `json:"nodeLabels"`
+					TopologyName string            `json:"topologyName"`
+				} `json:"spec"`
+			}
+			require.NoError(t, yaml.Unmarshal([]byte(provider["resource-flavor.yaml.tpl"]), &resourceFlavor))
+			require.Equal(t, "ResourceFlavor", resourceFlavor.Kind)
+			require.Equal(t, flavor, resourceFlavor.Metadata.Name)
+			require.Equal(t, topology.Name, resourceFlavor.Spec.TopologyName)
+			require.Equal(t, map[string]string{
+				"node.kubernetes.io/instance-type": name,
+				shape.GPUResource():                "true",
+			}, resourceFlavor.Spec.NodeLabels)
+
+			var clusterQueue struct {
+				Kind     string `json:"kind"`
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Spec struct {
+					ResourceGroups []struct {
+						CoveredResources []string `json:"coveredResources"`
+						Flavors          []struct {
+							Name      string `json:"name"`
+							Resources []struct {
+								Name         string `json:"name"`
+								NominalQuota string `json:"nominalQuota"`
+							} `json:"resources"`
+						} `json:"flavors"`
+					} `json:"resourceGroups"`
+				} `json:"spec"`
+			}
+			require.NoError(t, yaml.Unmarshal([]byte(provider["cluster-queue.yaml.tpl"]), &clusterQueue))
+			require.Equal(t, "ClusterQueue", clusterQueue.Kind)
+			require.Equal(t, flavor, clusterQueue.Metadata.Name)
+			require.Len(t, clusterQueue.Spec.ResourceGroups, 1)
+			group := clusterQueue.Spec.ResourceGroups[0]
+			require.Contains(t, group.CoveredResources, shape.GPUResource())
+			require.Len(t, group.Flavors, 1)
+			require.Equal(t, flavor, group.Flavors[0].Name)
+			quotas := map[string]string{}
+			for _, resource := range group.Flavors[0].Resources {
+				quotas[resource.Name] = resource.NominalQuota
+			}
+			require.Equal(t, strconv.Itoa(quota), quotas[shape.GPUResource()],
+				"GPU quota is the %d nodes x %d GPUs of the pool", nodes, shape.GPUs)
+
+			var localQueue struct {
+				Metadata struct {
+					Namespace string `json:"namespace"`
+				} `json:"metadata"`
+				Spec struct {
+					ClusterQueue string `json:"clusterQueue"`
+				} `json:"spec"`
+			}
+			require.NoError(t, yaml.Unmarshal([]byte(provider["local-queue.yaml.tpl"]), &localQueue))
+			require.Equal(t, "default", localQueue.Metadata.Namespace)
+			require.Equal(t, flavor, localQueue.Spec.ClusterQueue)
+		})
+	}
+}
+
+func TestTemplatesRenderNoGPUQuotaWithoutTheRDMAPool(t *testing.T) {
+	shape, _ := shapes.Lookup("BM.GPU.H100.8")
+	ctx, nodes := kueueContext(t, shape, false)
+	require.Zero(t, nodes)
+	require.Contains(t, renderedTemplates(t, ctx, "via-provider-kueue.tf")["cluster-queue.yaml.tpl"], `nominalQuota: "0"`)
+}
+
+func TestGPUQuota(t *testing.T) {
+	quota, err := GPUQuota("BM.GPU.GB200.4", 18)
+	require.NoError(t, err)
+	require.Equal(t, 72, quota)
+	_, err = GPUQuota("VM.Standard.E5.Flex", 1)
+	require.Error(t, err)
+	require.Equal(t, "bm-gpu-mi355x-v1-8-rdma-topology-aware", FlavorName("BM.GPU.MI355X-v1.8"))
+}
+
+const fakeShape = "BM.GPU.H100.8"
+
+// fakeNodes are four Ready H100 nodes: two in local block lb-a, one in lb-b
+// and one without RDMA topology data.
+func fakeNodes() []corev1.Node {
+	node := func(name string, labels map[string]string) corev1.Node {
+		labels[instanceTypeLabel] = fakeShape
+		labels[hostnameLabel] = name
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+		}
+	}
+	block := func(localBlock string) map[string]string {
+		return map[string]string{
+			topology.IslandLabel:       "isl-1",
+			topology.NetworkBlockLabel: "nb-1",
+			topology.LocalBlockLabel:   localBlock,
+		}
+	}
+	return []corev1.Node{
+		node("10.0.3.10", block("lb-b")),
+		node("10.0.3.11", block("lb-a")),
+		node("10.0.3.12", block("lb-a")),
+		node("10.0.3.13", map[string]string{topology.LocalBlockLabel: topology.NoIMDS}),
+	}
+}
+
+type fakeJob struct {
+	name, uid string
+	workers   int64
+	level     string
+	active    bool
+	admitted  bool
+	evicted   bool
+	// pending is why Kueue has not admitted the job.
+	pending string
+}
+
+// fakeKueue stands in for Kueue and the scheduler: it admits the workloads
+// of submitted MPIJobs in submission order while the ClusterQueue has quota
+// and the nodes have free GPUs, without preempting, and binds the workers of admitted jobs to nodes of one
+// domain of their required topology level.
+type fakeKueue struct {
+	t      *testing.T
+	client *fake.Clientset
+	dyn    *dynamicfake.FakeDynamicClient
+	nodes  []corev1.Node
+	quota  int64
+	jobs   []*fakeJob
+	// spread ignores the required topology level when binding workers.
+	spread bool
+	// preempt lets new jobs evict admitted ones.
+	preempt bool
+}
+
+func newFakeKueue(t *testing.T) *fakeKueue {
+	t.Helper()
+	return newFakeKueueWithQuota(t, 32)
+}
+
+// newFakeKueueWithQuota returns a fakeKueue whose ClusterQueue has a GPU nominalQuota
+// of quota.
+func newFakeKueueWithQuota(t *testing.T, quota int64) *fakeKueue {
+	t.Helper()
+	k := &fakeKueue{t: t, nodes: fakeNodes(), quota: quota}
+	k.client = fake.NewClientset()
+	for i := range k.nodes {
+		_, err := k.client.CoreV1().Nodes().Create(context.Background(), &k.nodes[i], metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	flavor := FlavorName(fakeShape)
+	cq := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kueue.x-k8s.io/v1beta2",
+		"kind":       "ClusterQueue",
+		"metadata":   map[string]interface{}{"name": flavor},
+		"spec": map[string]interface{}{"resourceGroups": []interface{}{map[string]interface{}{
+			"coveredResources": []interface{}{"nvidia.com/gpu"},
+			"flavors": []interface{}{map[string]interface{}{
+				"name":      flavor,
+				"resources": []interface{}{map[string]interface{}{"name": "nvidia.com/gpu", "nominalQuota": strconv.FormatInt(k.quota, 10)}},
+			}},
+		}}},
+	}}
+	k.dyn = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		Workloads:                            "WorkloadList",
+		ClusterQueues:                        "ClusterQueueList",
+		namespacedResources["MPIJob"]:        "MPIJobList",
+		namespacedResources["ComputeDomain"]: "ComputeDomainList",
+	}, cq)
+
+	k.dyn.PrependReactor("create", "mpijobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		job := &fakeJob{name: obj.GetName(), uid: "uid-" + obj.GetName(), active: true}
+		obj.SetUID(types.UID(job.uid))
+		job.workers, _, _ = unstructured.NestedInt64(obj.Object, "spec", "mpiReplicaSpecs", "Worker", "replicas")
+		annotations, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "metadata", "annotations")
+		job.level = annotations["kueue.x-k8s.io/podset-required-topology"]
+		k.jobs = append(k.jobs, job)
+		k.reconcile()
+		return false, nil, nil
+	})
+	k.dyn.PrependReactor("delete", "mpijobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.DeleteAction).GetName()
+		k.jobs = slices.DeleteFunc(k.jobs, func(job *fakeJob) bool {
+			if job.name == name {
+				job.admitted = false
+				k.writeJob(job)
+				require.NoError(t, k.dyn.Tracker().Delete(Workloads, "default", "mpijob-"+name))
+			}
+			return job.name == name
+		})
+		k.reconcile()
+		return false, nil, nil
+	})
+	k.dyn.PrependReactor("patch", "workloads", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		var body struct {
+			Spec struct {
+				Active bool `json:"active"`
+			} `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(patch.GetPatch(), &body))
+		for _, job := range k.jobs {
+			if "mpijob-"+job.name == patch.GetName() {
+				job.active = body.Spec.Active
+			}
+		}
+		k.reconcile()
+		obj, err := k.dyn.Tracker().Get(Workloads, "default", patch.GetName())
+		return true, obj, err
+	})
+	return k
+}
+
+func (k *fakeKueue) gpus(job *fakeJob) int64 { return job.workers * 8 }
+
+// capacity is the number of GPUs the nodes have, or the quota if lower.
+func (k *fakeKueue) capacity() int64 { return min(k.quota, int64(len(k.nodes))*8) }
+
+func (k *fakeKueue) reconcile() {
+	var used int64
+	for _, job := range k.jobs {
+		if job.admitted && !job.active {
+			job.admitted, job.evicted = false, true
+		}
+		if job.admitted {
+			used += k.gpus(job)
+		}
+	}
+	for _, job := range k.jobs {
+		if job.admitted || !job.active {
+			continue
+		}
+		if k.preempt {
+			for _, other := range k.jobs {
+				if used+k.gpus(job) > k.capacity() && other.admitted {
+					other.admitted, other.evicted = false, true
+					used -= k.gpus(other)
+				}
+			}
+		}
+		switch {
+		case used+k.gpus(job) > k.quota:
+			job.pending = "couldn't assign flavors to pod set worker: insufficient unused quota for nvidia.com/gpu in flavor " + FlavorName(fakeShape)
+		case used+k.gpus(job) > k.capacity():
+			job.pending = fmt.Sprintf("couldn't assign flavors to pod set worker: topology %q doesn't allow to fit any of %d pod(s)", "oci-rdma", job.workers)
+		default:
+			job.admitted, job.evicted = true, false
+			used += k.gpus(job)
+		}
+	}
+	for _, job := range k.jobs {
+		k.writeJob(job)
+	}
+
+	flavor := FlavorName(fakeShape)
+	cq, err := k.dyn.Tracker().Get(ClusterQueues, "", flavor)
+	require.NoError(k.t, err)
+	usage := []interface{}{map[string]interface{}{
+		"name":      flavor,
+		"resources": []interface{}{map[string]interface{}{"name": "nvidia.com/gpu", "total": strconv.FormatInt(used, 10)}},
+	}}
+	require.NoError(k.t, unstructured.SetNestedSlice(cq.(*unstructured.Unstructured).Object, usage, "status", "flavorsUsage"))
+	require.NoError(k.t, k.dyn.Tracker().Update(ClusterQueues, cq, ""))
+}
+
+// writeJob writes the Workload of job and creates or deletes its worker pods.
+func (k *fakeKueue) writeJob(job *fakeJob) {
+	ctx := context.Background()
+	flavor := FlavorName(fakeShape)
+	condition := func(kind, status, message string) interface{} {
+		return map[string]interface{}{"type": kind, "status": status, "message": message}
+	}
+	w := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kueue.x-k8s.io/v1beta2",
+		"kind":       "Workload",
+		"metadata": map[string]interface{}{
+			"name":      "mpijob-" + job.name,
+			"namespace": "default",
+			"labels":    map[string]interface{}{jobUIDLabel: job.uid},
+		},
+		"spec": map[string]interface{}{"active": job.active},
+	}}
+	var conditions []interface{}
+	if job.admitted {
+		worker := map[string]interface{}{"name": workerPodSet, "flavors": map[string]interface{}{"nvidia.com/gpu": flavor}}
+		if job.level != "" {
+			worker["topologyAssignment"] = map[string]interface{}{"levels": []interface{}{hostnameLabel}}
+		}
+		conditions = append(conditions, condition("QuotaReserved", "True", "Quota reserved in ClusterQueue "+flavor), condition("Admitted", "True", "The workload is admitted"))
+		require.NoError(k.t, unstructured.SetNestedMap(w.Object, map[string]interface{}{
+			"clusterQueue":      flavor,
+			"podSetAssignments": []interface{}{map[string]interface{}{"name": "launcher", "flavors": map[string]interface{}{}}, worker},
+		}, "status", "admission"))
+	} else {
+		conditions = append(conditions, condition("QuotaReserved", "False", job.pending))
+	}
+	if job.evicted {
+		conditions = append(conditions, condition("Evicted", "True", "The workload is deactivated"))
+	}
+	require.NoError(k.t, unstructured.SetNestedSlice(w.Object, conditions, "status", "conditions"))
+	if _, err := k.dyn.Tracker().Get(Workloads, "default", w.GetName()); err == nil {
+		require.NoError(k.t, k.dyn.Tracker().Update(Workloads, w, "default"))
+	} else {
+		require.NoError(k.t, k.dyn.Tracker().Create(Workloads, w, "default"))
+	}
+
+	selector := fmt.Sprintf("%s=%s,%s=worker", jobNameLabel, job.name, jobRoleLabel)
+	pods, err := k.client.CoreV1().Pods("default").List(ctx, metav1.ListOptions{LabelSelector: selector})
+	require.NoError(k.t, err)
+	if !job.admitted {
+		for _, pod := range pods.Items {
+			require.NoError(k.t, k.client.CoreV1().Pods("default").Delete(ctx, pod.Name, metav1.DeleteOptions{}))
+		}
+		return
+	}
+	if len(pods.Items) > 0 {
+		return
+	}
+	nodes := k.nodes
+	if job.level != "" && !k.spread {
+		_, domain := PickLevel(k.nodes, []string{job.level}, int(job.workers))
+		nodes = slices.DeleteFunc(slices.Clone(nodes), func(node corev1.Node) bool { return node.Labels[job.level] != domain })
+	}
+	for i := range job.workers {
+		_, err := k.client.CoreV1().Pods("default").Create(ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-worker-%d", job.name, i),
+				Namespace: "default",
+				Labels:    map[string]string{jobNameLabel: job.name, jobRoleLabel: "worker"},
+			},
+			Spec: corev1.PodSpec{NodeName: nodes[i].Name},
+		}, metav1.CreateOptions{})
+		require.NoError(k.t, err)
+	}
+}
+
+func (k *fakeKueue) config(t *testing.T) Config {
+	t.Helper()
+	path, err := nccl.ManifestPath(filepath.Join("..", ".."), fakeShape, false)
+	require.NoError(t, err)
+	manifest, err := os.ReadFile(path)
+	require.NoError(t, err)
+	topo, err := ParseTopology(readRepositoryFile(t, "terraform", "files", "kueue", "topology.yaml"))
+	require.NoError(t, err)
+	return Config{
+		Namespace:    "default",
+		Shape:        fakeShape,
+		Manifest:     manifest,
+		Levels:       topo.Levels,
+		Timeout:      time.Second,
+		Settle:       20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+		Logf:         t.Logf,
+	}
+}
+
+func TestPickLevel(t *testing.T) {
+	levels := []string{topology.IslandLabel, topology.NetworkBlockLabel, topology.LocalBlockLabel, hostnameLabel}
+	level, domain := PickLevel(fakeNodes(), levels, 2)
+	require.Equal(t, topology.LocalBlockLabel, level)
+	require.Equal(t, "lb-a", domain)
+
+	level, domain = PickLevel(fakeNodes(), levels, 3)
+	require.Equal(t, topology.NetworkBlockLabel, level)
+	require.Equal(t, "nb-1", domain)
+
+	level, _ = PickLevel(fakeNodes(), levels, 4)
+	require.Empty(t, level, "nodes without RDMA data are in no domain")
+}
+
+func TestCheckAdmissionPlacesWorkersInOneDomain(t *testing.T) {
+	k := newFakeKueue(t)
+	placement, err := CheckAdmission(context.Background(), k.client, k.dyn, k.config(t))
+	require.NoError(t, err)
+	require.Equal(t, Placement{Level: topology.LocalBlockLabel, Domain: "lb-a", Nodes: []string{"10.0.3.11", "10.0.3.12"}}, placement)
+
+	var job *unstructured.Unstructured
+	for _, action := range k.dyn.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok && action.GetResource().Resource == "mpijobs" {
+			job = create.GetObject().(*unstructured.Unstructured)
+		}
+	}
+	require.NotNil(t, job)
+	require.Equal(t, "default", job.GetNamespace())
+	require.Equal(t, FlavorName(fakeShape), job.GetLabels()["kueue.x-k8s.io/queue-name"])
+	annotations, _, _ := unstructured.NestedStringMap(job.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "metadata", "annotations")
+	require.Equal(t, topology.LocalBlockLabel, annotations["kueue.x-k8s.io/podset-required-topology"])
+	require.Empty(t, k.jobs, "the job is deleted")
+
+	_, used, err := Quota(mustGet(t, k.dyn, ClusterQueues, FlavorName(fakeShape)), FlavorName(fakeShape), "nvidia.com/gpu")
+	require.NoError(t, err)
+	require.Zero(t, used)
+}
+
+func TestCheckAdmissionFailsWhenWorkersSpanDomains(t *testing.T) {
+	k := newFakeKueue(t)
+	k.spread = true
+	_, err := CheckAdmission(context.Background(), k.client, k.dyn, k.config(t))
+	require.ErrorContains(t, err, "span "+topology.LocalBlockLabel+" domains")
+	require.Empty(t, k.jobs, "the job is deleted on failure")
+}
+
+func TestCheckAdmissionFailsWithoutAdmission(t *testing.T) {
+	k := newFakeKueue(t)
+	k.quota = 8
+	cfg := k.config(t)
+	cfg.Timeout = 20 * time.Millisecond
+	_, err := CheckAdmission(context.Background(), k.client, k.dyn, cfg)
+	require.ErrorContains(t, err, "insufficient unused quota")
+}
+
+func TestCheckPreemption(t *testing.T) {
+	k := newFakeKueue(t)
+	require.NoError(t, CheckPreemption(context.Background(), k.client, k.dyn, k.config(t)))
+	require.Empty(t, k.jobs)
+
+	var patches []string
+	for _, action := range k.dyn.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			patches = append(patches, patch.GetName()+" "+string(patch.GetPatch()))
+		}
+	}
+	require.Equal(t, []string{
+		`mpijob-kueue-e2e-holder {"spec":{"active":false}}`,
+		`mpijob-kueue-e2e-holder {"spec":{"active":true}}`,
+	}, patches)
+}
+
+func TestCheckPreemptionFillsTheNodesOfALargerQuota(t *testing.T) {
+	k := newFakeKueueWithQuota(t, 10000)
+	cfg := k.config(t)
+	var logs []string
+	cfg.Logf = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	require.NoError(t, CheckPreemption(context.Background(), k.client, k.dyn, cfg))
+	require.Empty(t, k.jobs)
+	require.Contains(t, logs, fmt.Sprintf("kueue-e2e-waiter stays queued: couldn't assign flavors to pod set worker: topology %q doesn't allow to fit any of 2 pod(s)", "oci-rdma"))
+}
+
+func TestCheckPreemptionFailsWhenTheQueuedJobPreempts(t *testing.T) {
+	k := newFakeKueue(t)
+	k.preempt = true
+	err := CheckPreemption(context.Background(), k.client, k.dyn, k.config(t))
+	require.ErrorContains(t, err, "got quota while ClusterQueue")
+}
+
+func TestCheckPreemptionNeedsAnIdleClusterQueue(t *testing.T) {
+	k := newFakeKueue(t)
+	k.jobs = append(k.jobs, &fakeJob{name: "training", uid: "uid-training", workers: 1, active: true})
+	k.reconcile()
+	err := CheckPreemption(context.Background(), k.client, k.dyn, k.config(t))
+	require.ErrorContains(t, err, "already uses 8 of 32")
+}
+
+func mustGet(t *testing.T, dyn *dynamicfake.FakeDynamicClient, gvr schema.GroupVersionResource, name string) *unstructured.Unstructured {
+	t.Helper()
+	obj, err := dyn.Resource(gvr).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return obj
+}
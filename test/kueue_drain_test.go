@@ -0,0 +1,303 @@
+package test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKubectl stands in for kubectl on PATH when running predestroy-drain.sh.
+// Its state lives in $FAKE_KUBE:
+//   - crds: the output of "kubectl get crd"
+//   - objects/<kind>/<namespace>|<name>: Kueue objects. An object whose file
+//     contains "finalizer" survives delete, like one whose finalizer no
+//     controller clears, until its finalizers are patched away
+//   - down: every call fails as if the API server were gone
+//   - down-after: the API server goes away after this many calls
+//   - hang: seconds a delete of stuck objects blocks before it times out
+//
+// Every call is appended to calls, deletes that time out to timeouts, and
+// calls the script should never make to unexpected.
+const fakeKubectl = `#!/usr/bin/env bash
+set -u
+state="$FAKE_KUBE"
+echo "$*" >> "$state/calls"
+if [ -e "$state/down" ] || { [ -e "$state/down-after" ] && [ "$(wc -l < "$state/calls")" -gt "$(cat "$state/down-after")" ]; }; then
+  echo "The connection to the server 10.0.0.10:6443 was refused - did you specify the right host or port?" >&2
+  exit 1
+fi
+unexpected() {
+  echo "$*" >> "$state/unexpected"
+  echo "fake kubectl: unexpected call: $*" >&2
+  exit 99
+}
+
+verb="$1"; shift
+case "$verb" in
+get)
+  if [ "$1" = crd ]; then
+    echo "NAME                                CREATED AT"
+    cat "$state/crds"
+    exit 0
+  fi
+  kind="${1%%.*}"
+  [ "$1" = "$kind.kueue.x-k8s.io" ] && [ "$2" = -A ] || unexpected get "$@"
+  [ "$3 $4" = "-o jsonpath={range .items[*]}{.metadata.namespace}{\"|\"}{.metadata.name}{\"\\n\"}{end}" ] || unexpected get "$@"
+  for f in "$state/objects/$kind"/*; do
+    [ -e "$f" ] && printf '%s\n' "$(basename "$f")"
+  done
+  exit 0
+  ;;
+delete)
+  kind="${1%%.*}"
+  [ "$1" = "$kind.kueue.x-k8s.io" ] || unexpected delete "$@"
+  case " $* " in *" --all "*) ;; *) unexpected delete "$@" ;; esac
+  case " $* " in *" --all-namespaces "*) ;; *) unexpected delete "$@" ;; esac
+  stuck=""
+  for f in "$state/objects/$kind"/*; do
+    [ -e "$f" ] || continue
+    name="$(basename "$f")"
+    if grep -q finalizer "$f"; then
+      echo deleting >> "$f"
+      stuck="${name#*|}"
+    else
+      rm "$f"
+      echo "$kind.kueue.x-k8s.io \"${name#*|}\" deleted"
+    fi
+  done
+  if [ -n "$stuck" ]; then
+    [ -e "$state/hang" ] && sleep "$(cat "$state/hang")"
+    echo "$kind/$stuck" >> "$state/timeouts"
+    echo "error: timed out waiting for the condition on $kind/$stuck" >&2
+    exit 1
+  fi
+  exit 0
+  ;;
+patch)
+  kind="${1%%.*}"; name="$2"; shift 2
+  ns=""
+  if [ "$1" = -n ]; then ns="$2"; shift 2; fi
+  [ "$*" = "--type=merge -p {\"metadata\":{\"finalizers\":[]}}" ] || unexpected patch "$kind" "$name" "$@"
+  f="$state/objects/$kind/$ns|$name"
+  if [ ! -e "$f" ]; then
+    echo "Error from server (NotFound): $kind.kueue.x-k8s.io \"$name\" not found" >&2
+    exit 1
+  fi
+  if grep -q deleting "$f"; then rm "$f"; else : > "$f"; fi
+  echo "$kind.kueue.x-k8s.io/$name patched"
+  exit 0
+  ;;
+esac
+unexpected "$verb" "$@"
+`
+
+const kueueCRDs = `clusterqueues.kueue.x-k8s.io        2026-01-05T10:00:00Z
+localqueues.kueue.x-k8s.io          2026-01-05T10:00:00Z
+mpijobs.kubeflow.org                2026-01-05T09:58:00Z
+resourceflavors.kueue.x-k8s.io      2026-01-05T10:00:00Z
+topologies.kueue.x-k8s.io           2026-01-05T10:00:00Z
+workloads.kueue.x-k8s.io            2026-01-05T10:00:00Z
+`
+
+// newFakeKube creates the state of fakeKubectl with crds and objects, which
+// maps "<kind>/<namespace>|<name>" to whether the object has a finalizer no
+// controller clears.
+func newFakeKube(t *testing.T, crds string, objects map[string]bool) string {
+	t.Helper()
+	state := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(state, "crds"), []byte(crds), 0644))
+	for object, stuck := range objects {
+		path := filepath.Join(state, "objects", object)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		contents := ""
+		if stuck {
+			contents = "finalizer\n"
+		}
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	}
+	return state
+}
+
+// runKueueDrain runs predestroy-drain.sh the way the destroy provisioners do,
+// with fakeKubectl on PATH serving state. It returns the script's output and
+// the kubectl calls it made.
+func runKueueDrain(t *testing.T, state string) (string, []string, error) {
+	t.Helper()
+
+	script, err := filepath.Abs(filepath.Join(terraformDir(), "files", "kueue", "predestroy-drain.sh"))
+	require.NoError(t, err)
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "kubectl"), []byte(fakeKubectl), 0755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", script)
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "FAKE_KUBE="+state)
+	output, runErr := cmd.CombinedOutput()
+	require.NoError(t, ctx.Err(), "drain script did not finish; destroy would hang:\n%s", output)
+
+	_, err = os.Stat(filepath.Join(state, "unexpected"))
+	require.True(t, os.IsNotExist(err), "drain script made kubectl calls the fake does not know:\n%s", output)
+	calls, err := os.ReadFile(filepath.Join(state, "calls"))
+	require.NoError(t, err)
+	return string(output), strings.Split(strings.TrimSpace(string(calls)), "\n"), runErr
+}
+
+// remainingObjects lists the objects left in the state of fakeKubectl.
+func remainingObjects(t *testing.T, state string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(state, "objects", "*", "*"))
+	require.NoError(t, err)
+	var objects []string
+	for _, path := range paths {
+		objects = append(objects, filepath.Base(filepath.Dir(path))+"/"+filepath.Base(path))
+	}
+	return objects
+}
+
+// stateLines returns the lines of a file in the state of fakeKubectl.
+func stateLines(t *testing.T, state, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(state, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// callsWithVerb returns the calls that start with verb, without it.
+func callsWithVerb(calls []string, verb string) []string {
+	var out []string
+	for _, call := range calls {
+		if rest, ok := strings.CutPrefix(call, verb+" "); ok {
+			out = append(out, rest)
+		}
+	}
+	return out
+}
+
+func TestKueueDrainDeletesEveryKueueObject(t *testing.T) {
+	state := newFakeKube(t, kueueCRDs, map[string]bool{
+		"workloads/default|mpijob-nccl-tests-3f2a1": false,
+		"localqueues/default|bm-gpu-h100-8-rdma":    false,
+		"clusterqueues/|bm-gpu-h100-8-rdma":         false,
+		"resourceflavors/|bm-gpu-h100-8-rdma":       false,
+		"topologies/|oci-rdma":                      false,
+	})
+
+	output, calls, err := runKueueDrain(t, state)
+	require.NoError(t, err, output)
+	require.Contains(t, output, "Kueue CR drain complete.")
+	require.Empty(t, remainingObjects(t, state))
+	require.Empty(t, callsWithVerb(calls, "patch"), "nothing was stuck")
+
+	var kinds []string
+	for _, call := range callsWithVerb(calls, "delete") {
+		require.Contains(t, call, " --timeout=60s", "every delete is bounded")
+		kinds = append(kinds, strings.Fields(call)[0])
+	}
+	require.Equal(t, []string{
+		"workloads.kueue.x-k8s.io",
+		"localqueues.kueue.x-k8s.io",
+		"clusterqueues.kueue.x-k8s.io",
+		"resourceflavors.kueue.x-k8s.io",
+		"topologies.kueue.x-k8s.io",
+	}, kinds[:5], "workloads go before the queues that hold them, and queues before the flavors and topology they use")
+}
+
+func TestKueueDrainStripsStuckFinalizers(t *testing.T) {
+	state := newFakeKube(t, kueueCRDs, map[string]bool{
+		"workloads/team-a|mpijob-nccl-tests-3f2a1": true,
+		"workloads/team-a|mpijob-nccl-tests-9c7d0": false,
+		"clusterqueues/|bm-gpu-h100-8-rdma":        true,
+		"resourceflavors/|bm-gpu-h100-8-rdma":      false,
+	})
+
+	output, calls, err := runKueueDrain(t, state)
+	require.NoError(t, err, "a delete that times out must not fail the destroy:\n%s", output)
+	require.Equal(t, []string{"workloads/mpijob-nccl-tests-3f2a1", "clusterqueues/bm-gpu-h100-8-rdma"}, stateLines(t, state, "timeouts"))
+	require.Contains(t, output, "Kueue CR drain complete.")
+	require.Empty(t, remainingObjects(t, state), "stuck objects are released")
+	require.Equal(t, []string{
+		`workloads.kueue.x-k8s.io mpijob-nccl-tests-3f2a1 -n team-a --type=merge -p {"metadata":{"finalizers":[]}}`,
+		`clusterqueues.kueue.x-k8s.io bm-gpu-h100-8-rdma --type=merge -p {"metadata":{"finalizers":[]}}`,
+	}, callsWithVerb(calls, "patch"), "namespaced objects are patched in their namespace, cluster-scoped ones without one")
+}
+
+func TestKueueDrainSkipsClustersWithoutKueue(t *testing.T) {
+	state := newFakeKube(t, "mpijobs.kubeflow.org                2026-01-05T09:58:00Z\n", nil)
+
+	output, calls, err := runKueueDrain(t, state)
+	require.NoError(t, err, output)
+	require.Contains(t, output, "No Kueue CRDs present; nothing to drain.")
+	require.Equal(t, []string{"get crd"}, calls)
+}
+
+func TestKueueDrainToleratesAMissingAPIServer(t *testing.T) {
+	objects := map[string]bool{
+		"workloads/default|mpijob-nccl-tests-3f2a1": true,
+		"clusterqueues/|bm-gpu-h100-8-rdma":         false,
+	}
+
+	t.Run("before the drain", func(t *testing.T) {
+		state := newFakeKube(t, kueueCRDs, objects)
+		require.NoError(t, os.WriteFile(filepath.Join(state, "down"), nil, 0644))
+
+		output, calls, err := runKueueDrain(t, state)
+		require.NoError(t, err, output)
+		require.Equal(t, []string{"get crd"}, calls, "nothing else is tried without an API server")
+		require.Len(t, remainingObjects(t, state), 2)
+	})
+
+	t.Run("during the drain", func(t *testing.T) {
+		state := newFakeKube(t, kueueCRDs, objects)
+		require.NoError(t, os.WriteFile(filepath.Join(state, "down-after"), []byte("2"), 0644))
+
+		output, calls, err := runKueueDrain(t, state)
+		require.NoError(t, err, output)
+		require.Contains(t, output, "Kueue CR drain complete.")
+		require.Contains(t, remainingObjects(t, state), "clusterqueues/|bm-gpu-h100-8-rdma", "objects are left behind, not retried forever")
+		require.Empty(t, callsWithVerb(calls, "patch"))
+		require.Len(t, callsWithVerb(calls, "delete"), len(callsWithVerb(calls, "get"))-1, "each kind is deleted and listed once")
+	})
+}
+
+func TestKueueDrainContinuesAfterDeleteTimeouts(t *testing.T) {
+	state := newFakeKube(t, kueueCRDs, map[string]bool{
+		"workloads/default|mpijob-nccl-tests-3f2a1": true,
+		"localqueues/default|bm-gpu-h100-8-rdma":    true,
+		"clusterqueues/|bm-gpu-h100-8-rdma":         true,
+		"topologies/|oci-rdma":                      false,
+	})
+	require.NoError(t, os.WriteFile(filepath.Join(state, "hang"), []byte("0.2"), 0644))
+
+	output, calls, err := runKueueDrain(t, state)
+	require.NoError(t, err, output)
+	require.Len(t, stateLines(t, state, "timeouts"), 3)
+	require.Empty(t, remainingObjects(t, state))
+
+	deletes := callsWithVerb(calls, "delete")
+	require.NotEmpty(t, deletes)
+	for _, call := range deletes {
+		require.Contains(t, call, " --timeout=60s")
+		require.Contains(t, call, " --ignore-not-found")
+	}
+	lastDelete, firstPatch := -1, -1
+	for i, call := range calls {
+		if strings.HasPrefix(call, "delete ") {
+			lastDelete = i
+		}
+		if strings.HasPrefix(call, "patch ") && firstPatch == -1 {
+			firstPatch = i
+		}
+	}
+	require.NotEqual(t, -1, firstPatch)
+	require.Less(t, lastDelete, firstPatch, "finalizers are stripped only after every delete had its chance")
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/kueue"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/nccl"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// kueueWorkers is the worker count of the jobs TestKueue places.
+const kueueWorkers = 2
+
+// TestKueue submits nccl-tests or rccl-tests MPIJobs to the LocalQueue the
+// stack creates with install_kueue and checks admission through the
+// ClusterQueue of the Kueue pool, its GPU quota accounting, placement of the
+// workers in one topology domain, and that jobs queue behind a full pool and
+// are admitted when an evicted job frees it.
+func TestKueue(t *testing.T) {
+	skipUnlessEnv(t, "RUN_KUEUE_TESTS")
+
+	cluster := suiteCluster(t, kueueSuiteVars())
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping Kueue: API requests are not recorded in cassettes")
+	}
+	if cluster.options == nil {
+		t.Skip("Skipping Kueue: existing cluster has no terraform variables")
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	installed, err := varBool(vars, "install_kueue")
+	require.NoError(t, err)
+	if !installed {
+		t.Skip("Skipping Kueue: install_kueue is false")
+	}
+	mpiOperator, err := varBool(vars, "install_mpi_operator")
+	require.NoError(t, err)
+	if !mpiOperator {
+		t.Skip("Skipping Kueue: install_mpi_operator is false")
+	}
+	pool, shape, err := kueuePool(vars)
+	require.NoError(t, err)
+	if pool == "" {
+		t.Skipf("Skipping Kueue: the Kueue pool is not an RDMA GPU pool with %d nodes", kueueWorkers)
+	}
+	namespace, _ := vars["kueue_local_queue_default_namespace"].(string)
+	require.NotEmpty(t, namespace, "kueue_local_queue_default_namespace is not set")
+
+	data, err := os.ReadFile(filepath.Join(terraformDir(), "files", "kueue", "topology.yaml"))
+	require.NoError(t, err)
+	topology, err := kueue.ParseTopology(data)
+	require.NoError(t, err)
+	networkOperator, err := varBool(vars, "deploy_nvidia_network_operator")
+	require.NoError(t, err)
+	s, _ := shapes.Lookup(shape)
+	path, err := nccl.ManifestPath(filepath.Dir(terraformDir()), shape, networkOperator && s.VFs > 0)
+	require.NoError(t, err)
+	manifest, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+	config, err := clientcmd.BuildConfigFromFlags("", cluster.kubeconfigPath)
+	require.NoError(t, err)
+	dyn, err := dynamic.NewForConfig(config)
+	require.NoError(t, err)
+
+	cfg := kueue.Config{
+		Namespace: namespace,
+		Shape:     shape,
+		Manifest:  manifest,
+		Workers:   kueueWorkers,
+		Levels:    topology.Levels,
+		Name:      "kueue-" + currentRunID(),
+		Logf:      func(format string, args ...any) { t.Logf("kueue: "+format, args...) },
+	}
+	t.Logf("Submitting %s jobs to LocalQueue %s/%s for the %s nodes of %s", filepath.Base(path), namespace, kueue.FlavorName(shape), shape, pool)
+
+	t.Run("admission", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		defer cancel()
+		placement, err := kueue.CheckAdmission(ctx, client, dyn, cfg)
+		require.NoError(t, err, "job was not admitted and placed as requested")
+		if placement.Level == "" {
+			t.Logf("Workers ran on %v; no topology domain had %d nodes", placement.Nodes, kueueWorkers)
+		} else {
+			t.Logf("Workers ran on %v in %s=%s", placement.Nodes, placement.Level, placement.Domain)
+		}
+	})
+
+	t.Run("preemption", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
+		defer cancel()
+		require.NoError(t, kueue.CheckPreemption(ctx, client, dyn, cfg), "queued jobs did not wait for and take over the quota")
+	})
+}
+
+// kueueSuiteVars returns the topology overrides TestKueue needs.
+func kueueSuiteVars() map[string]interface{} {
+	return map[string]interface{}{
+		"install_kueue":        true,
+		"install_mpi_operator": true,
+	}
+}
+
+// kueuePool returns the pool and shape the stack creates the Kueue queues
+// for, like local.kueue_shape: oke-gmc when it is enabled, oke-rdma
+// otherwise. The pool is empty when it is not an RDMA GPU pool with at
+// least kueueWorkers nodes.
+func kueuePool(vars map[string]interface{}) (string, string, error) {
+	gmc, err := varBool(vars, "worker_gmc_enabled")
+	if err != nil {
+		return "", "", err
+	}
+	pool := "oke-rdma"
+	if gmc {
+		pool = "oke-gmc"
+	}
+	pools, err := gpuPoolShapes(vars)
+	if err != nil {
+		return "", "", err
+	}
+	sizes, err := expectedPoolSizes(vars)
+	if err != nil {
+		return "", "", err
+	}
+	shape, ok := pools[pool]
+	if s, _ := shapes.Lookup(shape); !ok || s.RDMANICs == 0 || sizes[pool] < kueueWorkers {
+		return "", "", nil
+	}
+	return pool, shape, nil
+}
+
+func TestKueuePool(t *testing.T) {
+	defaults, err := terraformVariableDefaults(terraformDir())
+	require.NoError(t, err)
+	pool, _, err := kueuePool(defaults)
+	require.NoError(t, err)
+	require.Empty(t, pool)
+
+	pool, shape, err := kueuePool(mergeVars(defaults, map[string]interface{}{
+		"worker_rdma_enabled":              true,
+		"worker_gmc_enabled":               true,
+		"worker_gmc_scale_target_size":     2,
+		"worker_gmc_gpu_memory_fabric_ids": "ocid1.computegpumemoryfabric.oc1..a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "oke-gmc", pool, "the queues are created for the GMC pool when it is enabled")
+	require.Equal(t, "BM.GPU.GB200-v3.4", shape)
+
+	pool, shape, err = kueuePool(mergeVars(defaults, map[string]interface{}{"worker_rdma_enabled": true}))
+	require.NoError(t, err)
+	require.Equal(t, "oke-rdma", pool)
+	require.Equal(t, "BM.GPU.H100.8", shape)
+
+	pool, _, err = kueuePool(mergeVars(defaults, map[string]interface{}{"worker_rdma_enabled": true, "worker_rdma_pool_size": 1}))
+	require.NoError(t, err)
+	require.Empty(t, pool, "a single node cannot run the two-worker jobs")
+}
@@ -0,0 +1,18 @@
+package test
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+// TestMain owns the optional shared cluster fixture (SHARED_FIXTURE=1), so the
+// provisioning suites can share a single apply/destroy cycle, and the watchdog
+// that tears clusters down on Ctrl-C, SIGTERM or an approaching -timeout.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	stop := watchForInterrupts(testTimeout())
+	code := runWithSharedFixture(m)
+	stop()
+	os.Exit(code)
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	http_helper "github.com/gruntwork-io/terratest/modules/http-helper"
-	"github.com/gruntwork-io/terratest/modules/terraform"
 	"github.com/stretchr/testify/require"
 )
 
@@ -16,38 +15,45 @@ import (
 func TestMonitoring(t *testing.T) {
 	skipUnlessEnv(t, "RUN_MONITORING_TESTS")
 
-	options := newTerraformOptions(t, map[string]interface{}{
-		"install_monitoring": true,
-		"install_node_problem_detector_kube_prometheus_stack": true,
-		"install_grafana":                     true,
-		"install_grafana_dashboards":          true,
-		"install_amd_device_metrics_exporter": false,
-		"preferred_kubernetes_services":       "internal",
-		"setup_alerting":                      false,
-	})
+	cluster := suiteCluster(t, monitoringSuiteVars())
 
-	defer terraform.Destroy(t, options)
-	terraform.InitAndApply(t, options)
+	t.Run("State", func(t *testing.T) {
+		resources := cluster.stateList(t)
 
-	resources := terraformStateList(t, options)
+		// Verify core monitoring components
+		requireStateHasPrefix(t, resources, "helm_release.prometheus")
+		requireStateHasPrefix(t, resources, "helm_release.node_problem_detector_nvidia")
+		requireStateHasPrefix(t, resources, "random_password.grafana_admin_password")
 
-	// Verify core monitoring components
-	requireStateHasPrefix(t, resources, "helm_release.prometheus")
-	requireStateHasPrefix(t, resources, "helm_release.node_problem_detector_nvidia")
-	requireStateHasPrefix(t, resources, "random_password.grafana_admin_password")
+		// Verify NVIDIA DCGM Exporter ServiceMonitor
+		requireStateHasPrefix(t, resources, "kubectl_manifest.nvidia_dcgm_exporter_service_monitor")
 
-	// Verify NVIDIA DCGM Exporter ServiceMonitor
-	requireStateHasPrefix(t, resources, "kubectl_manifest.nvidia_dcgm_exporter_service_monitor")
-
-	// Verify Grafana dashboards ConfigMaps
-	requireStateHasPrefix(t, resources, "kubernetes_config_map_v1.grafana_common_dashboards")
+		// Verify Grafana dashboards ConfigMaps
+		requireStateHasPrefix(t, resources, "kubernetes_config_map_v1.grafana_common_dashboards")
+	})
 
 	// Verify Grafana login if URL is available
-	grafanaURL := terraform.Output(t, options, "grafana_url")
-	if grafanaURL != "" {
-		grafanaPassword := terraform.Output(t, options, "grafana_admin_password")
+	t.Run("GrafanaLogin", func(t *testing.T) {
+		grafanaURL := cluster.outputs.GrafanaURL
+		if grafanaURL == "" {
+			t.Skip("Skipping Grafana login: grafana_url is empty")
+		}
+		grafanaPassword := cluster.outputs.GrafanaAdminPassword
 		require.NotEmpty(t, grafanaPassword, "grafana_admin_password should not be empty")
 		verifyGrafanaLogin(t, grafanaURL, "admin", grafanaPassword)
+	})
+}
+
+// monitoringSuiteVars returns the topology overrides TestMonitoring needs.
+func monitoringSuiteVars() map[string]interface{} {
+	return map[string]interface{}{
+		"install_monitoring": true,
+		"install_node_problem_detector_kube_prometheus_stack": true,
+		"install_grafana":                     true,
+		"install_grafana_dashboards":          true,
+		"install_amd_device_metrics_exporter": false,
+		"preferred_kubernetes_services":       "internal",
+		"setup_alerting":                      false,
 	}
 }
 
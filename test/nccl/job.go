@@ -0,0 +1,419 @@
+package nccl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// Labels the MPI Operator sets on the launcher pod, and the label that submits
+// a job through a Kueue LocalQueue.
+const (
+	jobNameLabel   = "training.kubeflow.org/job-name"
+	jobRoleLabel   = "training.kubeflow.org/job-role"
+	queueNameLabel = "kueue.x-k8s.io/queue-name"
+	kueueGroup     = "kueue.x-k8s.io"
+
+	requiredTopologyAnnotation  = "kueue.x-k8s.io/podset-required-topology"
+	preferredTopologyAnnotation = "kueue.x-k8s.io/podset-preferred-topology"
+)
+
+var mpiJobKind = schema.GroupVersionKind{Group: "kubeflow.org", Version: "v2beta1", Kind: "MPIJob"}
+
+// apiResource is where Run creates an object of a given kind.
+type apiResource struct {
+	schema.GroupVersionResource
+	namespaced bool
+}
+
+// apiResources are the kinds the nccl-tests and rccl-tests manifests contain.
+var apiResources = map[schema.GroupVersionKind]apiResource{
+	{Group: kueueGroup, Version: "v1beta2", Kind: "ResourceFlavor"}:           {schema.GroupVersionResource{Group: kueueGroup, Version: "v1beta2", Resource: "resourceflavors"}, false},
+	{Group: kueueGroup, Version: "v1beta2", Kind: "ClusterQueue"}:             {schema.GroupVersionResource{Group: kueueGroup, Version: "v1beta2", Resource: "clusterqueues"}, false},
+	{Group: kueueGroup, Version: "v1beta2", Kind: "LocalQueue"}:               {schema.GroupVersionResource{Group: kueueGroup, Version: "v1beta2", Resource: "localqueues"}, true},
+	{Group: "resource.nvidia.com", Version: "v1beta1", Kind: "ComputeDomain"}: {schema.GroupVersionResource{Group: "resource.nvidia.com", Version: "v1beta1", Resource: "computedomains"}, true},
+	mpiJobKind: {schema.GroupVersionResource{Group: "kubeflow.org", Version: "v2beta1", Resource: "mpijobs"}, true},
+}
+
+// ManifestPath returns the Kueue MPIJob manifest for shape under root, the
+// repository checkout: manifests/nccl-tests/kueue for NVIDIA shapes and
+// manifests/rccl-tests/kueue for AMD shapes, or their virtual-functions
+// directories for pools that use SR-IOV virtual functions.
+func ManifestPath(root, shape string, virtualFunctions bool) (string, error) {
+	s, ok := shapes.Lookup(shape)
+	if !ok || s.GPUs == 0 {
+		return "", fmt.Errorf("%s is not a GPU shape in the shapes catalog", shape)
+	}
+	tests := "nccl-tests"
+	if s.Vendor == shapes.AMD {
+		tests = "rccl-tests"
+	}
+	dir := filepath.Join(root, "manifests", tests, "kueue")
+	if virtualFunctions {
+		dir = filepath.Join(dir, "virtual-functions")
+	}
+	path := filepath.Join(dir, shape+".yaml")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no %s manifest for %s: %w", tests, shape, err)
+	}
+	return path, nil
+}
+
+// Options adjust a manifest for a run.
+type Options struct {
+	// Name replaces the MPIJob name when set.
+	Name string
+	// Workers replaces the worker replica count when set.
+	Workers int
+	// Kueue keeps the ResourceFlavor, ClusterQueue and LocalQueue and submits
+	// the job to the LocalQueue, which the manifest must define. Without it
+	// the job goes straight to the MPI Operator.
+	Kueue bool
+	// Nodes, when set, restricts the workers to these nodes with a required
+	// node affinity on kubernetes.io/hostname.
+	Nodes []string
+	// Queue submits the job to this existing LocalQueue instead of the
+	// manifest's, whose Kueue objects are dropped. It excludes Kueue.
+	Queue string
+	// Topology, when set, makes Kueue place every worker in one domain of
+	// this topology level (kueue.x-k8s.io/podset-required-topology).
+	Topology string
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// Render splits a multi-document manifest into objects and applies opts. The
+// manifest must contain exactly one MPIJob.
+func Render(manifest []byte, opts Options) ([]*unstructured.Unstructured, error) {
+	if opts.Kueue && opts.Queue != "" {
+		return nil, fmt.Errorf("options Kueue and Queue %s exclude each other", opts.Queue)
+	}
+	var objects []*unstructured.Unstructured
+	jobs := 0
+	for i, doc := range documentSeparator.Split(string(manifest), -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		data, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		if string(data) == "null" {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(data); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		gvk := obj.GroupVersionKind()
+		if gvk.Group == kueueGroup && !opts.Kueue {
+			continue
+		}
+		if gvk == mpiJobKind {
+			jobs++
+			if err := renderJob(obj, opts); err != nil {
+				return nil, err
+			}
+		}
+		objects = append(objects, obj)
+	}
+	if jobs != 1 {
+		return nil, fmt.Errorf("manifest has %d MPIJobs, want 1", jobs)
+	}
+	if opts.Kueue {
+		if err := checkLocalQueue(objects); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// checkLocalQueue requires the LocalQueue the MPIJob is submitted to to be
+// part of the manifest, since Run creates it in its own namespace.
+func checkLocalQueue(objects []*unstructured.Unstructured) error {
+	var job *unstructured.Unstructured
+	queues := map[string]bool{}
+	for _, obj := range objects {
+		switch obj.GetKind() {
+		case "MPIJob":
+			job = obj
+		case "LocalQueue":
+			queues[obj.GetName()] = true
+		}
+	}
+	queue := job.GetLabels()[queueNameLabel]
+	if !queues[queue] {
+		return fmt.Errorf("MPIJob %s is submitted to LocalQueue %s, which the manifest does not define", job.GetName(), queue)
+	}
+	return nil
+}
+
+func renderJob(job *unstructured.Unstructured, opts Options) error {
+	if opts.Name != "" {
+		job.SetName(opts.Name)
+	}
+	if !opts.Kueue {
+		labels := job.GetLabels()
+		delete(labels, queueNameLabel)
+		if opts.Queue != "" {
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[queueNameLabel] = opts.Queue
+		}
+		job.SetLabels(labels)
+	}
+	if opts.Topology != "" {
+		// Kueue rejects pod sets with more than one topology annotation.
+		annotations, _, _ := unstructured.NestedStringMap(job.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "metadata", "annotations")
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		delete(annotations, preferredTopologyAnnotation)
+		annotations[requiredTopologyAnnotation] = opts.Topology
+		if err := unstructured.SetNestedStringMap(job.Object, annotations, "spec", "mpiReplicaSpecs", "Worker", "template", "metadata", "annotations"); err != nil {
+			return fmt.Errorf("MPIJob %s: %w", job.GetName(), err)
+		}
+	}
+	if opts.Workers > 0 {
+		if err := unstructured.SetNestedField(job.Object, int64(opts.Workers), "spec", "mpiReplicaSpecs", "Worker", "replicas"); err != nil {
+			return fmt.Errorf("MPIJob %s: %w", job.GetName(), err)
+		}
+	}
+	if len(opts.Nodes) > 0 {
+		values := make([]interface{}, len(opts.Nodes))
+		for i, node := range opts.Nodes {
+			values[i] = node
+		}
+		terms := []interface{}{map[string]interface{}{
+			"matchExpressions": []interface{}{map[string]interface{}{
+				"key": "kubernetes.io/hostname", "operator": "In", "values": values,
+			}},
+		}}
+		if err := unstructured.SetNestedSlice(job.Object, terms, "spec", "mpiReplicaSpecs", "Worker", "template", "spec",
+			"affinity", "nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms"); err != nil {
+			return fmt.Errorf("MPIJob %s: %w", job.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// Config describes an all_reduce run.
+type Config struct {
+	// Namespace is created for the job and deleted afterwards.
+	Namespace string
+	// Manifest is a manifest from manifests/nccl-tests or manifests/rccl-tests
+	// (see ManifestPath), rendered with Options.
+	Manifest []byte
+	Options  Options
+	// Timeout bounds the job, including Kueue admission and image pulls.
+	// Defaults to 30 minutes.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = "nccl-tests"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 10 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// Run submits the rendered manifest, waits for the MPIJob to finish and parses
+// the launcher log. It deletes the namespace it created and any cluster-scoped
+// Kueue objects that did not exist before; existing ones are reused as-is.
+func Run(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg Config) (Result, error) {
+	cfg.setDefaults()
+
+	objects, err := Render(cfg.Manifest, cfg.Options)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, obj := range objects {
+		if _, ok := apiResources[obj.GroupVersionKind()]; !ok {
+			return Result{}, fmt.Errorf("%s %s: unsupported kind", obj.GroupVersionKind(), obj.GetName())
+		}
+	}
+
+	namespaces := client.CoreV1().Namespaces()
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.Namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return Result{}, fmt.Errorf("failed to create namespace %s: %w", cfg.Namespace, err)
+	}
+	var created []*unstructured.Unstructured
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := namespaces.Delete(cleanup, cfg.Namespace, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			cfg.Logf("failed to delete namespace %s: %v", cfg.Namespace, err)
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			obj := created[i]
+			err := dyn.Resource(apiResources[obj.GroupVersionKind()].GroupVersionResource).Delete(cleanup, obj.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				cfg.Logf("failed to delete %s %s: %v", obj.GetKind(), obj.GetName(), err)
+			}
+		}
+	}()
+
+	var job *unstructured.Unstructured
+	for _, obj := range objects {
+		res := apiResources[obj.GroupVersionKind()]
+		var resource dynamic.ResourceInterface = dyn.Resource(res.GroupVersionResource)
+		if res.namespaced {
+			obj.SetNamespace(cfg.Namespace)
+			resource = dyn.Resource(res.GroupVersionResource).Namespace(cfg.Namespace)
+		}
+		_, err := resource.Create(ctx, obj, metav1.CreateOptions{})
+		switch {
+		case err == nil && !res.namespaced:
+			created = append(created, obj)
+		case apierrors.IsAlreadyExists(err) && !res.namespaced:
+			cfg.Logf("using existing %s %s", obj.GetKind(), obj.GetName())
+		case err != nil:
+			return Result{}, fmt.Errorf("failed to create %s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		if obj.GroupVersionKind() == mpiJobKind {
+			job = obj
+		}
+	}
+
+	cfg.Logf("waiting for MPIJob %s/%s", cfg.Namespace, job.GetName())
+	failure, err := waitForJob(ctx, dyn, cfg, job.GetName())
+	if err != nil {
+		return Result{}, err
+	}
+	pod, log, err := launcherLog(ctx, client, cfg.Namespace, job.GetName())
+	if failure != "" {
+		if err == nil {
+			failure += "\n" + tail(log, 20)
+		}
+		return Result{}, fmt.Errorf("MPIJob %s/%s failed: %s", cfg.Namespace, job.GetName(), failure)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	result, err := Parse(log)
+	if err != nil {
+		return Result{}, fmt.Errorf("launcher pod %s: %w\n%s", pod, err, tail(log, 20))
+	}
+	return result, nil
+}
+
+// waitForJob polls the MPIJob until its Succeeded or Failed condition is
+// true. It returns the Failed condition's message, if any.
+func waitForJob(ctx context.Context, dyn dynamic.Interface, cfg Config, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	jobs := dyn.Resource(apiResources[mpiJobKind].GroupVersionResource).Namespace(cfg.Namespace)
+	state := "not found"
+	for {
+		job, err := jobs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			return "", fmt.Errorf("failed to get MPIJob %s: %w", name, err)
+		}
+		if err == nil {
+			conditions := jobConditions(job)
+			if message, ok := conditions["Succeeded"]; ok {
+				cfg.Logf("MPIJob %s succeeded: %s", name, message)
+				return "", nil
+			}
+			if message, ok := conditions["Failed"]; ok {
+				return message, nil
+			}
+			state = describeConditions(conditions)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("MPIJob %s/%s did not finish in %s: %s", cfg.Namespace, name, cfg.Timeout, state)
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+// jobConditions maps the type of every true condition to its message.
+func jobConditions(job *unstructured.Unstructured) map[string]string {
+	conditions := map[string]string{}
+	list, _, _ := unstructured.NestedSlice(job.Object, "status", "conditions")
+	for _, item := range list {
+		condition, ok := item.(map[string]interface{})
+		if !ok || condition["status"] != "True" {
+			continue
+		}
+		kind, _ := condition["type"].(string)
+		message, _ := condition["message"].(string)
+		conditions[kind] = message
+	}
+	return conditions
+}
+
+func describeConditions(conditions map[string]string) string {
+	if len(conditions) == 0 {
+		return "no conditions"
+	}
+	var parts []string
+	for kind, message := range conditions {
+		parts = append(parts, strings.TrimSpace(kind+" "+message))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
+
+// launcherLog returns the name and log of the job's newest launcher pod.
+func launcherLog(ctx context.Context, client kubernetes.Interface, namespace, job string) (string, string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=launcher", jobNameLabel, job, jobRoleLabel),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list launcher pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return "", "", fmt.Errorf("MPIJob %s/%s has no launcher pod", namespace, job)
+	}
+	newest := pods.Items[0]
+	for _, pod := range pods.Items[1:] {
+		if newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			newest = pod
+		}
+	}
+	raw, err := client.CoreV1().Pods(namespace).GetLogs(newest.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get logs of launcher pod %s: %w", newest.Name, err)
+	}
+	return newest.Name, string(raw), nil
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,247 @@
+// Package nccl runs the nccl-tests and rccl-tests all_reduce MPIJobs from
+// manifests/, parses their output into per-message-size rows and compares the
+// peak bus bandwidth with a per-shape baseline.
+package nccl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Measurement is one half of a result row: the out-of-place or in-place run.
+// Wrong is the #wrong column, "N/A" when the test ran without -c 1.
+type Measurement struct {
+	Time  float64 // microseconds
+	AlgBW float64 // GB/s
+	BusBW float64 // GB/s
+	Wrong string
+}
+
+// Row is one message size of a nccl-tests or rccl-tests run.
+type Row struct {
+	Size       int64 // bytes
+	Count      int64 // elements
+	Type       string
+	RedOp      string
+	OutOfPlace Measurement
+	InPlace    Measurement
+}
+
+// BusBW is the better of the out-of-place and in-place bus bandwidths.
+func (r Row) BusBW() float64 {
+	return max(r.OutOfPlace.BusBW, r.InPlace.BusBW)
+}
+
+// Wrong returns the number of wrong values the row reports, ignoring N/A.
+func (r Row) Wrong() int64 {
+	var total int64
+	for _, m := range []Measurement{r.OutOfPlace, r.InPlace} {
+		if n, err := strconv.ParseInt(m.Wrong, 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// Result is a parsed test run. AvgBusBW is the "# Avg bus bandwidth" trailer,
+// zero when the output has none.
+type Result struct {
+	Rows     []Row
+	AvgBusBW float64
+}
+
+// Peak returns the row with the highest bus bandwidth.
+func (r Result) Peak() (Row, bool) {
+	if len(r.Rows) == 0 {
+		return Row{}, false
+	}
+	peak := r.Rows[0]
+	for _, row := range r.Rows[1:] {
+		if row.BusBW() > peak.BusBW() {
+			peak = row
+		}
+	}
+	return peak, true
+}
+
+// String renders one line per message size.
+func (r Result) String() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "size\talgbw\tbusbw\tin-place algbw\tin-place busbw\t#wrong\t")
+	for _, row := range r.Rows {
+		fmt.Fprintf(w, "%s\t%.2f\t%.2f\t%.2f\t%.2f\t%d\t\n",
+			FormatSize(row.Size), row.OutOfPlace.AlgBW, row.OutOfPlace.BusBW, row.InPlace.AlgBW, row.InPlace.BusBW, row.Wrong())
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// resultColumns is the width of a data row: size, count, type, redop, root,
+// then time, algbw, busbw and #wrong for the out-of-place and in-place runs.
+const resultColumns = 13
+
+// Parse reads the output of an all_reduce_perf run, as printed by nccl-tests
+// or rccl-tests, possibly interleaved with launcher and NCCL log lines. Data
+// rows are the lines whose first field is a byte count; comments start with
+// "#". A row with the wrong number of columns is an error, as is output
+// without any rows.
+func Parse(output string) (Result, error) {
+	var result Result
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if rest, ok := strings.CutPrefix(text, "#"); ok {
+			if avg, ok := avgBusBW(rest); ok {
+				result.AvgBusBW = avg
+			}
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseInt(fields[0], 10, 64); err != nil {
+			continue
+		}
+		row, err := parseRow(fields)
+		if err != nil {
+			return Result{}, fmt.Errorf("line %d: %w", line, err)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return Result{}, err
+	}
+	if len(result.Rows) == 0 {
+		return Result{}, errors.New("no all_reduce_perf result rows in output")
+	}
+	return result, nil
+}
+
+// avgBusBW parses "Avg bus bandwidth    : 123.45" with the leading "#" removed.
+func avgBusBW(comment string) (float64, bool) {
+	key, value, ok := strings.Cut(comment, ":")
+	if !ok || strings.TrimSpace(key) != "Avg bus bandwidth" {
+		return 0, false
+	}
+	avg, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return avg, err == nil
+}
+
+func parseRow(fields []string) (Row, error) {
+	if len(fields) != resultColumns {
+		return Row{}, fmt.Errorf("expected %d columns, got %d: %q", resultColumns, len(fields), strings.Join(fields, " "))
+	}
+	var errs []error
+	integer := func(s string) int64 {
+		n, err := strconv.ParseInt(s, 10, 64)
+		errs = append(errs, err)
+		return n
+	}
+	float := func(s string) float64 {
+		f, err := strconv.ParseFloat(s, 64)
+		errs = append(errs, err)
+		return f
+	}
+	measurement := func(f []string) Measurement {
+		return Measurement{Time: float(f[0]), AlgBW: float(f[1]), BusBW: float(f[2]), Wrong: f[3]}
+	}
+	row := Row{
+		Size:       integer(fields[0]),
+		Count:      integer(fields[1]),
+		Type:       fields[2],
+		RedOp:      fields[3],
+		OutOfPlace: measurement(fields[5:9]),
+		InPlace:    measurement(fields[9:13]),
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Row{}, err
+	}
+	return row, nil
+}
+
+// GiB is the message size the documented baselines start at.
+const GiB int64 = 1 << 30
+
+// DefaultTolerance is how far below its baseline a run's peak bus bandwidth
+// may fall before Compare reports a regression.
+const DefaultTolerance = 0.10
+
+// Baseline is the expected peak all_reduce bus bandwidth of a shape on two
+// nodes, in GB/s. Only rows of at least MinSize bytes count towards the peak;
+// smaller messages are latency-bound.
+type Baseline struct {
+	Shape   string
+	BusBW   float64
+	MinSize int64
+}
+
+// Baselines are the two-node results recorded in docs/: the example outputs
+// in running-nccl-rccl-tests-from-slurm-operator.md and the Tree figure in
+// recommended-nccl-rccl-parameters-by-shape.md. Shapes without a documented
+// run have no baseline.
+var Baselines = map[string]Baseline{
+	"BM.GPU.B4.8":     {Shape: "BM.GPU.B4.8", BusBW: 189.60, MinSize: GiB},
+	"BM.GPU.MI300X.8": {Shape: "BM.GPU.MI300X.8", BusBW: 357.04, MinSize: GiB},
+	"BM.GPU.RTXPRO.8": {Shape: "BM.GPU.RTXPRO.8", BusBW: 34, MinSize: GiB},
+}
+
+// Compare checks result against baseline. The peak bus bandwidth of the rows
+// of at least MinSize bytes must be within tolerance (a fraction, see
+// DefaultTolerance) of the baseline; a regression lists every such message
+// size below the threshold. Rows reporting wrong values are errors too.
+func Compare(result Result, baseline Baseline, tolerance float64) error {
+	var errs []error
+	for _, row := range result.Rows {
+		if n := row.Wrong(); n > 0 {
+			errs = append(errs, fmt.Errorf("%s: %d wrong values", FormatSize(row.Size), n))
+		}
+	}
+
+	var rows []Row
+	for _, row := range result.Rows {
+		if row.Size >= baseline.MinSize {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		errs = append(errs, fmt.Errorf("%s: no message sizes of at least %s to compare with the baseline", baseline.Shape, FormatSize(baseline.MinSize)))
+		return errors.Join(errs...)
+	}
+	peak, _ := Result{Rows: rows}.Peak()
+	threshold := baseline.BusBW * (1 - tolerance)
+	if peak.BusBW() < threshold {
+		sort.Slice(rows, func(i, j int) bool { return rows[i].Size < rows[j].Size })
+		var regressed []string
+		for _, row := range rows {
+			if row.BusBW() < threshold {
+				regressed = append(regressed, fmt.Sprintf("%s (%.2f GB/s)", FormatSize(row.Size), row.BusBW()))
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: peak busbw %.2f GB/s at %s is below %.2f GB/s (baseline %.2f GB/s - %g%%); regressed message sizes: %s",
+			baseline.Shape, peak.BusBW(), FormatSize(peak.Size), threshold, baseline.BusBW, tolerance*100, strings.Join(regressed, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// FormatSize renders a byte count the way the -b and -e flags take it, for
+// example 512K, 8G or 1536 (bytes).
+func FormatSize(size int64) string {
+	for _, unit := range []struct {
+		suffix string
+		bytes  int64
+	}{{"G", GiB}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.bytes && size%unit.bytes == 0 {
+			return strconv.FormatInt(size/unit.bytes, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
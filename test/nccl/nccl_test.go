@@ -0,0 +1,366 @@
+package nccl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const repoRoot = "../.."
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestParseCapturedNCCLLog(t *testing.T) {
+	result, err := Parse(readTestdata(t, "BM.GPU.B4.8.log"))
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 4)
+	require.Equal(t, Row{
+		Size:       8 * GiB,
+		Count:      2147483648,
+		Type:       "float",
+		RedOp:      "sum",
+		OutOfPlace: Measurement{Time: 84948.7, AlgBW: 101.12, BusBW: 189.60, Wrong: "0"},
+		InPlace:    Measurement{Time: 84992.3, AlgBW: 101.07, BusBW: 189.50, Wrong: "0"},
+	}, result.Rows[3])
+	require.Zero(t, result.AvgBusBW)
+
+	peak, ok := result.Peak()
+	require.True(t, ok)
+	require.Equal(t, 8*GiB, peak.Size)
+	require.Equal(t, 189.60, peak.BusBW())
+}
+
+func TestParseCapturedRCCLLog(t *testing.T) {
+	result, err := Parse(readTestdata(t, "BM.GPU.MI300X.8.log"))
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 5)
+	require.Equal(t, Measurement{Time: 11406, AlgBW: 188.28, BusBW: 353.03, Wrong: "0"}, result.Rows[1].OutOfPlace)
+
+	peak, _ := result.Peak()
+	require.Equal(t, 16*GiB, peak.Size)
+	require.Equal(t, 358.37, peak.BusBW())
+}
+
+func TestParseLauncherLog(t *testing.T) {
+	result, err := Parse(readTestdata(t, "BM.GPU.B4.8-regressed.log"))
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 3)
+	require.Equal(t, "2", result.Rows[1].InPlace.Wrong)
+	require.Equal(t, 117.39, result.AvgBusBW)
+}
+
+func TestParseRejectsMalformedOutput(t *testing.T) {
+	_, err := Parse("Waiting for workers to be ready...\n# Collective test concluded: all_reduce_perf\n")
+	require.EqualError(t, err, "no all_reduce_perf result rows in output")
+
+	_, err = Parse("#  size count\n  1073741824     268435456     float     sum      -1  10887.4   98.62\n")
+	require.EqualError(t, err, `line 2: expected 13 columns, got 7: "1073741824 268435456 float sum -1 10887.4 98.62"`)
+
+	_, err = Parse("  1073741824     268435456     float     sum      -1  10887.4   98.62  fast       0  10867.5   98.80  185.26       0\n")
+	require.ErrorContains(t, err, `line 1: strconv.ParseFloat: parsing "fast"`)
+
+	result, err := Parse("  1048576     262144     float     sum      -1   45.10   23.25   43.59    N/A   44.90   23.35   43.79    N/A\n")
+	require.NoError(t, err)
+	require.Equal(t, "N/A", result.Rows[0].OutOfPlace.Wrong)
+}
+
+func TestCapturedLogsMeetTheirBaselines(t *testing.T) {
+	for _, shape := range []string{"BM.GPU.B4.8", "BM.GPU.MI300X.8"} {
+		result, err := Parse(readTestdata(t, shape+".log"))
+		require.NoError(t, err)
+		require.NoError(t, Compare(result, Baselines[shape], DefaultTolerance), shape)
+	}
+}
+
+func TestCompareReportsRegressedMessageSizes(t *testing.T) {
+	result, err := Parse(readTestdata(t, "BM.GPU.B4.8-regressed.log"))
+	require.NoError(t, err)
+	err = Compare(result, Baselines["BM.GPU.B4.8"], DefaultTolerance)
+	require.EqualError(t, err, "2G: 2 wrong values\n"+
+		"BM.GPU.B4.8: peak busbw 118.41 GB/s at 4G is below 170.64 GB/s (baseline 189.60 GB/s - 10%); regressed message sizes: 1G (116.08 GB/s), 2G (117.78 GB/s), 4G (118.41 GB/s)")
+
+	// A looser tolerance accepts the bandwidth but not the wrong values.
+	err = Compare(result, Baselines["BM.GPU.B4.8"], 0.5)
+	require.EqualError(t, err, "2G: 2 wrong values")
+}
+
+func TestCompareIgnoresSmallMessages(t *testing.T) {
+	result, err := Parse(
+		"  8     2     float     sum      -1   30.1    0.00    0.00      0   29.8    0.00    0.00      0\n" +
+			"  1073741824     268435456     float     sum      -1  10887.4   98.62  184.92       0  10867.5   98.80  185.26       0\n")
+	require.NoError(t, err)
+	require.NoError(t, Compare(result, Baselines["BM.GPU.B4.8"], DefaultTolerance))
+
+	err = Compare(Result{Rows: result.Rows[:1]}, Baselines["BM.GPU.B4.8"], DefaultTolerance)
+	require.EqualError(t, err, "BM.GPU.B4.8: no message sizes of at least 1G to compare with the baseline")
+}
+
+func TestFormatSize(t *testing.T) {
+	require.Equal(t, "8", FormatSize(8))
+	require.Equal(t, "1536", FormatSize(1536))
+	require.Equal(t, "512K", FormatSize(512<<10))
+	require.Equal(t, "3M", FormatSize(3<<20))
+	require.Equal(t, "16G", FormatSize(16*GiB))
+}
+
+func TestBaselinesHaveManifests(t *testing.T) {
+	for shape, baseline := range Baselines {
+		require.Equal(t, shape, baseline.Shape)
+		_, err := ManifestPath(repoRoot, shape, false)
+		require.NoError(t, err)
+	}
+}
+
+func TestManifestPath(t *testing.T) {
+	path, err := ManifestPath(repoRoot, "BM.GPU.MI300X.8", true)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(repoRoot, "manifests/rccl-tests/kueue/virtual-functions/BM.GPU.MI300X.8.yaml"), path)
+
+	_, err = ManifestPath(repoRoot, "BM.GPU.RTXPRO.8", true)
+	require.ErrorContains(t, err, "no nccl-tests manifest for BM.GPU.RTXPRO.8")
+	_, err = ManifestPath(repoRoot, "BM.Optimized3.36", false)
+	require.EqualError(t, err, "BM.Optimized3.36 is not a GPU shape in the shapes catalog")
+}
+
+func TestRenderEveryManifest(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"manifests/*-tests/kueue/*.yaml", "manifests/*-tests/kueue/virtual-functions/*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(repoRoot, pattern))
+		require.NoError(t, err)
+		paths = append(paths, matches...)
+	}
+	require.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		manifest, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		objects, err := Render(manifest, Options{Name: "all-reduce", Workers: 3})
+		require.NoError(t, err, path)
+		for _, obj := range objects {
+			require.Contains(t, apiResources, obj.GroupVersionKind(), path)
+			require.NotEqual(t, kueueGroup, obj.GroupVersionKind().Group, path)
+			if obj.GetKind() != "MPIJob" {
+				continue
+			}
+			require.Equal(t, "all-reduce", obj.GetName(), path)
+			require.NotContains(t, obj.GetLabels(), queueNameLabel, path)
+			replicas, _, err := unstructured.NestedInt64(obj.Object, "spec", "mpiReplicaSpecs", "Worker", "replicas")
+			require.NoError(t, err, path)
+			require.EqualValues(t, 3, replicas, path)
+		}
+
+		_, err = Render(manifest, Options{Kueue: true})
+		if filepath.Base(path) == "BM.GPU.RTXPRO.8.yaml" {
+			// Submits to the LocalQueue Terraform creates for topology-aware scheduling.
+			require.EqualError(t, err, "MPIJob nccl-test is submitted to LocalQueue bm-gpu-rtxpro-8-rdma-topology-aware, which the manifest does not define")
+		} else {
+			require.NoError(t, err, path)
+		}
+	}
+}
+
+func TestRenderPinsWorkersToNodes(t *testing.T) {
+	objects, err := Render(repoManifest(t, "BM.GPU.H100.8"), Options{Workers: 2, Nodes: []string{"10.0.3.2", "10.0.3.3"}})
+	require.NoError(t, err)
+	job := objects[len(objects)-1]
+	require.Equal(t, "MPIJob", job.GetKind())
+	terms, _, err := unstructured.NestedSlice(job.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "spec",
+		"affinity", "nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"matchExpressions": []interface{}{map[string]interface{}{
+			"key": "kubernetes.io/hostname", "operator": "In", "values": []interface{}{"10.0.3.2", "10.0.3.3"},
+		}},
+	}}, terms)
+	selector, _, err := unstructured.NestedStringMap(job.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "spec", "nodeSelector")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"node.kubernetes.io/instance-type": "BM.GPU.H100.8"}, selector, "the manifest's node selector is kept")
+}
+
+func TestRenderSubmitsToAnExistingQueue(t *testing.T) {
+	objects, err := Render(repoManifest(t, "BM.GPU.RTXPRO.8"), Options{
+		Queue:    "bm-gpu-rtxpro-8-rdma-topology-aware",
+		Topology: "oci.oraclecloud.com/rdma.network_block_id",
+	})
+	require.NoError(t, err)
+	require.Len(t, objects, 1, "the manifest's Kueue objects are dropped")
+	job := objects[0]
+	require.Equal(t, "bm-gpu-rtxpro-8-rdma-topology-aware", job.GetLabels()[queueNameLabel])
+	annotations, _, err := unstructured.NestedStringMap(job.Object, "spec", "mpiReplicaSpecs", "Worker", "template", "metadata", "annotations")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{requiredTopologyAnnotation: "oci.oraclecloud.com/rdma.network_block_id"}, annotations,
+		"the required topology replaces the manifest's preferred one")
+
+	_, err = Render(repoManifest(t, "BM.GPU.H100.8"), Options{Kueue: true, Queue: "q"})
+	require.Error(t, err)
+}
+
+func TestRenderRejectsManifestsWithoutOneJob(t *testing.T) {
+	_, err := Render([]byte("apiVersion: kueue.x-k8s.io/v1beta2\nkind: LocalQueue\nmetadata:\n  name: q\n"), Options{Kueue: true})
+	require.EqualError(t, err, "manifest has 0 MPIJobs, want 1")
+
+	job := "apiVersion: kubeflow.org/v2beta1\nkind: MPIJob\nmetadata:\n  name: a\n"
+	_, err = Render([]byte(job+"---\n"+job), Options{})
+	require.EqualError(t, err, "manifest has 2 MPIJobs, want 1")
+}
+
+var listKinds = map[schema.GroupVersionResource]string{}
+
+func init() {
+	for gvk, res := range apiResources {
+		listKinds[res.GroupVersionResource] = gvk.Kind + "List"
+	}
+}
+
+func mpiJobResource() schema.GroupVersionResource {
+	return apiResources[mpiJobKind].GroupVersionResource
+}
+
+// fakeCluster finishes every MPIJob with condition and message, creates its
+// launcher pod and serves log as the pod's log.
+func fakeCluster(t *testing.T, condition, message, log string, objects ...runtime.Object) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	client := fake.NewClientset()
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	dyn.PrependReactor("create", "mpijobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		if condition != "" {
+			conditions := []interface{}{map[string]interface{}{"type": condition, "status": "True", "message": message}}
+			require.NoError(t, unstructured.SetNestedSlice(job.Object, conditions, "status", "conditions"))
+		}
+		_, err := client.CoreV1().Pods(job.GetNamespace()).Create(context.Background(), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      job.GetName() + "-launcher-x7k2p",
+			Namespace: job.GetNamespace(),
+			Labels:    map[string]string{jobNameLabel: job.GetName(), jobRoleLabel: "launcher"},
+		}}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		return false, nil, nil
+	})
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "log" {
+			return false, nil, nil
+		}
+		return true, &runtime.Unknown{Raw: []byte(log)}, nil
+	})
+	return client, dyn
+}
+
+func repoManifest(t *testing.T, shape string) []byte {
+	t.Helper()
+	path, err := ManifestPath(repoRoot, shape, false)
+	require.NoError(t, err)
+	manifest, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return manifest
+}
+
+func TestRunSubmitsThroughKueueAndParsesLauncherLog(t *testing.T) {
+	existing := &unstructured.Unstructured{}
+	existing.SetAPIVersion("kueue.x-k8s.io/v1beta2")
+	existing.SetKind("ResourceFlavor")
+	existing.SetName("bm-gpu-b4-8")
+	client, dyn := fakeCluster(t, "Succeeded", "MPIJob nccl/nccl-b4 successfully completed.", readTestdata(t, "BM.GPU.B4.8.log"), existing)
+
+	var jobs []*unstructured.Unstructured
+	dyn.PrependReactor("create", "mpijobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		jobs = append(jobs, action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy())
+		return false, nil, nil
+	})
+
+	result, err := Run(context.Background(), client, dyn, Config{
+		Namespace:    "nccl",
+		Manifest:     repoManifest(t, "BM.GPU.B4.8"),
+		Options:      Options{Name: "nccl-b4", Workers: 2, Kueue: true},
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 4)
+
+	require.Len(t, jobs, 1)
+	require.Equal(t, "nccl", jobs[0].GetNamespace())
+	require.Equal(t, "bm-gpu-b4-8-nccl-tests", jobs[0].GetLabels()[queueNameLabel])
+
+	ctx := context.Background()
+	_, err = dyn.Resource(apiResources[kueueKind("LocalQueue")].GroupVersionResource).Namespace("nccl").Get(ctx, "bm-gpu-b4-8-nccl-tests", metav1.GetOptions{})
+	require.NoError(t, err, "the LocalQueue is created in the job namespace")
+	_, err = dyn.Resource(apiResources[kueueKind("ClusterQueue")].GroupVersionResource).Get(ctx, "bm-gpu-b4-8-nccl-tests-queue", metav1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err), "the ClusterQueue Run created is deleted")
+	_, err = dyn.Resource(apiResources[kueueKind("ResourceFlavor")].GroupVersionResource).Get(ctx, "bm-gpu-b4-8", metav1.GetOptions{})
+	require.NoError(t, err, "an existing ResourceFlavor is kept")
+	_, err = client.CoreV1().Namespaces().Get(ctx, "nccl", metav1.GetOptions{})
+	require.True(t, apierrors.IsNotFound(err), "the namespace is deleted")
+}
+
+func kueueKind(kind string) schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: kueueGroup, Version: "v1beta2", Kind: kind}
+}
+
+func TestRunSubmitsToTheMPIOperator(t *testing.T) {
+	client, dyn := fakeCluster(t, "Succeeded", "", readTestdata(t, "BM.GPU.MI300X.8.log"))
+
+	result, err := Run(context.Background(), client, dyn, Config{
+		Manifest:     repoManifest(t, "BM.GPU.MI300X.8"),
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 5)
+
+	job, err := dyn.Resource(mpiJobResource()).Namespace("nccl-tests").Get(context.Background(), "rccl-tests", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, job.GetLabels(), queueNameLabel)
+	for _, action := range dyn.Actions() {
+		require.NotEqual(t, kueueGroup, action.GetResource().Group)
+	}
+}
+
+func TestRunReportsFailedJobWithLogTail(t *testing.T) {
+	client, dyn := fakeCluster(t, "Failed", "launcher exited with code 1", "Waiting for workers to be ready...\nssh: connect to host 10.140.0.42 port 2222: Connection refused\n")
+
+	_, err := Run(context.Background(), client, dyn, Config{
+		Manifest:     repoManifest(t, "BM.GPU.B4.8"),
+		PollInterval: time.Millisecond,
+	})
+	require.EqualError(t, err, "MPIJob nccl-tests/nccl-test failed: launcher exited with code 1\n"+
+		"Waiting for workers to be ready...\nssh: connect to host 10.140.0.42 port 2222: Connection refused")
+}
+
+func TestRunReportsUnparsableLauncherLog(t *testing.T) {
+	client, dyn := fakeCluster(t, "Succeeded", "", "All workers are ready!\n")
+
+	_, err := Run(context.Background(), client, dyn, Config{
+		Manifest:     repoManifest(t, "BM.GPU.B4.8"),
+		PollInterval: time.Millisecond,
+	})
+	require.EqualError(t, err, "launcher pod nccl-test-launcher-x7k2p: no all_reduce_perf result rows in output\nAll workers are ready!")
+}
+
+func TestRunTimesOutWaitingForAdmission(t *testing.T) {
+	client, dyn := fakeCluster(t, "Suspended", "Not admitted by cluster queue", "")
+
+	_, err := Run(context.Background(), client, dyn, Config{
+		Manifest:     repoManifest(t, "BM.GPU.B4.8"),
+		Options:      Options{Kueue: true},
+		Timeout:      20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	require.EqualError(t, err, "MPIJob nccl-tests/nccl-test did not finish in 20ms: Suspended Not admitted by cluster queue")
+}
@@ -0,0 +1,602 @@
+// Package network checks the cluster data plane from inside pods: a
+// connectivity matrix between nodes of every worker pool, ClusterIP and
+// headless service DNS, and optionally an internal load balancer.
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	serverPort  = 8080
+	serverReply = "net-check-ok"
+	serviceName = "net-check"
+	// unlabeledPool groups nodes without the pool label.
+	unlabeledPool = "(none)"
+)
+
+// Config describes a network check run.
+type Config struct {
+	// Namespace is created for the check pods and deleted afterwards.
+	Namespace string
+	// PoolLabel groups nodes into pools. Defaults to oke.oraclecloud.com/pool.name.
+	PoolLabel string
+	// NodesPerPool is how many Ready nodes of each pool get a server and a
+	// client pod. Defaults to 2, so the matrix covers nodes within a pool too.
+	NodesPerPool int
+	// Image must provide sh, httpd, wget and nslookup. Defaults to busybox.
+	Image string
+	// InternalLB also probes a Service of type LoadBalancer with the OCI
+	// internal load balancer annotation, for preferred_kubernetes_services =
+	// "internal". InternalLBSubnetID and InternalLBNSGID optionally place it
+	// in the int_lb subnet and NSG.
+	InternalLB         bool
+	InternalLBSubnetID string
+	InternalLBNSGID    string
+	// Timeout bounds each phase: pods starting, the load balancer getting an
+	// address, and clients finishing. Defaults to 5 minutes.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = "net-check"
+	}
+	if c.PoolLabel == "" {
+		c.PoolLabel = "oke.oraclecloud.com/pool.name"
+	}
+	if c.NodesPerPool == 0 {
+		c.NodesPerPool = 2
+	}
+	if c.Image == "" {
+		c.Image = "busybox"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 2 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// Endpoint is one node under test and the server pod on it.
+type Endpoint struct {
+	Pool string
+	Node string
+	IP   string
+}
+
+func (e Endpoint) String() string { return e.Pool + "/" + e.Node }
+
+// Probe is the outcome of one request from a client pod.
+type Probe struct {
+	Target string
+	OK     bool
+	Detail string
+}
+
+// Report is what Run found. Matrix[i][j] is the request from the client on
+// Endpoints[i] to the server on Endpoints[j]; Services[i] are the DNS and
+// service probes made by the client on Endpoints[i].
+type Report struct {
+	Endpoints []Endpoint
+	Matrix    [][]Probe
+	Services  [][]Probe
+}
+
+// Failures lists every failed probe as "from -> target: detail".
+func (r Report) Failures() []string {
+	var failures []string
+	for i, from := range r.Endpoints {
+		for _, probe := range append(slices.Clone(r.Matrix[i]), r.Services[i]...) {
+			if !probe.OK {
+				failures = append(failures, fmt.Sprintf("%s -> %s: %s", from, probe.Target, probe.Detail))
+			}
+		}
+	}
+	return failures
+}
+
+// String renders the connectivity matrix, one row per client, followed by the
+// service probes.
+func (r Report) String() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	header := []string{"from \\ to"}
+	for _, to := range r.Endpoints {
+		header = append(header, to.String())
+	}
+	if len(r.Services) > 0 {
+		for _, probe := range r.Services[0] {
+			header = append(header, probe.Target)
+		}
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for i, from := range r.Endpoints {
+		row := []string{from.String()}
+		for _, probe := range append(slices.Clone(r.Matrix[i]), r.Services[i]...) {
+			row = append(row, mark(probe))
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+func mark(probe Probe) string {
+	if probe.OK {
+		return "ok"
+	}
+	return "FAIL"
+}
+
+// Run deploys the check pods, collects the report and deletes the namespace.
+// An error means the check could not run; failed probes are in the report.
+func Run(ctx context.Context, client kubernetes.Interface, cfg Config) (Report, error) {
+	cfg.setDefaults()
+
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	endpoints := selectEndpoints(nodes.Items, cfg.PoolLabel, cfg.NodesPerPool)
+	if len(endpoints) == 0 {
+		return Report{}, errors.New("no Ready nodes to run network checks on")
+	}
+
+	namespaces := client.CoreV1().Namespaces()
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.Namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return Report{}, fmt.Errorf("failed to create namespace %s: %w", cfg.Namespace, err)
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := namespaces.Delete(cleanup, cfg.Namespace, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			cfg.Logf("failed to delete namespace %s: %v", cfg.Namespace, err)
+		}
+	}()
+
+	r := &runner{client: client, cfg: cfg, endpoints: endpoints}
+	return r.run(ctx)
+}
+
+// selectEndpoints picks up to perPool Ready nodes of every pool, ordered by
+// pool and node name.
+func selectEndpoints(nodes []corev1.Node, label string, perPool int) []Endpoint {
+	byPool := map[string][]string{}
+	for _, node := range nodes {
+		if !nodeReady(node) {
+			continue
+		}
+		pool := node.Labels[label]
+		if pool == "" {
+			pool = unlabeledPool
+		}
+		byPool[pool] = append(byPool[pool], node.Name)
+	}
+	pools := make([]string, 0, len(byPool))
+	for pool := range byPool {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	var endpoints []Endpoint
+	for _, pool := range pools {
+		names := byPool[pool]
+		sort.Strings(names)
+		for _, name := range names[:min(perPool, len(names))] {
+			endpoints = append(endpoints, Endpoint{Pool: pool, Node: name})
+		}
+	}
+	return endpoints
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+type runner struct {
+	client    kubernetes.Interface
+	cfg       Config
+	endpoints []Endpoint
+}
+
+func (r *runner) run(ctx context.Context) (Report, error) {
+	pods := r.client.CoreV1().Pods(r.cfg.Namespace)
+	for i, endpoint := range r.endpoints {
+		if _, err := pods.Create(ctx, r.serverPod(i, endpoint), metav1.CreateOptions{}); err != nil {
+			return Report{}, fmt.Errorf("failed to create server pod on %s: %w", endpoint.Node, err)
+		}
+	}
+	clusterIP, err := r.createServices(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	r.cfg.Logf("waiting for %d server pod(s)", len(r.endpoints))
+	if err := r.waitForServers(ctx); err != nil {
+		return Report{}, err
+	}
+	lbIP := ""
+	if r.cfg.InternalLB {
+		r.cfg.Logf("waiting for the internal load balancer")
+		if lbIP, err = r.waitForLoadBalancer(ctx); err != nil {
+			return Report{}, err
+		}
+	}
+
+	targets := r.targets(lbIP)
+	for i, endpoint := range r.endpoints {
+		if _, err := pods.Create(ctx, r.clientPod(i, endpoint, targets), metav1.CreateOptions{}); err != nil {
+			return Report{}, fmt.Errorf("failed to create client pod on %s: %w", endpoint.Node, err)
+		}
+	}
+	r.cfg.Logf("waiting for %d client pod(s)", len(r.endpoints))
+	messages, err := r.waitForClients(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	serverIPs := make([]string, len(r.endpoints))
+	for i, endpoint := range r.endpoints {
+		serverIPs[i] = endpoint.IP
+	}
+	report := Report{Endpoints: r.endpoints}
+	for i := range r.endpoints {
+		results := parseResults(messages[i])
+		row := make([]Probe, len(r.endpoints))
+		for j := range r.endpoints {
+			row[j] = httpProbe(results, serverName(j))
+		}
+		report.Matrix = append(report.Matrix, row)
+
+		services := []Probe{
+			dnsProbe(results, "dns/clusterip", []string{clusterIP}),
+			dnsProbe(results, "dns/headless", serverIPs),
+			httpProbe(results, "svc/clusterip"),
+		}
+		if r.cfg.InternalLB {
+			services = append(services, httpProbe(results, "svc/internal-lb"))
+		}
+		report.Services = append(report.Services, services)
+	}
+	return report, nil
+}
+
+func serverName(i int) string { return fmt.Sprintf("server-%d", i) }
+func clientName(i int) string { return fmt.Sprintf("client-%d", i) }
+
+// tolerations let check pods run on GPU pools, like the CI health checks.
+var tolerations = []corev1.Toleration{
+	{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists},
+	{Key: "amd.com/gpu", Operator: corev1.TolerationOpExists},
+}
+
+func (r *runner) pod(name, role string, endpoint Endpoint, command string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: r.cfg.Namespace,
+			Labels:    map[string]string{"app": serviceName, "role": role},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      endpoint.Node,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Tolerations:   tolerations,
+			Containers: []corev1.Container{{
+				Name:    role,
+				Image:   r.cfg.Image,
+				Command: []string{"sh", "-c", command},
+			}},
+		},
+	}
+}
+
+func (r *runner) serverPod(i int, endpoint Endpoint) *corev1.Pod {
+	command := fmt.Sprintf("echo %s > /tmp/index.html && httpd -f -p %d -h /tmp", serverReply, serverPort)
+	pod := r.pod(serverName(i), "server", endpoint, command)
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: serverPort}}
+	pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(serverPort)}},
+	}
+	return pod
+}
+
+// createServices creates the ClusterIP and headless services in front of the
+// servers, and the internal load balancer if enabled. It returns the ClusterIP.
+func (r *runner) createServices(ctx context.Context) (string, error) {
+	services := r.client.CoreV1().Services(r.cfg.Namespace)
+	service := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: r.cfg.Namespace},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": serviceName, "role": "server"},
+				Ports:    []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt32(serverPort)}},
+			},
+		}
+	}
+
+	created, err := services.Create(ctx, service(serviceName), metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create service %s: %w", serviceName, err)
+	}
+	headless := service(serviceName + "-headless")
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+	if _, err := services.Create(ctx, headless, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create service %s: %w", headless.Name, err)
+	}
+	if r.cfg.InternalLB {
+		lb := service(serviceName + "-lb")
+		lb.Spec.Type = corev1.ServiceTypeLoadBalancer
+		lb.Annotations = map[string]string{
+			"service.beta.kubernetes.io/oci-load-balancer-internal":       "true",
+			"service.beta.kubernetes.io/oci-load-balancer-shape":          "flexible",
+			"service.beta.kubernetes.io/oci-load-balancer-shape-flex-min": "10",
+			"service.beta.kubernetes.io/oci-load-balancer-shape-flex-max": "10",
+		}
+		if r.cfg.InternalLBSubnetID != "" {
+			lb.Annotations["service.beta.kubernetes.io/oci-load-balancer-subnet1"] = r.cfg.InternalLBSubnetID
+		}
+		if r.cfg.InternalLBNSGID != "" {
+			lb.Annotations["oci.oraclecloud.com/oci-network-security-groups"] = r.cfg.InternalLBNSGID
+		}
+		if _, err := services.Create(ctx, lb, metav1.CreateOptions{}); err != nil {
+			return "", fmt.Errorf("failed to create service %s: %w", lb.Name, err)
+		}
+	}
+	return created.Spec.ClusterIP, nil
+}
+
+// poll calls done every PollInterval until it returns true or an error, or the
+// phase times out. describe explains what was still missing at the timeout.
+func (r *runner) poll(ctx context.Context, what string, done func() (bool, error), describe func() string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s: %s", what, describe())
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+func (r *runner) waitForServers(ctx context.Context) error {
+	pods := r.client.CoreV1().Pods(r.cfg.Namespace)
+	var pending []string
+	return r.poll(ctx, "server pods", func() (bool, error) {
+		pending = nil
+		for i, endpoint := range r.endpoints {
+			pod, err := pods.Get(ctx, serverName(i), metav1.GetOptions{})
+			if err != nil {
+				return false, fmt.Errorf("failed to get server pod on %s: %w", endpoint.Node, err)
+			}
+			if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+				return false, fmt.Errorf("server pod on %s exited: %s", endpoint.Node, pod.Status.Phase)
+			}
+			if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || !podReady(pod) {
+				pending = append(pending, fmt.Sprintf("%s (%s)", endpoint, pod.Status.Phase))
+				continue
+			}
+			r.endpoints[i].IP = pod.Status.PodIP
+		}
+		return len(pending) == 0, nil
+	}, func() string { return strings.Join(pending, ", ") })
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (r *runner) waitForLoadBalancer(ctx context.Context) (string, error) {
+	services := r.client.CoreV1().Services(r.cfg.Namespace)
+	var ip string
+	err := r.poll(ctx, "internal load balancer", func() (bool, error) {
+		service, err := services.Get(ctx, serviceName+"-lb", metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get service %s-lb: %w", serviceName, err)
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				ip = ingress.IP
+				return true, nil
+			}
+		}
+		return false, nil
+	}, func() string { return "no ingress IP" })
+	return ip, err
+}
+
+// target is one request a client makes: an HTTP GET of url, or a DNS lookup
+// of host, tried up to attempts times.
+type target struct {
+	name     string
+	url      string
+	host     string
+	attempts int
+}
+
+func (r *runner) targets(lbIP string) []target {
+	var targets []target
+	for i, endpoint := range r.endpoints {
+		targets = append(targets, target{name: serverName(i), url: fmt.Sprintf("http://%s/", hostPort(endpoint.IP, serverPort)), attempts: 5})
+	}
+	domain := r.cfg.Namespace + ".svc.cluster.local"
+	targets = append(targets,
+		target{name: "dns/clusterip", host: serviceName + "." + domain, attempts: 5},
+		target{name: "dns/headless", host: serviceName + "-headless." + domain, attempts: 5},
+		target{name: "svc/clusterip", url: "http://" + serviceName + "." + domain + "/", attempts: 5},
+	)
+	if lbIP != "" {
+		// A new load balancer needs a few health checks before it forwards.
+		targets = append(targets, target{name: "svc/internal-lb", url: fmt.Sprintf("http://%s/", hostPort(lbIP, 80)), attempts: 30})
+	}
+	return targets
+}
+
+func hostPort(ip string, port int) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// clientScript tries every target and writes one line per target, "<name> ok|fail <detail>", to stdout and the termination message.
+func clientScript(targets []target) string {
+	var b strings.Builder
+	b.WriteString(`probe() {
+  for i in $(seq "$3"); do
+    if out=$(wget -qO- -T 5 "$2" 2>&1); then echo "$1 ok $out"; return; fi
+    sleep 2
+  done
+  echo "$1 fail $(echo "$out" | tr '\n' ' ')"
+}
+resolve() {
+  for i in $(seq "$3"); do
+    ips=$(nslookup "$2" 2>/dev/null | awk '/^Address/ && !/:53$/ {print $NF}' | sort | tr '\n' ',')
+    if [ -n "$ips" ]; then echo "$1 ok $ips"; return; fi
+    sleep 2
+  done
+  echo "$1 fail no answer for $2"
+}
+{
+`)
+	for _, t := range targets {
+		if t.host != "" {
+			fmt.Fprintf(&b, "resolve %s %s %d\n", t.name, t.host, t.attempts)
+		} else {
+			fmt.Fprintf(&b, "probe %s %s %d\n", t.name, t.url, t.attempts)
+		}
+	}
+	b.WriteString("} | tee /dev/termination-log\n")
+	return b.String()
+}
+
+func (r *runner) clientPod(i int, endpoint Endpoint, targets []target) *corev1.Pod {
+	return r.pod(clientName(i), "client", endpoint, clientScript(targets))
+}
+
+// waitForClients waits for every client pod to finish and returns their
+// termination messages.
+func (r *runner) waitForClients(ctx context.Context) ([]string, error) {
+	pods := r.client.CoreV1().Pods(r.cfg.Namespace)
+	messages := make([]string, len(r.endpoints))
+	var running []string
+	err := r.poll(ctx, "client pods", func() (bool, error) {
+		running = nil
+		for i, endpoint := range r.endpoints {
+			pod, err := pods.Get(ctx, clientName(i), metav1.GetOptions{})
+			if err != nil {
+				return false, fmt.Errorf("failed to get client pod on %s: %w", endpoint.Node, err)
+			}
+			if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+				running = append(running, fmt.Sprintf("%s (%s)", endpoint, pod.Status.Phase))
+				continue
+			}
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.State.Terminated != nil {
+					messages[i] = status.State.Terminated.Message
+				}
+			}
+		}
+		return len(running) == 0, nil
+	}, func() string { return strings.Join(running, ", ") })
+	return messages, err
+}
+
+// result is one parsed line of a client's output.
+type result struct {
+	ok     bool
+	detail string
+}
+
+func parseResults(message string) map[string]result {
+	results := map[string]result{}
+	for _, line := range strings.Split(message, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		detail := ""
+		if len(fields) == 3 {
+			detail = strings.TrimSpace(fields[2])
+		}
+		results[fields[0]] = result{ok: fields[1] == "ok", detail: detail}
+	}
+	return results
+}
+
+// httpProbe passes when the client got the servers' reply from name.
+func httpProbe(results map[string]result, name string) Probe {
+	res, found := results[name]
+	switch {
+	case !found:
+		return Probe{Target: name, Detail: "no result from client"}
+	case !res.ok:
+		return Probe{Target: name, Detail: res.detail}
+	case !strings.Contains(res.detail, serverReply):
+		return Probe{Target: name, Detail: fmt.Sprintf("unexpected reply %q", res.detail)}
+	}
+	return Probe{Target: name, OK: true, Detail: res.detail}
+}
+
+// dnsProbe passes when name resolved to exactly want.
+func dnsProbe(results map[string]result, name string, want []string) Probe {
+	res, found := results[name]
+	switch {
+	case !found:
+		return Probe{Target: name, Detail: "no result from client"}
+	case !res.ok:
+		return Probe{Target: name, Detail: res.detail}
+	}
+	var got []string
+	for _, ip := range strings.Split(res.detail, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			got = append(got, ip)
+		}
+	}
+	sort.Strings(got)
+	want = slices.Sorted(slices.Values(want))
+	if !slices.Equal(got, want) {
+		return Probe{Target: name, Detail: fmt.Sprintf("resolved to %s, want %s", strings.Join(got, ","), strings.Join(want, ","))}
+	}
+	return Probe{Target: name, OK: true, Detail: strings.Join(got, ",")}
+}
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func node(name, pool string, ready corev1.ConditionStatus) *corev1.Node {
+	n := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready}}},
+	}
+	if pool != "" {
+		n.Labels = map[string]string{"oke.oraclecloud.com/pool.name": pool}
+	}
+	return n
+}
+
+// fakeCluster answers pod and service creation like a cluster would: server
+// pods start on their node with podIPs[node], services get addresses, and
+// client pods finish with the message clientOutput returns for their node.
+func fakeCluster(t *testing.T, podIPs map[string]string, clientOutput func(node string) string, nodes ...runtime.Object) *fake.Clientset {
+	t.Helper()
+	client := fake.NewClientset(nodes...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		switch pod.Labels["role"] {
+		case "server":
+			pod.Status = corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				PodIP:      podIPs[pod.Spec.NodeName],
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+			}
+		case "client":
+			pod.Status = corev1.PodStatus{
+				Phase: corev1.PodSucceeded,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "client",
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: clientOutput(pod.Spec.NodeName)}},
+				}},
+			}
+		}
+		return false, nil, nil
+	})
+	client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		service := action.(k8stesting.CreateAction).GetObject().(*corev1.Service)
+		switch {
+		case service.Spec.ClusterIP == corev1.ClusterIPNone:
+		case service.Spec.Type == corev1.ServiceTypeLoadBalancer:
+			service.Spec.ClusterIP = "10.96.0.20"
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.5.5"}}
+		default:
+			service.Spec.ClusterIP = "10.96.0.10"
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func TestRunBuildsConnectivityMatrixAcrossPools(t *testing.T) {
+	podIPs := map[string]string{"10.0.1.2": "10.244.0.2", "10.0.1.3": "10.244.0.3", "10.0.2.2": "10.244.1.2"}
+	clientOutput := func(node string) string {
+		lines := []string{
+			"server-0 ok net-check-ok",
+			"server-1 ok net-check-ok",
+			"server-2 ok net-check-ok",
+			"dns/clusterip ok 10.96.0.10,",
+			"dns/headless ok 10.244.0.2,10.244.0.3,10.244.1.2,",
+			"svc/clusterip ok net-check-ok",
+			"svc/internal-lb ok net-check-ok",
+		}
+		if node == "10.0.2.2" {
+			lines[0] = "server-0 fail wget: download timed out "
+			lines[4] = "dns/headless ok 10.244.1.2,"
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+	client := fakeCluster(t, podIPs, clientOutput,
+		node("10.0.1.2", "oke-system", corev1.ConditionTrue),
+		node("10.0.1.3", "oke-system", corev1.ConditionTrue),
+		node("10.0.1.4", "oke-system", corev1.ConditionTrue),
+		node("10.0.1.5", "oke-system", corev1.ConditionFalse),
+		node("10.0.2.2", "oke-gpu", corev1.ConditionTrue),
+	)
+
+	var logs []string
+	report, err := Run(context.Background(), client, Config{
+		Namespace:          "net-check-run-1",
+		InternalLB:         true,
+		InternalLBSubnetID: "ocid1.subnet.oc1..intlb",
+		PollInterval:       time.Millisecond,
+		Logf:               func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) },
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []Endpoint{
+		{Pool: "oke-gpu", Node: "10.0.2.2", IP: "10.244.1.2"},
+		{Pool: "oke-system", Node: "10.0.1.2", IP: "10.244.0.2"},
+		{Pool: "oke-system", Node: "10.0.1.3", IP: "10.244.0.3"},
+	}, report.Endpoints, "two Ready nodes per pool")
+	require.Equal(t, []string{
+		"oke-gpu/10.0.2.2 -> server-0: wget: download timed out",
+		"oke-gpu/10.0.2.2 -> dns/headless: resolved to 10.244.1.2, want 10.244.0.2,10.244.0.3,10.244.1.2",
+	}, report.Failures())
+	require.Equal(t, "from \\ to            oke-gpu/10.0.2.2  oke-system/10.0.1.2  oke-system/10.0.1.3  dns/clusterip  dns/headless  svc/clusterip  svc/internal-lb\n"+
+		"oke-gpu/10.0.2.2     FAIL              ok                   ok                   ok             FAIL          ok             ok\n"+
+		"oke-system/10.0.1.2  ok                ok                   ok                   ok             ok            ok             ok\n"+
+		"oke-system/10.0.1.3  ok                ok                   ok                   ok             ok            ok             ok\n",
+		report.String())
+	require.Equal(t, []string{"waiting for 3 server pod(s)", "waiting for the internal load balancer", "waiting for 3 client pod(s)"}, logs)
+
+	var created []*corev1.Pod
+	var lb *corev1.Service
+	for _, action := range client.Actions() {
+		create, ok := action.(k8stesting.CreateAction)
+		if !ok {
+			continue
+		}
+		switch obj := create.GetObject().(type) {
+		case *corev1.Pod:
+			created = append(created, obj)
+		case *corev1.Service:
+			if obj.Spec.Type == corev1.ServiceTypeLoadBalancer {
+				lb = obj
+			}
+		}
+	}
+	require.Len(t, created, 6)
+	for _, pod := range created {
+		require.Equal(t, "net-check-run-1", pod.Namespace)
+		require.NotEmpty(t, pod.Spec.NodeName)
+		require.ElementsMatch(t, []string{"nvidia.com/gpu", "amd.com/gpu"}, []string{pod.Spec.Tolerations[0].Key, pod.Spec.Tolerations[1].Key})
+	}
+	script := created[3].Spec.Containers[0].Command[2]
+	require.Contains(t, script, "probe server-1 http://10.244.0.2:8080/ 5\n")
+	require.Contains(t, script, "resolve dns/headless net-check-headless.net-check-run-1.svc.cluster.local 5\n")
+	require.Contains(t, script, "probe svc/internal-lb http://10.0.5.5:80/ 30\n")
+	require.Equal(t, "true", lb.Annotations["service.beta.kubernetes.io/oci-load-balancer-internal"])
+	require.Equal(t, "ocid1.subnet.oc1..intlb", lb.Annotations["service.beta.kubernetes.io/oci-load-balancer-subnet1"])
+
+	_, err = client.CoreV1().Namespaces().Get(context.Background(), "net-check-run-1", metav1.GetOptions{})
+	require.Error(t, err, "the namespace is deleted after the run")
+}
+
+func TestRunReportsClientsWithoutResults(t *testing.T) {
+	client := fakeCluster(t, map[string]string{"10.0.1.2": "10.244.0.2"}, func(string) string { return "" },
+		node("10.0.1.2", "", corev1.ConditionTrue))
+
+	report, err := Run(context.Background(), client, Config{PollInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, []Endpoint{{Pool: "(none)", Node: "10.0.1.2", IP: "10.244.0.2"}}, report.Endpoints)
+	require.Len(t, report.Services[0], 3, "no internal LB probe unless enabled")
+	require.Equal(t, []string{
+		"(none)/10.0.1.2 -> server-0: no result from client",
+		"(none)/10.0.1.2 -> dns/clusterip: no result from client",
+		"(none)/10.0.1.2 -> dns/headless: no result from client",
+		"(none)/10.0.1.2 -> svc/clusterip: no result from client",
+	}, report.Failures())
+}
+
+func TestRunTimesOutOnPendingServers(t *testing.T) {
+	client := fake.NewClientset(node("10.0.1.2", "oke-system", corev1.ConditionTrue))
+
+	_, err := Run(context.Background(), client, Config{Timeout: 10 * time.Millisecond, PollInterval: time.Millisecond})
+	require.EqualError(t, err, "timed out waiting for server pods: oke-system/10.0.1.2 ()")
+}
+
+func TestRunNeedsReadyNodes(t *testing.T) {
+	client := fake.NewClientset(node("10.0.1.2", "oke-system", corev1.ConditionFalse))
+
+	_, err := Run(context.Background(), client, Config{})
+	require.EqualError(t, err, "no Ready nodes to run network checks on")
+}
+
+func TestClientScriptIsValidShell(t *testing.T) {
+	script := clientScript([]target{
+		{name: "server-0", url: "http://10.244.0.2:8080/", attempts: 5},
+		{name: "dns/headless", host: "net-check-headless.default.svc.cluster.local", attempts: 5},
+	})
+	out, err := exec.Command("sh", "-n", "-c", script).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestHostPortBracketsIPv6(t *testing.T) {
+	require.Equal(t, "10.0.0.1:8080", hostPort("10.0.0.1", 8080))
+	require.Equal(t, "[fd00::1]:80", hostPort("fd00::1", 80))
+}
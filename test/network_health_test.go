@@ -0,0 +1,46 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/network"
+)
+
+// runNetworkChecks runs the data-plane checks from pods on every worker pool
+// and logs the connectivity matrix. The internal load balancer is probed when
+// the topology prefers internal Kubernetes services.
+func runNetworkChecks(t *testing.T, cluster *clusterFixture) {
+	t.Helper()
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping network checks: API requests are not recorded in cassettes")
+	}
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+
+	internalLB := false
+	if cluster.options != nil {
+		vars, err := effectiveVars(t, cluster.options)
+		require.NoError(t, err, "failed to resolve terraform variables")
+		internalLB = vars["preferred_kubernetes_services"] == "internal"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	defer cancel()
+	report, err := network.Run(ctx, client, network.Config{
+		Namespace:          "net-check-" + currentRunID(),
+		PoolLabel:          poolNameLabel,
+		InternalLB:         internalLB,
+		InternalLBSubnetID: cluster.outputs.IntLBSubnetID,
+		InternalLBNSGID:    cluster.outputs.IntLBNSGID,
+		Logf:               func(format string, args ...any) { t.Logf("Network check: "+format, args...) },
+	})
+	require.NoError(t, err, "network checks could not run")
+	t.Logf("Network check: connectivity matrix\n%s", report)
+	require.Empty(t, report.Failures(), "network probes failed")
+}
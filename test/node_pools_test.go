@@ -0,0 +1,306 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stretchr/testify/require"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// poolNameLabel is the node label OKE sets to the worker pool name, the keys of
+// local.worker_pools in oke-workers.tf.
+const poolNameLabel = "oke.oraclecloud.com/pool.name"
+
+// terraformVariableDefaults returns the literal defaults of the variables
+// declared in dir. Variables without a default, or with a default that needs
+// evaluation, are left out.
+func terraformVariableDefaults(dir string) (map[string]interface{}, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	parser := hclparse.NewParser()
+	schema := &hcl.BodySchema{Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}}}
+	defaultSchema := &hcl.BodySchema{Attributes: []hcl.AttributeSchema{{Name: "default"}}}
+
+	defaults := map[string]interface{}{}
+	declared := 0
+	for _, path := range files {
+		file, diags := parser.ParseHCLFile(path)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		content, _, diags := file.Body.PartialContent(schema)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		for _, block := range content.Blocks {
+			declared++
+			attrs, _, diags := block.Body.PartialContent(defaultSchema)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			attr, ok := attrs.Attributes["default"]
+			if !ok {
+				continue
+			}
+			value, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() || !value.IsWhollyKnown() {
+				continue
+			}
+			raw, err := ctyjson.SimpleJSONValue{Value: value}.MarshalJSON()
+			if err != nil {
+				return nil, fmt.Errorf("variable %q: %w", block.Labels[0], err)
+			}
+			var decoded interface{}
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				return nil, fmt.Errorf("variable %q: %w", block.Labels[0], err)
+			}
+			defaults[block.Labels[0]] = decoded
+		}
+	}
+	if declared == 0 {
+		return nil, fmt.Errorf("no variables declared in %s", dir)
+	}
+	return defaults, nil
+}
+
+// effectiveVars resolves the variables terraform applies with options: the
+// defaults in TerraformDir, then TF_VAR_ environment variables, then -var and
+// -var-file arguments in the order terratest passes them. TF_VAR_ values stay
+// strings.
+func effectiveVars(t terratesting.TestingT, options *terraform.Options) (map[string]interface{}, error) {
+	vars, err := terraformVariableDefaults(options.TerraformDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range os.Environ() {
+		if name, value, ok := strings.Cut(entry, "="); ok && strings.HasPrefix(name, "TF_VAR_") {
+			vars[strings.TrimPrefix(name, "TF_VAR_")] = value
+		}
+	}
+
+	applyFiles := func() error {
+		for _, path := range options.VarFiles {
+			fileVars := map[string]interface{}{}
+			if err := terraform.GetAllVariablesFromVarFileE(t, path, &fileVars); err != nil {
+				return fmt.Errorf("failed to read var file %s: %w", path, err)
+			}
+			maps.Copy(vars, fileVars)
+		}
+		return nil
+	}
+	if !options.SetVarsAfterVarFiles {
+		maps.Copy(vars, options.Vars)
+	}
+	if err := applyFiles(); err != nil {
+		return nil, err
+	}
+	if options.SetVarsAfterVarFiles {
+		maps.Copy(vars, options.Vars)
+	}
+	return vars, nil
+}
+
+// expectedPoolSizes returns the node count of each worker pool enabled in vars,
+// mirroring local.worker_pools: oke-system always, and oke-cpu, oke-gpu,
+// oke-rdma and oke-gmc when their worker_*_enabled flag is set. The GPU Memory
+// Cluster pool creates one cluster of worker_gmc_scale_target_size nodes per
+// fabric in worker_gmc_gpu_memory_fabric_ids.
+func expectedPoolSizes(vars map[string]interface{}) (map[string]int, error) {
+	sizes := map[string]int{}
+	var errs []string
+	intVar := func(key string) int {
+		n, err := varInt(vars, key)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		return n
+	}
+	enabled := func(key string) bool {
+		b, err := varBool(vars, key)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		return b
+	}
+
+	sizes["oke-system"] = intVar("worker_ops_pool_size")
+	for _, pool := range []string{"cpu", "gpu", "rdma"} {
+		if enabled("worker_" + pool + "_enabled") {
+			sizes["oke-"+pool] = intVar("worker_" + pool + "_pool_size")
+		}
+	}
+	if enabled("worker_gmc_enabled") {
+		ids, _ := vars["worker_gmc_gpu_memory_fabric_ids"].(string)
+		fabrics := 0
+		for _, id := range strings.Split(ids, "\n") {
+			if strings.TrimSpace(id) != "" {
+				fabrics++
+			}
+		}
+		sizes["oke-gmc"] = fabrics * intVar("worker_gmc_scale_target_size")
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return sizes, nil
+}
+
+// varInt reads a number variable that may have come from HCL, JSON, a Go
+// override or a string (ORM var files and TF_VAR_ values).
+func varInt(vars map[string]interface{}, key string) (int, error) {
+	switch v := vars[key].(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case string:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %q is not a number", key, v)
+		}
+		return n, nil
+	case nil:
+		return 0, fmt.Errorf("%s is not set", key)
+	default:
+		return 0, fmt.Errorf("%s: %v is not a number", key, v)
+	}
+}
+
+// varBool reads a bool variable like varInt. Unset reads as false.
+func varBool(vars map[string]interface{}, key string) (bool, error) {
+	switch v := vars[key].(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("%s: %q is not a bool", key, v)
+		}
+		return b, nil
+	case nil:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: %v is not a bool", key, v)
+	}
+}
+
+// gpuPoolShapes returns the shape of every GPU pool with nodes in vars:
+// oke-gpu, oke-rdma and oke-gmc when their shape is a GPU shape in the shapes
+// catalog. RDMA pools of CPU HPC shapes are left out.
+func gpuPoolShapes(vars map[string]interface{}) (map[string]string, error) {
+	sizes, err := expectedPoolSizes(vars)
+	if err != nil {
+		return nil, err
+	}
+	pools := map[string]string{}
+	for _, pool := range []string{"gpu", "rdma", "gmc"} {
+		name := "oke-" + pool
+		shapeName, _ := vars["worker_"+pool+"_shape"].(string)
+		if shape, ok := shapes.Lookup(shapeName); ok && shape.GPUs > 0 && sizes[name] > 0 {
+			pools[name] = shapeName
+		}
+	}
+	return pools, nil
+}
+
+func TestEffectiveVarsFollowTerraformPrecedence(t *testing.T) {
+	t.Setenv("TF_VAR_worker_cpu_pool_size", "5")
+	t.Setenv("TF_VAR_worker_gpu_pool_size", "6")
+	dir := t.TempDir()
+	varFile := filepath.Join(dir, "override.tfvars")
+	require.NoError(t, os.WriteFile(varFile, []byte("worker_gpu_pool_size = 2\nworker_gpu_enabled = true\n"), 0o600))
+
+	options := &terraform.Options{
+		TerraformDir: terraformDir(),
+		Vars:         map[string]interface{}{"worker_ops_pool_size": 1, "worker_gpu_pool_size": 9},
+		VarFiles:     []string{varFile},
+	}
+	vars, err := effectiveVars(t, options)
+	require.NoError(t, err)
+	require.Equal(t, float64(18), vars["worker_gmc_scale_target_size"], "default from variables.tf")
+	require.Equal(t, "5", vars["worker_cpu_pool_size"], "TF_VAR_ overrides the default")
+	require.Equal(t, 1, vars["worker_ops_pool_size"], "-var overrides the default")
+	require.Equal(t, float64(2), vars["worker_gpu_pool_size"], "var files come after -var")
+
+	options.SetVarsAfterVarFiles = true
+	vars, err = effectiveVars(t, options)
+	require.NoError(t, err)
+	require.Equal(t, 9, vars["worker_gpu_pool_size"])
+
+	_, err = effectiveVars(t, &terraform.Options{TerraformDir: dir})
+	require.ErrorContains(t, err, "no variables declared")
+}
+
+func TestExpectedPoolSizes(t *testing.T) {
+	defaults, err := terraformVariableDefaults(terraformDir())
+	require.NoError(t, err)
+	sizes, err := expectedPoolSizes(defaults)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"oke-system": 3}, sizes)
+
+	// tfvars/tf topologies enable the CPU and GPU pools.
+	options := &terraform.Options{TerraformDir: terraformDir(), VarFiles: []string{"tfvars/tf/public-base-tf.tfvars"}}
+	vars, err := effectiveVars(t, options)
+	require.NoError(t, err)
+	sizes, err = expectedPoolSizes(vars)
+	require.NoError(t, err)
+	require.Equal(t, 1, sizes["oke-cpu"])
+	require.Equal(t, 1, sizes["oke-gpu"])
+	require.NotContains(t, sizes, "oke-rdma")
+
+	// ORM var files carry every value as a string.
+	sizes, err = expectedPoolSizes(mergeVars(defaults, map[string]interface{}{
+		"worker_ops_pool_size":             "2",
+		"worker_rdma_enabled":              "true",
+		"worker_rdma_pool_size":            "8",
+		"worker_gmc_enabled":               true,
+		"worker_gmc_gpu_memory_fabric_ids": "ocid1.computegpumemoryfabric.oc1..a\n\n ocid1.computegpumemoryfabric.oc1..b \n",
+		"worker_gmc_scale_target_size":     4,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"oke-system": 2, "oke-rdma": 8, "oke-gmc": 8}, sizes)
+
+	_, err = expectedPoolSizes(map[string]interface{}{"worker_ops_pool_size": "three", "worker_cpu_enabled": "yes please"})
+	require.EqualError(t, err, `worker_ops_pool_size: "three" is not a number; worker_cpu_enabled: "yes please" is not a bool`)
+}
+
+func TestGPUPoolShapes(t *testing.T) {
+	defaults, err := terraformVariableDefaults(terraformDir())
+	require.NoError(t, err)
+	pools, err := gpuPoolShapes(defaults)
+	require.NoError(t, err)
+	require.Empty(t, pools)
+
+	pools, err = gpuPoolShapes(mergeVars(defaults, map[string]interface{}{
+		"worker_gpu_enabled":               "true",
+		"worker_rdma_enabled":              true,
+		"worker_rdma_shape":                "BM.Optimized3.36",
+		"worker_gmc_enabled":               true,
+		"worker_cpu_enabled":               true,
+		"worker_gmc_scale_target_size":     2,
+		"worker_gmc_gpu_memory_fabric_ids": "ocid1.computegpumemoryfabric.oc1..a",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"oke-gpu": "VM.GPU.A10.1", "oke-gmc": "BM.GPU.GB200-v3.4"}, pools, "CPU HPC shapes have no GPUs to check")
+
+	pools, err = gpuPoolShapes(mergeVars(defaults, map[string]interface{}{"worker_rdma_enabled": true, "worker_rdma_pool_size": 0}))
+	require.NoError(t, err)
+	require.Empty(t, pools, "empty pools are not checked")
+}
@@ -0,0 +1,28 @@
+// Package ociauth builds OCI SDK configuration providers from the auth
+// settings the test harness and its commands share.
+package ociauth
+
+import (
+	"fmt"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/common/auth"
+)
+
+// Provider returns the configuration provider for authType: api_key (the
+// default), security_token or instance_principal. configFile defaults to
+// ~/.oci/config and profile to DEFAULT.
+func Provider(authType, configFile, profile string) (common.ConfigurationProvider, error) {
+	if profile == "" {
+		profile = "DEFAULT"
+	}
+	switch authType {
+	case "", "api_key":
+		return common.CustomProfileConfigProvider(configFile, profile), nil
+	case "security_token":
+		return common.CustomProfileSessionTokenConfigProvider(configFile, profile), nil
+	case "instance_principal":
+		return auth.InstancePrincipalConfigurationProvider()
+	}
+	return nil, fmt.Errorf("unsupported auth %q", authType)
+}
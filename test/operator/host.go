@@ -0,0 +1,291 @@
+// Package operator runs commands on the operator host of a cluster created
+// with create_operator=true, jumping through the bastion host the same way the
+// via-operator-*.tf provisioners do.
+package operator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes how to reach the operator host.
+type Config struct {
+	// BastionAddr and OperatorAddr are host or host:port; the port defaults to 22.
+	BastionAddr  string
+	BastionUser  string
+	OperatorAddr string
+	OperatorUser string
+	Signer       ssh.Signer
+	// HostKeyCallback verifies both hosts. Nil accepts any key, like
+	// StrictHostKeyChecking=no in the provisioners: both hosts are created by
+	// the same apply and have no known keys yet.
+	HostKeyCallback ssh.HostKeyCallback
+	Timeout         time.Duration
+}
+
+// Host is an SSH connection to the operator host through the bastion.
+type Host struct {
+	bastion  *ssh.Client
+	operator *ssh.Client
+
+	mu    sync.Mutex
+	socks net.Listener
+	wg    sync.WaitGroup
+}
+
+// Dial connects to the bastion and, through it, to the operator host.
+func Dial(cfg Config) (*Host, error) {
+	if cfg.BastionUser == "" {
+		cfg.BastionUser = "opc"
+	}
+	if cfg.OperatorUser == "" {
+		cfg.OperatorUser = "opc"
+	}
+	if cfg.HostKeyCallback == nil {
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	clientConfig := func(user string) *ssh.ClientConfig {
+		return &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(cfg.Signer)},
+			HostKeyCallback: cfg.HostKeyCallback,
+			Timeout:         cfg.Timeout,
+		}
+	}
+
+	bastionAddr := withPort(cfg.BastionAddr)
+	bastion, err := ssh.Dial("tcp", bastionAddr, clientConfig(cfg.BastionUser))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bastion %s: %w", bastionAddr, err)
+	}
+	operatorAddr := withPort(cfg.OperatorAddr)
+	conn, err := bastion.Dial("tcp", operatorAddr)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("failed to reach operator %s from the bastion: %w", operatorAddr, err)
+	}
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, operatorAddr, clientConfig(cfg.OperatorUser))
+	if err != nil {
+		conn.Close()
+		bastion.Close()
+		return nil, fmt.Errorf("failed to connect to operator %s: %w", operatorAddr, err)
+	}
+	return &Host{bastion: bastion, operator: ssh.NewClient(clientConn, channels, requests)}, nil
+}
+
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "22")
+}
+
+// Run runs command in a login shell on the operator host and returns its
+// stdout. A non-zero exit returns an error that includes stderr.
+func (h *Host) Run(ctx context.Context, command string) (string, error) {
+	session, err := h.operator.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	// A login shell picks up ~/bin and the kubeconfig the operator is set up with.
+	if err := session.Start("bash -lc " + Quote(command)); err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+		return stdout.String(), ctx.Err()
+	}
+	if err != nil {
+		return stdout.String(), fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// Kubectl runs kubectl on the operator host.
+func (h *Host) Kubectl(ctx context.Context, args ...string) (string, error) {
+	return h.Run(ctx, command("kubectl", args))
+}
+
+// Helm runs helm on the operator host.
+func (h *Host) Helm(ctx context.Context, args ...string) (string, error) {
+	return h.Run(ctx, command("helm", args))
+}
+
+// ReadFile returns the content of path on the operator host, such as
+// /var/log/cloud-init-output.log. Root-owned files are read with sudo.
+func (h *Host) ReadFile(ctx context.Context, path string) (string, error) {
+	return h.Run(ctx, "sudo cat "+Quote(path))
+}
+
+func command(name string, args []string) string {
+	quoted := []string{name}
+	for _, arg := range args {
+		quoted = append(quoted, Quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Quote single-quotes s for a POSIX shell.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// SOCKS starts a SOCKS5 proxy on a loopback port that opens connections from
+// the operator host, so local tools can reach the private API endpoint, and
+// returns its address. Repeated calls return the same proxy.
+func (h *Host) SOCKS() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.socks != nil {
+		return h.socks.Addr().String(), nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	h.socks = listener
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			h.wg.Add(1)
+			go func() {
+				defer h.wg.Done()
+				defer conn.Close()
+				h.proxy(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// SOCKS5 constants from RFC 1928.
+const (
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+	socksIPv4         = 0x01
+	socksDomain       = 0x03
+	socksIPv6         = 0x04
+	socksSucceeded    = 0x00
+	socksHostUnreach  = 0x04
+	socksCmdNotSupp   = 0x07
+)
+
+// proxy serves one SOCKS5 CONNECT request without authentication.
+func (h *Host) proxy(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !bytes.Contains(methods, []byte{socksNoAuth}) {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	if request[1] != socksConnect {
+		reply(conn, socksCmdNotSupp)
+		return
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		reply(conn, socksCmdNotSupp)
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	remote, err := h.operator.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(int(port[0])<<8|int(port[1]))))
+	if err != nil {
+		reply(conn, socksHostUnreach)
+		return
+	}
+	defer remote.Close()
+	if !reply(conn, socksSucceeded) {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(remote, conn); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(conn, remote); done <- struct{}{} }()
+	<-done
+}
+
+func reply(conn net.Conn, status byte) bool {
+	_, err := conn.Write([]byte{socksVersion, status, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err == nil
+}
+
+// Close stops the proxy and closes both connections.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	var socksErr error
+	if h.socks != nil {
+		socksErr = h.socks.Close()
+	}
+	h.mu.Unlock()
+	err := errors.Join(socksErr, h.operator.Close(), h.bastion.Close())
+	h.wg.Wait()
+	return err
+}
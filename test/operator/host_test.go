@@ -0,0 +1,249 @@
+package operator
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeHost is an in-process SSH server standing in for the bastion or the
+// operator. It accepts one user and key, forwards direct-tcpip channels to the
+// addresses in forwards, and answers exec requests with exec.
+type fakeHost struct {
+	t        *testing.T
+	user     string
+	key      ssh.PublicKey
+	forwards map[string]string
+	exec     func(command string) (stdout, stderr string, status uint32)
+	addr     string
+
+	mu       sync.Mutex
+	commands []string
+	dialed   []string
+}
+
+func newFakeHost(t *testing.T, user string, key ssh.PublicKey, forwards map[string]string) *fakeHost {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	h := &fakeHost{t: t, user: user, key: key, forwards: forwards}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != h.user || string(key.Marshal()) != string(h.key.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	h.addr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go h.serve(conn, config)
+		}
+	}()
+	return h
+}
+
+func (h *fakeHost) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			go h.forward(newChannel)
+		case "session":
+			go h.session(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+		}
+	}
+}
+
+func (h *fakeHost) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	target := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+	h.mu.Lock()
+	h.dialed = append(h.dialed, target)
+	h.mu.Unlock()
+	backend, ok := h.forwards[target]
+	if !ok {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "no route to "+target)
+		return
+	}
+	upstream, err := net.Dial("tcp", backend)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(upstream, channel)
+		upstream.Close()
+	}()
+	_, _ = io.Copy(channel, upstream)
+	channel.Close()
+}
+
+func (h *fakeHost) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+		_ = req.Reply(true, nil)
+		h.mu.Lock()
+		h.commands = append(h.commands, payload.Command)
+		h.mu.Unlock()
+
+		stdout, stderr, status := h.exec(payload.Command)
+		_, _ = io.WriteString(channel, stdout)
+		_, _ = io.WriteString(channel.Stderr(), stderr)
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// newTopology starts a bastion that can only reach the operator, and an
+// operator that can reach the private API endpoint at 10.0.0.5:6443.
+func newTopology(t *testing.T, apiAddr string) (*fakeHost, *fakeHost, Config) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	operator := newFakeHost(t, "opc", signer.PublicKey(), map[string]string{"10.0.0.5:6443": apiAddr})
+	operator.exec = func(command string) (string, string, uint32) {
+		switch {
+		case strings.Contains(command, "kubectl"):
+			return "node-1   Ready\n", "", 0
+		case strings.Contains(command, "helm"):
+			return "", "Error: release not found\n", 1
+		}
+		return "", "", 0
+	}
+	bastion := newFakeHost(t, "ubuntu", signer.PublicKey(), map[string]string{"10.0.1.10:22": operator.addr})
+	return bastion, operator, Config{
+		BastionAddr:  bastion.addr,
+		BastionUser:  "ubuntu",
+		OperatorAddr: "10.0.1.10",
+		Signer:       signer,
+	}
+}
+
+func TestRunJumpsThroughBastion(t *testing.T) {
+	bastion, operator, cfg := newTopology(t, "127.0.0.1:1")
+
+	host, err := Dial(cfg)
+	require.NoError(t, err)
+	defer host.Close()
+
+	out, err := host.Kubectl(context.Background(), "get", "nodes", "-o", "jsonpath={.items[*].metadata.name}")
+	require.NoError(t, err)
+	require.Equal(t, "node-1   Ready\n", out)
+
+	_, err = host.Helm(context.Background(), "status", "kueue", "-n", "kueue-system")
+	require.ErrorContains(t, err, "release not found")
+
+	require.Equal(t, []string{"10.0.1.10:22"}, bastion.dialed)
+	require.Equal(t, []string{
+		`bash -lc 'kubectl '\''get'\'' '\''nodes'\'' '\''-o'\'' '\''jsonpath={.items[*].metadata.name}'\'''`,
+		`bash -lc 'helm '\''status'\'' '\''kueue'\'' '\''-n'\'' '\''kueue-system'\'''`,
+	}, operator.commands)
+}
+
+func TestDialRejectsWrongOperatorUser(t *testing.T) {
+	_, _, cfg := newTopology(t, "127.0.0.1:1")
+	cfg.OperatorUser = "root"
+
+	_, err := Dial(cfg)
+	require.ErrorContains(t, err, "failed to connect to operator 10.0.1.10:22")
+}
+
+func TestSOCKSReachesPrivateEndpointFromOperator(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "private api")
+	}))
+	defer api.Close()
+	_, operator, cfg := newTopology(t, api.Listener.Addr().String())
+
+	host, err := Dial(cfg)
+	require.NoError(t, err)
+	defer host.Close()
+
+	addr, err := host.SOCKS()
+	require.NoError(t, err)
+	again, err := host.SOCKS()
+	require.NoError(t, err)
+	require.Equal(t, addr, again)
+
+	proxyURL, err := url.Parse("socks5://" + addr)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://10.0.0.5:6443/version")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "private api", string(body))
+
+	_, err = client.Get("http://10.0.0.6:6443/version")
+	require.Error(t, err, "the operator cannot reach this address")
+	require.Equal(t, []string{"10.0.0.5:6443", "10.0.0.6:6443"}, operator.dialed)
+}
+
+func TestQuote(t *testing.T) {
+	require.Equal(t, `'it'\''s'`, Quote("it's"))
+	require.Equal(t, `''`, Quote(""))
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/operator"
+)
+
+// sshPrivateKeyPath is the key matching the ssh_public_key given to terraform:
+// SSH_PRIVATE_KEY_PATH, or SSH_PUBLIC_KEY_PATH without its .pub suffix.
+func sshPrivateKeyPath() string {
+	if path := envOrDefault([]string{"SSH_PRIVATE_KEY_PATH"}, ""); path != "" {
+		return resolveVarFilePath(path)
+	}
+	if path := envOrDefault([]string{"SSH_PUBLIC_KEY_PATH", "TF_VAR_ssh_public_key_path"}, ""); strings.HasSuffix(path, ".pub") {
+		return resolveVarFilePath(strings.TrimSuffix(path, ".pub"))
+	}
+	return ""
+}
+
+// operator connects to the fixture's operator host through its bastion on
+// first use and keeps the connection until the fixture is closed. It skips the
+// test for clusters without an operator or without a private key to use.
+func (c *clusterFixture) operator(t *testing.T) *operator.Host {
+	t.Helper()
+
+	if c.operatorHost != nil {
+		return c.operatorHost
+	}
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping operator checks: SSH sessions are not recorded in cassettes")
+	}
+	if c.outputs.OperatorPrivateIP == "" || c.outputs.BastionPublicIP == "" {
+		t.Skip("Skipping operator checks: cluster has no bastion and operator")
+	}
+	keyPath := sshPrivateKeyPath()
+	if keyPath == "" {
+		t.Skip("Skipping operator checks: set SSH_PRIVATE_KEY_PATH")
+	}
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("failed to read SSH private key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(content)
+	if err != nil {
+		t.Fatalf("failed to parse SSH private key %s: %v", keyPath, err)
+	}
+
+	host, err := operator.Dial(operator.Config{
+		BastionAddr:  c.outputs.BastionPublicIP,
+		BastionUser:  c.outputs.BastionSSHUser,
+		OperatorAddr: c.outputs.OperatorPrivateIP,
+		OperatorUser: c.outputs.OperatorSSHUser,
+		Signer:       signer,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to the operator host: %v", err)
+	}
+	c.operatorHost = host
+	c.closers = append(c.closers, func() error {
+		c.operatorHost = nil
+		return host.Close()
+	})
+	return host
+}
+
+// operatorKubectl returns a kubectl client for namespace that reaches the
+// private API endpoint through a SOCKS proxy on the operator host. The oci
+// CLI token plugin still talks to OCI directly. Like the SSH session itself,
+// these commands bypass cassettes.
+func (c *clusterFixture) operatorKubectl(t *testing.T, namespace string) kubectlClient {
+	t.Helper()
+
+	proxy, err := c.operator(t).SOCKS()
+	if err != nil {
+		t.Fatalf("failed to start the operator SOCKS proxy: %v", err)
+	}
+	settings := kubeconfigSettingsFromEnv()
+	server, err := clusterEndpoint(c.outputs, kubeEndpointPrivate)
+	if err != nil {
+		t.Fatalf("failed to select the Kubernetes API endpoint: %v", err)
+	}
+	options := k8s.NewKubectlOptions("", saveKubeconfig(t, t.TempDir(), c.outputs, settings, server), namespace)
+	options.Env = map[string]string{
+		"HTTPS_PROXY": "socks5://" + proxy,
+		"NO_PROXY":    ".oraclecloud.com",
+	}
+	return kubectlClient{exec: terratestKubectl{}, options: options}
+}
+
+func TestSSHPrivateKeyPathDefaultsToPublicKeySibling(t *testing.T) {
+	t.Setenv("SSH_PRIVATE_KEY_PATH", "")
+	t.Setenv("TF_VAR_ssh_public_key_path", "")
+	t.Setenv("SSH_PUBLIC_KEY_PATH", "/home/ci/.ssh/id_ed25519.pub")
+	require.Equal(t, "/home/ci/.ssh/id_ed25519", sshPrivateKeyPath())
+
+	t.Setenv("SSH_PRIVATE_KEY_PATH", "/keys/operator")
+	require.Equal(t, "/keys/operator", sshPrivateKeyPath())
+
+	t.Setenv("SSH_PRIVATE_KEY_PATH", "")
+	t.Setenv("SSH_PUBLIC_KEY_PATH", "")
+	require.Empty(t, sshPrivateKeyPath())
+}
@@ -0,0 +1,728 @@
+// Package rdma measures RDMA write bandwidth between the nodes of an RDMA
+// pool with ib_write_bw, over every RDMA interface, and reports a node by
+// node matrix with the interfaces that fall below a threshold. It automates
+// docs/running-ib-write-bw-test.md.
+package rdma
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// DefaultImage provides ib_write_bw, ibdev2netdev and ip. It is the image
+// docs/running-ib-write-bw-test.md uses.
+const DefaultImage = "oguzpastirmaci/mofed-perftest:5.4-3.6.8.1-ubuntu20.04-amd64"
+
+// DefaultArgs are the ib_write_bw flags from docs/running-ib-write-bw-test.md:
+// RDMA CM, GID index 3, traffic class 41, four QPs, results in Gb/s.
+const DefaultArgs = "-F -x 3 --report_gbits -R -T 41 -q 4"
+
+const (
+	appLabel = "rdma-bw-check"
+	// basePort is ib_write_bw's default port. Each interface of each round
+	// gets its own port so a server left over from a slow round never
+	// collides with the next one.
+	basePort = 18515
+	// clientAttempts is how often a client retries while its server starts.
+	clientAttempts = 30
+)
+
+// Config describes a bandwidth run.
+type Config struct {
+	// Namespace is created for the test pods and deleted afterwards.
+	Namespace string
+	// PoolLabel groups nodes into pools. Defaults to oke.oraclecloud.com/pool.name.
+	PoolLabel string
+	// Pool is the RDMA pool whose Ready nodes are measured.
+	Pool string
+	// Interfaces are the RDMA network interfaces measured on every pair.
+	// Defaults to rdma0 to rdma<n-1>, n being the RDMA NIC count of the
+	// pool's shape in the shapes catalog.
+	Interfaces []string
+	// MaxPairs limits the node pairs to a sample of at least one pair per
+	// node (see Schedule). Zero measures every pair.
+	MaxPairs int
+	// Seed picks the sample.
+	Seed uint64
+	// Threshold is the bandwidth in Gb/s below which a measurement is an
+	// outlier. When zero it is MinFraction of the median measurement.
+	Threshold float64
+	// MinFraction defaults to 0.8.
+	MinFraction float64
+	Image       string
+	// Args are the ib_write_bw flags shared by servers and clients. Defaults
+	// to DefaultArgs.
+	Args string
+	// Timeout bounds each phase: address discovery and every round of pairs.
+	// Defaults to 5 minutes.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Logf, if set, receives progress messages.
+	Logf func(format string, args ...any)
+}
+
+func (c *Config) setDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = appLabel
+	}
+	if c.PoolLabel == "" {
+		c.PoolLabel = "oke.oraclecloud.com/pool.name"
+	}
+	if c.MinFraction == 0 {
+		c.MinFraction = 0.8
+	}
+	if c.Image == "" {
+		c.Image = DefaultImage
+	}
+	if c.Args == "" {
+		c.Args = DefaultArgs
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Minute
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 5 * time.Second
+	}
+	if c.Logf == nil {
+		c.Logf = func(string, ...any) {}
+	}
+}
+
+// Bandwidth is the result line of an ib_write_bw run.
+type Bandwidth struct {
+	Bytes       int64
+	Iterations  int64
+	PeakGbps    float64
+	AverageGbps float64
+	MsgRateMpps float64
+}
+
+// ParseWriteBW reads the result line of ib_write_bw --report_gbits output:
+// "#bytes #iterations BW peak BW average MsgRate". The rest of the output is
+// ignored, so a bare result line parses too.
+func ParseWriteBW(output string) (Bandwidth, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		var bw Bandwidth
+		var errs []error
+		parseInt := func(s string) int64 {
+			n, err := strconv.ParseInt(s, 10, 64)
+			errs = append(errs, err)
+			return n
+		}
+		parseFloat := func(s string) float64 {
+			f, err := strconv.ParseFloat(s, 64)
+			errs = append(errs, err)
+			return f
+		}
+		bw.Bytes, bw.Iterations = parseInt(fields[0]), parseInt(fields[1])
+		bw.PeakGbps, bw.AverageGbps, bw.MsgRateMpps = parseFloat(fields[2]), parseFloat(fields[3]), parseFloat(fields[4])
+		if errors.Join(errs...) == nil {
+			return bw, nil
+		}
+	}
+	return Bandwidth{}, fmt.Errorf("no ib_write_bw result line in %q", oneLine(output))
+}
+
+// Measurement is one client to server run over one interface. Error is set
+// when the run produced no result.
+type Measurement struct {
+	Client    string
+	Server    string
+	Interface string
+	Bandwidth Bandwidth
+	Error     string
+}
+
+func (m Measurement) String() string {
+	return fmt.Sprintf("%s -> %s %s", m.Client, m.Server, m.Interface)
+}
+
+// Report is what Run measured, ordered by round, pair and interface.
+type Report struct {
+	Nodes        []string
+	Interfaces   []string
+	Threshold    float64
+	Measurements []Measurement
+}
+
+// Outliers are the measurements below the threshold.
+func (r Report) Outliers() []Measurement {
+	var outliers []Measurement
+	for _, m := range r.Measurements {
+		if m.Error == "" && m.Bandwidth.AverageGbps < r.Threshold {
+			outliers = append(outliers, m)
+		}
+	}
+	return outliers
+}
+
+// Failures lists every failed measurement and outlier as
+// "client -> server interface: problem".
+func (r Report) Failures() []string {
+	var failures []string
+	for _, m := range r.Measurements {
+		switch {
+		case m.Error != "":
+			failures = append(failures, fmt.Sprintf("%s: %s", m, m.Error))
+		case m.Bandwidth.AverageGbps < r.Threshold:
+			failures = append(failures, fmt.Sprintf("%s: %.2f Gb/s is below %.2f Gb/s", m, m.Bandwidth.AverageGbps, r.Threshold))
+		}
+	}
+	return failures
+}
+
+// Suspects are the "node/interface" endpoints whose every measurement, two
+// or more, failed or was an outlier: a single bad pair cannot tell which end
+// is at fault, but a NIC or cable that is bad towards every peer can.
+func (r Report) Suspects() []string {
+	total, bad := map[string]int{}, map[string]int{}
+	for _, m := range r.Measurements {
+		failed := m.Error != "" || m.Bandwidth.AverageGbps < r.Threshold
+		for _, node := range []string{m.Client, m.Server} {
+			endpoint := node + "/" + m.Interface
+			total[endpoint]++
+			if failed {
+				bad[endpoint]++
+			}
+		}
+	}
+	var suspects []string
+	for endpoint, n := range total {
+		if n >= 2 && bad[endpoint] == n {
+			suspects = append(suspects, endpoint)
+		}
+	}
+	sort.Strings(suspects)
+	return suspects
+}
+
+// String renders the node by node matrix, one row per client and one column
+// per server, numbered like the rows. Each cell is the lowest average
+// bandwidth over the interfaces in Gb/s, marked "*" below the threshold,
+// "FAIL" when an interface produced no result, and "-" for pairs that were not
+// measured.
+func (r Report) String() string {
+	index := map[string]int{}
+	for i, node := range r.Nodes {
+		index[node] = i
+	}
+	cells := make([][]string, len(r.Nodes))
+	lowest := make([][]float64, len(r.Nodes))
+	for i := range r.Nodes {
+		cells[i] = slices.Repeat([]string{"-"}, len(r.Nodes))
+		lowest[i] = make([]float64, len(r.Nodes))
+	}
+	for _, m := range r.Measurements {
+		i, j := index[m.Client], index[m.Server]
+		switch {
+		case cells[i][j] == "FAIL":
+		case m.Error != "":
+			cells[i][j] = "FAIL"
+		case cells[i][j] == "-" || m.Bandwidth.AverageGbps < lowest[i][j]:
+			lowest[i][j] = m.Bandwidth.AverageGbps
+			cells[i][j] = fmt.Sprintf("%.1f", m.Bandwidth.AverageGbps)
+			if m.Bandwidth.AverageGbps < r.Threshold {
+				cells[i][j] += "*"
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	header := []string{"client \\ server"}
+	for i := range r.Nodes {
+		header = append(header, strconv.Itoa(i))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for i, node := range r.Nodes {
+		fmt.Fprintln(w, strings.Join(append([]string{fmt.Sprintf("%d %s", i, node)}, cells[i]...), "\t"))
+	}
+	_ = w.Flush()
+	fmt.Fprintf(&buf, "lowest of %d interface(s) in Gb/s; * below %.2f Gb/s\n", len(r.Interfaces), r.Threshold)
+	return buf.String()
+}
+
+// Pair is a client and a server, as indexes into the measured nodes.
+type Pair struct {
+	Client, Server int
+}
+
+// Schedule returns the pairs of n nodes to measure, grouped into rounds in
+// which every node is in at most one pair, so measurements never share a NIC.
+// Every pair is measured, in n-1 rounds for an even n (n for an odd n), unless
+// maxPairs is smaller than that: then a sample picked with seed is measured,
+// always including the ring 0-1, 1-2, ..., (n-1)-0 so every node is measured
+// against two peers.
+func Schedule(n, maxPairs int, seed uint64) [][]Pair {
+	// The circle method: node 0 stays put and the others rotate, each round
+	// pairing opposite positions. An odd n gets a dummy node that sits out.
+	slots := n + n%2
+	order := make([]int, slots)
+	for i := range order {
+		order[i] = i
+	}
+	var all []Pair
+	for round := range slots - 1 {
+		for i := range slots / 2 {
+			a, b := order[i], order[slots-1-i]
+			if round%2 == 1 {
+				// Alternate directions so every node is a client and a server.
+				a, b = b, a
+			}
+			if a < n && b < n {
+				all = append(all, Pair{Client: a, Server: b})
+			}
+		}
+		order = append([]int{order[0], order[slots-1]}, order[1:slots-1]...)
+	}
+
+	if maxPairs > 0 && maxPairs < len(all) {
+		key := func(p Pair) [2]int { return [2]int{min(p.Client, p.Server), max(p.Client, p.Server)} }
+		keep := map[[2]int]bool{}
+		for i := range n {
+			keep[key(Pair{i, (i + 1) % n})] = true
+		}
+		rng := rand.New(rand.NewPCG(seed, 0))
+		for _, i := range rng.Perm(len(all)) {
+			if len(keep) >= maxPairs {
+				break
+			}
+			keep[key(all[i])] = true
+		}
+		all = slices.DeleteFunc(all, func(p Pair) bool { return !keep[key(p)] })
+	}
+
+	// Pack the pairs into the first round where both nodes are free. The
+	// circle order packs every pair back into its own round.
+	var rounds [][]Pair
+	var busy []map[int]bool
+	for _, p := range all {
+		r := slices.IndexFunc(busy, func(b map[int]bool) bool { return !b[p.Client] && !b[p.Server] })
+		if r < 0 {
+			r = len(rounds)
+			rounds = append(rounds, nil)
+			busy = append(busy, map[int]bool{})
+		}
+		rounds[r] = append(rounds[r], p)
+		busy[r][p.Client], busy[r][p.Server] = true, true
+	}
+	return rounds
+}
+
+// Run measures the Ready nodes of the pool and deletes the namespace it
+// created. An error means the run could not happen; failed measurements are
+// in the report.
+func Run(ctx context.Context, client kubernetes.Interface, cfg Config) (Report, error) {
+	cfg.setDefaults()
+
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", cfg.PoolLabel, cfg.Pool),
+	})
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var ready []corev1.Node
+	for _, node := range nodes.Items {
+		if nodeReady(node) {
+			ready = append(ready, node)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Name < ready[j].Name })
+	if len(ready) < 2 {
+		return Report{}, fmt.Errorf("pool %s has %d Ready node(s), need at least 2", cfg.Pool, len(ready))
+	}
+	if len(cfg.Interfaces) == 0 {
+		name := ready[0].Labels[corev1.LabelInstanceTypeStable]
+		shape, ok := shapes.Lookup(name)
+		if !ok || shape.RDMANICs == 0 {
+			return Report{}, fmt.Errorf("pool %s: shape %q has no RDMA NICs in the shapes catalog; set Interfaces", cfg.Pool, name)
+		}
+		for i := range shape.RDMANICs {
+			cfg.Interfaces = append(cfg.Interfaces, fmt.Sprintf("rdma%d", i))
+		}
+	}
+
+	namespaces := client.CoreV1().Namespaces()
+	_, err = namespaces.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cfg.Namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return Report{}, fmt.Errorf("failed to create namespace %s: %w", cfg.Namespace, err)
+	}
+	defer func() {
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := namespaces.Delete(cleanup, cfg.Namespace, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			cfg.Logf("failed to delete namespace %s: %v", cfg.Namespace, err)
+		}
+	}()
+
+	r := &runner{client: client, cfg: cfg}
+	for _, node := range ready {
+		r.nodes = append(r.nodes, node.Name)
+	}
+	return r.run(ctx)
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+type runner struct {
+	client kubernetes.Interface
+	cfg    Config
+	nodes  []string
+	// addresses maps node and interface to the interface's IPv4 address.
+	addresses []map[string]string
+}
+
+func (r *runner) run(ctx context.Context) (Report, error) {
+	r.cfg.Logf("discovering %d interface(s) on %d node(s)", len(r.cfg.Interfaces), len(r.nodes))
+	if err := r.discover(ctx); err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Nodes: r.nodes, Interfaces: r.cfg.Interfaces}
+	rounds := Schedule(len(r.nodes), r.cfg.MaxPairs, r.cfg.Seed)
+	for i, round := range rounds {
+		r.cfg.Logf("round %d/%d: %d pair(s)", i+1, len(rounds), len(round))
+		measurements, err := r.runRound(ctx, i, round)
+		if err != nil {
+			return Report{}, err
+		}
+		report.Measurements = append(report.Measurements, measurements...)
+	}
+
+	report.Threshold = r.cfg.Threshold
+	if report.Threshold == 0 {
+		report.Threshold = r.cfg.MinFraction * median(report.Measurements)
+	}
+	return report, nil
+}
+
+// median is the median average bandwidth of the measurements with a result.
+func median(measurements []Measurement) float64 {
+	var values []float64
+	for _, m := range measurements {
+		if m.Error == "" {
+			values = append(values, m.Bandwidth.AverageGbps)
+		}
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	if len(values)%2 == 1 {
+		return values[len(values)/2]
+	}
+	return (values[len(values)/2-1] + values[len(values)/2]) / 2
+}
+
+// tolerations let the pods run on GPU pools, like the CI health checks.
+var tolerations = []corev1.Toleration{
+	{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists},
+	{Key: "amd.com/gpu", Operator: corev1.TolerationOpExists},
+}
+
+// pod runs command on node with host networking and the RDMA devices, like
+// the pods in docs/running-ib-write-bw-test.md.
+func (r *runner) pod(name, role, node, command string) *corev1.Pod {
+	privileged := true
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: r.cfg.Namespace,
+			Labels:    map[string]string{"app": appLabel, "role": role},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      node,
+			HostNetwork:   true,
+			DNSPolicy:     corev1.DNSClusterFirstWithHostNet,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Tolerations:   tolerations,
+			Volumes: []corev1.Volume{
+				{Name: "devinf", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/dev/infiniband"}}},
+			},
+			Containers: []corev1.Container{{
+				Name:    role,
+				Image:   r.cfg.Image,
+				Command: []string{"sh", "-c", command},
+				SecurityContext: &corev1.SecurityContext{
+					Privileged:   &privileged,
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"IPC_LOCK"}},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "devinf", MountPath: "/dev/infiniband"}},
+				Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("1"),
+					corev1.ResourceMemory: resource.MustParse("512Mi"),
+				}},
+			}},
+		},
+	}
+}
+
+func discoverName(i int) string { return fmt.Sprintf("discover-%d", i) }
+
+// discoverScript writes "<interface> <IPv4 address>" for every interface to
+// the termination message, "-" when it has none.
+func discoverScript(interfaces []string) string {
+	return fmt.Sprintf(`for iface in %s; do
+  ip=$(ip -o -4 addr show dev "$iface" 2>/dev/null | awk '{split($4, a, "/"); print a[1]; exit}')
+  echo "$iface ${ip:--}"
+done | tee /dev/termination-log
+`, strings.Join(interfaces, " "))
+}
+
+// discover finds the address of every interface of every node.
+func (r *runner) discover(ctx context.Context) error {
+	pods := make([]string, len(r.nodes))
+	for i, node := range r.nodes {
+		pods[i] = discoverName(i)
+		if _, err := r.client.CoreV1().Pods(r.cfg.Namespace).Create(ctx, r.pod(pods[i], "discover", node, discoverScript(r.cfg.Interfaces)), metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create discovery pod on %s: %w", node, err)
+		}
+	}
+	finished, err := r.wait(ctx, pods)
+	if err != nil {
+		return err
+	}
+	r.addresses = make([]map[string]string, len(r.nodes))
+	for i, node := range r.nodes {
+		pod, ok := finished[pods[i]]
+		if !ok {
+			return fmt.Errorf("discovery pod on %s did not finish in %s", node, r.cfg.Timeout)
+		}
+		if pod.Status.Phase == corev1.PodFailed {
+			return fmt.Errorf("discovery pod on %s failed: %s", node, oneLine(terminationMessage(pod)))
+		}
+		r.addresses[i] = map[string]string{}
+		for _, line := range strings.Split(terminationMessage(pod), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[1] != "-" {
+				r.addresses[i][fields[0]] = fields[1]
+			}
+		}
+	}
+	return nil
+}
+
+func serverName(round, pair int) string { return fmt.Sprintf("round-%d-server-%d", round, pair) }
+func clientName(round, pair int) string { return fmt.Sprintf("round-%d-client-%d", round, pair) }
+
+// target is one interface a client measures: the server's address on it and
+// the port its server listens on.
+type target struct {
+	iface string
+	ip    string
+	port  int
+}
+
+// serverScript runs one ib_write_bw server per target, each serving a single
+// client, and gives up after timeout seconds.
+func serverScript(args string, targets []target, timeout int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `serve() {
+  dev=$(ibdev2netdev 2>/dev/null | awk -v i="$1" '$5 == i {print $1}')
+  [ -n "$dev" ] || { echo "no RDMA device for $1"; return 1; }
+  timeout %d ib_write_bw %s -d "$dev" -p "$2" >/dev/null 2>&1
+}
+`, timeout, args)
+	for _, t := range targets {
+		fmt.Fprintf(&b, "serve %s %d &\n", t.iface, t.port)
+	}
+	b.WriteString("wait\n")
+	return b.String()
+}
+
+// clientScript measures every target at once, retrying while the server
+// starts, and writes "=== <interface> exit=<code>" followed by the result line
+// or the end of the error output for each, to the termination message.
+func clientScript(args string, targets []target) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `measure() {
+  dev=$(ibdev2netdev 2>/dev/null | awk -v i="$1" '$5 == i {print $1}')
+  if [ -z "$dev" ]; then printf '=== %%s exit=1\nno RDMA device for %%s\n' "$1" "$1"; return; fi
+  for attempt in $(seq %d); do
+    out=$(timeout 60 ib_write_bw %s -d "$dev" -p "$3" "$2" 2>&1); rc=$?
+    [ "$rc" -eq 0 ] && break
+    sleep 2
+  done
+  echo "=== $1 exit=$rc"
+  if ! echo "$out" | awk '/#bytes/ {getline; print; found=1; exit} END {exit !found}'; then
+    echo "$out" | tail -n 2 | tr '\n' ' ' | cut -c1-160; echo
+  fi
+}
+`, clientAttempts, args)
+	var files []string
+	for _, t := range targets {
+		file := "/tmp/bw-" + t.iface
+		files = append(files, file)
+		fmt.Fprintf(&b, "measure %s %s %d > %s &\n", t.iface, t.ip, t.port, file)
+	}
+	fmt.Fprintf(&b, "wait\ncat %s | tee /dev/termination-log\n", strings.Join(files, " "))
+	return b.String()
+}
+
+// runRound measures the pairs of one round and returns a measurement for
+// every pair and interface.
+func (r *runner) runRound(ctx context.Context, round int, pairs []Pair) ([]Measurement, error) {
+	pods := r.client.CoreV1().Pods(r.cfg.Namespace)
+	var measurements []Measurement
+	clients := map[int]string{}
+	var waiting []string
+	for k, pair := range pairs {
+		client, server := r.nodes[pair.Client], r.nodes[pair.Server]
+		var targets []target
+		for i, iface := range r.cfg.Interfaces {
+			m := Measurement{Client: client, Server: server, Interface: iface}
+			switch {
+			case r.addresses[pair.Server][iface] == "":
+				m.Error = "server has no IPv4 address on " + iface
+			case r.addresses[pair.Client][iface] == "":
+				m.Error = "client has no IPv4 address on " + iface
+			default:
+				targets = append(targets, target{iface: iface, ip: r.addresses[pair.Server][iface], port: basePort + round*len(r.cfg.Interfaces) + i})
+			}
+			measurements = append(measurements, m)
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		timeout := int(r.cfg.Timeout.Seconds())
+		if _, err := pods.Create(ctx, r.pod(serverName(round, k), "server", server, serverScript(r.cfg.Args, targets, timeout)), metav1.CreateOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create server pod on %s: %w", server, err)
+		}
+		if _, err := pods.Create(ctx, r.pod(clientName(round, k), "client", client, clientScript(r.cfg.Args, targets)), metav1.CreateOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create client pod on %s: %w", client, err)
+		}
+		clients[k] = clientName(round, k)
+		waiting = append(waiting, clientName(round, k))
+	}
+
+	finished, err := r.wait(ctx, waiting)
+	if err != nil {
+		return nil, err
+	}
+	for k, pair := range pairs {
+		name, ok := clients[k]
+		if !ok {
+			continue
+		}
+		pod, done := finished[name]
+		var results map[string]string
+		if done {
+			results = parseClientResults(terminationMessage(pod))
+		}
+		for i := range measurements {
+			m := &measurements[i]
+			if m.Client != r.nodes[pair.Client] || m.Server != r.nodes[pair.Server] || m.Error != "" {
+				continue
+			}
+			result, found := results[m.Interface]
+			switch {
+			case !done:
+				m.Error = "client pod did not finish in " + r.cfg.Timeout.String()
+			case !found:
+				m.Error = fmt.Sprintf("no result from client pod (%s): %s", pod.Status.Phase, oneLine(terminationMessage(pod)))
+			default:
+				bw, err := ParseWriteBW(result)
+				if err != nil {
+					m.Error = oneLine(result)
+				} else {
+					m.Bandwidth = bw
+				}
+			}
+		}
+	}
+	return measurements, nil
+}
+
+// parseClientResults splits a client's output into the text after each
+// "=== <interface> exit=<code>" line, keyed by interface. A non-zero exit
+// code is kept in front of the text.
+func parseClientResults(message string) map[string]string {
+	results := map[string]string{}
+	iface := ""
+	for _, line := range strings.Split(message, "\n") {
+		if rest, ok := strings.CutPrefix(line, "=== "); ok {
+			name, exit, _ := strings.Cut(rest, " ")
+			iface = name
+			results[iface] = ""
+			if exit != "exit=0" {
+				results[iface] = exit + ": "
+			}
+			continue
+		}
+		if iface != "" {
+			results[iface] += line + "\n"
+		}
+	}
+	return results
+}
+
+// wait polls the named pods until all of them finished or the phase timed
+// out, and returns the finished ones.
+func (r *runner) wait(ctx context.Context, names []string) (map[string]*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	pods := r.client.CoreV1().Pods(r.cfg.Namespace)
+	finished := map[string]*corev1.Pod{}
+	for {
+		for _, name := range names {
+			if finished[name] != nil {
+				continue
+			}
+			pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+			if err != nil && ctx.Err() == nil {
+				return nil, fmt.Errorf("failed to get pod %s: %w", name, err)
+			}
+			if err == nil && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+				finished[name] = pod
+			}
+		}
+		if len(finished) == len(names) {
+			return finished, nil
+		}
+		select {
+		case <-ctx.Done():
+			return finished, nil
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+func terminationMessage(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil {
+			return status.State.Terminated.Message
+		}
+	}
+	return ""
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
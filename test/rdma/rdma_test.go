@@ -0,0 +1,264 @@
+package rdma
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const poolLabel = "oke.oraclecloud.com/pool.name"
+
+func node(name, pool, shape string, ready corev1.ConditionStatus) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{poolLabel: pool, corev1.LabelInstanceTypeStable: shape}},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready}}},
+	}
+}
+
+var measureLine = regexp.MustCompile(`(?m)^measure (\S+) (\S+) (\d+) `)
+
+// fakeCluster finishes discovery pods with discover(node) and client pods
+// with the output measure returns for each "measure" line of their script.
+// Server pods and pods for which a function returns "" keep running.
+func fakeCluster(discover func(node string) string, measure func(node, iface, ip string) string, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewClientset(objects...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		var message string
+		switch pod.Labels["role"] {
+		case "discover":
+			message = discover(pod.Spec.NodeName)
+		case "client":
+			for _, m := range measureLine.FindAllStringSubmatch(pod.Spec.Containers[0].Command[2], -1) {
+				message += measure(pod.Spec.NodeName, m[1], m[2])
+			}
+		}
+		if message == "" {
+			pod.Status.Phase = corev1.PodRunning
+			return false, nil, nil
+		}
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+		}}
+		return false, nil, nil
+	})
+	return client
+}
+
+func resultLine(gbps float64) string {
+	return fmt.Sprintf(" 65536      20000            %.2f              %.2f  \t\t   0.186932\n", gbps+0.5, gbps)
+}
+
+func TestParseWriteBW(t *testing.T) {
+	output, err := os.ReadFile("testdata/ib_write_bw.log")
+	require.NoError(t, err)
+	bw, err := ParseWriteBW(string(output))
+	require.NoError(t, err)
+	require.Equal(t, Bandwidth{Bytes: 65536, Iterations: 20000, PeakGbps: 98.01, AverageGbps: 98.01, MsgRateMpps: 0.186932}, bw)
+
+	bw, err = ParseWriteBW(resultLine(196.4))
+	require.NoError(t, err)
+	require.Equal(t, 196.4, bw.AverageGbps)
+
+	_, err = ParseWriteBW(" Unable to perform rdma_client function\n Couldn't connect to 10.224.5.57:18515\n")
+	require.EqualError(t, err, `no ib_write_bw result line in "Unable to perform rdma_client function Couldn't connect to 10.224.5.57:18515"`)
+}
+
+func TestScheduleCoversEveryPairOnce(t *testing.T) {
+	for n := 2; n <= 9; n++ {
+		rounds := Schedule(n, 0, 0)
+		require.Len(t, rounds, n-1+n%2, "n=%d", n)
+		seen := map[[2]int]bool{}
+		for _, round := range rounds {
+			busy := map[int]bool{}
+			for _, p := range round {
+				require.False(t, busy[p.Client] || busy[p.Server], "n=%d: a node is in two pairs of one round", n)
+				busy[p.Client], busy[p.Server] = true, true
+				key := [2]int{min(p.Client, p.Server), max(p.Client, p.Server)}
+				require.False(t, seen[key], "n=%d: pair %v measured twice", n, key)
+				seen[key] = true
+			}
+		}
+		require.Len(t, seen, n*(n-1)/2, "n=%d", n)
+	}
+}
+
+func TestScheduleSamplesIncludeTheRing(t *testing.T) {
+	pairs := func(rounds [][]Pair) map[[2]int]bool {
+		keys := map[[2]int]bool{}
+		for _, round := range rounds {
+			for _, p := range round {
+				keys[[2]int{min(p.Client, p.Server), max(p.Client, p.Server)}] = true
+			}
+		}
+		return keys
+	}
+	sample := pairs(Schedule(8, 12, 7))
+	require.Len(t, sample, 12)
+	for i := range 8 {
+		require.True(t, sample[[2]int{min(i, (i+1)%8), max(i, (i+1)%8)}], "ring pair %d-%d", i, (i+1)%8)
+	}
+	require.Equal(t, sample, pairs(Schedule(8, 12, 7)), "the same seed picks the same sample")
+	require.Len(t, pairs(Schedule(8, 3, 7)), 8, "the ring is always measured")
+	require.Len(t, pairs(Schedule(8, 100, 7)), 28)
+}
+
+func TestRunBuildsMatrixAndFindsOutliers(t *testing.T) {
+	addresses := map[string]string{"10.0.3.2": "10.224.0.2", "10.0.3.3": "10.224.0.3", "10.0.3.4": "10.224.0.4"}
+	discover := func(node string) string {
+		rdma1 := strings.Replace(addresses[node], "10.224.0", "10.224.1", 1)
+		return fmt.Sprintf("rdma0 %s\nrdma1 %s\n", addresses[node], rdma1)
+	}
+	// rdma1 of 10.0.3.4 is slow towards every peer; the 10.0.3.2 client
+	// cannot reach the rdma0 server on 10.0.3.3.
+	measure := func(node, iface, ip string) string {
+		switch {
+		case node == "10.0.3.2" && ip == "10.224.0.3":
+			return "=== rdma0 exit=1\n Couldn't connect to 10.224.0.3:18515 \n"
+		case iface == "rdma1" && (node == "10.0.3.4" || ip == "10.224.1.4"):
+			return "=== rdma1 exit=0\n" + resultLine(48.2)
+		}
+		return fmt.Sprintf("=== %s exit=0\n%s", iface, resultLine(97.9))
+	}
+	client := fakeCluster(discover, measure,
+		node("10.0.3.4", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionTrue),
+		node("10.0.3.2", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionTrue),
+		node("10.0.3.3", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionTrue),
+		node("10.0.3.5", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionFalse),
+		node("10.0.1.2", "oke-system", "VM.Standard.E5.Flex", corev1.ConditionTrue),
+	)
+
+	var logs []string
+	report, err := Run(context.Background(), client, Config{
+		Namespace:    "rdma-bw-run-1",
+		Pool:         "oke-rdma",
+		Interfaces:   []string{"rdma0", "rdma1"},
+		PollInterval: time.Millisecond,
+		Logf:         func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) },
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"10.0.3.2", "10.0.3.3", "10.0.3.4"}, report.Nodes, "Ready nodes of the pool")
+	require.Len(t, report.Measurements, 6, "three pairs over two interfaces")
+	require.InDelta(t, 0.8*97.9, report.Threshold, 1e-9, "80% of the median")
+	require.Equal(t, []string{
+		"10.0.3.3 -> 10.0.3.4 rdma1: 48.20 Gb/s is below 78.32 Gb/s",
+		"10.0.3.4 -> 10.0.3.2 rdma1: 48.20 Gb/s is below 78.32 Gb/s",
+		"10.0.3.2 -> 10.0.3.3 rdma0: exit=1: Couldn't connect to 10.224.0.3:18515",
+	}, report.Failures())
+	require.Len(t, report.Outliers(), 2)
+	require.Equal(t, []string{"10.0.3.4/rdma1"}, report.Suspects())
+	require.Equal(t, "client \\ server  0      1     2\n"+
+		"0 10.0.3.2       -      FAIL  -\n"+
+		"1 10.0.3.3       -      -     48.2*\n"+
+		"2 10.0.3.4       48.2*  -     -\n"+
+		"lowest of 2 interface(s) in Gb/s; * below 78.32 Gb/s\n", report.String())
+	require.Equal(t, []string{
+		"discovering 2 interface(s) on 3 node(s)",
+		"round 1/3: 1 pair(s)",
+		"round 2/3: 1 pair(s)",
+		"round 3/3: 1 pair(s)",
+	}, logs)
+
+	var servers []*corev1.Pod
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok {
+			if pod, ok := create.GetObject().(*corev1.Pod); ok && pod.Labels["role"] == "server" {
+				servers = append(servers, pod)
+			}
+		}
+	}
+	require.Len(t, servers, 3)
+	require.True(t, servers[0].Spec.HostNetwork)
+	require.Contains(t, servers[1].Spec.Containers[0].Command[2], "serve rdma0 18517 &\nserve rdma1 18518 &\n", "each round uses its own ports")
+
+	_, err = client.CoreV1().Namespaces().Get(context.Background(), "rdma-bw-run-1", metav1.GetOptions{})
+	require.Error(t, err, "the namespace is deleted after the run")
+}
+
+func TestRunReportsMissingAddressesAndStuckClients(t *testing.T) {
+	discover := func(node string) string {
+		if node == "10.0.3.3" {
+			return "rdma0 10.224.0.3\nrdma1 -\n"
+		}
+		return "rdma0 10.224.0.2\nrdma1 10.224.1.2\n"
+	}
+	client := fakeCluster(discover, func(string, string, string) string { return "" },
+		node("10.0.3.2", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionTrue),
+		node("10.0.3.3", "oke-rdma", "BM.GPU.H100.8", corev1.ConditionTrue),
+	)
+
+	report, err := Run(context.Background(), client, Config{
+		Pool:         "oke-rdma",
+		Interfaces:   []string{"rdma0", "rdma1"},
+		Timeout:      20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"10.0.3.2 -> 10.0.3.3 rdma0: client pod did not finish in 20ms",
+		"10.0.3.2 -> 10.0.3.3 rdma1: server has no IPv4 address on rdma1",
+	}, report.Failures())
+	require.Zero(t, report.Threshold, "no measurement to take the median of")
+}
+
+func TestRunDefaultsInterfacesFromTheShape(t *testing.T) {
+	var scripts []string
+	client := fakeCluster(func(string) string { return "" }, nil,
+		node("10.0.3.2", "oke-rdma", "BM.GPU.H200.8", corev1.ConditionTrue),
+		node("10.0.3.3", "oke-rdma", "BM.GPU.H200.8", corev1.ConditionTrue),
+	)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scripts = append(scripts, action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).Spec.Containers[0].Command[2])
+		return false, nil, nil
+	})
+
+	_, err := Run(context.Background(), client, Config{Pool: "oke-rdma", Timeout: 10 * time.Millisecond, PollInterval: time.Millisecond})
+	require.EqualError(t, err, "discovery pod on 10.0.3.2 did not finish in 10ms")
+	require.Contains(t, scripts[0], "for iface in rdma0 rdma1 rdma2 rdma3 rdma4 rdma5 rdma6 rdma7; do")
+}
+
+func TestRunRejectsUnusablePools(t *testing.T) {
+	client := fake.NewClientset(
+		node("10.0.3.2", "oke-rdma", "BM.Optimized3.36", corev1.ConditionTrue),
+		node("10.0.3.3", "oke-rdma", "BM.Optimized3.36", corev1.ConditionTrue),
+		node("10.0.3.4", "oke-rdma", "BM.Optimized3.36", corev1.ConditionFalse),
+	)
+	_, err := Run(context.Background(), client, Config{Pool: "oke-gpu"})
+	require.EqualError(t, err, "pool oke-gpu has 0 Ready node(s), need at least 2")
+	_, err = Run(context.Background(), client, Config{Pool: "oke-rdma"})
+	require.EqualError(t, err, `pool oke-rdma: shape "BM.Optimized3.36" has no RDMA NICs in the shapes catalog; set Interfaces`)
+}
+
+func TestParseClientResults(t *testing.T) {
+	results := parseClientResults("=== rdma0 exit=0\n" + resultLine(97.9) + "=== rdma1 exit=124\n\n")
+	require.Equal(t, []string{"rdma0", "rdma1"}, slices.Sorted(maps.Keys(results)))
+	require.Equal(t, "exit=124: \n\n", results["rdma1"])
+}
+
+func TestScriptsAreValidShell(t *testing.T) {
+	targets := []target{{iface: "rdma0", ip: "10.224.0.3", port: 18515}, {iface: "rdma1", ip: "10.224.1.3", port: 18516}}
+	for _, script := range []string{
+		discoverScript([]string{"rdma0", "rdma1"}),
+		serverScript(DefaultArgs, targets, 300),
+		clientScript(DefaultArgs, targets),
+	} {
+		out, err := exec.Command("sh", "-n", "-c", script).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/health"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/rdma"
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// TestRDMABandwidth runs ib_write_bw between the nodes of the RDMA pool over
+// every RDMA interface and fails on pairs that fail or fall below the
+// threshold. RDMA_BW_MAX_PAIRS samples the pairs of large pools and
+// RDMA_BW_THRESHOLD_GBPS replaces the relative threshold.
+func TestRDMABandwidth(t *testing.T) {
+	skipUnlessEnv(t, "RUN_RDMA_BW_TESTS")
+
+	cluster := suiteCluster(t, nil)
+
+	if cassetteMode() == cassetteReplay {
+		t.Skip("Skipping RDMA bandwidth: API requests are not recorded in cassettes")
+	}
+	if cluster.options == nil {
+		t.Skip("Skipping RDMA bandwidth: existing cluster has no terraform variables")
+	}
+	vars, err := effectiveVars(t, cluster.options)
+	require.NoError(t, err, "failed to resolve terraform variables")
+	sizes, err := expectedPoolSizes(vars)
+	require.NoError(t, err)
+	if sizes["oke-rdma"] < 2 {
+		t.Skip("Skipping RDMA bandwidth: the oke-rdma pool has fewer than 2 nodes")
+	}
+	shapeName, _ := vars["worker_rdma_shape"].(string)
+	if shape, ok := shapes.Lookup(shapeName); !ok || shape.RDMANICs == 0 {
+		t.Skipf("Skipping RDMA bandwidth: %s has no RDMA NICs in the shapes catalog", shapeName)
+	}
+
+	cfg, err := rdmaBandwidthConfig()
+	require.NoError(t, err)
+	cfg.Namespace = "rdma-bw-" + currentRunID()
+	cfg.PoolLabel = poolNameLabel
+	cfg.Pool = "oke-rdma"
+	cfg.Logf = func(format string, args ...any) { t.Logf("RDMA bandwidth: "+format, args...) }
+
+	client, err := health.NewClient(cluster.kubeconfigPath)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
+	defer cancel()
+	report, err := rdma.Run(ctx, client, cfg)
+	require.NoError(t, err, "RDMA bandwidth test could not run")
+	t.Logf("RDMA bandwidth: %s\n%s", shapeName, report)
+	if suspects := report.Suspects(); len(suspects) > 0 {
+		t.Logf("RDMA bandwidth: suspect interfaces: %v", suspects)
+	}
+	require.Empty(t, report.Failures(), "RDMA bandwidth test failed")
+}
+
+// rdmaBandwidthConfig reads RDMA_BW_MAX_PAIRS and RDMA_BW_THRESHOLD_GBPS.
+func rdmaBandwidthConfig() (rdma.Config, error) {
+	var cfg rdma.Config
+	if v := os.Getenv("RDMA_BW_MAX_PAIRS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return rdma.Config{}, fmt.Errorf("RDMA_BW_MAX_PAIRS=%q: want a non-negative integer", v)
+		}
+		cfg.MaxPairs = n
+	}
+	if v := os.Getenv("RDMA_BW_THRESHOLD_GBPS"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return rdma.Config{}, fmt.Errorf("RDMA_BW_THRESHOLD_GBPS=%q: want a positive number", v)
+		}
+		cfg.Threshold = f
+	}
+	return cfg, nil
+}
+
+func TestRDMABandwidthConfig(t *testing.T) {
+	t.Setenv("RDMA_BW_MAX_PAIRS", "")
+	t.Setenv("RDMA_BW_THRESHOLD_GBPS", "")
+	cfg, err := rdmaBandwidthConfig()
+	require.NoError(t, err)
+	require.Zero(t, cfg.MaxPairs)
+	require.Zero(t, cfg.Threshold)
+
+	t.Setenv("RDMA_BW_MAX_PAIRS", "40")
+	t.Setenv("RDMA_BW_THRESHOLD_GBPS", "180.5")
+	cfg, err = rdmaBandwidthConfig()
+	require.NoError(t, err)
+	require.Equal(t, 40, cfg.MaxPairs)
+	require.Equal(t, 180.5, cfg.Threshold)
+
+	t.Setenv("RDMA_BW_THRESHOLD_GBPS", "fast")
+	_, err = rdmaBandwidthConfig()
+	require.EqualError(t, err, `RDMA_BW_THRESHOLD_GBPS="fast": want a positive number`)
+}
@@ -0,0 +1,28 @@
+package test
+
+import (
+	"github.com/gruntwork-io/terratest/modules/terraform"
+)
+
+// ociRetryableErrors extends terratest's default retryable errors with
+// transient OCI API and Helm failures. Keys are regexes matched against the
+// terraform output; values explain why the error is retried. Out of host
+// capacity is not retried here: retrying the same AD only delays the AD
+// fallback in apply (see adFallback).
+var ociRetryableErrors = map[string]string{
+	`429-TooManyRequests`: "OCI API rate limit hit",
+	`(?s)409-(Conflict|IncorrectState).*(network_security_group|route_table)`:                                   "Concurrent update of an NSG or route table",
+	`(?s)(network_security_group|route_table).*409-(Conflict|IncorrectState)`:                                   "Concurrent update of an NSG or route table",
+	`failed calling webhook.*(connection refused|no endpoints available|context deadline exceeded|i/o timeout)`: "Helm admission webhook not ready yet",
+}
+
+// withOCIRetryableErrors adds ociRetryableErrors to the options' retryable errors.
+func withOCIRetryableErrors(options *terraform.Options) *terraform.Options {
+	if options.RetryableTerraformErrors == nil {
+		options.RetryableTerraformErrors = map[string]string{}
+	}
+	for pattern, reason := range ociRetryableErrors {
+		options.RetryableTerraformErrors[pattern] = reason
+	}
+	return options
+}
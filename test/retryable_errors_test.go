@@ -0,0 +1,42 @@
+package test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCIRetryableErrorsMatchTransientFailures(t *testing.T) {
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	options := newTerraformOptions(t, nil)
+
+	retryable := func(output string) bool {
+		for pattern := range options.RetryableTerraformErrors {
+			if regexp.MustCompile(pattern).MatchString(output) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, output := range []string{
+		"Error: 429-TooManyRequests, Too many requests for the user",
+		"Error: 409-Conflict, The resource is in a conflicted state\n\n  with module.oke.oci_core_network_security_group_security_rule.oke[\"workers\"],",
+		"Error: 409-IncorrectState, Route table is being updated\n  with oci_core_route_table.private,",
+		`Error: Internal error occurred: failed calling webhook "webhook.cert-manager.io": failed to call webhook: Post "https://cert-manager-webhook.cert-manager.svc:443/validate?timeout=30s": dial tcp 10.96.1.2:443: connect: connection refused`,
+		`Error: failed calling webhook "validate.nginx.ingress.kubernetes.io": no endpoints available for service "ingress-nginx-controller-admission"`,
+	} {
+		require.True(t, retryable(output), "expected retryable: %s", output)
+	}
+
+	for _, output := range []string{
+		"Error: 400-LimitExceeded, The following service limits were exceeded: gpu-a100-count",
+		"Error: 500-InternalError, Out of host capacity.\nSuggestion: The service for this resource encountered an error.",
+		"Error: 409-Conflict, Cluster name already in use\n  with module.oke.oci_containerengine_cluster.k8s,",
+		"Error: 404-NotAuthorizedOrNotFound, Authorization failed or requested resource not found",
+		"Error: Invalid value for variable",
+	} {
+		require.False(t, retryable(output), "expected non-retryable: %s", output)
+	}
+}
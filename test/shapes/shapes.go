@@ -0,0 +1,133 @@
+// Package shapes describes the OCI GPU and HPC shapes the stack deploys
+// workers on. It is the one place the harness looks up GPU counts, RDMA NICs
+// and image support; shapes_test.go keeps it in line with the Terraform
+// locals, docs and scripts that encode the same facts.
+package shapes
+
+import (
+	"slices"
+	"strings"
+)
+
+// Vendor is the GPU vendor of a shape.
+type Vendor string
+
+const (
+	NVIDIA Vendor = "nvidia"
+	AMD    Vendor = "amd"
+)
+
+// Architectures, as written in docs/worker-node-images.json.
+const (
+	X86_64  = "x86_64"
+	Aarch64 = "aarch64"
+)
+
+// OSRelease is an operating system release that worker images are built on.
+type OSRelease struct {
+	OS      string
+	Version string
+}
+
+func (r OSRelease) String() string { return r.OS + " " + r.Version }
+
+var (
+	ubuntu2204 = OSRelease{OS: "Ubuntu", Version: "22.04"}
+	ubuntu2404 = OSRelease{OS: "Ubuntu", Version: "24.04"}
+)
+
+// Shape is what the stack relies on about one compute shape.
+type Shape struct {
+	Name   string
+	Vendor Vendor
+	Arch   string
+	GPUs   int
+	// RDMANICs is the number of RDMA NICs NCCL/RCCL uses, the NCCL_IB_HCA
+	// list in docs/recommended-nccl-rccl-parameters-by-shape.md. Zero for
+	// shapes without recommended parameters.
+	RDMANICs int
+	// VFs is the number of SR-IOV RDMA virtual functions the NVIDIA Network
+	// Operator advertises per node (local.slinky_shape_rdma_vf_count). Zero
+	// when the shape has no SR-IOV policy.
+	VFs int
+	// GMC shapes join GPU Memory Clusters over an NVLink fabric and run IMEX
+	// across nodes.
+	GMC  bool
+	IMEX bool
+	// GraceBlackwell shapes are rejected in the RDMA pool by
+	// validate_grace_blackwell_shape and deploy through the GMC pool.
+	GraceBlackwell bool
+	// Images are the OS releases with a published worker image for the shape
+	// in docs/worker-node-images.json.
+	Images []OSRelease
+}
+
+// GPUResource is the extended resource the device plugin advertises.
+func (s Shape) GPUResource() string {
+	if s.Vendor == AMD {
+		return "amd.com/gpu"
+	}
+	return "nvidia.com/gpu"
+}
+
+// SupportsImage reports whether the shape has a worker image for os and version.
+func (s Shape) SupportsImage(os, version string) bool {
+	return slices.Contains(s.Images, OSRelease{OS: os, Version: version})
+}
+
+var catalog = []Shape{
+	{Name: "VM.GPU.A10.1", Vendor: NVIDIA, Arch: X86_64, GPUs: 1, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "VM.GPU.A10.2", Vendor: NVIDIA, Arch: X86_64, GPUs: 2, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.A10.4", Vendor: NVIDIA, Arch: X86_64, GPUs: 4, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.L40S.4", Vendor: NVIDIA, Arch: X86_64, GPUs: 4, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU4.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 16, VFs: 16, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.A100-v2.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 16, VFs: 16, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.B4.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 16, VFs: 16, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.H100.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 16, VFs: 16, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.H200.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 8, VFs: 8, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.B200.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 8, VFs: 8, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.B300.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 16, VFs: 16, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.RTXPRO.8", Vendor: NVIDIA, Arch: X86_64, GPUs: 8, RDMANICs: 8},
+	{Name: "BM.GPU.GB200.4", Vendor: NVIDIA, Arch: Aarch64, GPUs: 4, RDMANICs: 4, GMC: true, IMEX: true, GraceBlackwell: true, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.GB200-v2.4", Vendor: NVIDIA, Arch: Aarch64, GPUs: 4, RDMANICs: 4, GMC: true, IMEX: true, GraceBlackwell: true},
+	{Name: "BM.GPU.GB200-v3.4", Vendor: NVIDIA, Arch: Aarch64, GPUs: 4, RDMANICs: 8, GMC: true, IMEX: true, GraceBlackwell: true, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.GB300.4", Vendor: NVIDIA, Arch: Aarch64, GPUs: 4, RDMANICs: 8, GMC: true, IMEX: true, GraceBlackwell: true, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.MI300X.8", Vendor: AMD, Arch: X86_64, GPUs: 8, RDMANICs: 8, VFs: 8, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+	{Name: "BM.GPU.MI355X.8", Vendor: AMD, Arch: X86_64, GPUs: 8, RDMANICs: 8, Images: []OSRelease{ubuntu2404}},
+	{Name: "BM.GPU.MI355X-v1.8", Vendor: AMD, Arch: X86_64, GPUs: 8, RDMANICs: 8, VFs: 8, Images: []OSRelease{ubuntu2204, ubuntu2404}},
+}
+
+// Lookup returns the shape called name.
+func Lookup(name string) (Shape, bool) {
+	i := slices.IndexFunc(catalog, func(s Shape) bool { return s.Name == name })
+	if i < 0 {
+		return Shape{}, false
+	}
+	return clone(catalog[i]), true
+}
+
+// All returns every shape, sorted by name.
+func All() []Shape {
+	all := make([]Shape, 0, len(catalog))
+	for _, s := range catalog {
+		all = append(all, clone(s))
+	}
+	slices.SortFunc(all, func(a, b Shape) int { return strings.Compare(a.Name, b.Name) })
+	return all
+}
+
+// Names returns the sorted names of the shapes keep accepts.
+func Names(keep func(Shape) bool) []string {
+	var names []string
+	for _, s := range All() {
+		if keep(s) {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+func clone(s Shape) Shape {
+	s.Images = slices.Clone(s.Images)
+	return s
+}
@@ -0,0 +1,214 @@
+package shapes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
+	"sigs.k8s.io/yaml"
+)
+
+func readRepositoryFile(t *testing.T, path ...string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(append([]string{"..", ".."}, path...)...))
+	require.NoError(t, err)
+	return data
+}
+
+// terraformLocal returns the expression assigned to name in a locals block of
+// terraform/<file>.
+func terraformLocal(t *testing.T, file, name string) hclsyntax.Expression {
+	t.Helper()
+	parsed, diags := hclsyntax.ParseConfig(readRepositoryFile(t, "terraform", file), file, hcl.InitialPos)
+	require.False(t, diags.HasErrors(), diags.Error())
+	for _, block := range parsed.Body.(*hclsyntax.Body).Blocks {
+		if block.Type != "locals" {
+			continue
+		}
+		if attr, ok := block.Body.Attributes[name]; ok {
+			return attr.Expr
+		}
+	}
+	t.Fatalf("local.%s is not declared in terraform/%s", name, file)
+	return nil
+}
+
+func literal(t *testing.T, expr hclsyntax.Expression, target any) {
+	t.Helper()
+	value, diags := expr.Value(nil)
+	require.False(t, diags.HasErrors(), diags.Error())
+	if value.Type().IsTupleType() {
+		value = cty.ListVal(value.AsValueSlice())
+	} else if value.Type().IsObjectType() {
+		value = cty.MapVal(value.AsValueMap())
+	}
+	require.NoError(t, gocty.FromCtyValue(value, target))
+}
+
+func terraformStringList(t *testing.T, file, name string) []string {
+	t.Helper()
+	var list []string
+	literal(t, terraformLocal(t, file, name), &list)
+	slices.Sort(list)
+	return list
+}
+
+func TestLookup(t *testing.T) {
+	shape, ok := Lookup("BM.GPU.MI300X.8")
+	require.True(t, ok)
+	require.Equal(t, AMD, shape.Vendor)
+	require.Equal(t, "amd.com/gpu", shape.GPUResource())
+	require.True(t, shape.SupportsImage("Ubuntu", "22.04"))
+
+	shape.Images[0] = OSRelease{OS: "Oracle Linux", Version: "8"}
+	again, _ := Lookup("BM.GPU.MI300X.8")
+	require.False(t, again.SupportsImage("Oracle Linux", "8"), "callers get a copy")
+
+	_, ok = Lookup("VM.Standard.E5.Flex")
+	require.False(t, ok)
+}
+
+func TestShapeNamesAreUniqueAndSorted(t *testing.T) {
+	names := Names(func(Shape) bool { return true })
+	require.Len(t, names, len(catalog))
+	require.True(t, slices.IsSorted(names))
+	require.Len(t, slices.Compact(slices.Clone(names)), len(names))
+}
+
+func TestShapeGraceBlackwellMatchesValidation(t *testing.T) {
+	call, ok := terraformLocal(t, "validation.tf", "invalid_grace_blackwell_shape").(*hclsyntax.FunctionCallExpr)
+	require.True(t, ok, "invalid_grace_blackwell_shape is a contains() call")
+	require.Equal(t, "contains", call.Name)
+	var rejected []string
+	literal(t, call.Args[0], &rejected)
+	slices.Sort(rejected)
+
+	require.Equal(t, rejected, Names(func(s Shape) bool { return s.GraceBlackwell }))
+	require.Equal(t, rejected, Names(func(s Shape) bool { return s.GMC }), "Grace Blackwell shapes deploy through the GMC pool")
+	require.Equal(t, rejected, Names(func(s Shape) bool { return s.IMEX }))
+	require.Equal(t, rejected, Names(func(s Shape) bool { return s.Arch == Aarch64 }))
+}
+
+func TestShapeVFsMatchSlinkyAndSRIOVPolicy(t *testing.T) {
+	var vfs map[string]int
+	literal(t, terraformLocal(t, "slinky.tf", "slinky_shape_rdma_vf_count"), &vfs)
+	want := map[string]int{}
+	for _, s := range All() {
+		if s.VFs > 0 {
+			want[s.Name] = s.VFs
+		}
+	}
+	require.Equal(t, want, vfs)
+
+	sriovShapes := terraformStringList(t, "via-provider-nvidia-network-operator.tf", "nvidia_network_operator_sriov_shapes")
+	require.Equal(t, Names(func(s Shape) bool { return s.VFs > 0 }), sriovShapes)
+
+	policies := map[string]int{}
+	for _, doc := range bytes.Split(readRepositoryFile(t, "terraform", "files", "nvidia-network-operator", "sriov-network-node-policy.yaml"), []byte("\n---")) {
+		var policy struct {
+			Spec struct {
+				NicSelector struct {
+					RootDevices []string `json:"rootDevices"`
+				} `json:"nicSelector"`
+				NodeSelector map[string]string `json:"nodeSelector"`
+				NumVfs       int               `json:"numVfs"`
+			} `json:"spec"`
+		}
+		require.NoError(t, yaml.Unmarshal(doc, &policy))
+		shape := policy.Spec.NodeSelector["node.kubernetes.io/instance-type"]
+		require.NotEmpty(t, shape)
+		policies[shape] = len(policy.Spec.NicSelector.RootDevices) * policy.Spec.NumVfs
+	}
+	require.Equal(t, want, policies)
+}
+
+func TestShapeAMDListsMatchTerraform(t *testing.T) {
+	amd := Names(func(s Shape) bool { return s.Vendor == AMD })
+	require.Equal(t, amd, terraformStringList(t, "slinky.tf", "slinky_amd_shapes"))
+	require.Equal(t, amd, terraformStringList(t, "oke-addons.tf", "amd_gpu_plugin_shapes"))
+	require.Equal(t, amd, terraformStringList(t, "via-provider-kueue.tf", "kueue_amd_shapes"))
+}
+
+func TestShapeRDMANICsMatchNCCLParameters(t *testing.T) {
+	heading := regexp.MustCompile(`^## (\S+)`)
+	hca := regexp.MustCompile(`^NCCL_IB_HCA=+(\S+)`)
+	documented := map[string]int{}
+	var current string
+	scanner := bufio.NewScanner(bytes.NewReader(readRepositoryFile(t, "docs", "recommended-nccl-rccl-parameters-by-shape.md")))
+	for scanner.Scan() {
+		if m := heading.FindStringSubmatch(scanner.Text()); m != nil {
+			current = m[1]
+		} else if m := hca.FindStringSubmatch(scanner.Text()); m != nil && current != "" {
+			if _, seen := documented[current]; !seen {
+				documented[current] = len(strings.Split(m[1], ","))
+			}
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	want := map[string]int{}
+	for _, s := range All() {
+		if s.RDMANICs > 0 {
+			want[s.Name] = s.RDMANICs
+		}
+	}
+	require.Equal(t, want, documented)
+}
+
+func TestShapeImagesMatchWorkerNodeImages(t *testing.T) {
+	var doc struct {
+		Images []struct {
+			Shapes    []string `json:"shapes"`
+			OS        string   `json:"os"`
+			OSVersion string   `json:"os_version"`
+			Arch      string   `json:"arch"`
+			Vendor    string   `json:"vendor"`
+		} `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(readRepositoryFile(t, "docs", "worker-node-images.json"), &doc))
+
+	published := map[string][]OSRelease{}
+	for _, image := range doc.Images {
+		for _, name := range image.Shapes {
+			shape, ok := Lookup(name)
+			require.True(t, ok, "%s has a worker image but is not in the catalog", name)
+			require.Equal(t, Vendor(image.Vendor), shape.Vendor, name)
+			require.Equal(t, image.Arch, shape.Arch, name)
+			published[name] = append(published[name], OSRelease{OS: image.OS, Version: image.OSVersion})
+		}
+	}
+	for _, shape := range All() {
+		got := published[shape.Name]
+		slices.SortFunc(got, func(a, b OSRelease) int { return strings.Compare(a.String(), b.String()) })
+		require.Equal(t, shape.Images, slices.Compact(got), shape.Name)
+	}
+}
+
+// node_ordering.py writes one hostfile line and rankfile slot per GPU with a
+// hardcoded count, so it only fits the 8-GPU RDMA shapes.
+func TestShapeGPUCountMatchesNodeOrdering(t *testing.T) {
+	script := string(readRepositoryFile(t, "docker", "node-ordering", "node_ordering.py"))
+	m := regexp.MustCompile(`(?m)^gpus=(\d+)$`).FindStringSubmatch(script)
+	require.NotNil(t, m, "node_ordering.py sets gpus")
+	gpus, err := strconv.Atoi(m[1])
+	require.NoError(t, err)
+	require.Contains(t, script, "for x in range("+m[1]+"):", "srun hostfile lines follow gpus")
+
+	rdma := func(s Shape) bool { return s.RDMANICs > 0 }
+	require.Equal(t,
+		Names(func(s Shape) bool { return rdma(s) && s.GraceBlackwell }),
+		Names(func(s Shape) bool { return rdma(s) && s.GPUs != gpus }),
+		"only the 4-GPU Grace Blackwell shapes differ from node_ordering.py")
+}
@@ -0,0 +1,322 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+	terratesting "github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// Stage names follow terratest's test_structure convention: setting
+// SKIP_<stage> (for example SKIP_teardown=1) skips that stage.
+const (
+	stageSetup    = "setup"
+	stageApply    = "apply"
+	stageValidate = "validate"
+	stageTeardown = "teardown"
+)
+
+// stageWorkRoot is where staged clusters keep their terraform copy, options and
+// outputs between runs. Override with TEST_WORK_DIR.
+func stageWorkRoot() string {
+	return resolveVarFilePath(envOrDefault([]string{"TEST_WORK_DIR"}, ".work"))
+}
+
+func stageSkipped(stage string) bool {
+	return os.Getenv(test_structure.SkipStageEnvVarPrefix+stage) != ""
+}
+
+// clusterStages drives one cluster through setup, apply and teardown, persisting
+// everything later stages need under workDir so each stage can run in a
+// separate `go test` invocation.
+type clusterStages struct {
+	workDir string
+	// exec runs the terraform, kubectl and oci commands; zero fields use the
+	// real implementations.
+	exec executors
+
+	// mu serialises teardown between the test itself and the interrupt
+	// watchdog, so a cluster is never destroyed twice concurrently.
+	mu       sync.Mutex
+	tornDown bool
+}
+
+func newClusterStages(name string) *clusterStages {
+	return &clusterStages{workDir: filepath.Join(stageWorkRoot(), name)}
+}
+
+func (s *clusterStages) executor() terraformExecutor {
+	return s.exec.withDefaults().terraform
+}
+
+func (s *clusterStages) terraformDir() string {
+	return filepath.Join(s.workDir, "terraform")
+}
+
+func (s *clusterStages) outputsPath() string {
+	return test_structure.FormatTestDataPath(s.workDir, "outputs.json")
+}
+
+func (s *clusterStages) optionsPresent(t terratesting.TestingT) bool {
+	return test_structure.IsTestDataPresent(t, test_structure.FormatTestDataPath(s.workDir, "TerraformOptions.json"))
+}
+
+// setup copies the terraform configuration into the work directory and saves
+// the options every later stage loads, with the cluster named and tagged after
+// the run ID. A work directory left behind by an interrupted run is moved to the
+// orphans directory rather than overwritten.
+func (s *clusterStages) setup(t terratesting.TestingT, overrides map[string]interface{}) {
+	t.Helper()
+
+	if s.optionsPresent(t) {
+		orphan := s.preserveOrphan(t)
+		logger.Default.Logf(t, "Previous work dir %s still holds terraform state; moved it to %s. Destroy it with:\n  %s",
+			s.workDir, orphan, orphanDestroyCommand(orphan))
+	}
+	if err := os.RemoveAll(s.terraformDir()); err != nil {
+		t.Fatalf("failed to clear %s: %v", s.terraformDir(), err)
+	}
+	copyTerraformTo(t, s.terraformDir())
+
+	options := newTerraformOptions(t, mergeVars(runIsolationVars(t.Name()), overrides))
+	options.TerraformDir = s.terraformDir()
+	test_structure.SaveTerraformOptions(t, s.workDir, options)
+	updateRunAudit(t, options, s.workDir, func(*runAudit) {})
+}
+
+// initAndApply runs terraform init and apply, holding applies so that the
+// interrupt watchdog waits for an interrupted apply to save its state.
+func (s *clusterStages) initAndApply(t terratesting.TestingT, options *terraform.Options) (string, error) {
+	applies.RLock()
+	defer applies.RUnlock()
+	return s.executor().InitAndApply(t, harnessContext, options)
+}
+
+// apply runs terraform apply and saves the outputs for the validate stage. If
+// a worker pool is out of capacity, apply is retried with the pool moved to the
+// next AD from its env list; the ADs that finally worked are saved with the
+// options and recorded in the run audit.
+func (s *clusterStages) apply(t terratesting.TestingT) {
+	t.Helper()
+
+	options := test_structure.LoadTerraformOptions(t, s.workDir)
+	fallback := newADFallback()
+	for {
+		out, err := s.initAndApply(t, options)
+		if err == nil {
+			break
+		}
+		if harnessContext.Err() != nil {
+			t.Fatalf("terraform apply was interrupted; teardown destroys what it saved to state: %v", err)
+		}
+		changed, fallbackErr := fallback.advance(options, out+"\n"+err.Error())
+		if fallbackErr != nil {
+			fatalClassified(t, "terraform apply", out, err)
+		}
+		logger.Default.Logf(t, "Apply hit a capacity error; retrying with %v", changed)
+		test_structure.SaveTerraformOptions(t, s.workDir, options)
+	}
+
+	all, err := s.executor().OutputAll(t, options)
+	if err != nil {
+		t.Fatalf("failed to read terraform outputs: %v", err)
+	}
+	outputs, err := decodeClusterOutputs(all)
+	if err != nil {
+		t.Fatalf("failed to decode terraform outputs: %v", err)
+	}
+	// Written directly rather than via SaveTestData, which logs the value and
+	// would print secrets such as grafana_admin_password.
+	content, err := json.Marshal(outputs)
+	if err != nil {
+		t.Fatalf("failed to encode terraform outputs: %v", err)
+	}
+	if err := os.WriteFile(s.outputsPath(), content, 0600); err != nil {
+		t.Fatalf("failed to save terraform outputs: %v", err)
+	}
+
+	updateRunAudit(t, options, s.workDir, func(audit *runAudit) {
+		now := time.Now().UTC()
+		audit.StateID = outputs.StateID
+		audit.ClusterID = outputs.ClusterID
+		audit.VCNID = outputs.VCNID
+		audit.AvailabilityDomains = poolADs(options)
+		audit.AppliedAt = &now
+	})
+}
+
+// load rebuilds the fixture from the saved options and outputs.
+func (s *clusterStages) load(t terratesting.TestingT, kubeconfigDir string) *clusterFixture {
+	t.Helper()
+
+	options := test_structure.LoadTerraformOptions(t, s.workDir)
+	content, err := os.ReadFile(s.outputsPath())
+	if err != nil {
+		t.Fatalf("failed to load saved terraform outputs (was the apply stage run?): %v", err)
+	}
+	var outputs clusterOutputs
+	if err := json.Unmarshal(content, &outputs); err != nil {
+		t.Fatalf("failed to parse saved terraform outputs: %v", err)
+	}
+	return newClusterFixture(t, s.exec.withDefaults(), options, outputs, kubeconfigDir)
+}
+
+// teardown destroys the cluster within destroyBudget and removes the work
+// directory. It is a no-op if setup never saved options. If destroy fails the
+// work directory, including terraform state, is kept under the orphans
+// directory and the command to retry is logged.
+func (s *clusterStages) teardown(t terratesting.TestingT) {
+	t.Helper()
+
+	if !s.optionsPresent(t) {
+		return
+	}
+	options := test_structure.LoadTerraformOptions(t, s.workDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), destroyBudget())
+	defer cancel()
+	if out, err := s.executor().Destroy(t, ctx, options); err != nil {
+		orphan := s.preserveOrphan(t)
+		fatalClassified(t, "terraform destroy", out, fmt.Errorf("%w\nTerraform state preserved in %s. Destroy it with:\n  %s",
+			err, orphan, orphanDestroyCommand(orphan)))
+	}
+	updateRunAudit(t, options, s.workDir, func(audit *runAudit) {
+		now := time.Now().UTC()
+		audit.DestroyedAt = &now
+	})
+	if err := os.RemoveAll(s.workDir); err != nil {
+		t.Errorf("failed to remove work dir %s: %v", s.workDir, err)
+	}
+}
+
+// preserveOrphan moves the work directory under orphanRoot, unless it is
+// already there, and points the saved options at the new location.
+func (s *clusterStages) preserveOrphan(t terratesting.TestingT) string {
+	t.Helper()
+
+	root := orphanRoot()
+	if strings.HasPrefix(s.workDir, root+string(filepath.Separator)) {
+		return s.workDir
+	}
+	dst := filepath.Join(root, filepath.Base(s.workDir)+"-"+time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("failed to create orphans dir %s: %v", root, err)
+	}
+	if err := os.Rename(s.workDir, dst); err != nil {
+		t.Fatalf("failed to move %s to %s: %v", s.workDir, dst, err)
+	}
+
+	options := test_structure.LoadTerraformOptions(t, dst)
+	options.TerraformDir = filepath.Join(dst, "terraform")
+	test_structure.SaveTerraformOptions(t, dst, options)
+	updateRunAudit(t, options, dst, func(audit *runAudit) { audit.WorkDir = dst })
+	return dst
+}
+
+// runSetupAndApply runs the setup and apply stages unless they are skipped. The
+// cluster is tracked from here on so an interrupt can tear it down; a replayed
+// cluster does not exist, so it is not tracked.
+func (s *clusterStages) runSetupAndApply(t terratesting.TestingT, overrides map[string]interface{}) {
+	t.Helper()
+
+	if cassetteMode() != cassetteReplay {
+		trackStages(s)
+	}
+	test_structure.RunTestStage(t, stageSetup, func() { s.setup(t, overrides) })
+	test_structure.RunTestStage(t, stageApply, func() { s.apply(t) })
+}
+
+// runTeardown runs the teardown stage unless it is skipped. Only the first
+// caller tears down; later callers wait for it to finish.
+func (s *clusterStages) runTeardown(t terratesting.TestingT) {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tornDown {
+		return
+	}
+	s.tornDown = true
+	defer untrackStages(s)
+
+	test_structure.RunTestStage(t, stageTeardown, func() { s.teardown(t) })
+}
+
+func TestClusterStagesPersistOptionsAndOutputs(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+
+	stages := newClusterStages("TestStaged")
+	stages.setup(t, map[string]interface{}{"create_fss": true})
+	require.FileExists(t, filepath.Join(stages.terraformDir(), "variables.tf"))
+	require.NoDirExists(t, filepath.Join(stages.terraformDir(), ".terraform"))
+	require.True(t, stages.optionsPresent(t))
+
+	// Simulate a completed apply stage from an earlier run.
+	require.NoError(t, os.WriteFile(stages.outputsPath(),
+		[]byte(`{"cluster_id":"ocid1.cluster.oc1.iad.aaaa","fss_mount_path":"/mnt/oci-fss"}`), 0600))
+
+	fixture := stages.load(t, t.TempDir())
+	require.Equal(t, stages.terraformDir(), fixture.options.TerraformDir)
+	require.Equal(t, true, fixture.options.Vars["create_fss"])
+	require.Equal(t, "ocid1.cluster.oc1.iad.aaaa", fixture.outputs.ClusterID)
+	require.Empty(t, fixture.kubeconfigPath, "no kubeconfig without a public endpoint")
+}
+
+func TestStageSkippedFollowsTerratestConvention(t *testing.T) {
+	t.Setenv("SKIP_teardown", "1")
+	t.Setenv("SKIP_apply", "")
+	require.True(t, stageSkipped(stageTeardown))
+	require.False(t, stageSkipped(stageApply))
+}
+
+func TestFailedTeardownPreservesOrphanState(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	t.Setenv("TERRATEST_MAX_RETRIES", "0")
+	// Terraform is either missing or the copied configuration is uninitialised,
+	// so destroy fails without touching any cloud resources.
+	t.Setenv("PATH", t.TempDir())
+
+	stages := newClusterStages("TestOrphan")
+	stages.setup(t, nil)
+	require.NoError(t, os.WriteFile(filepath.Join(stages.terraformDir(), "terraform.tfstate"), []byte("{}"), 0600))
+
+	err := runFixtureStage("teardown", func(ft *fixtureT) { stages.runTeardown(ft) })
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RUN_CLEANUP=1 ORPHAN_DIR=")
+	require.Contains(t, err.Error(), "terraform destroy failed [bug:")
+	require.NoDirExists(t, stages.workDir)
+
+	var failures []failureRecord
+	content, readErr := os.ReadFile(failureReportPath())
+	require.NoError(t, readErr)
+	require.NoError(t, json.Unmarshal(content, &failures))
+	require.Len(t, failures, 1)
+	require.Equal(t, "terraform destroy", failures[0].Stage)
+	require.Equal(t, failureBug, failures[0].Category)
+
+	orphans, findErr := findOrphanDirs(orphanRoot())
+	require.NoError(t, findErr)
+	require.Len(t, orphans, 1)
+	require.FileExists(t, filepath.Join(orphans[0], "terraform", "terraform.tfstate"))
+
+	orphan := &clusterStages{workDir: orphans[0]}
+	fixtureOptions := test_structure.LoadTerraformOptions(t, orphan.workDir)
+	require.Equal(t, filepath.Join(orphans[0], "terraform"), fixtureOptions.TerraformDir)
+
+	// A second failure leaves the orphan where it is.
+	require.Error(t, runFixtureStage("teardown", func(ft *fixtureT) { orphan.runTeardown(ft) }))
+	require.DirExists(t, orphans[0])
+}
@@ -2,77 +2,90 @@ package test
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 	"strings"
 	"testing"
 
-	"github.com/gruntwork-io/terratest/modules/k8s"
-	"github.com/gruntwork-io/terratest/modules/terraform"
 	"github.com/stretchr/testify/require"
 )
 
 func TestStorageFSS(t *testing.T) {
 	skipUnlessEnv(t, "RUN_FSS_TESTS")
 
-	vars := map[string]interface{}{
-		"create_fss": true,
-	}
-	// Optional: override AD if FSS_AD is set, otherwise falls back to worker_ops_ad
-	if fssAD := envOrDefault([]string{"FSS_AD", "OCI_FSS_AD", "TF_VAR_fss_ad"}, ""); fssAD != "" {
-		vars["fss_ad"] = fssAD
-	}
-	options := newTerraformOptions(t, vars)
-
-	defer terraform.Destroy(t, options)
-	terraform.InitAndApply(t, options)
-
-	// State assertions
-	resources := terraformStateList(t, options)
-	requireStateHasPrefix(t, resources, "oci_file_storage_file_system.fss")
-	requireStateHasPrefix(t, resources, "oci_file_storage_mount_target.fss_mt")
-	requireStateHasPrefix(t, resources, "oci_file_storage_export.FSSExport")
-	requireStateHasPrefix(t, resources, "kubernetes_persistent_volume_v1.fss")
+	testStorageFSS(t, suiteCluster(t, fssSuiteVars()))
+}
 
-	// Attribute validation
-	stateID := terraform.Output(t, options, "state_id")
-	require.NotEmpty(t, stateID)
+// TestStorageFSSReplaysCassette runs the FSS suite offline from a synthetic
+// cassette: setup, init and apply, the state list, the outputs, the
+// Kubernetes checks and the destroy at teardown. The cassette was written by
+// hand in the recorded format, not recorded from a cluster, so its IDs,
+// addresses and CA certificate are placeholders.
+func TestStorageFSSReplaysCassette(t *testing.T) {
+	t.Setenv("TEST_WORK_DIR", t.TempDir())
+	t.Setenv("TFVARS_FILE", "./tfvars/base/base.tfvars")
+	t.Setenv("TEST_KUBE_ENDPOINT", "")
+	t.Setenv(cassetteDirEnv, "testdata/cassettes")
+	t.Setenv(cassetteModeEnv, cassetteReplay)
+	player, err := openCassette("TestStorageFSS.synthetic")
+	require.NoError(t, err)
 
-	fsID := terraform.Output(t, options, "fss_file_system_id")
-	require.True(t, isValidOCID(fsID), "fss_file_system_id should be a valid OCID: %s", fsID)
+	t.Run("TestStorageFSS", func(t *testing.T) {
+		testStorageFSS(t, provisionCluster(t, player.executors(), fssSuiteVars()))
+	})
+	require.Equal(t, len(player.interactions), player.next, "every recorded interaction should be replayed")
+	require.Equal(t, []string{"destroy"}, player.interactions[len(player.interactions)-1].Args)
+}
 
-	mtIP := terraform.Output(t, options, "fss_mount_target_ip")
-	require.Regexp(t, regexp.MustCompile(`^\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`), mtIP,
-		"fss_mount_target_ip should be a valid IPv4: %s", mtIP)
+// testStorageFSS checks the FSS resources and outputs of cluster, and mounts
+// the file system from pods when the cluster is reachable.
+func testStorageFSS(t *testing.T, cluster *clusterFixture) {
+	outputs := cluster.outputs
 
-	exportPath := terraform.Output(t, options, "fss_export_path")
-	require.Equal(t, fmt.Sprintf("/oke-gpu-%s", stateID), exportPath,
-		"fss_export_path format mismatch")
+	t.Run("State", func(t *testing.T) {
+		resources := cluster.stateList(t)
+		requireStateHasPrefix(t, resources, "oci_file_storage_file_system.fss")
+		requireStateHasPrefix(t, resources, "oci_file_storage_mount_target.fss_mt")
+		requireStateHasPrefix(t, resources, "oci_file_storage_export.FSSExport")
+		requireStateHasPrefix(t, resources, "kubernetes_persistent_volume_v1.fss")
+	})
 
-	nsgID := terraform.Output(t, options, "fss_nsg_id")
-	require.True(t, isValidOCID(nsgID), "fss_nsg_id should be a valid OCID: %s", nsgID)
+	t.Run("Outputs", func(t *testing.T) {
+		require.NotEmpty(t, outputs.StateID)
+		require.True(t, isValidOCID(outputs.FSSFileSystemID), "fss_file_system_id should be a valid OCID: %s", outputs.FSSFileSystemID)
+		require.Regexp(t, regexp.MustCompile(`^\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`), outputs.FSSMountTargetIP,
+			"fss_mount_target_ip should be a valid IPv4: %s", outputs.FSSMountTargetIP)
+		require.Equal(t, fmt.Sprintf("/oke-gpu-%s", outputs.StateID), outputs.FSSExportPath,
+			"fss_export_path format mismatch")
+		require.True(t, isValidOCID(outputs.FSSNSGID), "fss_nsg_id should be a valid OCID: %s", outputs.FSSNSGID)
+		require.True(t, isValidOCID(outputs.FSSSubnetID), "fss_subnet_id should be a valid OCID: %s", outputs.FSSSubnetID)
+	})
 
-	subnetID := terraform.Output(t, options, "fss_subnet_id")
-	require.True(t, isValidOCID(subnetID), "fss_subnet_id should be a valid OCID: %s", subnetID)
+	// Kubernetes tests — gated on a reachable endpoint (same pattern as core_provisioning_test.go)
+	t.Run("Kubernetes", func(t *testing.T) {
+		if cluster.kubeconfigPath == "" {
+			t.Skip("Skipping Kubernetes FSS tests: no public endpoint or Bastion Service")
+		}
+		testFSSKubernetes(t, cluster.kubectl("default"), outputs.FSSMountPath)
+	})
+}
 
-	// Kubernetes tests — gated on public endpoint (same pattern as core_provisioning_test.go)
-	publicEndpoint := optionalOutput(t, options, "cluster_public_endpoint")
-	if publicEndpoint == "" {
-		t.Log("Skipping Kubernetes FSS tests: no public endpoint")
-		return
+// fssSuiteVars returns the topology overrides TestStorageFSS needs.
+func fssSuiteVars() map[string]interface{} {
+	vars := map[string]interface{}{
+		"create_fss": true,
+	}
+	// Optional: override AD if FSS_AD is set, otherwise falls back to worker_ops_ad
+	if fssAD := envOrDefault([]string{"FSS_AD", "OCI_FSS_AD", "TF_VAR_fss_ad"}, ""); fssAD != "" {
+		vars["fss_ad"] = fssAD
 	}
-	clusterID := terraform.Output(t, options, "cluster_id")
-	region := os.Getenv("OCI_REGION")
-	kubeconfigPath := generateKubeconfig(t, clusterID, region)
-	testFSSKubernetes(t, kubeconfigPath, options)
+	return vars
 }
 
 // testFSSKubernetes verifies PVC binding and shared filesystem write/read.
 // Both tests share one PVC because fss-pv uses the Retain reclaim policy —
 // after a PVC is deleted the PV enters Released state and cannot be rebound.
-func testFSSKubernetes(t *testing.T, kubeconfigPath string, options *terraform.Options) {
+func testFSSKubernetes(t *testing.T, opts kubectlClient, fssMountPath string) {
 	t.Helper()
-	opts := k8s.NewKubectlOptions("", kubeconfigPath, "default")
 
 	pvcYAML := `
 apiVersion: v1
@@ -88,11 +101,11 @@ spec:
       storage: 50Gi
   volumeName: fss-pv
 `
-	k8s.KubectlApplyFromString(t, opts, pvcYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pvc", "fss-test-pvc", "--ignore-not-found=true")
+	opts.apply(t, pvcYAML)
+	defer opts.run(t, "delete", "pvc", "fss-test-pvc", "--ignore-not-found=true")
 
 	t.Log("Waiting for FSS PVC to bind")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Bound",
 		"pvc/fss-test-pvc",
 		"--timeout=120s",
@@ -125,17 +138,17 @@ spec:
     persistentVolumeClaim:
       claimName: fss-test-pvc
 `
-	k8s.KubectlApplyFromString(t, opts, writerYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "fss-writer", "--ignore-not-found=true")
+	opts.apply(t, writerYAML)
+	defer opts.run(t, "delete", "pod", "fss-writer", "--ignore-not-found=true")
 
 	t.Log("Waiting for FSS writer pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/fss-writer",
 		"--timeout=120s",
 	)
 
-	writerNodeRaw, err := k8s.RunKubectlAndGetOutputE(t, opts,
+	writerNodeRaw, err := opts.output(t,
 		"get", "pod", "fss-writer",
 		"-o", "jsonpath={.spec.nodeName}",
 	)
@@ -179,24 +192,23 @@ spec:
     persistentVolumeClaim:
       claimName: fss-test-pvc
 `
-	k8s.KubectlApplyFromString(t, opts, readerYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "fss-reader", "--ignore-not-found=true")
+	opts.apply(t, readerYAML)
+	defer opts.run(t, "delete", "pod", "fss-reader", "--ignore-not-found=true")
 
 	t.Log("Waiting for FSS reader pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/fss-reader",
 		"--timeout=120s",
 	)
 
-	output, err := k8s.RunKubectlAndGetOutputE(t, opts, "logs", "fss-reader")
+	output, err := opts.output(t, "logs", "fss-reader")
 	require.NoError(t, err)
 	require.Contains(t, output, "fss-test-content",
 		"reader pod output should contain written content")
 	t.Log("FSS write/read test passed")
 
 	// OS-level mount check: read the file written via CSI using a hostPath pod on the same node
-	fssMountPath := terraform.Output(t, options, "fss_mount_path")
 	require.NotEmpty(t, fssMountPath)
 
 	hostpathReaderYAML := fmt.Sprintf(`
@@ -226,17 +238,17 @@ spec:
       type: Directory
 `, writerNode, fssMountPath)
 
-	k8s.KubectlApplyFromString(t, opts, hostpathReaderYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "fss-hostpath-reader", "--ignore-not-found=true")
+	opts.apply(t, hostpathReaderYAML)
+	defer opts.run(t, "delete", "pod", "fss-hostpath-reader", "--ignore-not-found=true")
 
 	t.Log("Waiting for FSS hostPath reader pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/fss-hostpath-reader",
 		"--timeout=120s",
 	)
 
-	hostOutput, err := k8s.RunKubectlAndGetOutputE(t, opts, "logs", "fss-hostpath-reader")
+	hostOutput, err := opts.output(t, "logs", "fss-hostpath-reader")
 	require.NoError(t, err)
 	require.Contains(t, hostOutput, "fss-test-content",
 		"FSS hostPath reader should see the file written via CSI path")
@@ -2,19 +2,46 @@ package test
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 	"strings"
 	"testing"
 
-	"github.com/gruntwork-io/terratest/modules/k8s"
-	"github.com/gruntwork-io/terratest/modules/terraform"
 	"github.com/stretchr/testify/require"
 )
 
 func TestStorageLustre(t *testing.T) {
 	skipUnlessEnv(t, "RUN_LUSTRE_TESTS")
 
+	cluster := suiteCluster(t, lustreSuiteVars())
+	outputs := cluster.outputs
+
+	t.Run("State", func(t *testing.T) {
+		resources := cluster.stateList(t)
+		requireStateHasPrefix(t, resources, "oci_lustre_file_storage_lustre_file_system.lustre")
+		requireStateHasPrefix(t, resources, `module.oke.module.network.oci_core_network_security_group.custom_nsgs["lustre"]`)
+		requireStateHasPrefix(t, resources, `module.oke.module.network.oci_core_subnet.oke["lustre"]`)
+		requireStateHasPrefix(t, resources, "kubectl_manifest.lustre_pv")
+	})
+
+	t.Run("Outputs", func(t *testing.T) {
+		require.True(t, isValidOCID(outputs.LustreFileSystemID), "lustre_file_system_id should be a valid OCID: %s", outputs.LustreFileSystemID)
+		require.Regexp(t, regexp.MustCompile(`^\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`), outputs.LustreManagementServiceAddress,
+			"lustre_management_service_address should be a valid IPv4: %s", outputs.LustreManagementServiceAddress)
+		require.True(t, isValidOCID(outputs.LustreNSGID), "lustre_nsg_id should be a valid OCID: %s", outputs.LustreNSGID)
+		require.True(t, isValidOCID(outputs.LustreSubnetID), "lustre_subnet_id should be a valid OCID: %s", outputs.LustreSubnetID)
+	})
+
+	// Kubernetes tests — gated on a reachable endpoint (same pattern as storage_fss_test.go)
+	t.Run("Kubernetes", func(t *testing.T) {
+		if cluster.kubeconfigPath == "" {
+			t.Skip("Skipping Kubernetes Lustre tests: no public endpoint or Bastion Service")
+		}
+		testLustreKubernetes(t, cluster.kubectl("default"), outputs.LustreMountPath)
+	})
+}
+
+// lustreSuiteVars returns the topology overrides TestStorageLustre needs.
+func lustreSuiteVars() map[string]interface{} {
 	vars := map[string]interface{}{
 		"create_lustre": true,
 	}
@@ -22,50 +49,14 @@ func TestStorageLustre(t *testing.T) {
 	if lustreAD := envOrDefault([]string{"LUSTRE_AD", "OCI_LUSTRE_AD", "TF_VAR_lustre_ad"}, ""); lustreAD != "" {
 		vars["lustre_ad"] = lustreAD
 	}
-	options := newTerraformOptions(t, vars)
-
-	defer terraform.Destroy(t, options)
-	terraform.InitAndApply(t, options)
-
-	// State assertions
-	resources := terraformStateList(t, options)
-	requireStateHasPrefix(t, resources, "oci_lustre_file_storage_lustre_file_system.lustre")
-	requireStateHasPrefix(t, resources, `module.oke.module.network.oci_core_network_security_group.custom_nsgs["lustre"]`)
-	requireStateHasPrefix(t, resources, `module.oke.module.network.oci_core_subnet.oke["lustre"]`)
-	requireStateHasPrefix(t, resources, "kubectl_manifest.lustre_pv")
-
-	// Attribute validation
-	fsID := terraform.Output(t, options, "lustre_file_system_id")
-	require.True(t, isValidOCID(fsID), "lustre_file_system_id should be a valid OCID: %s", fsID)
-
-	mgsAddr := terraform.Output(t, options, "lustre_management_service_address")
-	require.Regexp(t, regexp.MustCompile(`^\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`), mgsAddr,
-		"lustre_management_service_address should be a valid IPv4: %s", mgsAddr)
-
-	nsgID := terraform.Output(t, options, "lustre_nsg_id")
-	require.True(t, isValidOCID(nsgID), "lustre_nsg_id should be a valid OCID: %s", nsgID)
-
-	subnetID := terraform.Output(t, options, "lustre_subnet_id")
-	require.True(t, isValidOCID(subnetID), "lustre_subnet_id should be a valid OCID: %s", subnetID)
-
-	// Kubernetes tests — gated on public endpoint (same pattern as storage_fss_test.go)
-	publicEndpoint := optionalOutput(t, options, "cluster_public_endpoint")
-	if publicEndpoint == "" {
-		t.Log("Skipping Kubernetes Lustre tests: no public endpoint")
-		return
-	}
-	clusterID := terraform.Output(t, options, "cluster_id")
-	region := os.Getenv("OCI_REGION")
-	kubeconfigPath := generateKubeconfig(t, clusterID, region)
-	testLustreKubernetes(t, kubeconfigPath, options)
+	return vars
 }
 
 // testLustreKubernetes verifies PVC binding and shared filesystem write/read.
 // Both tests share one PVC because lustre-pv uses the Retain reclaim policy —
 // after a PVC is deleted the PV enters Released state and cannot be rebound.
-func testLustreKubernetes(t *testing.T, kubeconfigPath string, options *terraform.Options) {
+func testLustreKubernetes(t *testing.T, opts kubectlClient, lustreMountPath string) {
 	t.Helper()
-	opts := k8s.NewKubectlOptions("", kubeconfigPath, "default")
 
 	pvcYAML := `
 apiVersion: v1
@@ -81,11 +72,11 @@ spec:
       storage: 1Ti
   volumeName: lustre-pv
 `
-	k8s.KubectlApplyFromString(t, opts, pvcYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pvc", "lustre-test-pvc", "--ignore-not-found=true")
+	opts.apply(t, pvcYAML)
+	defer opts.run(t, "delete", "pvc", "lustre-test-pvc", "--ignore-not-found=true")
 
 	t.Log("Waiting for Lustre PVC to bind")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Bound",
 		"pvc/lustre-test-pvc",
 		"--timeout=120s",
@@ -118,17 +109,17 @@ spec:
     persistentVolumeClaim:
       claimName: lustre-test-pvc
 `
-	k8s.KubectlApplyFromString(t, opts, writerYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "lustre-writer", "--ignore-not-found=true")
+	opts.apply(t, writerYAML)
+	defer opts.run(t, "delete", "pod", "lustre-writer", "--ignore-not-found=true")
 
 	t.Log("Waiting for Lustre writer pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/lustre-writer",
 		"--timeout=120s",
 	)
 
-	writerNodeRaw, err := k8s.RunKubectlAndGetOutputE(t, opts,
+	writerNodeRaw, err := opts.output(t,
 		"get", "pod", "lustre-writer",
 		"-o", "jsonpath={.spec.nodeName}",
 	)
@@ -172,24 +163,23 @@ spec:
     persistentVolumeClaim:
       claimName: lustre-test-pvc
 `
-	k8s.KubectlApplyFromString(t, opts, readerYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "lustre-reader", "--ignore-not-found=true")
+	opts.apply(t, readerYAML)
+	defer opts.run(t, "delete", "pod", "lustre-reader", "--ignore-not-found=true")
 
 	t.Log("Waiting for Lustre reader pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/lustre-reader",
 		"--timeout=120s",
 	)
 
-	output, err := k8s.RunKubectlAndGetOutputE(t, opts, "logs", "lustre-reader")
+	output, err := opts.output(t, "logs", "lustre-reader")
 	require.NoError(t, err)
 	require.Contains(t, output, "lustre-test-content",
 		"reader pod output should contain written content")
 	t.Log("Lustre write/read test passed")
 
 	// OS-level mount check: read the file written via CSI using a hostPath pod on the same node
-	lustreMountPath := terraform.Output(t, options, "lustre_mount_path")
 	require.NotEmpty(t, lustreMountPath)
 
 	hostpathReaderYAML := fmt.Sprintf(`
@@ -219,17 +209,17 @@ spec:
       type: Directory
 `, writerNode, lustreMountPath)
 
-	k8s.KubectlApplyFromString(t, opts, hostpathReaderYAML)
-	defer k8s.RunKubectl(t, opts, "delete", "pod", "lustre-hostpath-reader", "--ignore-not-found=true")
+	opts.apply(t, hostpathReaderYAML)
+	defer opts.run(t, "delete", "pod", "lustre-hostpath-reader", "--ignore-not-found=true")
 
 	t.Log("Waiting for Lustre hostPath reader pod to complete")
-	k8s.RunKubectl(t, opts, "wait",
+	opts.run(t, "wait",
 		"--for=jsonpath={.status.phase}=Succeeded",
 		"pod/lustre-hostpath-reader",
 		"--timeout=120s",
 	)
 
-	hostOutput, err := k8s.RunKubectlAndGetOutputE(t, opts, "logs", "lustre-hostpath-reader")
+	hostOutput, err := opts.output(t, "logs", "lustre-hostpath-reader")
 	require.NoError(t, err)
 	require.Contains(t, hostOutput, "lustre-test-content",
 		"Lustre hostPath reader should see the file written via CSI path")
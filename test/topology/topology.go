@@ -0,0 +1,431 @@
+// Package topology orders hosts so that ranks next to each other in an MPI job
+// share as much of the RDMA network as possible, and writes the result as
+// hostfiles and rankfiles. Topology comes from the node labels written by the
+// oci-hpc-oke-utils labeler, or from scontrol show topology on Slurm. It
+// replaces docker/node-ordering/node_ordering.py, which needs Slurm or SSH and
+// assumes eight GPUs per host.
+package topology
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/oracle-quickstart/oci-hpc-oke/test/shapes"
+)
+
+// Labels written by the labeler from the IMDS /host/ document. Values are the
+// last 11 characters of the OCIDs, or NoIMDS when IMDS had no RDMA data.
+const (
+	IslandLabel          = "oci.oraclecloud.com/rdma.hpc_island_id"
+	NetworkBlockLabel    = "oci.oraclecloud.com/rdma.network_block_id"
+	LocalBlockLabel      = "oci.oraclecloud.com/rdma.local_block_id"
+	HostIDLabel          = "oci.oraclecloud.com/rdma.host_id"
+	GPUMemoryFabricLabel = "oci.oraclecloud.com/host.gpu_memory_fabric_id"
+	// RackLabel is the label the labelMappings example in the
+	// oci-hpc-oke-utils values.yaml maps GPU memory fabrics to. It is only
+	// present on clusters that configure that mapping.
+	RackLabel = "oci.oraclecloud.com/host.internal_rack_id"
+
+	NoIMDS = "no-imds-data"
+
+	instanceTypeLabel = "node.kubernetes.io/instance-type"
+)
+
+// DefaultLevels are the labels hosts are grouped by, from the widest part of
+// the network to the narrowest: HPC island, network block, local block, then
+// rack, by the mapped rack label or else the GPU memory fabric.
+var DefaultLevels = []string{IslandLabel, NetworkBlockLabel, LocalBlockLabel, RackLabel + "|" + GPUMemoryFabricLabel}
+
+// Host is one entry of a hostfile.
+type Host struct {
+	Name string
+	// Path locates the host in the network, widest level first. An empty
+	// element is a level the host has no data for; hosts with an empty Path
+	// have no known topology.
+	Path []string
+	// Slots is the number of ranks the host runs, normally its GPU count.
+	Slots int
+}
+
+// FromNodes returns a host per node, with Path read from the levels labels
+// (DefaultLevels when nil) and Slots set to the GPU count of the node's shape,
+// falling back to its GPU capacity and then to 1. A level may list several
+// labels separated by "|"; the first one set is used.
+func FromNodes(nodes []corev1.Node, levels []string) []Host {
+	hosts := make([]Host, 0, len(nodes))
+	for _, node := range nodes {
+		hosts = append(hosts, Host{
+			Name:  node.Name,
+			Path:  labelPath(node.Labels, levels),
+			Slots: nodeSlots(node),
+		})
+	}
+	return hosts
+}
+
+// FromPods returns a host per scheduled pod, named the way the MPI Operator
+// writes its hostfile (<hostname>.<subdomain>.<namespace>.svc) when the pod
+// has a subdomain, and by its IP otherwise. Path comes from the labels of the
+// pod's node. Slots is the pod's GPU limit, or the node's when it sets none.
+func FromPods(pods []corev1.Pod, nodes []corev1.Node, levels []string) []Host {
+	byName := map[string]corev1.Node{}
+	for _, node := range nodes {
+		byName[node.Name] = node
+	}
+	var hosts []Host
+	for _, pod := range pods {
+		node, ok := byName[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		name := pod.Status.PodIP
+		if pod.Spec.Subdomain != "" {
+			hostname := cmp.Or(pod.Spec.Hostname, pod.Name)
+			name = fmt.Sprintf("%s.%s.%s.svc", hostname, pod.Spec.Subdomain, pod.Namespace)
+		}
+		if name == "" {
+			continue
+		}
+		slots := podGPUs(pod)
+		if slots == 0 {
+			slots = nodeSlots(node)
+		}
+		hosts = append(hosts, Host{Name: name, Path: labelPath(node.Labels, levels), Slots: slots})
+	}
+	return hosts
+}
+
+// FromNames returns a host per name with the given slots, placed by paths
+// (see ParseSlurmTopology). Names missing from paths have no topology.
+func FromNames(names []string, paths map[string][]string, slots int) []Host {
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		hosts = append(hosts, Host{Name: name, Path: slices.Clone(paths[name]), Slots: slots})
+	}
+	return hosts
+}
+
+func labelPath(labels map[string]string, levels []string) []string {
+	if levels == nil {
+		levels = DefaultLevels
+	}
+	path := make([]string, len(levels))
+	for i, level := range levels {
+		for _, key := range strings.Split(level, "|") {
+			if value := labels[key]; value != "" && value != NoIMDS {
+				path[i] = value
+				break
+			}
+		}
+	}
+	return trimPath(path)
+}
+
+// trimPath drops the trailing levels without data, so a host with none has an
+// empty path.
+func trimPath(path []string) []string {
+	for len(path) > 0 && path[len(path)-1] == "" {
+		path = path[:len(path)-1]
+	}
+	return path
+}
+
+func nodeSlots(node corev1.Node) int {
+	if shape, ok := shapes.Lookup(node.Labels[instanceTypeLabel]); ok && shape.GPUs > 0 {
+		return shape.GPUs
+	}
+	for _, name := range []corev1.ResourceName{"nvidia.com/gpu", "amd.com/gpu"} {
+		if quantity, ok := node.Status.Capacity[name]; ok && quantity.Value() > 0 {
+			return int(quantity.Value())
+		}
+	}
+	return 1
+}
+
+func podGPUs(pod corev1.Pod) int {
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		for _, name := range []corev1.ResourceName{"nvidia.com/gpu", "amd.com/gpu"} {
+			if quantity, ok := container.Resources.Limits[name]; ok {
+				total += quantity.Value()
+			}
+		}
+	}
+	return int(total)
+}
+
+// Order returns hosts so that hosts sharing a level are contiguous. At every
+// level the largest groups come first, like node_ordering.py sorts racks,
+// with ties broken by name; hosts keep their relative order inside their
+// narrowest group. Hosts without data for a level follow the groups of that
+// level, and hosts without topology come last.
+func Order(hosts []Host) []Host {
+	ordered := make([]Host, 0, len(hosts))
+	return orderLevel(ordered, hosts, 0)
+}
+
+func orderLevel(ordered, hosts []Host, level int) []Host {
+	var keys []string
+	groups := map[string][]Host{}
+	var rest []Host
+	for _, host := range hosts {
+		if len(host.Path) <= level {
+			rest = append(rest, host)
+			continue
+		}
+		key := host.Path[level]
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], host)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		// Hosts missing this level but placed below it form the "" group,
+		// which goes after the real groups.
+		if (a == "") != (b == "") {
+			if a == "" {
+				return 1
+			}
+			return -1
+		}
+		if n := len(groups[b]) - len(groups[a]); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	for _, key := range keys {
+		ordered = orderLevel(ordered, groups[key], level+1)
+	}
+	return append(ordered, rest...)
+}
+
+// Groups returns the hosts of each group at level (0 being the widest) in
+// order, for printing which hosts share a block or rack. Hosts without data
+// for the level are left out.
+func Groups(hosts []Host, level int) [][]Host {
+	var groups [][]Host
+	index := map[string]int{}
+	for _, host := range hosts {
+		if len(host.Path) <= level || host.Path[level] == "" {
+			continue
+		}
+		key := strings.Join(host.Path[:level+1], "/")
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], host)
+	}
+	return groups
+}
+
+// Hostfile formats.
+const (
+	// Plain lists each host once.
+	Plain = "plain"
+	// Slots lists each host once with its slot count, as Open MPI and the MPI
+	// Operator write it ("host slots=8").
+	Slots = "slots"
+	// Srun repeats each host once per slot, for SLURM_HOSTFILE with
+	// --distribution=arbitrary.
+	Srun = "srun"
+)
+
+// WriteHostfile writes hosts in order in format.
+func WriteHostfile(w io.Writer, hosts []Host, format string) error {
+	bw := bufio.NewWriter(w)
+	for _, host := range hosts {
+		switch format {
+		case Plain:
+			fmt.Fprintln(bw, host.Name)
+		case Slots:
+			fmt.Fprintf(bw, "%s slots=%d\n", host.Name, host.Slots)
+		case Srun:
+			for range host.Slots {
+				fmt.Fprintln(bw, host.Name)
+			}
+		default:
+			return fmt.Errorf("unknown hostfile format %q (want %s, %s or %s)", format, Plain, Slots, Srun)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteRankfile writes an Open MPI rankfile that gives every host as many
+// consecutive ranks as it has slots ("rank 0=host slot=0").
+func WriteRankfile(w io.Writer, hosts []Host) error {
+	bw := bufio.NewWriter(w)
+	rank := 0
+	for _, host := range hosts {
+		for slot := range host.Slots {
+			fmt.Fprintf(bw, "rank %d=%s slot=%d\n", rank, host.Name, slot)
+			rank++
+		}
+	}
+	return bw.Flush()
+}
+
+// ParseSlurmTopology reads scontrol show topology output and returns the path
+// of every node in it. With topology/tree the path runs from the top switch
+// down to the node's leaf switch; with topology/block it is the node's block.
+func ParseSlurmTopology(output string) (map[string][]string, error) {
+	type switchLine struct {
+		level    int
+		nodes    []string
+		switches []string
+	}
+	switches := map[string]switchLine{}
+	paths := map[string][]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := map[string]string{}
+		for _, field := range strings.Fields(line) {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				fields[key] = value
+			}
+		}
+		switch {
+		case fields["SwitchName"] != "":
+			level, err := strconv.Atoi(fields["Level"])
+			if err != nil {
+				return nil, fmt.Errorf("switch %s: bad level %q", fields["SwitchName"], fields["Level"])
+			}
+			nodes, err := ExpandHostlist(fields["Nodes"])
+			if err != nil {
+				return nil, fmt.Errorf("switch %s: %w", fields["SwitchName"], err)
+			}
+			children, err := ExpandHostlist(fields["Switches"])
+			if err != nil {
+				return nil, fmt.Errorf("switch %s: %w", fields["SwitchName"], err)
+			}
+			switches[fields["SwitchName"]] = switchLine{level: level, nodes: nodes, switches: children}
+		case fields["BlockName"] != "":
+			nodes, err := ExpandHostlist(fields["Nodes"])
+			if err != nil {
+				return nil, fmt.Errorf("block %s: %w", fields["BlockName"], err)
+			}
+			for _, node := range nodes {
+				paths[node] = []string{fields["BlockName"]}
+			}
+		}
+	}
+	if len(switches) == 0 && len(paths) == 0 {
+		return nil, fmt.Errorf("no switches or blocks in scontrol show topology output")
+	}
+
+	parent := map[string]string{}
+	for name, sw := range switches {
+		for _, child := range sw.switches {
+			parent[child] = name
+		}
+	}
+	for name, sw := range switches {
+		if sw.level != 0 {
+			continue
+		}
+		path := []string{name}
+		for up, ok := parent[name]; ok; up, ok = parent[up] {
+			if slices.Contains(path, up) {
+				return nil, fmt.Errorf("switch %s is its own ancestor", up)
+			}
+			path = append(path, up)
+		}
+		slices.Reverse(path)
+		for _, node := range sw.nodes {
+			paths[node] = path
+		}
+	}
+	return paths, nil
+}
+
+// ExpandHostlist expands a Slurm hostlist such as gpu-[01-03,07],login into
+// its host names, keeping the zero padding of the ranges. "(null)" and ""
+// expand to nothing.
+func ExpandHostlist(list string) ([]string, error) {
+	if list == "" || list == "(null)" {
+		return nil, nil
+	}
+	var names []string
+	depth, start := 0, 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			switch list[i] {
+			case '[':
+				depth++
+				continue
+			case ']':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth != 0 {
+			return nil, fmt.Errorf("unbalanced brackets in hostlist %q", list)
+		}
+		expanded, err := expandHost(list[start:i])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, expanded...)
+		start = i + 1
+	}
+	return names, nil
+}
+
+// expandHost expands the bracketed ranges of one hostlist entry.
+func expandHost(entry string) ([]string, error) {
+	open := strings.IndexByte(entry, '[')
+	if open < 0 {
+		if entry == "" {
+			return nil, nil
+		}
+		return []string{entry}, nil
+	}
+	closing := strings.IndexByte(entry[open:], ']')
+	if closing < 0 {
+		return nil, fmt.Errorf("unbalanced brackets in hostlist entry %q", entry)
+	}
+	closing += open
+	prefix, ranges := entry[:open], entry[open+1:closing]
+	suffixes, err := expandHost(entry[closing+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(suffixes) == 0 {
+		suffixes = []string{""}
+	}
+	var names []string
+	for _, part := range strings.Split(ranges, ",") {
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		from, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("bad range %q in hostlist entry %q", part, entry)
+		}
+		to, err := strconv.Atoi(high)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("bad range %q in hostlist entry %q", part, entry)
+		}
+		for n := from; n <= to; n++ {
+			for _, suffix := range suffixes {
+				names = append(names, fmt.Sprintf("%s%0*d%s", prefix, len(low), n, suffix))
+			}
+		}
+	}
+	return names, nil
+}
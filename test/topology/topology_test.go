@@ -0,0 +1,193 @@
+package topology
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func loadNodes(t *testing.T) []corev1.Node {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "nodes.yaml"))
+	require.NoError(t, err)
+	var list corev1.NodeList
+	require.NoError(t, yaml.Unmarshal(data, &list))
+	return list.Items
+}
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func names(hosts []Host) []string {
+	var out []string
+	for _, host := range hosts {
+		out = append(out, host.Name)
+	}
+	return out
+}
+
+func TestFromNodes(t *testing.T) {
+	hosts := FromNodes(loadNodes(t), nil)
+	byName := map[string]Host{}
+	for _, host := range hosts {
+		byName[host.Name] = host
+	}
+
+	require.Equal(t, Host{Name: "10.0.3.10", Path: []string{"fakeisland1", "fakenetblk1", "fakelocblkA"}, Slots: 8}, byName["10.0.3.10"])
+	require.Equal(t, []string{"fakeisland2", "fakenetblk3", "fakelocblkD", "rack-7"}, byName["10.0.4.20"].Path, "the mapped rack label wins over the fabric")
+	require.Equal(t, []string{"fakeisland2", "fakenetblk3", "fakelocblkD", "fakefabric2"}, byName["10.0.4.21"].Path)
+	require.Equal(t, 4, byName["10.0.4.20"].Slots, "GB200 slots come from the shapes catalog")
+	require.Empty(t, byName["10.0.3.15"].Path, "no-imds-data is no topology")
+	require.Equal(t, 2, byName["10.0.5.30"].Slots, "unknown shapes fall back to GPU capacity")
+
+	custom := FromNodes(loadNodes(t), []string{LocalBlockLabel})
+	require.Equal(t, []string{"fakelocblkC"}, custom[3].Path)
+}
+
+func TestOrderByLabels(t *testing.T) {
+	ordered := Order(FromNodes(loadNodes(t), nil))
+	require.Equal(t, []string{
+		// island 1, network block 1, local block A then B
+		"10.0.3.10", "10.0.3.12", "10.0.3.14", "10.0.3.11",
+		// island 1, network block 2
+		"10.0.3.13",
+		// island 2, one host per rack
+		"10.0.4.21", "10.0.4.20",
+		// no topology
+		"10.0.3.15", "10.0.5.30",
+	}, names(ordered))
+
+	blocks := Groups(ordered, 2)
+	require.Len(t, blocks, 4)
+	require.Equal(t, []string{"10.0.3.10", "10.0.3.12", "10.0.3.14"}, names(blocks[0]))
+}
+
+func TestOrderKeepsHostsMissingALevelWithTheirGroup(t *testing.T) {
+	ordered := Order([]Host{
+		{Name: "a", Path: []string{"isl", "", "lb-1"}},
+		{Name: "b", Path: []string{"isl", "nb-1", "lb-2"}},
+		{Name: "c", Path: []string{"isl"}},
+		{Name: "d"},
+		{Name: "e", Path: []string{"isl", "nb-1", "lb-2"}},
+		{Name: "f", Path: []string{"other"}},
+	})
+	require.Equal(t, []string{"b", "e", "a", "c", "f", "d"}, names(ordered))
+}
+
+func TestFromPods(t *testing.T) {
+	nodes := loadNodes(t)
+	worker := func(name, node string, gpus int64) corev1.Pod {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.PodSpec{
+				NodeName:   node,
+				Hostname:   name,
+				Subdomain:  "nccl-tests",
+				Containers: []corev1.Container{{Name: "worker"}},
+			},
+		}
+		if gpus > 0 {
+			pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{"nvidia.com/gpu": *resource.NewQuantity(gpus, resource.DecimalSI)}
+		}
+		return pod
+	}
+	pods := []corev1.Pod{
+		worker("nccl-tests-worker-0", "10.0.3.11", 0),
+		worker("nccl-tests-worker-1", "10.0.3.10", 4),
+		worker("nccl-tests-worker-2", "", 8),
+	}
+	pods = append(pods, corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "10.0.3.13"},
+		Status:     corev1.PodStatus{PodIP: "10.244.1.7"},
+	})
+
+	hosts := Order(FromPods(pods, nodes, nil))
+	require.Equal(t, []Host{
+		{Name: "nccl-tests-worker-1.nccl-tests.default.svc", Path: []string{"fakeisland1", "fakenetblk1", "fakelocblkA"}, Slots: 4},
+		{Name: "nccl-tests-worker-0.nccl-tests.default.svc", Path: []string{"fakeisland1", "fakenetblk1", "fakelocblkB"}, Slots: 8},
+		{Name: "10.244.1.7", Path: []string{"fakeisland1", "fakenetblk2", "fakelocblkC"}, Slots: 8},
+	}, hosts, "unscheduled pods are left out")
+}
+
+func TestWrite(t *testing.T) {
+	hosts := []Host{{Name: "a", Slots: 2}, {Name: "b", Slots: 3}}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteHostfile(&buf, hosts, Plain))
+	require.Equal(t, "a\nb\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteHostfile(&buf, hosts, Slots))
+	require.Equal(t, "a slots=2\nb slots=3\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteHostfile(&buf, hosts, Srun))
+	require.Equal(t, "a\na\nb\nb\nb\n", buf.String())
+
+	require.Error(t, WriteHostfile(&buf, hosts, "hydra"))
+
+	buf.Reset()
+	require.NoError(t, WriteRankfile(&buf, hosts))
+	require.Equal(t, "rank 0=a slot=0\nrank 1=a slot=1\nrank 2=b slot=0\nrank 3=b slot=1\nrank 4=b slot=2\n", buf.String())
+}
+
+func TestParseSlurmTopologyTree(t *testing.T) {
+	paths, err := ParseSlurmTopology(readTestdata(t, "scontrol-tree.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"root", "nb-1", "lb-a"}, paths["gpu-3"])
+	require.Equal(t, []string{"root", "nb-2", "lb-c"}, paths["gpu-6"])
+
+	hosts := Order(FromNames([]string{"gpu-1", "gpu-2", "gpu-3", "gpu-4", "gpu-5", "gpu-6", "login"}, paths, 8))
+	require.Equal(t, []string{"gpu-1", "gpu-3", "gpu-4", "gpu-2", "gpu-5", "gpu-6", "login"}, names(hosts))
+	require.Equal(t, 8, hosts[0].Slots)
+}
+
+func TestParseSlurmTopologyBlock(t *testing.T) {
+	paths, err := ParseSlurmTopology(readTestdata(t, "scontrol-block.txt"))
+	require.NoError(t, err)
+	require.Len(t, paths, 6)
+	require.Equal(t, []string{"lb-b"}, paths["gpu-09"])
+
+	hosts := Order(FromNames([]string{"gpu-09", "gpu-01", "gpu-04", "gpu-02"}, paths, 4))
+	require.Equal(t, []string{"gpu-01", "gpu-02", "gpu-09", "gpu-04"}, names(hosts))
+}
+
+func TestParseSlurmTopologyRejectsOtherOutput(t *testing.T) {
+	_, err := ParseSlurmTopology("topology/flat has no topology information\n")
+	require.Error(t, err)
+	_, err = ParseSlurmTopology("SwitchName=s1 Level=x Nodes=gpu-1\n")
+	require.Error(t, err)
+}
+
+func TestExpandHostlist(t *testing.T) {
+	for list, want := range map[string][]string{
+		"":                        nil,
+		"(null)":                  nil,
+		"gpu-1":                   {"gpu-1"},
+		"gpu-[08-11],login":       {"gpu-08", "gpu-09", "gpu-10", "gpu-11", "login"},
+		"gpu-[1,3-4]":             {"gpu-1", "gpu-3", "gpu-4"},
+		"rack[1-2]-node[1-2]":     {"rack1-node1", "rack1-node2", "rack2-node1", "rack2-node2"},
+		"a-[1-2],b-[01-02],c":     {"a-1", "a-2", "b-01", "b-02", "c"},
+		"10.0.3.[10-11],10.0.4.2": {"10.0.3.10", "10.0.3.11", "10.0.4.2"},
+	} {
+		got, err := ExpandHostlist(list)
+		require.NoError(t, err, list)
+		require.Equal(t, want, got, list)
+	}
+	for _, list := range []string{"gpu-[1-2", "gpu-[2-1]", "gpu-[a-b]"} {
+		_, err := ExpandHostlist(list)
+		require.Error(t, err, list)
+	}
+}